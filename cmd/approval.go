@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/abicky/ecsmec/internal/capacity"
+)
+
+func addApprovalFlags(cmd *cobra.Command) {
+	cmd.Flags().Bool("yes", false, "Drain container instances without asking for approval")
+	cmd.Flags().String("approval-file", "", "Wait for `FILE` to be created instead of asking for approval on the terminal")
+	cmd.Flags().String("approval-address", "", "Wait for a request to \"POST /approve\" on `ADDRESS` instead of asking for approval on the terminal")
+	cmd.MarkFlagsMutuallyExclusive("yes", "approval-file", "approval-address")
+}
+
+func newApprover(cmd *cobra.Command) (capacity.Approver, error) {
+	yes, _ := cmd.Flags().GetBool("yes")
+	file, _ := cmd.Flags().GetString("approval-file")
+	addr, _ := cmd.Flags().GetString("approval-address")
+
+	switch {
+	case yes || isDryRun():
+		return capacity.NewAutoApprover(), nil
+	case file != "":
+		return capacity.NewFileApprover(file), nil
+	case addr != "":
+		approver, err := capacity.NewHTTPApprover(addr)
+		if err != nil {
+			return nil, fmt.Errorf("\"approval-address\" is invalid: %w", err)
+		}
+		return approver, nil
+	default:
+		return capacity.NewTTYApprover(os.Stdin, os.Stdout), nil
+	}
+}
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/spf13/cobra"
+
+	"github.com/abicky/ecsmec/internal/capacity"
+)
+
+func addDrainerFlags(cmd *cobra.Command) {
+	cmd.Flags().Bool("service-aware-batching", false, "Split batches so that no service loses more tasks at once than its minimum healthy percent tolerates")
+	cmd.Flags().Duration("task-protection-timeout", 0, "The maximum time to wait for the scale-in protection of tasks to expire before stopping them (0 means not checking the protection)")
+	cmd.Flags().Bool("relaunch-standalone-tasks", false, "Run the tasks that don't belong to a service on other container instances after stopping them")
+	cmd.Flags().Duration("wait-for-standalone-tasks", 0, "The maximum time to let the tasks that don't belong to a service finish on their own before stopping them (0 means stopping them immediately)")
+	cmd.Flags().StringArray("wait-for-task-group", nil, "Wait only for the standalone tasks in the task `GROUP` (can be specified multiple times)")
+	cmd.Flags().StringToString("wait-for-task-tag", nil, "Wait only for the standalone tasks with the tag `KEY=VALUE` (can be specified multiple times)")
+	addApprovalFlags(cmd)
+}
+
+func newDrainerOptions(cmd *cobra.Command, ec2Svc capacity.EC2API) ([]capacity.DrainerOption, error) {
+	approver, err := newApprover(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	taskProtectionTimeout, _ := cmd.Flags().GetDuration("task-protection-timeout")
+	opts := []capacity.DrainerOption{
+		capacity.WithApprover(approver),
+		capacity.WithTaskProtectionTimeout(taskProtectionTimeout),
+		capacity.WithProgressReport(os.Stdout, newLogLineCounter()),
+	}
+	if serviceAware, _ := cmd.Flags().GetBool("service-aware-batching"); serviceAware {
+		opts = append(opts, capacity.WithServiceAwareBatching())
+	}
+	if relaunch, _ := cmd.Flags().GetBool("relaunch-standalone-tasks"); relaunch {
+		opts = append(opts, capacity.WithStandaloneTaskRelaunch(ec2Svc))
+	}
+	// Tasks are never stopped in dry-run mode, so waiting for them to finish would just waste time
+	if timeout, _ := cmd.Flags().GetDuration("wait-for-standalone-tasks"); timeout > 0 && !isDryRun() {
+		groups, _ := cmd.Flags().GetStringArray("wait-for-task-group")
+		tags, _ := cmd.Flags().GetStringToString("wait-for-task-tag")
+		opts = append(opts, capacity.WithStandaloneTaskCompletionWait(timeout, groups, tags))
+	}
+	return opts, nil
+}
+
+// newLogLineCounter makes the logger count the lines it writes if the progress report can be redrawn, otherwise
+// returns nil. Both stdout and stderr must be terminals because the report is printed to stdout, and the logs to
+// stderr must be printed below it on the same screen.
+func newLogLineCounter() capacity.LineCounter {
+	if !isTerminal(os.Stdout) || !isTerminal(os.Stderr) {
+		return nil
+	}
+	if w, ok := log.Writer().(*lineCountingWriter); ok {
+		return w
+	}
+	w := &lineCountingWriter{w: log.Writer()}
+	log.SetOutput(w)
+	return w
+}
+
+// lineCountingWriter counts the lines written to w.
+type lineCountingWriter struct {
+	mu    sync.Mutex
+	w     io.Writer
+	count int
+}
+
+func (w *lineCountingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	w.count += bytes.Count(p, []byte("\n"))
+	w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+func (w *lineCountingWriter) CountLines() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	count := w.count
+	w.count = 0
+	return count
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,205 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"regexp"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	eventbridgetypes "github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/spf13/cobra"
+
+	"github.com/abicky/ecsmec/internal/capacity"
+	"github.com/abicky/ecsmec/internal/const/ecsconst"
+)
+
+var drainTerminatingInstancesCmd *cobra.Command
+
+const (
+	queueNamePrefixForLifecycleActions = "ecsmec-lifecycle-actions-"
+	ruleNamePrefixForLifecycleActions  = "ecsmec-forward-lifecycle-actions-"
+
+	// cf. https://docs.aws.amazon.com/AWSSimpleQueueService/latest/APIReference/API_CreateQueue.html
+	maxQueueNameLength = 80
+	// cf. https://docs.aws.amazon.com/eventbridge/latest/APIReference/API_PutRule.html
+	maxRuleNameLength = 64
+)
+
+var invalidResourceNameChars = regexp.MustCompile(`[^0-9A-Za-z_-]`)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "drain-terminating-instances",
+		Short: "Drain container instances terminated by the auto scaling group",
+		Long: `This command keeps draining container instances that belong to the
+specified auto scaling group and are being terminated by scale-in
+until it receives SIGINT or SIGTERM.
+The auto scaling group must have a lifecycle hook for the transition
+"autoscaling:EC2_INSTANCE_TERMINATING".`,
+		RunE: drainTerminatingInstances,
+	}
+	rootCmd.AddCommand(cmd)
+
+	cmd.Flags().String("auto-scaling-group-name", "", "The name of the target `GROUP` (required)")
+	cmd.MarkFlagRequired("auto-scaling-group-name")
+
+	cmd.Flags().String("cluster", "default", "The name of the target `CLUSTER`")
+
+	cmd.Flags().Duration("heartbeat-interval", time.Minute, "The interval of heartbeats that extend the timeout of the lifecycle hook while draining instances")
+
+	drainTerminatingInstancesCmd = cmd
+}
+
+func drainTerminatingInstances(cmd *cobra.Command, args []string) error {
+	name, _ := drainTerminatingInstancesCmd.Flags().GetString("auto-scaling-group-name")
+	cluster, _ := drainTerminatingInstancesCmd.Flags().GetString("cluster")
+	heartbeatInterval, _ := drainTerminatingInstancesCmd.Flags().GetDuration("heartbeat-interval")
+
+	cfg, err := newConfig(cmd.Context())
+	if err != nil {
+		return newRuntimeError("failed to initialize a session: %w", err)
+	}
+
+	rec := newRecorder()
+	if rec != nil {
+		defer rec.PrintPlan(os.Stdout)
+	}
+
+	asg, err := capacity.NewAutoScalingGroup(name, newAutoScalingClient(cfg, rec), newEC2Client(cfg, rec))
+	if err != nil {
+		return newRuntimeError("failed to initialize a AutoScalingGroup: %w", err)
+	}
+
+	// Each daemon uses its own queue and rule so as not to receive lifecycle actions of other groups
+	queueName := resourceNameForLifecycleActions(queueNamePrefixForLifecycleActions, name, maxQueueNameLength)
+	ruleName := resourceNameForLifecycleActions(ruleNamePrefixForLifecycleActions, name, maxRuleNameLength)
+
+	if rec != nil {
+		// Notifications are sent only when the auto scaling group actually terminates instances
+		rec.Record("Create the SQS queue %q and the event rule %q to receive lifecycle actions", queueName, ruleName)
+		rec.Record("Drain instances in the auto scaling group %q and complete their lifecycle actions every time they are terminated", name)
+		rec.Record("Delete the event rule %q and the SQS queue %q", ruleName, queueName)
+		return nil
+	}
+
+	ecsSvc := newECSClient(cfg, rec)
+	// The drainer must not wait for approval because nobody is watching the daemon
+	drainer, err := capacity.NewDrainer(cluster, ecsconst.MaxListableContainerInstances, ecsSvc, capacity.WithApprover(capacity.NewAutoApprover()))
+	if err != nil {
+		return newRuntimeError("failed to initialize a Drainer: %w", err)
+	}
+
+	eventPattern, err := json.Marshal(map[string]any{
+		"detail-type": []string{"EC2 Instance-terminate Lifecycle Action"},
+		"source":      []string{"aws.autoscaling"},
+		"detail": map[string][]string{
+			"AutoScalingGroupName": {name},
+		},
+	})
+	if err != nil {
+		return newRuntimeError("failed to create an event pattern: %w", err)
+	}
+
+	sqsSvc := sqs.NewFromConfig(cfg)
+	eventsSvc := eventbridge.NewFromConfig(cfg)
+
+	// The resources that already exist are used by another daemon or left behind by an interrupted one,
+	// so they must not be deleted at exit
+	queueExists, err := sqsQueueExists(cmd.Context(), sqsSvc, queueName)
+	if err != nil {
+		return newRuntimeError("failed to check the SQS queue \"%s\": %w", queueName, err)
+	}
+	if queueExists {
+		log.Printf("[WARNING] The SQS queue %q already exists, so it won't be deleted at exit\n", queueName)
+	}
+	ruleExists, err := eventRuleExists(cmd.Context(), eventsSvc, ruleName)
+	if err != nil {
+		return newRuntimeError("failed to check the event rule \"%s\": %w", ruleName, err)
+	}
+	if ruleExists {
+		log.Printf("[WARNING] The event rule %q already exists, so it won't be deleted at exit\n", ruleName)
+	}
+
+	queueURL, queueArn, err := putSQSQueue(cmd.Context(), sqsSvc, queueName)
+	if err != nil {
+		return newRuntimeError("failed to create a queue for lifecycle actions: %w", err)
+	}
+
+	targetID := "sqs"
+	if err := putEventRule(cmd.Context(), eventsSvc, sqsSvc, ruleName, string(eventPattern), targetID, queueURL, queueArn); err != nil {
+		return newRuntimeError("failed to create an event rule for lifecycle actions: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	asg.DrainTerminatingInstances(ctx, drainer, capacity.NewCluster(cluster, ecsSvc), capacity.NewSQSQueuePoller(queueURL, sqsSvc), heartbeatInterval)
+
+	// Clean up the resources even if the deadline has been exceeded
+	cleanupCtx := context.WithoutCancel(cmd.Context())
+	if !ruleExists {
+		if err := deleteEventRule(cleanupCtx, eventsSvc, ruleName, targetID); err != nil {
+			return newRuntimeError("failed to delete the event rule \"%s\": %w", ruleName, err)
+		}
+	}
+	if !queueExists {
+		if err := deleteSQSQueue(cleanupCtx, sqsSvc, queueURL); err != nil {
+			return newRuntimeError("failed to delete the SQS queue \"%s\": %w", queueName, err)
+		}
+	}
+
+	return nil
+}
+
+// resourceNameForLifecycleActions returns the name of the SQS queue or the event rule dedicated to the auto scaling
+// group. The hash of the group name is appended because the group name is sanitized and truncated to satisfy
+// the naming rules, which might make the names of different groups identical.
+func resourceNameForLifecycleActions(prefix, groupName string, maxLength int) string {
+	sum := sha256.Sum256([]byte(groupName))
+	suffix := "-" + hex.EncodeToString(sum[:4])
+
+	name := invalidResourceNameChars.ReplaceAllString(groupName, "-")
+	if len(name) > maxLength-len(prefix)-len(suffix) {
+		name = name[:maxLength-len(prefix)-len(suffix)]
+	}
+
+	return prefix + name + suffix
+}
+
+func sqsQueueExists(ctx context.Context, svc *sqs.Client, name string) (bool, error) {
+	_, err := svc.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{
+		QueueName: aws.String(name),
+	})
+	var notExist *sqstypes.QueueDoesNotExist
+	if errors.As(err, &notExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func eventRuleExists(ctx context.Context, svc *eventbridge.Client, name string) (bool, error) {
+	_, err := svc.DescribeRule(ctx, &eventbridge.DescribeRuleInput{
+		Name: aws.String(name),
+	})
+	var notFound *eventbridgetypes.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
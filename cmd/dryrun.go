@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+
+	"github.com/abicky/ecsmec/internal/capacity"
+	"github.com/abicky/ecsmec/internal/dryrun"
+)
+
+func isDryRun() bool {
+	dryRun, _ := rootCmd.Flags().GetBool("dry-run")
+	return dryRun
+}
+
+// newRecorder returns nil unless "--dry-run" is specified.
+func newRecorder() *dryrun.Recorder {
+	if !isDryRun() {
+		return nil
+	}
+	return dryrun.NewRecorder()
+}
+
+func newAutoScalingClient(cfg aws.Config, rec *dryrun.Recorder) capacity.AutoScalingAPI {
+	svc := autoscaling.NewFromConfig(cfg)
+	if rec == nil {
+		return svc
+	}
+	return rec.AutoScaling(svc)
+}
+
+func newEC2Client(cfg aws.Config, rec *dryrun.Recorder) capacity.EC2API {
+	svc := ec2.NewFromConfig(cfg)
+	if rec == nil {
+		return svc
+	}
+	return rec.EC2(svc)
+}
+
+func newECSClient(cfg aws.Config, rec *dryrun.Recorder) dryrun.ECSAPI {
+	svc := ecs.NewFromConfig(cfg)
+	if rec == nil {
+		return svc
+	}
+	return rec.ECS(svc)
+}
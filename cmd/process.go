@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/xerrors"
+
+	"github.com/abicky/ecsmec/internal/capacity"
+	"github.com/abicky/ecsmec/internal/const/autoscalingconst"
+)
+
+func addSuspendProcessesFlag(cmd *cobra.Command) {
+	cmd.Flags().StringSlice("suspend-processes", capacity.DefaultSuspendedProcesses, "The scaling `PROCESSES` of the auto scaling group suspended during the operation (e.g. Launch and Terminate can also be specified)")
+}
+
+// getSuspendedProcesses returns the processes specified by "--suspend-processes" except for the disallowed ones.
+func getSuspendedProcesses(cmd *cobra.Command, disallowed ...string) ([]string, error) {
+	processes, _ := cmd.Flags().GetStringSlice("suspend-processes")
+	for _, p := range processes {
+		if !slices.Contains(autoscalingconst.ScalingProcesses, p) {
+			return nil, fmt.Errorf("\"suspend-processes\" includes an unknown process: %s", p)
+		}
+		if slices.Contains(disallowed, p) {
+			return nil, fmt.Errorf("\"suspend-processes\" can't include %s for this command", p)
+		}
+	}
+	return processes, nil
+}
+
+// suspendScaling suspends the scaling processes and the managed scaling of the capacity provider backed by asg
+// so that neither of them changes the desired capacity during the operation.
+func suspendScaling(ctx context.Context, asg *capacity.AutoScalingGroup, ecsSvc capacity.ECSAPI, processes []string) error {
+	if err := asg.SuspendProcesses(ctx, processes); err != nil {
+		return xerrors.Errorf("failed to suspend processes: %w", err)
+	}
+	if err := asg.DisableManagedScaling(ctx, ecsSvc); err != nil {
+		return xerrors.Errorf("failed to disable managed scaling: %w", err)
+	}
+	return nil
+}
+
+// resumeScaling restores what suspendScaling has changed.
+func resumeScaling(ctx context.Context, asg *capacity.AutoScalingGroup, ecsSvc capacity.ECSAPI) error {
+	if err := asg.RestoreManagedScaling(ctx, ecsSvc); err != nil {
+		return xerrors.Errorf("failed to restore managed scaling: %w", err)
+	}
+	if err := asg.ResumeProcesses(ctx); err != nil {
+		return xerrors.Errorf("failed to resume processes: %w", err)
+	}
+	return nil
+}
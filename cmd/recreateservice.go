@@ -2,12 +2,13 @@ package cmd
 
 import (
 	"encoding/json"
+	"os"
 	"strings"
 
-	"github.com/aws/aws-sdk-go-v2/service/ecs"
 	"github.com/spf13/cobra"
 
 	"github.com/abicky/ecsmec/internal/service"
+	"github.com/abicky/ecsmec/internal/timeout"
 )
 
 var recreateServiceCmd *cobra.Command
@@ -49,6 +50,8 @@ to place its tasks.`,
 
 	cmd.Flags().String("overrides", "{}", "An `JSON` to override some fields of the new service")
 
+	addTimeoutFlags(cmd, timeout.PhaseTaskStop, timeout.PhaseServiceStabilization)
+
 	recreateServiceCmd = cmd
 }
 
@@ -69,7 +72,12 @@ func recreateService(cmd *cobra.Command, args []string) error {
 		return newRuntimeError("failed to initialize configuration: %w", err)
 	}
 
-	if err := service.NewService(ecs.NewFromConfig(cfg)).Recreate(cmd.Context(), cluster, serviceName, overrideDef); err != nil {
+	rec := newRecorder()
+	if rec != nil {
+		defer rec.PrintPlan(os.Stdout)
+	}
+
+	if err := service.NewService(newECSClient(cfg, rec)).Recreate(cmd.Context(), cluster, serviceName, overrideDef); err != nil {
 		return newRuntimeError("failed to recreate the service: %w", err)
 	}
 	return nil
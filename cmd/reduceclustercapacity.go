@@ -4,11 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
-	"github.com/aws/aws-sdk-go-v2/service/ec2"
-	"github.com/aws/aws-sdk-go-v2/service/ecs"
 	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
 	eventbridgetypes "github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
@@ -18,13 +19,15 @@ import (
 
 	"github.com/abicky/ecsmec/internal/capacity"
 	"github.com/abicky/ecsmec/internal/const/ecsconst"
+	"github.com/abicky/ecsmec/internal/timeout"
 )
 
 var reduceClusterCapacityCmd *cobra.Command
 
 const (
-	queueNameForInterruptionWarnings = "ecsmec-ec2-spot-instance-interruption-warnings"
-	ruleNameForInterruptionWarnings  = "ecsmec-forward-ec2-spot-instance-interruption-warnings"
+	queueNameForInterruptionWarnings    = "ecsmec-ec2-spot-instance-interruption-warnings"
+	ruleNameForInterruptionWarnings     = "ecsmec-forward-ec2-spot-instance-interruption-warnings"
+	eventPatternForInterruptionWarnings = `{"detail-type":["EC2 Spot Instance Interruption Warning"],"source":["aws.ec2"]}`
 )
 
 func init() {
@@ -44,8 +47,28 @@ that belong to the auto scaling group or spot fleet request.`,
 
 	cmd.Flags().String("cluster", "default", "The name of the target `CLUSTER`")
 
-	cmd.Flags().Int32("amount", 0, "The amount of the capacity to reduce (required)")
-	cmd.MarkFlagRequired("amount")
+	cmd.Flags().Int32("amount", 0, "The amount of the capacity to reduce (required unless target instances are specified, in which case all of them are terminated by default)")
+
+	cmd.Flags().StringSlice("instance-ids", nil, "The `IDS` of the instances to terminate")
+	cmd.Flags().String("availability-zone", "", "The availability `ZONE` whose instances are terminated")
+	cmd.Flags().String("container-instance-filter", "", "The cluster query language `EXPRESSION` to select container instances to terminate")
+	cmd.Flags().Bool("return-to-warm-pool", false, "Return the instances to the warm pool of the auto scaling group instead of terminating them")
+	cmd.Flags().Bool("override-protection", false, "Remove the scale-in and termination protection of the instances to terminate instead of skipping them")
+
+	strategies := make([]string, len(capacity.SelectionStrategies))
+	for i, s := range capacity.SelectionStrategies {
+		strategies[i] = string(s)
+	}
+	cmd.Flags().String("selection-strategy", string(capacity.SelectionStrategyOldest), fmt.Sprintf("The `STRATEGY` to select instances to terminate in each availability zone of the auto scaling group (%s)", strings.Join(strategies, ", ")))
+
+	addSuspendProcessesFlag(cmd)
+
+	addTerminationModeFlag(cmd)
+
+	addTimeoutFlags(cmd, timeout.PhaseInstanceDrain, timeout.PhaseInstanceTermination, timeout.PhaseTaskStop, timeout.PhaseServiceStabilization)
+
+	addDrainerFlags(cmd)
+	cmd.Flags().Bool("force", false, "Drain container instances even if the tasks on them don't fit on the remaining container instances")
 
 	reduceClusterCapacityCmd = cmd
 }
@@ -55,36 +78,132 @@ func reduceClusterCapacity(cmd *cobra.Command, args []string) error {
 	name, _ := reduceClusterCapacityCmd.Flags().GetString("auto-scaling-group-name")
 	cluster, _ := reduceClusterCapacityCmd.Flags().GetString("cluster")
 	amount, _ := reduceClusterCapacityCmd.Flags().GetInt32("amount")
+	strategy, _ := reduceClusterCapacityCmd.Flags().GetString("selection-strategy")
+	instanceIDs, _ := reduceClusterCapacityCmd.Flags().GetStringSlice("instance-ids")
+	az, _ := reduceClusterCapacityCmd.Flags().GetString("availability-zone")
+	filter, _ := reduceClusterCapacityCmd.Flags().GetString("container-instance-filter")
+	overrideProtection, _ := reduceClusterCapacityCmd.Flags().GetBool("override-protection")
+	returnToWarmPool, _ := reduceClusterCapacityCmd.Flags().GetBool("return-to-warm-pool")
+	force, _ := reduceClusterCapacityCmd.Flags().GetBool("force")
 
-	if amount <= 0 {
+	targeted := len(instanceIDs) > 0 || az != "" || filter != ""
+	if amount < 0 || (amount == 0 && !targeted) {
 		return errors.New("\"amount\" must be greater than 0")
 	}
+	if !slices.Contains(capacity.SelectionStrategies, capacity.SelectionStrategy(strategy)) {
+		return fmt.Errorf("\"selection-strategy\" is invalid: %s", strategy)
+	}
+	if len(id) > 0 && reduceClusterCapacityCmd.Flags().Changed("selection-strategy") {
+		return errors.New("\"selection-strategy\" is only available for auto scaling groups")
+	}
+	if len(id) > 0 && targeted {
+		return errors.New("\"instance-ids\", \"availability-zone\", and \"container-instance-filter\" are only available for auto scaling groups")
+	}
+	if len(id) > 0 && overrideProtection {
+		return errors.New("\"override-protection\" is only available for auto scaling groups")
+	}
+	if len(id) > 0 && reduceClusterCapacityCmd.Flags().Changed("termination-mode") {
+		return errors.New("\"termination-mode\" is only available for auto scaling groups")
+	}
+	if len(id) > 0 && returnToWarmPool {
+		return errors.New("\"return-to-warm-pool\" is only available for auto scaling groups")
+	}
+	if returnToWarmPool && reduceClusterCapacityCmd.Flags().Changed("termination-mode") {
+		return errors.New("\"return-to-warm-pool\" and \"termination-mode\" can't be specified together")
+	}
+	if len(id) > 0 && reduceClusterCapacityCmd.Flags().Changed("suspend-processes") {
+		return errors.New("\"suspend-processes\" is only available for auto scaling groups")
+	}
+	processes, err := getSuspendedProcesses(reduceClusterCapacityCmd)
+	if err != nil {
+		return err
+	}
+	terminationMode, err := getTerminationMode(reduceClusterCapacityCmd)
+	if err != nil {
+		return err
+	}
 
 	cfg, err := newConfig(cmd.Context())
 	if err != nil {
 		return newRuntimeError("failed to initialize a session: %w", err)
 	}
 
-	drainer, err := capacity.NewDrainer(cluster, ecsconst.MaxListableContainerInstances, ecs.NewFromConfig(cfg))
+	rec := newRecorder()
+	if rec != nil {
+		defer rec.PrintPlan(os.Stdout)
+	}
+
+	ecsSvc := newECSClient(cfg, rec)
+	// Simulated container instances don't have remaining resources, so the check only warns in dry-run mode.
+	drainerOpts, err := newDrainerOptions(reduceClusterCapacityCmd, newEC2Client(cfg, rec))
+	if err != nil {
+		return err
+	}
+	drainerOpts = append(drainerOpts, capacity.WithPreflightCheck(force || isDryRun()))
+	drainer, err := capacity.NewDrainer(cluster, ecsconst.MaxListableContainerInstances, ecsSvc, drainerOpts...)
 	if err != nil {
 		return newRuntimeError("failed to initialize a Drainer: %w", err)
 	}
 
 	if len(id) == 0 {
-		asg, err := capacity.NewAutoScalingGroup(name, autoscaling.NewFromConfig(cfg), ec2.NewFromConfig(cfg))
+		asg, err := capacity.NewAutoScalingGroup(name, newAutoScalingClient(cfg, rec), newEC2Client(cfg, rec), capacity.WithTerminationMode(terminationMode))
 		if err != nil {
 			return newRuntimeError("failed to initialize a AutoScalingGroup: %w", err)
 		}
+		// Suspending and resuming the processes would overwrite the ones saved by the interrupted replacement
+		if asg.StateSavedAt != nil {
+			return newRuntimeError("the auto scaling group %q has a replacement in progress, so resume it with replace-auto-scaling-group-instances or roll it back with rollback-auto-scaling-group-instances first", name)
+		}
 
-		if err := asg.ReduceCapacity(cmd.Context(), amount, drainer); err != nil {
-			return newRuntimeError("failed to reduce the cluster capacity: %w", err)
+		ecsCluster := capacity.NewCluster(cluster, ecsSvc)
+		opts := []capacity.ReduceOption{capacity.WithSelectionStrategy(capacity.SelectionStrategy(strategy), ecsCluster)}
+		if len(instanceIDs) > 0 {
+			opts = append(opts, capacity.WithTargetInstances(instanceIDs))
+		}
+		if az != "" {
+			opts = append(opts, capacity.WithTargetAvailabilityZone(az))
+		}
+		if filter != "" {
+			opts = append(opts, capacity.WithContainerInstanceFilter(filter, ecsCluster))
+		}
+		if overrideProtection {
+			opts = append(opts, capacity.WithProtectionOverride())
+		}
+		if returnToWarmPool {
+			opts = append(opts, capacity.WithWarmPoolReturn(ecsCluster))
+		}
+
+		if err := suspendScaling(cmd.Context(), asg, ecsSvc, processes); err != nil {
+			return newRuntimeError("failed to suspend scaling: %w", err)
+		}
+		// Unlike the replacement, the reduction isn't resumable, so scaling is resumed even if it fails
+		reduceErr := asg.ReduceCapacity(cmd.Context(), amount, drainer, opts...)
+		if err := resumeScaling(cmd.Context(), asg, ecsSvc); err != nil {
+			if reduceErr == nil {
+				return newRuntimeError("failed to resume scaling: %w", err)
+			}
+			log.Printf("[WARNING] Failed to resume scaling: %v\n", err)
+		}
+		if reduceErr != nil {
+			return newRuntimeError("failed to reduce the cluster capacity: %w", reduceErr)
 		}
 	} else {
-		sfr, err := capacity.NewSpotFleetRequest(id, ec2.NewFromConfig(cfg))
+		sfr, err := capacity.NewSpotFleetRequest(id, newEC2Client(cfg, rec))
 		if err != nil {
 			return newRuntimeError("failed to initialize a SpotFleetRequest: %w", err)
 		}
 
+		if rec != nil {
+			// Neither the queue nor the rule is created in dry-run mode,
+			// and the recorder simulates interruption warnings instead.
+			rec.Record("Create the SQS queue %q and the event rule %q to receive interruption warnings", queueNameForInterruptionWarnings, ruleNameForInterruptionWarnings)
+			if err := sfr.ReduceCapacity(cmd.Context(), amount, drainer, capacity.NewSQSQueuePoller(queueNameForInterruptionWarnings, rec.SQS())); err != nil {
+				return newRuntimeError("failed to reduce the cluster capacity: %w", err)
+			}
+			rec.Record("Delete the event rule %q and the SQS queue %q", ruleNameForInterruptionWarnings, queueNameForInterruptionWarnings)
+			return nil
+		}
+
 		sqsSvc := sqs.NewFromConfig(cfg)
 		queueURL, queueArn, err := putSQSQueue(cmd.Context(), sqsSvc, queueNameForInterruptionWarnings)
 		if err != nil {
@@ -93,7 +212,7 @@ func reduceClusterCapacity(cmd *cobra.Command, args []string) error {
 
 		eventsSvc := eventbridge.NewFromConfig(cfg)
 		targetID := "sqs"
-		if err := putEventRule(cmd.Context(), eventsSvc, sqsSvc, ruleNameForInterruptionWarnings, targetID, queueURL, queueArn); err != nil {
+		if err := putEventRule(cmd.Context(), eventsSvc, sqsSvc, ruleNameForInterruptionWarnings, eventPatternForInterruptionWarnings, targetID, queueURL, queueArn); err != nil {
 			return newRuntimeError("failed to create an event rule for interruption warnings: %w", err)
 		}
 
@@ -140,13 +259,13 @@ func deleteSQSQueue(ctx context.Context, svc *sqs.Client, queueURL string) error
 	return err
 }
 
-func putEventRule(ctx context.Context, eventsSvc *eventbridge.Client, sqsSvc *sqs.Client, ruleName, targetID, queueURL, queueArn string) error {
+func putEventRule(ctx context.Context, eventsSvc *eventbridge.Client, sqsSvc *sqs.Client, ruleName, eventPattern, targetID, queueURL, queueArn string) error {
 	rule, err := eventsSvc.PutRule(ctx, &eventbridge.PutRuleInput{
-		EventPattern: aws.String("{\"detail-type\":[\"EC2 Spot Instance Interruption Warning\"],\"source\":[\"aws.ec2\"]}"),
+		EventPattern: aws.String(eventPattern),
 		Name:         aws.String(ruleName),
 	})
 	if err != nil {
-		return xerrors.Errorf("failed to create a rule for interruption warnings: %w", err)
+		return xerrors.Errorf("failed to create the rule \"%s\": %w", ruleName, err)
 	}
 
 	_, err = sqsSvc.SetQueueAttributes(ctx, &sqs.SetQueueAttributesInput{
@@ -173,7 +292,7 @@ func putEventRule(ctx context.Context, eventsSvc *eventbridge.Client, sqsSvc *sq
 		QueueUrl: aws.String(queueURL),
 	})
 	if err != nil {
-		return xerrors.Errorf("failed to update the queue access policy for interruption warnings: %w", err)
+		return xerrors.Errorf("failed to update the access policy of the queue \"%s\": %w", queueURL, err)
 	}
 
 	_, err = eventsSvc.PutTargets(ctx, &eventbridge.PutTargetsInput{
@@ -186,7 +305,7 @@ func putEventRule(ctx context.Context, eventsSvc *eventbridge.Client, sqsSvc *sq
 		},
 	})
 	if err != nil {
-		return xerrors.Errorf("failed to put a target for interruption warnings: %w", err)
+		return xerrors.Errorf("failed to put a target of the rule \"%s\": %w", ruleName, err)
 	}
 
 	return nil
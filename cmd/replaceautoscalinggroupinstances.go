@@ -1,17 +1,26 @@
 package cmd
 
 import (
-	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
-	"github.com/aws/aws-sdk-go-v2/service/ec2"
-	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
 	"github.com/spf13/cobra"
 
 	"github.com/abicky/ecsmec/internal/capacity"
 	"github.com/abicky/ecsmec/internal/const/ecsconst"
+	"github.com/abicky/ecsmec/internal/timeout"
 )
 
 var replaceAutoScalingGroupInstancesCmd *cobra.Command
 
+var agentVersionRegexp = regexp.MustCompile(`^\d+(\.\d+)*$`)
+
 func init() {
 	cmd := &cobra.Command{
 		Use:   "replace-auto-scaling-group-instances",
@@ -30,6 +39,28 @@ launches new ones.`,
 
 	cmd.Flags().Int32("batch-size", ecsconst.MaxListableContainerInstances, "The number of instances drained at a once")
 
+	cmd.Flags().Int32("max-surge", 0, "The maximum number of new instances launched at a once (0 means as many as the old instances)")
+
+	cmd.Flags().Bool("drifted-only", false, "Replace only instances whose launch template version, AMI ID, or instance type differs from what the group launches now")
+
+	cmd.Flags().Int32("canary-count", 0, "The number of old instances drained first as canaries before the rest (0 means no canaries)")
+
+	cmd.Flags().Duration("canary-soak-period", 5*time.Minute, "How long to watch the services affected by the canaries before draining the rest")
+
+	cmd.Flags().Bool("refresh-warm-pool", false, "Terminate the instances in the warm pool whose AMI differs from what the group launches now before launching new instances")
+
+	cmd.Flags().String("min-agent-version", "", "The minimum `VERSION` of the ECS agent that new container instances must run")
+
+	cmd.Flags().StringArray("required-attribute", nil, "The attribute that new container instances must have in the format `NAME[=VALUE]` (can be specified multiple times)")
+
+	addSuspendProcessesFlag(cmd)
+
+	addTerminationModeFlag(cmd)
+
+	addTimeoutFlags(cmd, timeout.PhaseInstanceLaunch, timeout.PhaseInstanceTermination, timeout.PhaseTaskStop, timeout.PhaseServiceStabilization)
+
+	addDrainerFlags(cmd)
+
 	replaceAutoScalingGroupInstancesCmd = cmd
 }
 
@@ -37,25 +68,98 @@ func replaceAutoScalingGroupInstances(cmd *cobra.Command, args []string) error {
 	name, _ := replaceAutoScalingGroupInstancesCmd.Flags().GetString("auto-scaling-group-name")
 	clusterName, _ := replaceAutoScalingGroupInstancesCmd.Flags().GetString("cluster")
 	batchSize, _ := replaceAutoScalingGroupInstancesCmd.Flags().GetInt32("batch-size")
+	maxSurge, _ := replaceAutoScalingGroupInstancesCmd.Flags().GetInt32("max-surge")
+	driftedOnly, _ := replaceAutoScalingGroupInstancesCmd.Flags().GetBool("drifted-only")
+	canaryCount, _ := replaceAutoScalingGroupInstancesCmd.Flags().GetInt32("canary-count")
+	canarySoakPeriod, _ := replaceAutoScalingGroupInstancesCmd.Flags().GetDuration("canary-soak-period")
+	refreshWarmPool, _ := replaceAutoScalingGroupInstancesCmd.Flags().GetBool("refresh-warm-pool")
+	minAgentVersion, _ := replaceAutoScalingGroupInstancesCmd.Flags().GetString("min-agent-version")
+	requiredAttributes, _ := replaceAutoScalingGroupInstancesCmd.Flags().GetStringArray("required-attribute")
+
+	if minAgentVersion != "" && !agentVersionRegexp.MatchString(minAgentVersion) {
+		return fmt.Errorf("\"min-agent-version\" must be a version like \"1.80.0\": %s", minAgentVersion)
+	}
+	// New instances can't be launched while Launch is suspended
+	processes, err := getSuspendedProcesses(replaceAutoScalingGroupInstancesCmd, "Launch")
+	if err != nil {
+		return err
+	}
+	terminationMode, err := getTerminationMode(replaceAutoScalingGroupInstancesCmd)
+	if err != nil {
+		return err
+	}
 
 	cfg, err := newConfig(cmd.Context())
 	if err != nil {
 		return newRuntimeError("failed to initialize a session: %w", err)
 	}
 
-	asg, err := capacity.NewAutoScalingGroup(name, autoscaling.NewFromConfig(cfg), ec2.NewFromConfig(cfg))
+	rec := newRecorder()
+	if rec != nil {
+		defer rec.PrintPlan(os.Stdout)
+	}
+
+	asg, err := capacity.NewAutoScalingGroup(name, newAutoScalingClient(cfg, rec), newEC2Client(cfg, rec), capacity.WithTerminationMode(terminationMode))
 	if err != nil {
 		return newRuntimeError("failed to initialize a AutoScalingGroup: %w", err)
 	}
 
-	ecsSvc := ecs.NewFromConfig(cfg)
-	drainer, err := capacity.NewDrainer(clusterName, batchSize, ecsSvc)
+	ecsSvc := newECSClient(cfg, rec)
+	drainerOpts, err := newDrainerOptions(replaceAutoScalingGroupInstancesCmd, newEC2Client(cfg, rec))
+	if err != nil {
+		return err
+	}
+	drainer, err := capacity.NewDrainer(clusterName, batchSize, ecsSvc, drainerOpts...)
 	if err != nil {
 		return newRuntimeError("failed to initialize a Drainer: %w", err)
 	}
 
-	if err := asg.ReplaceInstances(cmd.Context(), drainer, capacity.NewCluster(clusterName, ecsSvc)); err != nil {
+	opts := make([]capacity.ReplaceOption, 0)
+	// Don't override the mode of the interrupted replacement unless the options are specified
+	if maxSurge > 0 {
+		opts = append(opts, capacity.WithMaxSurge(maxSurge))
+	}
+	if driftedOnly {
+		opts = append(opts, capacity.WithDriftedOnly())
+	}
+	if canaryCount > 0 {
+		// Watching the services is meaningless in dry-run mode because nothing is drained actually
+		if isDryRun() {
+			canarySoakPeriod = 0
+		}
+		opts = append(opts, capacity.WithCanary(canaryCount, canarySoakPeriod))
+	}
+	if refreshWarmPool {
+		opts = append(opts, capacity.WithWarmPoolRefresh())
+	} else if asg.WarmPoolConfiguration != nil {
+		log.Printf("[WARNING] The auto scaling group %q has a warm pool, so new instances might be taken from it with the old AMI unless \"refresh-warm-pool\" is specified\n", name)
+	}
+
+	// Simulated container instances in dry-run mode have neither the agent version nor attributes
+	clusterOpts := make([]capacity.ClusterOption, 0)
+	if !isDryRun() {
+		if minAgentVersion != "" {
+			clusterOpts = append(clusterOpts, capacity.WithMinimumAgentVersion(minAgentVersion))
+		}
+		for _, attr := range requiredAttributes {
+			name, value, found := strings.Cut(attr, "=")
+			a := ecstypes.Attribute{Name: aws.String(name)}
+			if found {
+				a.Value = aws.String(value)
+			}
+			clusterOpts = append(clusterOpts, capacity.WithRequiredAttributes(a))
+		}
+	}
+
+	if err := suspendScaling(cmd.Context(), asg, ecsSvc, processes); err != nil {
+		return newRuntimeError("failed to suspend scaling: %w", err)
+	}
+	// Scaling is kept suspended if the replacement fails so that it can be resumed or rolled back safely
+	if err := asg.ReplaceInstances(cmd.Context(), drainer, capacity.NewCluster(clusterName, ecsSvc, clusterOpts...), opts...); err != nil {
 		return newRuntimeError("failed to replace instances: %w", err)
 	}
+	if err := resumeScaling(cmd.Context(), asg, ecsSvc); err != nil {
+		return newRuntimeError("failed to resume scaling: %w", err)
+	}
 	return nil
 }
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/abicky/ecsmec/internal/capacity"
+	"github.com/abicky/ecsmec/internal/const/ecsconst"
+	"github.com/abicky/ecsmec/internal/timeout"
+)
+
+var rollbackAutoScalingGroupInstancesCmd *cobra.Command
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "rollback-auto-scaling-group-instances",
+		Short: "Roll back the interrupted replacement of container instances",
+		Long: `This command rolls back the replacement of container instances that
+was interrupted halfway by "replace-auto-scaling-group-instances".
+It terminates the new instances, reactivates the old container instances,
+and restores the original state of the specified auto scaling group.`,
+		RunE: rollbackAutoScalingGroupInstances,
+	}
+	rootCmd.AddCommand(cmd)
+
+	cmd.Flags().String("auto-scaling-group-name", "", "The name of the target `GROUP` (required)")
+	cmd.MarkFlagRequired("auto-scaling-group-name")
+
+	cmd.Flags().String("cluster", "default", "The name of the target `CLUSTER`")
+
+	cmd.Flags().Int32("batch-size", ecsconst.MaxListableContainerInstances, "The number of instances drained at a once")
+
+	addSuspendProcessesFlag(cmd)
+
+	addTerminationModeFlag(cmd)
+
+	addTimeoutFlags(cmd, timeout.PhaseInstanceTermination, timeout.PhaseTaskStop, timeout.PhaseServiceStabilization)
+
+	addDrainerFlags(cmd)
+
+	rollbackAutoScalingGroupInstancesCmd = cmd
+}
+
+func rollbackAutoScalingGroupInstances(cmd *cobra.Command, args []string) error {
+	name, _ := rollbackAutoScalingGroupInstancesCmd.Flags().GetString("auto-scaling-group-name")
+	clusterName, _ := rollbackAutoScalingGroupInstancesCmd.Flags().GetString("cluster")
+	batchSize, _ := rollbackAutoScalingGroupInstancesCmd.Flags().GetInt32("batch-size")
+
+	processes, err := getSuspendedProcesses(rollbackAutoScalingGroupInstancesCmd)
+	if err != nil {
+		return err
+	}
+	terminationMode, err := getTerminationMode(rollbackAutoScalingGroupInstancesCmd)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := newConfig(cmd.Context())
+	if err != nil {
+		return newRuntimeError("failed to initialize a session: %w", err)
+	}
+
+	rec := newRecorder()
+	if rec != nil {
+		defer rec.PrintPlan(os.Stdout)
+	}
+
+	asg, err := capacity.NewAutoScalingGroup(name, newAutoScalingClient(cfg, rec), newEC2Client(cfg, rec), capacity.WithTerminationMode(terminationMode))
+	if err != nil {
+		return newRuntimeError("failed to initialize a AutoScalingGroup: %w", err)
+	}
+
+	ecsSvc := newECSClient(cfg, rec)
+	drainerOpts, err := newDrainerOptions(rollbackAutoScalingGroupInstancesCmd, newEC2Client(cfg, rec))
+	if err != nil {
+		return err
+	}
+	drainer, err := capacity.NewDrainer(clusterName, batchSize, ecsSvc, drainerOpts...)
+	if err != nil {
+		return newRuntimeError("failed to initialize a Drainer: %w", err)
+	}
+
+	if err := suspendScaling(cmd.Context(), asg, ecsSvc, processes); err != nil {
+		return newRuntimeError("failed to suspend scaling: %w", err)
+	}
+	if err := asg.RollbackReplacement(cmd.Context(), drainer, capacity.NewCluster(clusterName, ecsSvc)); err != nil {
+		return newRuntimeError("failed to roll back the replacement: %w", err)
+	}
+	// Scaling suspended by the interrupted replacement is also resumed
+	if err := resumeScaling(cmd.Context(), asg, ecsSvc); err != nil {
+		return newRuntimeError("failed to resume scaling: %w", err)
+	}
+	return nil
+}
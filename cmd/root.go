@@ -23,8 +23,19 @@ var rootCmd = &cobra.Command{
 	SilenceErrors: true,
 	SilenceUsage:  true,
 	Version:       version,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		if deadline, _ := cmd.Flags().GetDuration("deadline"); deadline > 0 {
+			ctx, cancelDeadline = context.WithTimeout(ctx, deadline)
+		}
+		cmd.SetContext(withTimeouts(ctx, cmd))
+		return nil
+	},
 }
 
+// cancelDeadline releases the resources of the context with the deadline specified by --deadline
+var cancelDeadline context.CancelFunc = func() {}
+
 type runtimeError struct {
 	err error
 }
@@ -40,6 +51,8 @@ func newRuntimeError(format string, a ...any) error {
 }
 
 func Execute() int {
+	defer func() { cancelDeadline() }()
+
 	if cmd, err := rootCmd.ExecuteC(); err != nil {
 		var rerr *runtimeError
 		if errors.As(err, &rerr) {
@@ -62,6 +75,8 @@ func init() {
 `, revision))
 	rootCmd.PersistentFlags().String("profile", "", "An AWS profile name in your credential file")
 	rootCmd.PersistentFlags().String("region", "", "The AWS region")
+	rootCmd.PersistentFlags().Bool("dry-run", false, "Print the operations that would be executed without executing them")
+	rootCmd.PersistentFlags().Duration("deadline", 0, "The maximum time the whole operation can take (0 means no deadline)")
 }
 
 func newConfig(ctx context.Context) (aws.Config, error) {
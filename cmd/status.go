@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/spf13/cobra"
+	"golang.org/x/xerrors"
+
+	"github.com/abicky/ecsmec/internal/capacity"
+)
+
+var statusCmd *cobra.Command
+
+// All the SQS queues and event rules created by ecsmec have this prefix
+const resourceNamePrefix = "ecsmec-"
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show the operations in progress",
+		Long: `This command shows the operations of ecsmec that are in progress or
+were interrupted, that is, auto scaling groups that have tags starting
+with the prefix "ecsmec:" and whose instances belong to the specified
+cluster, and SQS queues and event rules that ecsmec left behind.`,
+		RunE: status,
+	}
+	rootCmd.AddCommand(cmd)
+
+	cmd.Flags().String("cluster", "default", "The name of the target `CLUSTER`")
+
+	statusCmd = cmd
+}
+
+func status(cmd *cobra.Command, args []string) error {
+	clusterName, _ := statusCmd.Flags().GetString("cluster")
+
+	cfg, err := newConfig(cmd.Context())
+	if err != nil {
+		return newRuntimeError("failed to initialize a session: %w", err)
+	}
+
+	// This command never mutates resources, so it doesn't need a recorder even in dry-run mode
+	groups, err := capacity.FindAutoScalingGroupsInProgress(cmd.Context(), newAutoScalingClient(cfg, nil), newEC2Client(cfg, nil))
+	if err != nil {
+		return newRuntimeError("failed to find auto scaling groups in progress: %w", err)
+	}
+
+	w := cmd.OutOrStdout()
+	cluster := capacity.NewCluster(clusterName, newECSClient(cfg, nil))
+	found := false
+	for _, asg := range groups {
+		printed, err := printReplacementStatus(cmd.Context(), w, asg, cluster)
+		if err != nil {
+			return newRuntimeError("failed to print the status of the auto scaling group %q: %w", *asg.AutoScalingGroupName, err)
+		}
+		found = found || printed
+	}
+
+	leftovers, err := findLeftoverResources(cmd.Context(), sqs.NewFromConfig(cfg), eventbridge.NewFromConfig(cfg))
+	if err != nil {
+		return newRuntimeError("failed to find leftover resources: %w", err)
+	}
+	if len(leftovers) > 0 {
+		found = true
+		fmt.Fprintln(w, "Resources created by ecsmec (they are left behind unless a command using them is running):")
+		for _, l := range leftovers {
+			fmt.Fprintf(w, "  %s\n", l)
+		}
+	}
+
+	if !found {
+		fmt.Fprintf(w, "There are no operations in progress in the cluster %q\n", clusterName)
+	}
+
+	return nil
+}
+
+// printReplacementStatus prints the status of the replacement and returns false if the auto scaling group doesn't
+// belong to the cluster.
+func printReplacementStatus(ctx context.Context, w io.Writer, asg *capacity.AutoScalingGroup, cluster capacity.Cluster) (bool, error) {
+	instanceIDs := make([]string, len(asg.Instances))
+	for i, instance := range asg.Instances {
+		instanceIDs[i] = *instance.InstanceId
+	}
+	if len(instanceIDs) == 0 {
+		return false, nil
+	}
+
+	containerInstances, err := cluster.ContainerInstances(ctx, instanceIDs)
+	if err != nil {
+		return false, xerrors.Errorf("failed to fetch container instances: %w", err)
+	}
+	if len(containerInstances) == 0 {
+		return false, nil
+	}
+
+	s, err := asg.ReplacementStatus(ctx)
+	if err != nil {
+		return false, xerrors.Errorf("failed to fetch the replacement status: %w", err)
+	}
+
+	fmt.Fprintf(w, "Auto scaling group %q: replacement in progress\n", *asg.AutoScalingGroupName)
+	fmt.Fprintf(w, "  Phase: %s\n", s.Phase)
+	fmt.Fprintf(w, "  Started at: %s\n", asg.StateSavedAt.Format(time.RFC3339))
+	if asg.MaxSurge != nil {
+		fmt.Fprintf(w, "  Max surge: %d\n", *asg.MaxSurge)
+	}
+	if asg.DriftedOnly {
+		fmt.Fprintln(w, "  Drifted only: true")
+	}
+	fmt.Fprintf(w, "  Desired capacity: %d (original: %d)\n", *asg.DesiredCapacity, *asg.OriginalDesiredCapacity)
+	fmt.Fprintf(w, "  Max size: %d (original: %d)\n", *asg.MaxSize, *asg.OriginalMaxSize)
+	if asg.OriginalSuspendedProcesses != nil {
+		processes := make([]string, len(asg.SuspendedProcesses))
+		for i, p := range asg.SuspendedProcesses {
+			processes[i] = *p.ProcessName
+		}
+		fmt.Fprintf(w, "  Suspended processes: %v (original: %v)\n", processes, asg.OriginalSuspendedProcesses)
+	}
+	if asg.CapacityProviderName != nil {
+		fmt.Fprintf(w, "  Capacity provider: %s (managed scaling disabled)\n", *asg.CapacityProviderName)
+	}
+	fmt.Fprintf(w, "  Old instances remaining: %d\n", len(s.OldInstanceIDs))
+	fmt.Fprintf(w, "  New instances: %d\n", len(s.NewInstanceIDs))
+
+	draining := make([]ecstypes.ContainerInstance, 0)
+	for _, ci := range containerInstances {
+		if aws.ToString(ci.Status) == string(ecstypes.ContainerInstanceStatusDraining) {
+			draining = append(draining, ci)
+		}
+	}
+	fmt.Fprintf(w, "  Draining container instances: %d\n", len(draining))
+	for _, ci := range draining {
+		fmt.Fprintf(w, "    %s (%s, %d running tasks)\n", *ci.ContainerInstanceArn, aws.ToString(ci.Ec2InstanceId), ci.RunningTasksCount)
+	}
+
+	return true, nil
+}
+
+func findLeftoverResources(ctx context.Context, sqsSvc *sqs.Client, eventsSvc *eventbridge.Client) ([]string, error) {
+	leftovers := make([]string, 0)
+
+	queuePaginator := sqs.NewListQueuesPaginator(sqsSvc, &sqs.ListQueuesInput{
+		QueueNamePrefix: aws.String(resourceNamePrefix),
+	})
+	for queuePaginator.HasMorePages() {
+		page, err := queuePaginator.NextPage(ctx)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to list SQS queues: %w", err)
+		}
+		for _, url := range page.QueueUrls {
+			leftovers = append(leftovers, fmt.Sprintf("SQS queue: %s", url))
+		}
+	}
+
+	params := &eventbridge.ListRulesInput{
+		NamePrefix: aws.String(resourceNamePrefix),
+	}
+	for {
+		resp, err := eventsSvc.ListRules(ctx, params)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to list event rules: %w", err)
+		}
+		for _, r := range resp.Rules {
+			leftovers = append(leftovers, fmt.Sprintf("Event rule: %s", *r.Name))
+		}
+		if resp.NextToken == nil {
+			break
+		}
+		params.NextToken = resp.NextToken
+	}
+
+	return leftovers, nil
+}
@@ -1,12 +1,13 @@
 package cmd
 
 import (
-	"github.com/aws/aws-sdk-go-v2/service/ec2"
-	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"os"
+
 	"github.com/spf13/cobra"
 
 	"github.com/abicky/ecsmec/internal/capacity"
 	"github.com/abicky/ecsmec/internal/const/ecsconst"
+	"github.com/abicky/ecsmec/internal/timeout"
 )
 
 var terminateSpotFleetInstancesCmd *cobra.Command
@@ -28,6 +29,10 @@ to the specified spot fleet request with state "cancelled".`,
 
 	cmd.Flags().Int32("batch-size", ecsconst.MaxListableContainerInstances, "The number of instances drained at a once")
 
+	addTimeoutFlags(cmd, timeout.PhaseInstanceTermination, timeout.PhaseTaskStop, timeout.PhaseServiceStabilization)
+
+	addDrainerFlags(cmd)
+
 	terminateSpotFleetInstancesCmd = cmd
 }
 
@@ -41,12 +46,21 @@ func terminateSpotFleetInstances(cmd *cobra.Command, args []string) error {
 		return newRuntimeError("failed to initialize a session: %w", err)
 	}
 
-	sfr, err := capacity.NewSpotFleetRequest(id, ec2.NewFromConfig(cfg))
+	rec := newRecorder()
+	if rec != nil {
+		defer rec.PrintPlan(os.Stdout)
+	}
+
+	sfr, err := capacity.NewSpotFleetRequest(id, newEC2Client(cfg, rec))
 	if err != nil {
 		return newRuntimeError("failed to initialize a SpotFleetRequest: %w", err)
 	}
 
-	drainer, err := capacity.NewDrainer(cluster, batchSize, ecs.NewFromConfig(cfg))
+	drainerOpts, err := newDrainerOptions(terminateSpotFleetInstancesCmd, newEC2Client(cfg, rec))
+	if err != nil {
+		return err
+	}
+	drainer, err := capacity.NewDrainer(cluster, batchSize, newECSClient(cfg, rec), drainerOpts...)
 	if err != nil {
 		return newRuntimeError("failed to initialize a Drainer: %w", err)
 	}
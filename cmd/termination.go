@@ -0,0 +1,28 @@
+package cmd
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/abicky/ecsmec/internal/capacity"
+)
+
+func addTerminationModeFlag(cmd *cobra.Command) {
+	modes := make([]string, len(capacity.TerminationModes))
+	for i, m := range capacity.TerminationModes {
+		modes[i] = string(m)
+	}
+	cmd.Flags().String("termination-mode", string(capacity.TerminationModeDetach), fmt.Sprintf("The `MODE` to terminate instances of the auto scaling group (%s), where auto-scaling-group runs termination lifecycle hooks", strings.Join(modes, ", ")))
+}
+
+// getTerminationMode returns the mode specified by "--termination-mode".
+func getTerminationMode(cmd *cobra.Command) (capacity.TerminationMode, error) {
+	mode, _ := cmd.Flags().GetString("termination-mode")
+	if !slices.Contains(capacity.TerminationModes, capacity.TerminationMode(mode)) {
+		return "", fmt.Errorf("\"termination-mode\" is invalid: %s", mode)
+	}
+	return capacity.TerminationMode(mode), nil
+}
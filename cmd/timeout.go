@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/abicky/ecsmec/internal/timeout"
+)
+
+var timeoutUsages = map[timeout.Phase]string{
+	timeout.PhaseInstanceLaunch:       "The maximum time to wait for new instances to be in service and registered to the cluster",
+	timeout.PhaseInstanceDrain:        "The maximum time to wait for instances to be drained after reducing the target capacity",
+	timeout.PhaseInstanceTermination:  "The maximum time to wait for instances to be terminated",
+	timeout.PhaseTaskStop:             "The maximum time to wait for tasks to stop",
+	timeout.PhaseServiceStabilization: "The maximum time to wait for services to become stable",
+}
+
+func addTimeoutFlags(cmd *cobra.Command, phases ...timeout.Phase) {
+	for _, p := range phases {
+		cmd.Flags().Duration(timeoutFlagName(p), timeout.Default(p), timeoutUsages[p])
+	}
+}
+
+// withTimeouts returns a copy of ctx that carries the timeouts specified by the flags of cmd.
+func withTimeouts(ctx context.Context, cmd *cobra.Command) context.Context {
+	timeouts := make(map[timeout.Phase]time.Duration)
+	for _, p := range timeout.Phases {
+		if cmd.Flags().Lookup(timeoutFlagName(p)) == nil {
+			continue
+		}
+		timeouts[p], _ = cmd.Flags().GetDuration(timeoutFlagName(p))
+	}
+	return timeout.WithTimeouts(ctx, timeouts)
+}
+
+func timeoutFlagName(p timeout.Phase) string {
+	return strings.ReplaceAll(string(p), " ", "-") + "-timeout"
+}
@@ -0,0 +1,180 @@
+package capacity
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	autoscalingtypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"golang.org/x/xerrors"
+)
+
+// launchActivityRegexp matches the description of the scaling activity that launches an instance,
+// including the one that takes an instance from a warm pool.
+var launchActivityRegexp = regexp.MustCompile(`^Launching a new EC2 instance(?: from warm pool)?: (i-[0-9a-f]+)`)
+
+// maxConsecutiveFailures is the number of consecutive failures regarded as persistent. Fewer failures are tolerated
+// because auto scaling groups and spot fleets retry, e.g. in another availability zone or with another instance type.
+const maxConsecutiveFailures = 3
+
+// scalingActivityWatcher logs the scaling activities of an auto scaling group started after startedAt,
+// and detects persistent failures.
+type scalingActivityWatcher struct {
+	asSvc     AutoScalingAPI
+	groupName string
+	startedAt time.Time
+	// statusCodes is the last status code logged for each activity ID
+	statusCodes map[string]autoscalingtypes.ScalingActivityStatusCode
+	// failedCount is the number of activities that have failed since the last successful one
+	failedCount int
+}
+
+func newScalingActivityWatcher(asSvc AutoScalingAPI, groupName string, startedAt time.Time) *scalingActivityWatcher {
+	return &scalingActivityWatcher{
+		asSvc:       asSvc,
+		groupName:   groupName,
+		startedAt:   startedAt,
+		statusCodes: make(map[string]autoscalingtypes.ScalingActivityStatusCode),
+	}
+}
+
+// watch logs the scaling activities whose status has changed, and returns an error with the cause if
+// maxConsecutiveFailures activities have failed in a row.
+func (w *scalingActivityWatcher) watch(ctx context.Context) error {
+	resp, err := w.asSvc.DescribeScalingActivities(ctx, &autoscaling.DescribeScalingActivitiesInput{
+		AutoScalingGroupName: aws.String(w.groupName),
+	})
+	if err != nil {
+		return xerrors.Errorf("failed to describe scaling activities: %w", err)
+	}
+
+	// Activities are sorted in descending order of their start time
+	activities := slices.Clone(resp.Activities)
+	slices.Reverse(activities)
+	for _, a := range activities {
+		if a.StartTime == nil || a.StartTime.Before(w.startedAt) || w.statusCodes[*a.ActivityId] == a.StatusCode {
+			continue
+		}
+		w.statusCodes[*a.ActivityId] = a.StatusCode
+
+		if a.StatusMessage != nil {
+			log.Printf("[%s] %s: %s: %s\n", w.groupName, aws.ToString(a.Description), a.StatusCode, *a.StatusMessage)
+		} else {
+			log.Printf("[%s] %s: %s\n", w.groupName, aws.ToString(a.Description), a.StatusCode)
+		}
+
+		switch a.StatusCode {
+		case autoscalingtypes.ScalingActivityStatusCodeSuccessful:
+			w.failedCount = 0
+		case autoscalingtypes.ScalingActivityStatusCodeFailed:
+			w.failedCount++
+			if w.failedCount >= maxConsecutiveFailures {
+				return xerrors.Errorf("%d scaling activities failed in a row, and the last one %q failed: %s", w.failedCount, aws.ToString(a.Description), aws.ToString(a.StatusMessage))
+			}
+		}
+	}
+
+	return nil
+}
+
+// spotFleetHistoryWatcher logs the history of a spot fleet request, and detects persistent errors.
+type spotFleetHistoryWatcher struct {
+	ec2Svc EC2API
+	id     string
+	// since is the time from which the history is fetched next time
+	since time.Time
+	// seen is the set of the records already logged, which might be fetched again because since is inclusive
+	seen map[string]bool
+	// errorCount is the number of errors reported since the last instance change
+	errorCount int
+}
+
+func newSpotFleetHistoryWatcher(ec2Svc EC2API, id string, startedAt time.Time) *spotFleetHistoryWatcher {
+	return &spotFleetHistoryWatcher{
+		ec2Svc: ec2Svc,
+		id:     id,
+		since:  startedAt,
+		seen:   make(map[string]bool),
+	}
+}
+
+// watch logs the new history records, and returns an error with the description if maxConsecutiveFailures errors
+// have been reported without any instance change in between.
+func (w *spotFleetHistoryWatcher) watch(ctx context.Context) error {
+	resp, err := w.ec2Svc.DescribeSpotFleetRequestHistory(ctx, &ec2.DescribeSpotFleetRequestHistoryInput{
+		SpotFleetRequestId: aws.String(w.id),
+		StartTime:          aws.Time(w.since),
+	})
+	if err != nil {
+		return xerrors.Errorf("failed to describe the spot fleet request history: %w", err)
+	}
+	if resp.LastEvaluatedTime != nil {
+		w.since = *resp.LastEvaluatedTime
+	}
+
+	for _, r := range resp.HistoryRecords {
+		var description string
+		if r.EventInformation != nil {
+			description = aws.ToString(r.EventInformation.EventDescription)
+			if subType := aws.ToString(r.EventInformation.EventSubType); subType != "" {
+				description = subType + ": " + description
+			}
+		}
+		key := fmt.Sprintf("%s %s %s", aws.ToTime(r.Timestamp).Format(time.RFC3339Nano), r.EventType, description)
+		if w.seen[key] {
+			continue
+		}
+		w.seen[key] = true
+		log.Printf("[%s] %s: %s\n", w.id, r.EventType, description)
+
+		switch r.EventType {
+		case ec2types.EventTypeInstanceChange:
+			w.errorCount = 0
+		case ec2types.EventTypeError:
+			w.errorCount++
+			if w.errorCount >= maxConsecutiveFailures {
+				return xerrors.Errorf("the spot fleet request reported %d errors in a row, and the last one is: %s", w.errorCount, description)
+			}
+		}
+	}
+
+	return nil
+}
+
+// loadLaunchedInstanceIDs adds the instances launched after the state was saved to launchedInstanceIDs so that
+// another process can tell the instances launched by the replacement. The launch time isn't enough because
+// the instances taken from a running warm pool keep their original launch time.
+func (asg *AutoScalingGroup) loadLaunchedInstanceIDs(ctx context.Context) error {
+	if asg.launchedInstanceIDs == nil {
+		asg.launchedInstanceIDs = make(map[string]bool)
+	}
+
+	paginator := autoscaling.NewDescribeScalingActivitiesPaginator(asg.asSvc, &autoscaling.DescribeScalingActivitiesInput{
+		AutoScalingGroupName: asg.AutoScalingGroupName,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return xerrors.Errorf("failed to describe scaling activities: %w", err)
+		}
+
+		// Activities are sorted in descending order of their start time
+		for _, a := range page.Activities {
+			if a.StartTime != nil && a.StartTime.Before(*asg.StateSavedAt) {
+				return nil
+			}
+			if m := launchActivityRegexp.FindStringSubmatch(aws.ToString(a.Description)); m != nil {
+				asg.launchedInstanceIDs[m[1]] = true
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package capacity
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/abicky/ecsmec/internal/testing/capacitymock"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	autoscalingtypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"go.uber.org/mock/gomock"
+)
+
+func TestScalingActivityWatcher_Watch(t *testing.T) {
+	startedAt := time.Now()
+	newActivity := func(id string, startTime time.Time, statusCode autoscalingtypes.ScalingActivityStatusCode) autoscalingtypes.Activity {
+		return autoscalingtypes.Activity{
+			ActivityId:  aws.String(id),
+			Description: aws.String("Launching a new EC2 instance"),
+			StartTime:   aws.Time(startTime),
+			StatusCode:  statusCode,
+		}
+	}
+
+	tests := []struct {
+		name string
+		// activities are sorted in descending order of their start time
+		activities []autoscalingtypes.Activity
+		wantErr    bool
+	}{
+		{
+			name: "the failures are followed by a success",
+			activities: []autoscalingtypes.Activity{
+				newActivity("3", startedAt.Add(4*time.Second), autoscalingtypes.ScalingActivityStatusCodeFailed),
+				newActivity("2", startedAt.Add(3*time.Second), autoscalingtypes.ScalingActivityStatusCodeSuccessful),
+				newActivity("1", startedAt.Add(2*time.Second), autoscalingtypes.ScalingActivityStatusCodeFailed),
+				newActivity("0", startedAt.Add(time.Second), autoscalingtypes.ScalingActivityStatusCodeFailed),
+			},
+			wantErr: false,
+		},
+		{
+			name: "some failures started before the watch",
+			activities: []autoscalingtypes.Activity{
+				newActivity("2", startedAt.Add(time.Second), autoscalingtypes.ScalingActivityStatusCodeFailed),
+				newActivity("1", startedAt.Add(-time.Second), autoscalingtypes.ScalingActivityStatusCodeFailed),
+				newActivity("0", startedAt.Add(-2*time.Second), autoscalingtypes.ScalingActivityStatusCodeFailed),
+			},
+			wantErr: false,
+		},
+		{
+			name: "the failures persist",
+			activities: []autoscalingtypes.Activity{
+				newActivity("2", startedAt.Add(3*time.Second), autoscalingtypes.ScalingActivityStatusCodeFailed),
+				newActivity("1", startedAt.Add(2*time.Second), autoscalingtypes.ScalingActivityStatusCodeFailed),
+				newActivity("0", startedAt.Add(time.Second), autoscalingtypes.ScalingActivityStatusCodeFailed),
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx := context.Background()
+
+			asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+			asMock.EXPECT().DescribeScalingActivities(ctx, gomock.Any()).Return(&autoscaling.DescribeScalingActivitiesOutput{
+				Activities: tt.activities,
+			}, nil)
+
+			w := newScalingActivityWatcher(asMock, "autoscaling-group-name", startedAt)
+			if err := w.watch(ctx); (err != nil) != tt.wantErr {
+				t.Errorf("err = %#v; wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSpotFleetHistoryWatcher_Watch(t *testing.T) {
+	startedAt := time.Now()
+	newRecord := func(i int, eventType ec2types.EventType) ec2types.HistoryRecord {
+		return ec2types.HistoryRecord{
+			EventInformation: &ec2types.EventInformation{
+				EventDescription: aws.String(fmt.Sprintf("event %d", i)),
+			},
+			EventType: eventType,
+			Timestamp: aws.Time(startedAt.Add(time.Duration(i) * time.Second)),
+		}
+	}
+
+	tests := []struct {
+		name    string
+		records []ec2types.HistoryRecord
+		wantErr bool
+	}{
+		{
+			name: "the errors are followed by an instance change",
+			records: []ec2types.HistoryRecord{
+				newRecord(0, ec2types.EventTypeError),
+				newRecord(1, ec2types.EventTypeError),
+				newRecord(2, ec2types.EventTypeInstanceChange),
+				newRecord(3, ec2types.EventTypeError),
+			},
+			wantErr: false,
+		},
+		{
+			name: "the errors persist",
+			records: []ec2types.HistoryRecord{
+				newRecord(0, ec2types.EventTypeError),
+				newRecord(1, ec2types.EventTypeInformation),
+				newRecord(2, ec2types.EventTypeError),
+				newRecord(3, ec2types.EventTypeError),
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx := context.Background()
+
+			ec2Mock := capacitymock.NewMockEC2API(ctrl)
+			ec2Mock.EXPECT().DescribeSpotFleetRequestHistory(ctx, gomock.Any()).Return(&ec2.DescribeSpotFleetRequestHistoryOutput{
+				HistoryRecords: tt.records,
+			}, nil)
+
+			w := newSpotFleetHistoryWatcher(ec2Mock, "sfr-id", startedAt)
+			if err := w.watch(ctx); (err != nil) != tt.wantErr {
+				t.Errorf("err = %#v; wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
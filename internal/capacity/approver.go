@@ -0,0 +1,165 @@
+package capacity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// ErrNotApproved is returned by an Approver when the operation is rejected.
+var ErrNotApproved = errors.New("the operation was not approved")
+
+type Approver interface {
+	Approve(context.Context, string) error
+}
+
+type ttyApprover struct {
+	in  io.Reader
+	out io.Writer
+}
+
+func NewTTYApprover(in io.Reader, out io.Writer) Approver {
+	return &ttyApprover{
+		in:  in,
+		out: out,
+	}
+}
+
+func (a *ttyApprover) Approve(ctx context.Context, description string) error {
+	fmt.Fprintf(a.out, "\nPress ENTER to continue ")
+	fmt.Fscanln(a.in)
+	return nil
+}
+
+type autoApprover struct{}
+
+func NewAutoApprover() Approver {
+	return &autoApprover{}
+}
+
+func (a *autoApprover) Approve(ctx context.Context, description string) error {
+	log.Println("Approved automatically")
+	return nil
+}
+
+type fileApprover struct {
+	path     string
+	interval time.Duration
+}
+
+// NewFileApprover returns an Approver that waits until the file is created.
+// The operation is rejected if the file content is "reject", otherwise it is approved.
+// The file is deleted after it is read so that each operation requires a new approval.
+func NewFileApprover(path string) Approver {
+	return &fileApprover{
+		path:     path,
+		interval: time.Second,
+	}
+}
+
+func (a *fileApprover) Approve(ctx context.Context, description string) error {
+	log.Printf("Wait for the file %q to be created to approve the operation (write \"reject\" to the file to reject it)\n", a.path)
+
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	for {
+		content, err := os.ReadFile(a.path)
+		if err == nil {
+			if err := os.Remove(a.path); err != nil {
+				return xerrors.Errorf("failed to delete the approval file: %w", err)
+			}
+			if strings.TrimSpace(string(content)) == "reject" {
+				return ErrNotApproved
+			}
+			return nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return xerrors.Errorf("failed to read the approval file: %w", err)
+		}
+
+		select {
+		case <-ticker.C:
+			continue
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+type httpApprover struct {
+	addr string
+}
+
+// NewHTTPApprover returns an Approver that listens on the address and waits for a request to "POST /approve" or
+// "POST /reject". "GET /" returns the description of the operation waiting for approval.
+// The address must be a loopback address because the requests aren't authenticated.
+func NewHTTPApprover(addr string) (Approver, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to parse the address %q: %w", addr, err)
+	}
+	if host != "localhost" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			return nil, xerrors.Errorf("the address %q is not a loopback address, so anyone who can reach it could approve the operation", addr)
+		}
+	}
+
+	return &httpApprover{
+		addr: addr,
+	}, nil
+}
+
+func (a *httpApprover) Approve(ctx context.Context, description string) error {
+	listener, err := net.Listen("tcp", a.addr)
+	if err != nil {
+		return xerrors.Errorf("failed to listen on %s: %w", a.addr, err)
+	}
+
+	approved := make(chan bool, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, description)
+	})
+	mux.HandleFunc("POST /approve", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case approved <- true:
+			fmt.Fprintln(w, "approved")
+		default:
+			http.Error(w, "already decided", http.StatusConflict)
+		}
+	})
+	mux.HandleFunc("POST /reject", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case approved <- false:
+			fmt.Fprintln(w, "rejected")
+		default:
+			http.Error(w, "already decided", http.StatusConflict)
+		}
+	})
+
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	defer server.Shutdown(context.Background())
+
+	log.Printf("Wait for a request to \"POST http://%s/approve\" or \"POST http://%s/reject\"\n", listener.Addr(), listener.Addr())
+
+	select {
+	case ok := <-approved:
+		if !ok {
+			return ErrNotApproved
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
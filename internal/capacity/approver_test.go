@@ -0,0 +1,167 @@
+package capacity_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abicky/ecsmec/internal/capacity"
+)
+
+func TestTTYApprover_Approve(t *testing.T) {
+	var out bytes.Buffer
+	approver := capacity.NewTTYApprover(strings.NewReader("\n"), &out)
+
+	if err := approver.Approve(context.Background(), "description"); err != nil {
+		t.Errorf("err = %#v; want nil", err)
+	}
+	if !strings.Contains(out.String(), "Press ENTER to continue") {
+		t.Errorf("out = %q; want to contain the prompt", out.String())
+	}
+}
+
+func TestAutoApprover_Approve(t *testing.T) {
+	if err := capacity.NewAutoApprover().Approve(context.Background(), "description"); err != nil {
+		t.Errorf("err = %#v; want nil", err)
+	}
+}
+
+func TestFileApprover_Approve(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    error
+	}{
+		{
+			name:    "approved",
+			content: "",
+			want:    nil,
+		},
+		{
+			name:    "rejected",
+			content: "reject\n",
+			want:    capacity.ErrNotApproved,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "approval")
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			err := capacity.NewFileApprover(path).Approve(context.Background(), "description")
+			if !errors.Is(err, tt.want) {
+				t.Errorf("err = %#v; want %#v", err, tt.want)
+			}
+			if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("the approval file still exists")
+			}
+		})
+	}
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		err := capacity.NewFileApprover(filepath.Join(t.TempDir(), "approval")).Approve(ctx, "description")
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("err = %#v; want %#v", err, context.DeadlineExceeded)
+		}
+	})
+}
+
+func TestHTTPApprover_Approve(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want error
+	}{
+		{
+			name: "approved",
+			path: "/approve",
+			want: nil,
+		},
+		{
+			name: "rejected",
+			path: "/reject",
+			want: capacity.ErrNotApproved,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := findFreeAddress(t)
+
+			approver, err := capacity.NewHTTPApprover(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			done := make(chan error)
+			go func() {
+				done <- approver.Approve(context.Background(), "description")
+			}()
+
+			var resp *http.Response
+			for range 100 {
+				resp, err = http.Post("http://"+addr+tt.path, "text/plain", nil)
+				if err == nil {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if err := <-done; !errors.Is(err, tt.want) {
+				t.Errorf("err = %#v; want %#v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewHTTPApprover(t *testing.T) {
+	tests := []struct {
+		addr    string
+		wantErr bool
+	}{
+		{addr: "127.0.0.1:8080", wantErr: false},
+		{addr: "[::1]:8080", wantErr: false},
+		{addr: "localhost:8080", wantErr: false},
+		{addr: ":8080", wantErr: true},
+		{addr: "0.0.0.0:8080", wantErr: true},
+		{addr: "192.0.2.1:8080", wantErr: true},
+		{addr: "example.com:8080", wantErr: true},
+		{addr: "127.0.0.1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if _, err := capacity.NewHTTPApprover(tt.addr); (err != nil) != tt.wantErr {
+				t.Errorf("err = %#v; wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func findFreeAddress(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
@@ -1,12 +1,15 @@
 package capacity
 
 import (
+	"cmp"
 	"context"
 	"fmt"
 	"log"
+	"math"
 	"slices"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -17,56 +20,185 @@ import (
 	"golang.org/x/xerrors"
 
 	"github.com/abicky/ecsmec/internal/const/autoscalingconst"
+	"github.com/abicky/ecsmec/internal/timeout"
 )
 
 type AutoScalingGroup struct {
 	OriginalDesiredCapacity *int32
 	OriginalMaxSize         *int32
 	StateSavedAt            *time.Time
+	MaxSurge                *int32
+	DriftedOnly             bool
+	// OriginalSuspendedProcesses is the processes suspended before SuspendProcesses is called,
+	// or nil if the processes aren't suspended by ecsmec
+	OriginalSuspendedProcesses []string
+	// CapacityProviderName is the name of the capacity provider whose managed scaling is disabled by
+	// DisableManagedScaling, or nil if it isn't disabled by ecsmec
+	CapacityProviderName                 *string
+	OriginalManagedTerminationProtection string
 
 	autoscalingtypes.AutoScalingGroup
 
 	asSvc  AutoScalingAPI
 	ec2Svc EC2API
 	name   string
+
+	managedTerminationProtection bool
+	terminationMode              TerminationMode
+	// terminationProtection caches the termination protection of instances so that each instance is described once
+	terminationProtection map[string]bool
+	// launchedInstanceIDs is the set of the instances launched by launchNewInstancesAndCollectIDs
+	launchedInstanceIDs map[string]bool
+}
+
+type ReplaceOption func(*replaceOptions)
+
+type replaceOptions struct {
+	maxSurge    int32
+	driftedOnly bool
+
+	canaryCount      int32
+	canarySoakPeriod time.Duration
+
+	refreshWarmPool bool
 }
 
-func NewAutoScalingGroup(name string, asSvc AutoScalingAPI, ec2Svc EC2API) (*AutoScalingGroup, error) {
-	asg := AutoScalingGroup{asSvc: asSvc, ec2Svc: ec2Svc, name: name}
+// WithMaxSurge makes ReplaceInstances replace instances in waves, each of which launches up to maxSurge new instances
+// and then terminates as many old instances. If maxSurge is 0, all the old instances are replaced at once.
+func WithMaxSurge(maxSurge int32) ReplaceOption {
+	return func(o *replaceOptions) {
+		o.maxSurge = maxSurge
+	}
+}
+
+// WithDriftedOnly makes ReplaceInstances replace only instances whose launch template version, AMI ID, or instance type
+// differs from what the auto scaling group launches now.
+func WithDriftedOnly() ReplaceOption {
+	return func(o *replaceOptions) {
+		o.driftedOnly = true
+	}
+}
+
+// WithCanary makes ReplaceInstances drain count old instances first and watch the services whose tasks were running
+// on them for soakPeriod before draining the rest. If the canary fails, ReplaceInstances stops without terminating
+// any old instances so that the replacement can be resumed or rolled back.
+func WithCanary(count int32, soakPeriod time.Duration) ReplaceOption {
+	return func(o *replaceOptions) {
+		o.canaryCount = count
+		o.canarySoakPeriod = soakPeriod
+	}
+}
+
+// WithWarmPoolRefresh makes ReplaceInstances terminate the instances in the warm pool whose AMI differs from what
+// the auto scaling group launches now before launching new instances, so that the warm pool is replenished with
+// new instances.
+func WithWarmPoolRefresh() ReplaceOption {
+	return func(o *replaceOptions) {
+		o.refreshWarmPool = true
+	}
+}
+
+func NewAutoScalingGroup(name string, asSvc AutoScalingAPI, ec2Svc EC2API, opts ...AutoScalingGroupOption) (*AutoScalingGroup, error) {
+	asg := AutoScalingGroup{asSvc: asSvc, ec2Svc: ec2Svc, name: name, terminationMode: TerminationModeDetach}
+	for _, opt := range opts {
+		opt(&asg)
+	}
 	if err := asg.reload(context.Background()); err != nil {
 		return nil, err
 	}
 	return &asg, nil
 }
 
-func (asg *AutoScalingGroup) ReplaceInstances(ctx context.Context, drainer Drainer, cluster Cluster) error {
-	oldInstanceIDs := make([]string, 0)
-	baseTime := asg.StateSavedAt
-	if baseTime == nil {
-		baseTime = aws.Time(time.Now())
+func (asg *AutoScalingGroup) ReplaceInstances(ctx context.Context, drainer Drainer, cluster Cluster, opts ...ReplaceOption) error {
+	// Resume the replacement in the same mode
+	o := replaceOptions{driftedOnly: asg.DriftedOnly}
+	if asg.MaxSurge != nil {
+		o.maxSurge = *asg.MaxSurge
+	}
+	for _, opt := range opts {
+		opt(&o)
 	}
 
-	err := asg.fetchInstances(ctx, func(i ec2types.Instance) error {
-		if i.LaunchTime.Before(*baseTime) {
-			oldInstanceIDs = append(oldInstanceIDs, *i.InstanceId)
+	// Waves can leave the availability zones unbalanced because each of them terminates only old instances
+	if o.maxSurge > 0 && len(asg.AvailabilityZones) > 1 && !asg.isProcessSuspended("AZRebalance") {
+		return xerrors.Errorf("AZRebalance of the auto scaling group %q must be suspended to replace instances in waves, otherwise it will terminate instances without draining them", *asg.AutoScalingGroupName)
+	}
+
+	// The instances launched by the interrupted process are unknown to this process
+	if asg.StateSavedAt != nil {
+		if err := asg.loadLaunchedInstanceIDs(ctx); err != nil {
+			return xerrors.Errorf("failed to load the instances launched by the replacement: %w", err)
 		}
-		return nil
-	})
+	}
+
+	startedAt := time.Now()
+	isNew := func(i ec2types.Instance) bool {
+		// Instances taken from a running warm pool keep their original launch time
+		if asg.launchedInstanceIDs[*i.InstanceId] {
+			return true
+		}
+		// Compare with StateSavedAt once it is saved so that the result doesn't change even if the process is resumed
+		if asg.StateSavedAt != nil {
+			return !i.LaunchTime.Before(*asg.StateSavedAt)
+		}
+		return !i.LaunchTime.Before(startedAt)
+	}
+	isOld := func(i ec2types.Instance) bool {
+		return !isNew(i)
+	}
+	if o.driftedOnly {
+		asg.DriftedOnly = true
+		isDrifted, err := asg.newDriftDetector(ctx)
+		if err != nil {
+			return xerrors.Errorf("failed to detect drifted instances: %w", err)
+		}
+		isOld = func(i ec2types.Instance) bool {
+			return !isNew(i) && isDrifted(i)
+		}
+	}
+
+	// Refresh the warm pool first because new instances are launched from it
+	if o.refreshWarmPool {
+		if err := asg.refreshWarmPool(ctx); err != nil {
+			return xerrors.Errorf("failed to refresh the warm pool: %w", err)
+		}
+	}
+
+	if o.maxSurge > 0 {
+		return asg.replaceInstancesInWaves(ctx, drainer, cluster, o, isNew, isOld)
+	}
+
+	oldInstanceIDs, newInstanceIDs, err := asg.fetchOldInstanceIDs(ctx, isNew, isOld)
 	if err != nil {
 		return xerrors.Errorf("failed to fetch old instance IDs: %w", err)
 	}
+	if len(oldInstanceIDs) == 0 && asg.StateSavedAt == nil {
+		log.Printf("There are no instances to replace in the auto scaling group %q\n", *asg.AutoScalingGroupName)
+		return nil
+	}
 
-	if err := asg.launchNewInstances(ctx, len(oldInstanceIDs)); err != nil {
+	// Check the protection before launching so as not to leave the auto scaling group inflated
+	if _, err := asg.checkProtection(ctx, oldInstanceIDs, false); err != nil {
+		return err
+	}
+
+	launchedInstanceIDs, err := asg.launchNewInstancesAndCollectIDs(ctx, asg.requiredInstanceCount(len(oldInstanceIDs)))
+	if err != nil {
 		return xerrors.Errorf("failed to launch new instances: %w", err)
 	}
+	newInstanceIDs = append(newInstanceIDs, launchedInstanceIDs...)
 
 	newInstanceCount := *asg.DesiredCapacity - *asg.OriginalDesiredCapacity
 	log.Printf("Wait for all the new instances to be registered in the cluster %q\n", cluster.Name())
-	if err := cluster.WaitUntilContainerInstancesRegistered(ctx, int(newInstanceCount), asg.StateSavedAt); err != nil {
+	if err := cluster.WaitUntilContainerInstancesRegistered(ctx, newInstanceIDs); err != nil {
 		return xerrors.Errorf("failed to wait until container instances are registered: %w", err)
 	}
 
-	if err := asg.terminateInstances(ctx, newInstanceCount, drainer); err != nil {
+	if err := asg.runCanary(ctx, drainer, o, len(oldInstanceIDs), isOld); err != nil {
+		return err
+	}
+
+	if err := asg.terminateInstances(ctx, newInstanceCount, drainer, isOld); err != nil {
 		return xerrors.Errorf("failed to terminate instances: %w", err)
 	}
 
@@ -77,8 +209,225 @@ func (asg *AutoScalingGroup) ReplaceInstances(ctx context.Context, drainer Drain
 	return nil
 }
 
-func (asg *AutoScalingGroup) ReduceCapacity(ctx context.Context, amount int32, drainer Drainer) error {
-	return asg.terminateInstances(ctx, amount, drainer)
+func (asg *AutoScalingGroup) replaceInstancesInWaves(ctx context.Context, drainer Drainer, cluster Cluster, o replaceOptions, isNew, isOld func(ec2types.Instance) bool) error {
+	maxSurge := o.maxSurge
+	asg.MaxSurge = aws.Int32(maxSurge)
+
+	prevOldInstanceCount := -1
+	for {
+		oldInstanceIDs, newInstanceIDs, err := asg.fetchOldInstanceIDs(ctx, isNew, isOld)
+		if err != nil {
+			return xerrors.Errorf("failed to fetch old instance IDs: %w", err)
+		}
+		if len(oldInstanceIDs) == 0 {
+			break
+		}
+		if len(oldInstanceIDs) == prevOldInstanceCount {
+			return xerrors.Errorf("no old instances were terminated in the last wave")
+		}
+		prevOldInstanceCount = len(oldInstanceIDs)
+
+		if _, err := asg.checkProtection(ctx, oldInstanceIDs, false); err != nil {
+			return err
+		}
+
+		// The number of new instances isn't rounded up to a multiple of the number of availability zones so as not to
+		// exceed maxSurge. AZRebalance doesn't matter because it is suspended.
+		waveSize := min(int(maxSurge), len(oldInstanceIDs))
+		log.Printf("Replace %d of the %d old instances in the auto scaling group %q\n", waveSize, len(oldInstanceIDs), *asg.AutoScalingGroupName)
+		launchedInstanceIDs, err := asg.launchNewInstancesAndCollectIDs(ctx, waveSize)
+		if err != nil {
+			return xerrors.Errorf("failed to launch new instances: %w", err)
+		}
+
+		// Instances launched in the previous waves are also checked because they might have become unhealthy
+		newInstanceIDs = append(newInstanceIDs, launchedInstanceIDs...)
+		log.Printf("Wait for all the new instances to be registered in the cluster %q\n", cluster.Name())
+		if err := cluster.WaitUntilContainerInstancesRegistered(ctx, newInstanceIDs); err != nil {
+			return xerrors.Errorf("failed to wait until container instances are registered: %w", err)
+		}
+
+		if err := asg.runCanary(ctx, drainer, o, waveSize, isOld); err != nil {
+			return err
+		}
+		// Only the first wave needs the canary
+		o.canaryCount = 0
+
+		// Terminate only old instances so that the new instances launched in the previous waves are never terminated
+		// even if some availability zones have run out of old instances
+		if err := asg.terminateOldInstances(ctx, *asg.DesiredCapacity-*asg.OriginalDesiredCapacity, drainer, isOld); err != nil {
+			return xerrors.Errorf("failed to terminate instances: %w", err)
+		}
+	}
+
+	if asg.StateSavedAt == nil {
+		return nil
+	}
+
+	if err := asg.restoreState(ctx); err != nil {
+		return xerrors.Errorf("failed to restore the auto scaling group: %w", err)
+	}
+
+	return nil
+}
+
+// RollbackReplacement rolls back the replacement interrupted halfway, that is, terminates the instances launched by
+// the replacement, reactivates the old container instances, and restores the original state.
+func (asg *AutoScalingGroup) RollbackReplacement(ctx context.Context, drainer Drainer, cluster Cluster) error {
+	if asg.StateSavedAt == nil {
+		return xerrors.Errorf("the auto scaling group %q has no replacement to roll back", *asg.AutoScalingGroupName)
+	}
+
+	if err := asg.loadLaunchedInstanceIDs(ctx); err != nil {
+		return xerrors.Errorf("failed to load the instances launched by the replacement: %w", err)
+	}
+	isNew := func(i ec2types.Instance) bool {
+		// Instances taken from a running warm pool keep their original launch time
+		return asg.launchedInstanceIDs[*i.InstanceId] || !i.LaunchTime.Before(*asg.StateSavedAt)
+	}
+	oldInstanceIDs := make([]string, 0)
+	newInstanceIDs := make([]string, 0)
+	err := asg.fetchInstances(ctx, func(i ec2types.Instance) error {
+		if isNew(i) {
+			newInstanceIDs = append(newInstanceIDs, *i.InstanceId)
+		} else {
+			oldInstanceIDs = append(oldInstanceIDs, *i.InstanceId)
+		}
+		return nil
+	})
+	if err != nil {
+		return xerrors.Errorf("failed to fetch instances: %w", err)
+	}
+
+	// Reactivate the old container instances first so that tasks on the new ones can be placed on them
+	if err := cluster.ReactivateContainerInstances(ctx, oldInstanceIDs); err != nil {
+		return xerrors.Errorf("failed to reactivate container instances: %w", err)
+	}
+
+	// If some old instances have been already terminated, keep as many new instances
+	count := *asg.DesiredCapacity - *asg.OriginalDesiredCapacity
+	if count > 0 {
+		instanceIDs := newInstanceIDs
+		if int(count) < len(newInstanceIDs) {
+			instanceIDs, err = asg.fetchSortedInstanceIDs(ctx, count, isNew)
+			if err != nil {
+				return xerrors.Errorf("failed to fetch sorted instance IDs: %w", err)
+			}
+		}
+
+		// New instances that have never joined the cluster, e.g. because of a broken AMI, are the most common reason
+		// for the rollback, and they have nothing to drain
+		containerInstances, err := cluster.ContainerInstances(ctx, instanceIDs)
+		if err != nil {
+			return xerrors.Errorf("failed to fetch container instances: %w", err)
+		}
+		registered := make(map[string]bool, len(containerInstances))
+		for _, ci := range containerInstances {
+			registered[aws.ToString(ci.Ec2InstanceId)] = true
+		}
+		instanceIDsToDrain := make([]string, 0, len(instanceIDs))
+		unregisteredInstanceIDs := make([]string, 0)
+		for _, id := range instanceIDs {
+			if registered[id] {
+				instanceIDsToDrain = append(instanceIDsToDrain, id)
+			} else {
+				unregisteredInstanceIDs = append(unregisteredInstanceIDs, id)
+			}
+		}
+		if len(unregisteredInstanceIDs) > 0 {
+			log.Println("Terminate the instances not registered in the cluster without draining them:", unregisteredInstanceIDs)
+		}
+
+		if err := asg.drainAndUnprotectInstances(ctx, instanceIDs, instanceIDsToDrain, drainer, false); err != nil {
+			return xerrors.Errorf("failed to terminate instances: %w", err)
+		}
+		if err := asg.terminateDrainedInstanceIDs(ctx, instanceIDs); err != nil {
+			return xerrors.Errorf("failed to terminate instances: %w", err)
+		}
+	}
+
+	if err := asg.restoreState(ctx); err != nil {
+		return xerrors.Errorf("failed to restore the auto scaling group: %w", err)
+	}
+
+	return nil
+}
+
+func (asg *AutoScalingGroup) ReduceCapacity(ctx context.Context, amount int32, drainer Drainer, opts ...ReduceOption) error {
+	o := reduceOptions{strategy: SelectionStrategyOldest}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.returnToWarmPool {
+		if err := asg.checkWarmPoolReuse(); err != nil {
+			return err
+		}
+	}
+
+	compare, err := asg.newInstanceComparator(ctx, o)
+	if err != nil {
+		return xerrors.Errorf("failed to prepare the selection strategy %q: %w", o.strategy, err)
+	}
+
+	isTarget, err := asg.newTargetMatcher(ctx, o)
+	if err != nil {
+		return xerrors.Errorf("failed to prepare the target instances: %w", err)
+	}
+
+	isOld := func(i ec2types.Instance) bool {
+		return asg.StateSavedAt != nil && i.LaunchTime.Before(*asg.StateSavedAt)
+	}
+
+	var isCandidate func(ec2types.Instance) (bool, error)
+	if isTarget != nil {
+		isCandidate = func(i ec2types.Instance) (bool, error) {
+			return isTarget(i), nil
+		}
+	}
+
+	var isProtected func(ec2types.Instance) (bool, error)
+	if !o.overrideProtection {
+		isProtected = func(i ec2types.Instance) (bool, error) {
+			return asg.isProtected(ctx, *i.InstanceId)
+		}
+	}
+
+	// If the target instances are specified without the amount, all of them except protected ones are terminated
+	if isTarget != nil && amount == 0 {
+		err := asg.fetchInstances(ctx, func(i ec2types.Instance) error {
+			if !isTarget(i) {
+				return nil
+			}
+			if isProtected != nil {
+				protected, err := isProtected(i)
+				if err != nil || protected {
+					return err
+				}
+			}
+			amount++
+			return nil
+		})
+		if err != nil {
+			return xerrors.Errorf("failed to fetch instances: %w", err)
+		}
+		if amount == 0 {
+			return xerrors.Errorf("no instances in the auto scaling group %q match the conditions", *asg.AutoScalingGroupName)
+		}
+	}
+	if amount == 0 {
+		return nil
+	}
+
+	// Sort instanceIDs to prevent AZRebalance from terminating instances unexpectedly
+	sortedInstanceIDs, err := asg.fetchSortedInstanceIDsBy(ctx, amount, isOld, compare, isCandidate, isProtected)
+	if err != nil {
+		return xerrors.Errorf("failed to fetch sorted instance IDs: %w", err)
+	}
+
+	if o.returnToWarmPool {
+		return asg.returnInstanceIDsToWarmPool(ctx, sortedInstanceIDs, drainer, o.overrideProtection, o.cluster)
+	}
+	return asg.terminateInstanceIDs(ctx, sortedInstanceIDs, drainer, o.overrideProtection)
 }
 
 func (asg *AutoScalingGroup) reload(ctx context.Context) error {
@@ -93,9 +442,17 @@ func (asg *AutoScalingGroup) reload(ctx context.Context) error {
 		return xerrors.Errorf("the auto scaling group \"%s\" doesn't exist", asg.name)
 	}
 
-	asg.AutoScalingGroup = resp.AutoScalingGroups[0]
+	return asg.load(resp.AutoScalingGroups[0])
+}
+
+func (asg *AutoScalingGroup) load(group autoscalingtypes.AutoScalingGroup) error {
+	asg.AutoScalingGroup = group
+	// Instances in the warm pool are neither in service nor counted in the desired capacity
+	asg.Instances = slices.DeleteFunc(slices.Clone(group.Instances), isWarmed)
 	asg.OriginalDesiredCapacity = asg.DesiredCapacity
 	asg.OriginalMaxSize = asg.MaxSize
+	asg.OriginalSuspendedProcesses = nil
+	asg.CapacityProviderName = nil
 	for _, t := range asg.Tags {
 		switch *t.Key {
 		case "ecsmec:OriginalDesiredCapacity":
@@ -116,6 +473,27 @@ func (asg *AutoScalingGroup) reload(ctx context.Context) error {
 				return xerrors.Errorf("ecsmec:StateSavedAt is invalid (%s): %w", *t.Value, err)
 			}
 			asg.StateSavedAt = &stateSavedAt
+		case "ecsmec:MaxSurge":
+			maxSurge, err := strconv.ParseInt(*t.Value, 10, 32)
+			if err != nil {
+				return xerrors.Errorf("ecsmec:MaxSurge is invalid (%s): %w", *t.Value, err)
+			}
+			asg.MaxSurge = aws.Int32(int32(maxSurge))
+		case "ecsmec:DriftedOnly":
+			driftedOnly, err := strconv.ParseBool(*t.Value)
+			if err != nil {
+				return xerrors.Errorf("ecsmec:DriftedOnly is invalid (%s): %w", *t.Value, err)
+			}
+			asg.DriftedOnly = driftedOnly
+		case "ecsmec:OriginalSuspendedProcesses":
+			asg.OriginalSuspendedProcesses = make([]string, 0)
+			if *t.Value != "" {
+				asg.OriginalSuspendedProcesses = strings.Split(*t.Value, ",")
+			}
+		case "ecsmec:CapacityProvider":
+			asg.CapacityProviderName = t.Value
+		case "ecsmec:OriginalManagedTerminationProtection":
+			asg.OriginalManagedTerminationProtection = *t.Value
 		}
 	}
 
@@ -127,6 +505,14 @@ func (asg *AutoScalingGroup) fetchInstances(ctx context.Context, callback func(e
 	for i, instance := range asg.Instances {
 		ids[i] = *instance.InstanceId
 	}
+	return asg.describeInstances(ctx, ids, callback)
+}
+
+func (asg *AutoScalingGroup) describeInstances(ctx context.Context, ids []string, callback func(ec2types.Instance) error) error {
+	// DescribeInstances without instance IDs describes all the instances
+	if len(ids) == 0 {
+		return nil
+	}
 
 	resp, err := asg.ec2Svc.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
 		InstanceIds: ids,
@@ -146,11 +532,56 @@ func (asg *AutoScalingGroup) fetchInstances(ctx context.Context, callback func(e
 	return nil
 }
 
-func (asg *AutoScalingGroup) launchNewInstances(ctx context.Context, oldInstanceCount int) error {
-	if oldInstanceCount == 0 {
+// fetchOldInstanceIDs returns the IDs of the instances to replace and the IDs of the new instances.
+func (asg *AutoScalingGroup) fetchOldInstanceIDs(ctx context.Context, isNew, isOld func(ec2types.Instance) bool) ([]string, []string, error) {
+	oldInstanceIDs := make([]string, 0)
+	newInstanceIDs := make([]string, 0)
+	err := asg.fetchInstances(ctx, func(i ec2types.Instance) error {
+		if isNew(i) {
+			newInstanceIDs = append(newInstanceIDs, *i.InstanceId)
+		} else if isOld(i) {
+			oldInstanceIDs = append(oldInstanceIDs, *i.InstanceId)
+		}
 		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return oldInstanceIDs, newInstanceIDs, nil
+}
+
+// launchNewInstancesAndCollectIDs launches new instances like launchNewInstances and returns the IDs of the instances
+// that have joined the auto scaling group meanwhile. The instances are also remembered as new ones because instances
+// taken from a running warm pool can't be distinguished from old ones by their launch time.
+func (asg *AutoScalingGroup) launchNewInstancesAndCollectIDs(ctx context.Context, requiredCount int) ([]string, error) {
+	existing := make(map[string]bool, len(asg.Instances))
+	for _, i := range asg.Instances {
+		existing[*i.InstanceId] = true
+	}
+
+	if err := asg.launchNewInstances(ctx, requiredCount); err != nil {
+		return nil, err
+	}
+
+	if asg.launchedInstanceIDs == nil {
+		asg.launchedInstanceIDs = make(map[string]bool)
+	}
+	launchedInstanceIDs := make([]string, 0)
+	for _, i := range asg.Instances {
+		if !existing[*i.InstanceId] {
+			launchedInstanceIDs = append(launchedInstanceIDs, *i.InstanceId)
+			asg.launchedInstanceIDs[*i.InstanceId] = true
+		}
 	}
-	requiredCount := int32(oldInstanceCount)
+	return launchedInstanceIDs, nil
+}
+
+// requiredInstanceCount returns the number of new instances to launch to replace the old instances at once.
+func (asg *AutoScalingGroup) requiredInstanceCount(oldInstanceCount int) int {
+	if oldInstanceCount == 0 {
+		return 0
+	}
+	requiredCount := oldInstanceCount
 
 	if len(asg.AvailabilityZones) > 2 && *asg.OriginalDesiredCapacity%int32(len(asg.AvailabilityZones)) > 0 {
 		// If there are more than two availability zones, the new desired capacity must be a multiple of the number of
@@ -164,14 +595,25 @@ func (asg *AutoScalingGroup) launchNewInstances(ctx context.Context, oldInstance
 		//   ap-northeast-1a: 1, ap-northeast-1c: 3, ap-northeast-1d: 1
 		// AZRebalance will launch another instance in ap-northeast-1a or ap-northeast-1d and terminate one
 		// in ap-northeast-1c without draining it.
-		requiredCount += int32(len(asg.AvailabilityZones)) - *asg.OriginalDesiredCapacity%int32(len(asg.AvailabilityZones))
+		requiredCount += len(asg.AvailabilityZones) - int(*asg.OriginalDesiredCapacity%int32(len(asg.AvailabilityZones)))
+	}
+
+	return requiredCount
+}
+
+// launchNewInstances increases the desired capacity so that there are requiredCount instances more than the original
+// desired capacity, and waits until they are in service.
+func (asg *AutoScalingGroup) launchNewInstances(ctx context.Context, requiredCount int) error {
+	if requiredCount == 0 {
+		return nil
 	}
 
-	if err := asg.waitUntilInstancesInService(ctx, *asg.DesiredCapacity); err != nil {
+	// The desired capacity might have been updated by the interrupted replacement after saving the state
+	if err := asg.waitUntilInstancesInService(ctx, *asg.DesiredCapacity, aws.ToTime(asg.StateSavedAt)); err != nil {
 		return xerrors.Errorf("failed to wait until %d instances are in service: %w", *asg.DesiredCapacity, err)
 	}
 
-	newDesiredCapacity := *asg.OriginalDesiredCapacity + requiredCount
+	newDesiredCapacity := *asg.OriginalDesiredCapacity + int32(requiredCount)
 	if newDesiredCapacity <= *asg.DesiredCapacity {
 		return nil
 	}
@@ -187,6 +629,7 @@ func (asg *AutoScalingGroup) launchNewInstances(ctx context.Context, oldInstance
 
 	log.Printf("Update the auto scaling group \"%s\": DesirdCapacity: %d, MaxSize: %d\n",
 		*asg.AutoScalingGroupName, newDesiredCapacity, newDesiredMaxSize)
+	updatedAt := time.Now()
 	_, err := asg.asSvc.UpdateAutoScalingGroup(ctx, &autoscaling.UpdateAutoScalingGroupInput{
 		AutoScalingGroupName: asg.AutoScalingGroupName,
 		DesiredCapacity:      aws.Int32(newDesiredCapacity),
@@ -196,28 +639,114 @@ func (asg *AutoScalingGroup) launchNewInstances(ctx context.Context, oldInstance
 		return xerrors.Errorf("failed to update the auto scaling group: %w", err)
 	}
 
-	if err := asg.waitUntilInstancesInService(ctx, newDesiredCapacity); err != nil {
+	if err := asg.waitUntilInstancesInService(ctx, newDesiredCapacity, updatedAt); err != nil {
 		return xerrors.Errorf("failed to wait until %d instances are in service: %w", newDesiredCapacity, err)
 	}
 
 	return asg.reload(ctx)
 }
 
-func (asg *AutoScalingGroup) terminateInstances(ctx context.Context, count int32, drainer Drainer) error {
+// runCanary drains up to the canary count of the old instances that terminateInstances would terminate first,
+// and lets drainer watch the affected services.
+func (asg *AutoScalingGroup) runCanary(ctx context.Context, drainer Drainer, o replaceOptions, oldInstanceCount int, isOld func(ec2types.Instance) bool) error {
+	count := min(o.canaryCount, int32(oldInstanceCount))
+	if count == 0 {
+		return nil
+	}
+
+	instanceIDs, err := asg.fetchSortedOldInstanceIDs(ctx, count, isOld)
+	if err != nil {
+		return xerrors.Errorf("failed to fetch sorted instance IDs: %w", err)
+	}
+
+	if _, err := asg.checkProtection(ctx, instanceIDs, false); err != nil {
+		return err
+	}
+
+	log.Printf("Drain %d canary instances and watch the services for %v: %v\n", count, o.canarySoakPeriod, instanceIDs)
+	if err := drainer.DrainCanary(ctx, instanceIDs, o.canarySoakPeriod); err != nil {
+		return xerrors.Errorf("failed to drain canary instances: %w", err)
+	}
+
+	return nil
+}
+
+func (asg *AutoScalingGroup) terminateInstances(ctx context.Context, count int32, drainer Drainer, isOld func(ec2types.Instance) bool) error {
 	if count == 0 {
 		return nil
 	}
 
 	// Sort instanceIDs to prevent AZRebalance from terminating instances unexpectedly
-	sortedInstanceIDs, err := asg.fetchSortedInstanceIDs(ctx, count)
+	sortedInstanceIDs, err := asg.fetchSortedInstanceIDs(ctx, count, isOld)
+	if err != nil {
+		return xerrors.Errorf("failed to fetch sorted instance IDs: %w", err)
+	}
+
+	return asg.terminateInstanceIDs(ctx, sortedInstanceIDs, drainer, false)
+}
+
+// terminateOldInstances terminates count instances like terminateInstances, but never selects instances other than
+// old ones.
+func (asg *AutoScalingGroup) terminateOldInstances(ctx context.Context, count int32, drainer Drainer, isOld func(ec2types.Instance) bool) error {
+	if count == 0 {
+		return nil
+	}
+
+	sortedInstanceIDs, err := asg.fetchSortedOldInstanceIDs(ctx, count, isOld)
 	if err != nil {
 		return xerrors.Errorf("failed to fetch sorted instance IDs: %w", err)
 	}
 
-	if err := drainer.Drain(ctx, sortedInstanceIDs); err != nil {
-		return xerrors.Errorf("failed to drain instances: %w", err)
+	return asg.terminateInstanceIDs(ctx, sortedInstanceIDs, drainer, false)
+}
+
+func (asg *AutoScalingGroup) terminateInstanceIDs(ctx context.Context, sortedInstanceIDs []string, drainer Drainer, overrideProtection bool) error {
+	if err := asg.drainAndUnprotectInstances(ctx, sortedInstanceIDs, sortedInstanceIDs, drainer, overrideProtection); err != nil {
+		return err
+	}
+
+	return asg.terminateDrainedInstanceIDs(ctx, sortedInstanceIDs)
+}
+
+// terminateDrainedInstanceIDs terminates the instances in the termination mode and reloads the auto scaling group.
+func (asg *AutoScalingGroup) terminateDrainedInstanceIDs(ctx context.Context, sortedInstanceIDs []string) error {
+	var err error
+	if asg.terminationMode == TerminationModeAutoScalingGroup {
+		err = asg.terminateInstancesInGroup(ctx, sortedInstanceIDs)
+	} else {
+		err = asg.detachAndTerminateInstances(ctx, sortedInstanceIDs)
+	}
+	if err != nil {
+		return err
+	}
+
+	return asg.reload(ctx)
+}
+
+// drainAndUnprotectInstances drains the instances specified by instanceIDsToDrain and removes the protection of
+// all the instances.
+func (asg *AutoScalingGroup) drainAndUnprotectInstances(ctx context.Context, sortedInstanceIDs, instanceIDsToDrain []string, drainer Drainer, overrideProtection bool) error {
+	// Check the protection before draining so as not to leave draining container instances behind
+	terminationProtectedIDs, err := asg.checkProtection(ctx, sortedInstanceIDs, overrideProtection)
+	if err != nil {
+		return err
+	}
+
+	if len(instanceIDsToDrain) > 0 {
+		if err := drainer.Drain(ctx, instanceIDsToDrain); err != nil {
+			return xerrors.Errorf("failed to drain instances: %w", err)
+		}
+	}
+
+	if err := asg.unprotectInstances(ctx, sortedInstanceIDs, terminationProtectedIDs); err != nil {
+		return xerrors.Errorf("failed to unprotect instances: %w", err)
 	}
 
+	return nil
+}
+
+// detachAndTerminateInstances detaches the instances from the auto scaling group and then terminates them.
+func (asg *AutoScalingGroup) detachAndTerminateInstances(ctx context.Context, sortedInstanceIDs []string) error {
 	for ids := range slices.Chunk(sortedInstanceIDs, autoscalingconst.MaxDetachableInstances) {
 		log.Println("Detach instances:", ids)
 		_, err := asg.asSvc.DetachInstances(ctx, &autoscaling.DetachInstancesInput{
@@ -231,7 +760,7 @@ func (asg *AutoScalingGroup) terminateInstances(ctx context.Context, count int32
 	}
 
 	log.Println("Terminate instances:", sortedInstanceIDs)
-	_, err = asg.ec2Svc.TerminateInstances(ctx, &ec2.TerminateInstancesInput{
+	_, err := asg.ec2Svc.TerminateInstances(ctx, &ec2.TerminateInstancesInput{
 		InstanceIds: sortedInstanceIDs,
 	})
 	if err != nil {
@@ -243,12 +772,12 @@ func (asg *AutoScalingGroup) terminateInstances(ctx context.Context, count int32
 	})
 	err = waiter.Wait(ctx, &ec2.DescribeInstancesInput{
 		InstanceIds: sortedInstanceIDs,
-	}, 10*time.Minute)
+	}, timeout.Get(ctx, timeout.PhaseInstanceTermination))
 	if err != nil {
-		return xerrors.Errorf("failed to terminate the instances: %w", err)
+		return xerrors.Errorf("failed to terminate the instances: %w", timeout.Wrap(ctx, timeout.PhaseInstanceTermination, err))
 	}
 
-	return asg.reload(ctx)
+	return nil
 }
 
 func (asg *AutoScalingGroup) restoreState(ctx context.Context) error {
@@ -266,12 +795,19 @@ func (asg *AutoScalingGroup) restoreState(ctx context.Context) error {
 		return xerrors.Errorf("failed to update the auto scaling group: %w", err)
 	}
 
+	tags := []autoscalingtypes.Tag{
+		asg.createTag("ecsmec:OriginalDesiredCapacity", fmt.Sprint(*asg.OriginalDesiredCapacity)),
+		asg.createTag("ecsmec:OriginalMaxSize", fmt.Sprint(*asg.OriginalMaxSize)),
+		asg.createTag("ecsmec:StateSavedAt", fmt.Sprint(asg.StateSavedAt.Format(time.RFC3339))),
+	}
+	if asg.MaxSurge != nil {
+		tags = append(tags, asg.createTag("ecsmec:MaxSurge", fmt.Sprint(*asg.MaxSurge)))
+	}
+	if asg.DriftedOnly {
+		tags = append(tags, asg.createTag("ecsmec:DriftedOnly", "true"))
+	}
 	_, err = asg.asSvc.DeleteTags(ctx, &autoscaling.DeleteTagsInput{
-		Tags: []autoscalingtypes.Tag{
-			asg.createTag("ecsmec:OriginalDesiredCapacity", fmt.Sprint(*asg.OriginalDesiredCapacity)),
-			asg.createTag("ecsmec:OriginalMaxSize", fmt.Sprint(*asg.OriginalMaxSize)),
-			asg.createTag("ecsmec:StateSavedAt", fmt.Sprint(asg.StateSavedAt.Format(time.RFC3339))),
-		},
+		Tags: tags,
 	})
 	if err != nil {
 		return xerrors.Errorf("failed to delete tags: %w", err)
@@ -288,12 +824,19 @@ func (asg *AutoScalingGroup) saveCurrentState(ctx context.Context) error {
 		stateSavedAt = time.Now().UTC()
 	}
 
+	tags := []autoscalingtypes.Tag{
+		asg.createTag("ecsmec:OriginalDesiredCapacity", fmt.Sprint(*asg.OriginalDesiredCapacity)),
+		asg.createTag("ecsmec:OriginalMaxSize", fmt.Sprint(*asg.OriginalMaxSize)),
+		asg.createTag("ecsmec:StateSavedAt", stateSavedAt.Format(time.RFC3339)),
+	}
+	if asg.MaxSurge != nil {
+		tags = append(tags, asg.createTag("ecsmec:MaxSurge", fmt.Sprint(*asg.MaxSurge)))
+	}
+	if asg.DriftedOnly {
+		tags = append(tags, asg.createTag("ecsmec:DriftedOnly", "true"))
+	}
 	_, err := asg.asSvc.CreateOrUpdateTags(ctx, &autoscaling.CreateOrUpdateTagsInput{
-		Tags: []autoscalingtypes.Tag{
-			asg.createTag("ecsmec:OriginalDesiredCapacity", fmt.Sprint(*asg.OriginalDesiredCapacity)),
-			asg.createTag("ecsmec:OriginalMaxSize", fmt.Sprint(*asg.OriginalMaxSize)),
-			asg.createTag("ecsmec:StateSavedAt", stateSavedAt.Format(time.RFC3339)),
-		},
+		Tags: tags,
 	})
 	if err != nil {
 		return xerrors.Errorf("failed to create or update tags: %w", err)
@@ -312,16 +855,23 @@ func (asg *AutoScalingGroup) createTag(key string, value string) autoscalingtype
 	}
 }
 
-func (asg *AutoScalingGroup) waitUntilInstancesInService(ctx context.Context, capacity int32) error {
+// waitUntilInstancesInService waits until there are capacity in-service instances, and fails if the scaling activities
+// started after updatedAt, that is, caused by the update of the desired capacity, fail persistently. If updatedAt is
+// zero, the scaling activities aren't watched because they are irrelevant to ecsmec.
+func (asg *AutoScalingGroup) waitUntilInstancesInService(ctx context.Context, capacity int32, updatedAt time.Time) error {
 	// NOTE: autoscaling.GroupInServiceWaiter waits until there are MinSize instances with lifecycle state "InService",
 	// that is, without increasing MinSize, Wait() might exists immediately.
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
 
-	timeout := 5 * time.Minute
-	timer := time.NewTimer(timeout)
+	maxWait := timeout.Get(ctx, timeout.PhaseInstanceLaunch)
+	timer := time.NewTimer(maxWait)
 	defer timer.Stop()
 
+	var watcher *scalingActivityWatcher
+	if !updatedAt.IsZero() {
+		watcher = newScalingActivityWatcher(asg.asSvc, *asg.AutoScalingGroupName, updatedAt)
+	}
 	for {
 		resp, err := asg.asSvc.DescribeAutoScalingGroups(ctx, &autoscaling.DescribeAutoScalingGroupsInput{
 			AutoScalingGroupNames: []string{*asg.AutoScalingGroupName},
@@ -340,18 +890,48 @@ func (asg *AutoScalingGroup) waitUntilInstancesInService(ctx context.Context, ca
 			}
 		}
 
+		if watcher != nil {
+			if err := watcher.watch(ctx); err != nil {
+				return err
+			}
+		}
+
 		select {
 		case <-ticker.C:
 			continue
 		case <-timer.C:
-			return xerrors.Errorf("can't prepare at least %d in-service instances within %v", capacity, timeout)
+			return &timeout.Error{
+				Phase:   timeout.PhaseInstanceLaunch,
+				Timeout: maxWait,
+				Err:     xerrors.Errorf("can't prepare at least %d in-service instances", capacity),
+			}
 		case <-ctx.Done():
-			return ctx.Err()
+			return timeout.Wrap(ctx, timeout.PhaseInstanceLaunch, ctx.Err())
 		}
 	}
 }
 
-func (asg *AutoScalingGroup) fetchSortedInstanceIDs(ctx context.Context, count int32) ([]string, error) {
+// fetchSortedInstanceIDs returns the IDs of count instances, giving priority to old instances and then to older ones.
+func (asg *AutoScalingGroup) fetchSortedInstanceIDs(ctx context.Context, count int32, isOld func(ec2types.Instance) bool) ([]string, error) {
+	return asg.fetchSortedInstanceIDsBy(ctx, count, isOld, compareLaunchTimes, nil, nil)
+}
+
+// fetchSortedOldInstanceIDs returns the IDs of count old instances, giving priority to older ones.
+func (asg *AutoScalingGroup) fetchSortedOldInstanceIDs(ctx context.Context, count int32, isOld func(ec2types.Instance) bool) ([]string, error) {
+	return asg.fetchSortedInstanceIDsBy(ctx, count, isOld, compareLaunchTimes, func(i ec2types.Instance) (bool, error) {
+		return isOld(i), nil
+	}, nil)
+}
+
+// fetchSortedInstanceIDsBy returns the IDs of count instances, giving priority to old instances and then to the ones
+// ordered first by compare, while keeping the numbers of instances in the availability zones balanced.
+// Old instances are selected from any availability zone as long as the difference in the numbers doesn't exceed one,
+// so that old instances concentrated in one availability zone don't survive instead of new ones in the others.
+// If isCandidate isn't nil, only the instances for which it returns true are selected. If isProtected isn't nil,
+// protected instances are skipped in favor of the others in the same availability zone, and an error is returned if
+// the availability zones can't be kept balanced without selecting them. Both are called only for the instances in
+// question because they might call APIs.
+func (asg *AutoScalingGroup) fetchSortedInstanceIDsBy(ctx context.Context, count int32, isOld func(ec2types.Instance) bool, compare func(a, b ec2types.Instance) int, isCandidate, isProtected func(ec2types.Instance) (bool, error)) ([]string, error) {
 	instances := make([]ec2types.Instance, 0, *asg.DesiredCapacity)
 	err := asg.fetchInstances(ctx, func(i ec2types.Instance) error {
 		instances = append(instances, i)
@@ -362,42 +942,138 @@ func (asg *AutoScalingGroup) fetchSortedInstanceIDs(ctx context.Context, count i
 	}
 
 	sort.SliceStable(instances, func(i, j int) bool {
-		return instances[i].LaunchTime.Before(*instances[j].LaunchTime)
+		if isOld(instances[i]) != isOld(instances[j]) {
+			return isOld(instances[i])
+		}
+		return compare(instances[i], instances[j]) < 0
 	})
 
 	azs := make([]string, 0)
-	azToInstances := make(map[string][]ec2types.Instance)
+	azToInstanceCount := make(map[string]int)
 	azToOldInstanceCount := make(map[string]int)
+	azToInstances := make(map[string][]ec2types.Instance)
 	for _, i := range instances {
 		az := *i.Placement.AvailabilityZone
 		if !slices.Contains(azs, az) {
 			azs = append(azs, az)
 		}
-		azToInstances[az] = append(azToInstances[az], i)
-		if asg.StateSavedAt != nil && i.LaunchTime.Before(*asg.StateSavedAt) {
+		azToInstanceCount[az] += 1
+		if isOld(i) {
 			azToOldInstanceCount[az] += 1
 		}
+		azToInstances[az] = append(azToInstances[az], i)
 	}
 
 	sort.SliceStable(azs, func(i, j int) bool {
-		if len(azToInstances[azs[i]]) == len(azToInstances[azs[j]]) {
+		if azToInstanceCount[azs[i]] == azToInstanceCount[azs[j]] {
 			return azToOldInstanceCount[azs[i]] > azToOldInstanceCount[azs[j]]
 		} else {
-			return len(azToInstances[azs[i]]) > len(azToInstances[azs[j]])
+			return azToInstanceCount[azs[i]] > azToInstanceCount[azs[j]]
 		}
 	})
 
+	// nextCandidate returns the instance to be selected next in the availability zone, or nil if there is none.
+	// Protected instances are moved to azToProtectedIDs because they still count toward the balance.
+	checkedInstanceIDs := make(map[string]bool)
+	azToProtectedIDs := make(map[string][]string)
+	nextCandidate := func(az string) (*ec2types.Instance, error) {
+		for len(azToInstances[az]) > 0 {
+			i := azToInstances[az][0]
+			if checkedInstanceIDs[*i.InstanceId] {
+				return &i, nil
+			}
+			if isCandidate != nil {
+				ok, err := isCandidate(i)
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					azToInstances[az] = azToInstances[az][1:]
+					continue
+				}
+			}
+			if isProtected != nil {
+				protected, err := isProtected(i)
+				if err != nil {
+					return nil, err
+				}
+				if protected {
+					log.Printf("Skip the instance %s protected from scale in or termination\n", *i.InstanceId)
+					azToProtectedIDs[az] = append(azToProtectedIDs[az], *i.InstanceId)
+					azToInstances[az] = azToInstances[az][1:]
+					continue
+				}
+			}
+			checkedInstanceIDs[*i.InstanceId] = true
+			return &i, nil
+		}
+		return nil, nil
+	}
+
+	// imbalanceAfterSelection returns the difference between the largest and the smallest numbers of instances in
+	// the availability zones after an instance is selected from az. Differences up to one are regarded as balanced.
+	imbalanceAfterSelection := func(az string) int {
+		largest, smallest := 0, math.MaxInt
+		for _, a := range azs {
+			n := azToInstanceCount[a]
+			if a == az {
+				n--
+			}
+			largest = max(largest, n)
+			smallest = min(smallest, n)
+		}
+		return max(largest-smallest, 1)
+	}
+
 	sortedInstanceIDs := make([]string, 0, count)
-Loop:
-	for {
+	for int32(len(sortedInstanceIDs)) < count {
+		// Determine the availability zones to select from before excluding protected instances so that the other
+		// availability zones don't make up for them
+		azToCandidate := make(map[string]*ec2types.Instance)
+		minImbalance := math.MaxInt
+		for _, az := range azs {
+			i, err := nextCandidate(az)
+			if err != nil {
+				return nil, err
+			}
+			if i == nil && len(azToProtectedIDs[az]) == 0 {
+				continue
+			}
+			azToCandidate[az] = i
+			minImbalance = min(minImbalance, imbalanceAfterSelection(az))
+		}
+		if len(azToCandidate) == 0 {
+			return nil, xerrors.Errorf("%d instances should be selected but only %d instances can be selected", count, len(sortedInstanceIDs))
+		}
+
+		var selectedAZ string
+		var selected *ec2types.Instance
+		protectedIDs := make([]string, 0)
 		for _, az := range azs {
-			if int32(len(sortedInstanceIDs)) == count {
-				break Loop
+			i, ok := azToCandidate[az]
+			if !ok || imbalanceAfterSelection(az) > minImbalance {
+				continue
+			}
+			if i == nil {
+				protectedIDs = append(protectedIDs, azToProtectedIDs[az]...)
+				continue
 			}
-			var i ec2types.Instance
-			i, azToInstances[az] = azToInstances[az][0], azToInstances[az][1:]
-			sortedInstanceIDs = append(sortedInstanceIDs, *i.InstanceId)
+			if selected != nil {
+				if c := cmp.Or(compareBools(isOld(*i), isOld(*selected)), compare(*i, *selected)); c > 0 {
+					continue
+				} else if c == 0 && azToInstanceCount[az] <= azToInstanceCount[selectedAZ] {
+					continue
+				}
+			}
+			selectedAZ, selected = az, i
 		}
+		if selected == nil {
+			return nil, xerrors.Errorf("%d instances should be selected but only %d instances can be selected without breaking the balance of availability zones because the others are protected: %v", count, len(sortedInstanceIDs), protectedIDs)
+		}
+
+		sortedInstanceIDs = append(sortedInstanceIDs, *selected.InstanceId)
+		azToInstances[selectedAZ] = azToInstances[selectedAZ][1:]
+		azToInstanceCount[selectedAZ]--
 	}
 
 	return sortedInstanceIDs, nil
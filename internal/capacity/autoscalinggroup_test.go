@@ -2,8 +2,10 @@ package capacity_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"slices"
+	"strings"
 	"testing"
 	"time"
 
@@ -13,6 +15,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
 	"go.uber.org/mock/gomock"
 
 	"github.com/abicky/ecsmec/internal/capacity"
@@ -21,6 +24,18 @@ import (
 	"github.com/abicky/ecsmec/internal/testing/testutil"
 )
 
+func createContainerInstances(instances []autoscalingtypes.Instance) []ecstypes.ContainerInstance {
+	containerInstances := make([]ecstypes.ContainerInstance, len(instances))
+	for i, instance := range instances {
+		containerInstances[i] = ecstypes.ContainerInstance{
+			ContainerInstanceArn: aws.String(fmt.Sprintf("arn:aws:ecs:ap-northeast-1:123456789:container-instance/test/%s", *instance.InstanceId)),
+			Ec2InstanceId:        instance.InstanceId,
+		}
+	}
+
+	return containerInstances
+}
+
 func createReservation(instance autoscalingtypes.Instance, launchTime time.Time) ec2types.Reservation {
 	return createReservations([]autoscalingtypes.Instance{instance}, launchTime)[0]
 }
@@ -68,6 +83,7 @@ func expectLaunchNewInstances(
 	existingInstances, newInstances []autoscalingtypes.Instance,
 	desiredCapacity, maxSize int32,
 	stateSavedAt string,
+	extraTags map[string]string,
 ) *gomock.Call {
 	t.Helper()
 
@@ -98,8 +114,8 @@ func expectLaunchNewInstances(
 		}, nil),
 
 		asMock.EXPECT().CreateOrUpdateTags(ctx, gomock.Any()).Do(func(_ context.Context, input *autoscaling.CreateOrUpdateTagsInput, _ ...func(*ecs.Options)) {
-			if len(input.Tags) != 3 {
-				t.Errorf("len(input.Tags) = %d; want %d", len(input.Tags), 3)
+			if len(input.Tags) != 3+len(extraTags) {
+				t.Errorf("len(input.Tags) = %d; want %d", len(input.Tags), 3+len(extraTags))
 			}
 			for _, tag := range input.Tags {
 				switch *tag.Key {
@@ -121,7 +137,12 @@ func expectLaunchNewInstances(
 						t.Errorf("ecsmec:StateSavedAt = %v; want around %v", savedAt, time.Now())
 					}
 				default:
-					t.Errorf("unknown tag %s", *tag.Key)
+					value, ok := extraTags[*tag.Key]
+					if !ok {
+						t.Errorf("unknown tag %s", *tag.Key)
+					} else if *tag.Value != value {
+						t.Errorf("%s = %s; want %s", *tag.Key, *tag.Value, value)
+					}
 				}
 			}
 		}),
@@ -159,6 +180,7 @@ func expectTerminateInstances(
 	instancesToTerminate, instancesToKeep []autoscalingtypes.Instance,
 	reservationsToTerminate, reservationsToKeep []ec2types.Reservation,
 	desiredCapacity, maxSize int32,
+	tags []autoscalingtypes.TagDescription,
 ) *gomock.Call {
 	t.Helper()
 
@@ -224,6 +246,7 @@ func expectTerminateInstances(
 					DesiredCapacity:      aws.Int32(desiredCapacity),
 					Instances:            instancesToKeep,
 					MaxSize:              aws.Int32(maxSize),
+					Tags:                 tags,
 				},
 			},
 		}, nil),
@@ -236,6 +259,7 @@ func expectRestoreState(
 	asMock *capacitymock.MockAutoScalingAPI,
 	desiredCapacity, maxSize int32,
 	stateSavedAt string,
+	extraTags map[string]string,
 ) *gomock.Call {
 	t.Helper()
 
@@ -250,8 +274,8 @@ func expectRestoreState(
 		}),
 
 		asMock.EXPECT().DeleteTags(ctx, gomock.Any()).Do(func(_ context.Context, input *autoscaling.DeleteTagsInput, _ ...func(*autoscaling.Options)) {
-			if len(input.Tags) != 3 {
-				t.Errorf("len(input.Tags) = %d; want %d", len(input.Tags), 3)
+			if len(input.Tags) != 3+len(extraTags) {
+				t.Errorf("len(input.Tags) = %d; want %d", len(input.Tags), 3+len(extraTags))
 			}
 			for _, tag := range input.Tags {
 				switch *tag.Key {
@@ -268,7 +292,12 @@ func expectRestoreState(
 						t.Errorf("ecsmec:StateSavedAt = %s; want %s", *tag.Value, stateSavedAt)
 					}
 				default:
-					t.Errorf("unknown tag %s", *tag.Key)
+					value, ok := extraTags[*tag.Key]
+					if !ok {
+						t.Errorf("unknown tag %s", *tag.Key)
+					} else if *tag.Value != value {
+						t.Errorf("%s = %s; want %s", *tag.Key, *tag.Value, value)
+					}
 				}
 			}
 		}),
@@ -424,6 +453,7 @@ func TestAutoScalingGroup_ReplaceInstances(t *testing.T) {
 
 			asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
 			ec2Mock := capacitymock.NewMockEC2API(ctrl)
+			expectNoTerminationProtection(ec2Mock)
 			drainerMock := capacitymock.NewMockDrainer(ctrl)
 			clusterMock := capacitymock.NewMockCluster(ctrl)
 			clusterMock.EXPECT().Name()
@@ -455,10 +485,10 @@ func TestAutoScalingGroup_ReplaceInstances(t *testing.T) {
 					Reservations: oldReservations,
 				}, nil),
 
-				expectLaunchNewInstances(t, ctx, asMock, tt.oldInstances, tt.newInstances, tt.desiredCapacity, tt.maxSize, stateSavedAt),
-				clusterMock.EXPECT().WaitUntilContainerInstancesRegistered(ctx, len(tt.newInstances), gomock.AssignableToTypeOf(&time.Time{})),
-				expectTerminateInstances(t, ctx, asMock, ec2Mock, drainerMock, tt.oldInstances, tt.newInstances, oldReservations, newReservations, tt.desiredCapacity, tt.maxSize),
-				expectRestoreState(t, ctx, asMock, tt.desiredCapacity, tt.maxSize, stateSavedAt),
+				expectLaunchNewInstances(t, ctx, asMock, tt.oldInstances, tt.newInstances, tt.desiredCapacity, tt.maxSize, stateSavedAt, nil),
+				clusterMock.EXPECT().WaitUntilContainerInstancesRegistered(ctx, instanceIDs(tt.newInstances)),
+				expectTerminateInstances(t, ctx, asMock, ec2Mock, drainerMock, tt.oldInstances, tt.newInstances, oldReservations, newReservations, tt.desiredCapacity, tt.maxSize, nil),
+				expectRestoreState(t, ctx, asMock, tt.desiredCapacity, tt.maxSize, stateSavedAt, nil),
 			)
 
 			group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
@@ -472,6 +502,174 @@ func TestAutoScalingGroup_ReplaceInstances(t *testing.T) {
 		})
 	}
 
+	t.Run("a scaling activity fails while launching new instances", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+		ec2Mock := capacitymock.NewMockEC2API(ctrl)
+		expectNoTerminationProtection(ec2Mock)
+		drainerMock := capacitymock.NewMockDrainer(ctrl)
+		clusterMock := capacitymock.NewMockCluster(ctrl)
+
+		oldInstances := append(createInstances("ap-northeast-1a", 1), createInstances("ap-northeast-1c", 1)...)
+		group := autoscalingtypes.AutoScalingGroup{
+			AutoScalingGroupName: aws.String("autoscaling-group-name"),
+			AvailabilityZones:    []string{"ap-northeast-1a", "ap-northeast-1c"},
+			DesiredCapacity:      aws.Int32(2),
+			Instances:            oldInstances,
+			MaxSize:              aws.Int32(2),
+		}
+		statusMessage := "We currently do not have sufficient m5.large capacity in the Availability Zone you requested (ap-northeast-1a)."
+
+		gomock.InOrder(
+			asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+				AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{group},
+			}, nil),
+
+			// For fetchInstances
+			ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+				Reservations: createReservations(oldInstances, time.Now().Add(-24*time.Hour)),
+			}, nil),
+
+			// For waitUntilInstancesInService
+			asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+				AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{group},
+			}, nil),
+
+			asMock.EXPECT().CreateOrUpdateTags(ctx, gomock.Any()),
+			asMock.EXPECT().UpdateAutoScalingGroup(ctx, gomock.Any()),
+
+			// For waitUntilInstancesInService
+			asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+				AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{group},
+			}, nil),
+			asMock.EXPECT().DescribeScalingActivities(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, _ *autoscaling.DescribeScalingActivitiesInput, _ ...func(*autoscaling.Options)) (*autoscaling.DescribeScalingActivitiesOutput, error) {
+				// Activities are sorted in descending order of their start time
+				activities := make([]autoscalingtypes.Activity, 3)
+				for i := range activities {
+					activities[i] = autoscalingtypes.Activity{
+						ActivityId:    aws.String(fmt.Sprintf("activity-id-%d", i)),
+						Description:   aws.String("Launching a new EC2 instance.  Status Reason: Could not launch On-Demand Instances."),
+						StartTime:     aws.Time(time.Now().Add(time.Duration(len(activities)-i) * time.Millisecond)),
+						StatusCode:    autoscalingtypes.ScalingActivityStatusCodeFailed,
+						StatusMessage: aws.String(statusMessage),
+					}
+				}
+				return &autoscaling.DescribeScalingActivitiesOutput{Activities: activities}, nil
+			}),
+		)
+
+		asg, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = asg.ReplaceInstances(ctx, drainerMock, clusterMock)
+		if err == nil || !strings.Contains(err.Error(), statusMessage) {
+			t.Errorf("err = %#v; want an error including %q", err, statusMessage)
+		}
+	})
+
+	t.Run("with canary", func(t *testing.T) {
+		tests := []struct {
+			name      string
+			canaryErr error
+		}{
+			{
+				name:      "the canary succeeds",
+				canaryErr: nil,
+			},
+			{
+				name:      "the canary fails",
+				canaryErr: errors.New("the running count of the service \"foo\" dropped from 2 to 1 (desired: 2)"),
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				ctx := context.Background()
+
+				desiredCapacity := int32(2)
+				maxSize := int32(2)
+				soakPeriod := 5 * time.Minute
+
+				asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+				ec2Mock := capacitymock.NewMockEC2API(ctrl)
+				expectNoTerminationProtection(ec2Mock)
+				drainerMock := capacitymock.NewMockDrainer(ctrl)
+				clusterMock := capacitymock.NewMockCluster(ctrl)
+				clusterMock.EXPECT().Name()
+
+				now := time.Now().UTC()
+				stateSavedAt := now.Format(time.RFC3339)
+
+				oldInstances := append(createInstances("ap-northeast-1a", 1), createInstances("ap-northeast-1c", 1)...)
+				oldReservations := createReservations(oldInstances, now.Add(-24*time.Hour))
+				newInstances := append(createInstances("ap-northeast-1a", 1), createInstances("ap-northeast-1c", 1)...)
+				newReservations := createReservations(newInstances, now)
+
+				calls := []any{
+					asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+						AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+							{
+								AutoScalingGroupName: aws.String("autoscaling-group-name"),
+								AvailabilityZones:    []string{"ap-northeast-1a", "ap-northeast-1c"},
+								DesiredCapacity:      aws.Int32(desiredCapacity),
+								Instances:            oldInstances,
+								MaxSize:              aws.Int32(maxSize),
+							},
+						},
+					}, nil),
+
+					// For fetchInstances
+					ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+						Reservations: oldReservations,
+					}, nil),
+
+					expectLaunchNewInstances(t, ctx, asMock, oldInstances, newInstances, desiredCapacity, maxSize, stateSavedAt, nil),
+					clusterMock.EXPECT().WaitUntilContainerInstancesRegistered(ctx, instanceIDs(newInstances)),
+
+					// For fetchSortedInstanceIDs of the canary
+					ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+						Reservations: append(slices.Clone(oldReservations), newReservations...),
+					}, nil),
+					drainerMock.EXPECT().DrainCanary(ctx, gomock.Len(1), soakPeriod).DoAndReturn(func(_ context.Context, ids []string, _ time.Duration) error {
+						if !slices.Contains(instanceIDs(oldInstances), ids[0]) {
+							t.Errorf("canary instance = %s; want one of %v", ids[0], instanceIDs(oldInstances))
+						}
+						return tt.canaryErr
+					}),
+				}
+				if tt.canaryErr == nil {
+					calls = append(calls,
+						expectTerminateInstances(t, ctx, asMock, ec2Mock, drainerMock, oldInstances, newInstances, oldReservations, newReservations, desiredCapacity, maxSize, nil),
+						expectRestoreState(t, ctx, asMock, desiredCapacity, maxSize, stateSavedAt, nil),
+					)
+				}
+				gomock.InOrder(calls...)
+
+				group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				err = group.ReplaceInstances(ctx, drainerMock, clusterMock, capacity.WithCanary(1, soakPeriod))
+				if tt.canaryErr == nil && err != nil {
+					t.Errorf("err = %#v; want nil", err)
+				}
+				if tt.canaryErr != nil && !errors.Is(err, tt.canaryErr) {
+					t.Errorf("err = %#v; want an error wrapping %#v", err, tt.canaryErr)
+				}
+			})
+		}
+	})
+
 	t.Run("the desired capacity is not a multiple of the number of availability zones", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
@@ -483,6 +681,7 @@ func TestAutoScalingGroup_ReplaceInstances(t *testing.T) {
 
 		asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
 		ec2Mock := capacitymock.NewMockEC2API(ctrl)
+		expectNoTerminationProtection(ec2Mock)
 		drainerMock := capacitymock.NewMockDrainer(ctrl)
 		clusterMock := capacitymock.NewMockCluster(ctrl)
 		clusterMock.EXPECT().Name()
@@ -538,10 +737,10 @@ func TestAutoScalingGroup_ReplaceInstances(t *testing.T) {
 				Reservations: oldReservations,
 			}, nil),
 
-			expectLaunchNewInstances(t, ctx, asMock, oldInstances, newInstances, desiredCapacity, maxSize, stateSavedAt),
-			clusterMock.EXPECT().WaitUntilContainerInstancesRegistered(ctx, len(newInstances), gomock.AssignableToTypeOf(&time.Time{})),
-			expectTerminateInstances(t, ctx, asMock, ec2Mock, drainerMock, instancesToTerminate, instancesToKeep, reservationsToTerminate, reservationsToKeep, desiredCapacity, maxSize),
-			expectRestoreState(t, ctx, asMock, desiredCapacity, maxSize, stateSavedAt),
+			expectLaunchNewInstances(t, ctx, asMock, oldInstances, newInstances, desiredCapacity, maxSize, stateSavedAt, nil),
+			clusterMock.EXPECT().WaitUntilContainerInstancesRegistered(ctx, instanceIDs(newInstances)),
+			expectTerminateInstances(t, ctx, asMock, ec2Mock, drainerMock, instancesToTerminate, instancesToKeep, reservationsToTerminate, reservationsToKeep, desiredCapacity, maxSize, nil),
+			expectRestoreState(t, ctx, asMock, desiredCapacity, maxSize, stateSavedAt, nil),
 		)
 
 		group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
@@ -564,7 +763,10 @@ func TestAutoScalingGroup_ReplaceInstances(t *testing.T) {
 		maxSize := int32(8)
 
 		asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+		// For loadLaunchedInstanceIDs
+		asMock.EXPECT().DescribeScalingActivities(gomock.Any(), gomock.Any(), gomock.Any()).Return(&autoscaling.DescribeScalingActivitiesOutput{}, nil)
 		ec2Mock := capacitymock.NewMockEC2API(ctrl)
+		expectNoTerminationProtection(ec2Mock)
 		drainerMock := capacitymock.NewMockDrainer(ctrl)
 		clusterMock := capacitymock.NewMockCluster(ctrl)
 		clusterMock.EXPECT().Name()
@@ -600,8 +802,8 @@ func TestAutoScalingGroup_ReplaceInstances(t *testing.T) {
 				Reservations: createReservations(instances, now),
 			}, nil),
 
-			clusterMock.EXPECT().WaitUntilContainerInstancesRegistered(ctx, 0, gomock.AssignableToTypeOf(&time.Time{})),
-			expectRestoreState(t, ctx, asMock, desiredCapacity, maxSize, stateSavedAt),
+			clusterMock.EXPECT().WaitUntilContainerInstancesRegistered(ctx, instanceIDs(instances)),
+			expectRestoreState(t, ctx, asMock, desiredCapacity, maxSize, stateSavedAt, nil),
 		)
 
 		group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
@@ -624,7 +826,10 @@ func TestAutoScalingGroup_ReplaceInstances(t *testing.T) {
 		maxSize := int32(8)
 
 		asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+		// For loadLaunchedInstanceIDs
+		asMock.EXPECT().DescribeScalingActivities(gomock.Any(), gomock.Any(), gomock.Any()).Return(&autoscaling.DescribeScalingActivitiesOutput{}, nil)
 		ec2Mock := capacitymock.NewMockEC2API(ctrl)
+		expectNoTerminationProtection(ec2Mock)
 		drainerMock := capacitymock.NewMockDrainer(ctrl)
 		clusterMock := capacitymock.NewMockCluster(ctrl)
 		clusterMock.EXPECT().Name()
@@ -671,9 +876,9 @@ func TestAutoScalingGroup_ReplaceInstances(t *testing.T) {
 				AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{asg},
 			}, nil),
 
-			clusterMock.EXPECT().WaitUntilContainerInstancesRegistered(ctx, len(newInstances), gomock.AssignableToTypeOf(&time.Time{})),
-			expectTerminateInstances(t, ctx, asMock, ec2Mock, drainerMock, oldInstances, newInstances, oldReservations, newReservations, desiredCapacity, maxSize),
-			expectRestoreState(t, ctx, asMock, desiredCapacity, maxSize, stateSavedAt),
+			clusterMock.EXPECT().WaitUntilContainerInstancesRegistered(ctx, instanceIDs(newInstances)),
+			expectTerminateInstances(t, ctx, asMock, ec2Mock, drainerMock, oldInstances, newInstances, oldReservations, newReservations, desiredCapacity, maxSize, nil),
+			expectRestoreState(t, ctx, asMock, desiredCapacity, maxSize, stateSavedAt, nil),
 		)
 
 		group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
@@ -685,114 +890,543 @@ func TestAutoScalingGroup_ReplaceInstances(t *testing.T) {
 			t.Errorf("err = %#v; want nil", err)
 		}
 	})
-}
 
-func TestAutoScalingGroup_ReduceCapacity(t *testing.T) {
-	ctrl := gomock.NewController(t)
-	defer ctrl.Finish()
+	t.Run("with max surge", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
 
-	ctx := context.Background()
+		ctx := context.Background()
 
-	asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
-	ec2Mock := capacitymock.NewMockEC2API(ctrl)
-	drainerMock := capacitymock.NewMockDrainer(ctrl)
+		desiredCapacity := int32(4)
+		maxSize := int32(4)
+		maxSurge := int32(2)
 
-	now := time.Now().UTC()
+		asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+		ec2Mock := capacitymock.NewMockEC2API(ctrl)
+		expectNoTerminationProtection(ec2Mock)
+		drainerMock := capacitymock.NewMockDrainer(ctrl)
+		clusterMock := capacitymock.NewMockCluster(ctrl)
+		clusterMock.EXPECT().Name().AnyTimes()
 
-	instancesToTerminate := append(
-		append(
-			createInstances("ap-northeast-1a", autoscalingconst.MaxDetachableInstances),
-			createInstances("ap-northeast-1c", autoscalingconst.MaxDetachableInstances+1)...,
-		),
-		createInstances("ap-northeast-1d", autoscalingconst.MaxDetachableInstances)...,
-	)
-	reservationsToTerminate := createReservations(instancesToTerminate, now.Add(-24*time.Hour))
+		now := time.Now().UTC()
+		stateSavedAt := now.Format(time.RFC3339)
+		tags := append(createTagDescriptions(desiredCapacity, maxSize, stateSavedAt), autoscalingtypes.TagDescription{
+			Key:   aws.String("ecsmec:MaxSurge"),
+			Value: aws.String(fmt.Sprint(maxSurge)),
+		})
 
-	instancesToKeep := append(
-		append(
-			createInstances("ap-northeast-1a", 2),
-			createInstances("ap-northeast-1c", 2)...,
-		),
-		createInstances("ap-northeast-1d", 2)...,
-	)
-	reservationsToKeep := createReservations(instancesToKeep, now)
+		firstOldInstances := append(
+			createInstances("ap-northeast-1a", 1),
+			createInstances("ap-northeast-1c", 1)...,
+		)
+		firstOldReservations := createReservations(firstOldInstances, now.Add(-48*time.Hour))
+		secondOldInstances := append(
+			createInstances("ap-northeast-1a", 1),
+			createInstances("ap-northeast-1c", 1)...,
+		)
+		secondOldReservations := createReservations(secondOldInstances, now.Add(-24*time.Hour))
+		oldInstances := append(firstOldInstances, secondOldInstances...)
 
-	allInstances := append(instancesToTerminate, instancesToKeep...)
-	detachedInstanceIds := make([]string, 0, len(instancesToTerminate))
-	terminatedInstanceIds := make([]string, 0, len(instancesToTerminate))
+		// New instances are launched after ReplaceInstances is called
+		firstNewInstances := append(
+			createInstances("ap-northeast-1a", 1),
+			createInstances("ap-northeast-1c", 1)...,
+		)
+		firstNewReservations := createReservations(firstNewInstances, now.Add(time.Hour))
+		secondNewInstances := append(
+			createInstances("ap-northeast-1a", 1),
+			createInstances("ap-northeast-1c", 1)...,
+		)
+		secondNewReservations := createReservations(secondNewInstances, now.Add(time.Hour))
 
-	gomock.InOrder(
-		asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
-			AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
-				{
-					AutoScalingGroupName: aws.String("autoscaling-group-name"),
-					DesiredCapacity:      aws.Int32(int32(len(allInstances))),
-					Instances:            allInstances,
-					MaxSize:              aws.Int32(int32(len(allInstances))),
+		instancesAfterFirstWave := append(slices.Clone(secondOldInstances), firstNewInstances...)
+		reservationsAfterFirstWave := append(slices.Clone(secondOldReservations), firstNewReservations...)
+		newInstances := append(slices.Clone(firstNewInstances), secondNewInstances...)
+		newReservations := append(slices.Clone(firstNewReservations), secondNewReservations...)
+
+		gomock.InOrder(
+			asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+				AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+					{
+						AutoScalingGroupName: aws.String("autoscaling-group-name"),
+						AvailabilityZones: []string{
+							"ap-northeast-1a",
+							"ap-northeast-1c",
+						},
+						DesiredCapacity: aws.Int32(desiredCapacity),
+						Instances:       oldInstances,
+						MaxSize:         aws.Int32(maxSize),
+						SuspendedProcesses: []autoscalingtypes.SuspendedProcess{
+							{ProcessName: aws.String("AZRebalance")},
+						},
+					},
 				},
-			},
-		}, nil),
+			}, nil),
 
-		ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).Return(&ec2.DescribeInstancesOutput{
-			Reservations: append(reservationsToTerminate, reservationsToKeep...),
-		}, nil),
+			// The first wave
+			ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+				Reservations: append(slices.Clone(firstOldReservations), secondOldReservations...),
+			}, nil),
+			expectLaunchNewInstances(t, ctx, asMock, oldInstances, firstNewInstances, desiredCapacity, maxSize, stateSavedAt, map[string]string{"ecsmec:MaxSurge": fmt.Sprint(maxSurge)}),
+			clusterMock.EXPECT().WaitUntilContainerInstancesRegistered(ctx, instanceIDs(firstNewInstances)),
+			expectTerminateInstances(t, ctx, asMock, ec2Mock, drainerMock, firstOldInstances, instancesAfterFirstWave, firstOldReservations, reservationsAfterFirstWave, desiredCapacity, desiredCapacity+maxSurge, tags),
 
-		drainerMock.EXPECT().Drain(ctx, gomock.Len(len(instancesToTerminate))),
+			// The second wave
+			ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+				Reservations: reservationsAfterFirstWave,
+			}, nil),
+			expectLaunchNewInstances(t, ctx, asMock, instancesAfterFirstWave, secondNewInstances, desiredCapacity, maxSize, stateSavedAt, map[string]string{"ecsmec:MaxSurge": fmt.Sprint(maxSurge)}),
+			clusterMock.EXPECT().WaitUntilContainerInstancesRegistered(ctx, instanceIDs(newInstances)),
+			expectTerminateInstances(t, ctx, asMock, ec2Mock, drainerMock, secondOldInstances, newInstances, secondOldReservations, newReservations, desiredCapacity, desiredCapacity+maxSurge, tags),
 
-		asMock.EXPECT().DetachInstances(ctx, gomock.Any()).Times(4).Do(func(_ context.Context, input *autoscaling.DetachInstancesInput, _ ...func(options *autoscaling.Options)) {
-			detachedInstanceIds = append(detachedInstanceIds, input.InstanceIds...)
-		}),
+			// No old instances remain
+			ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+				Reservations: newReservations,
+			}, nil),
+			expectRestoreState(t, ctx, asMock, desiredCapacity, maxSize, stateSavedAt, map[string]string{"ecsmec:MaxSurge": fmt.Sprint(maxSurge)}),
+		)
 
-		ec2Mock.EXPECT().TerminateInstances(ctx, gomock.Any()).Do(func(_ context.Context, input *ec2.TerminateInstancesInput, _ ...func(*ec2.Options)) {
-			terminatedInstanceIds = append(terminatedInstanceIds, input.InstanceIds...)
-		}),
+		group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-		// For InstanceTerminatedWaiter
-		ec2Mock.EXPECT().DescribeInstances(testutil.AnyContext(), gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, input *ec2.DescribeInstancesInput, _ ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
-			if !testutil.MatchSlice(input.InstanceIds, terminatedInstanceIds) {
-				t.Errorf("input.InstanceIds = %v; want %v", input.InstanceIds, terminatedInstanceIds)
-			}
+		if err := group.ReplaceInstances(ctx, drainerMock, clusterMock, capacity.WithMaxSurge(maxSurge)); err != nil {
+			t.Errorf("err = %#v; want nil", err)
+		}
+	})
 
-			instances := make([]ec2types.Instance, len(terminatedInstanceIds))
-			for i, id := range terminatedInstanceIds {
-				instances[i] = ec2types.Instance{
-					InstanceId: aws.String(id),
-					State: &ec2types.InstanceState{
-						Name: "terminated",
-					},
-				}
-			}
+	t.Run("with max surge and old instances are unevenly distributed across availability zones", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
 
-			return &ec2.DescribeInstancesOutput{
-				Reservations: []ec2types.Reservation{
+		ctx := context.Background()
+
+		desiredCapacity := int32(4)
+		maxSize := int32(4)
+		maxSurge := int32(2)
+
+		asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+		ec2Mock := capacitymock.NewMockEC2API(ctrl)
+		expectNoTerminationProtection(ec2Mock)
+		drainerMock := capacitymock.NewMockDrainer(ctrl)
+		clusterMock := capacitymock.NewMockCluster(ctrl)
+		clusterMock.EXPECT().Name().AnyTimes()
+
+		now := time.Now().UTC()
+		stateSavedAt := now.Format(time.RFC3339)
+		tags := append(createTagDescriptions(desiredCapacity, maxSize, stateSavedAt), autoscalingtypes.TagDescription{
+			Key:   aws.String("ecsmec:MaxSurge"),
+			Value: aws.String(fmt.Sprint(maxSurge)),
+		})
+
+		oldInstancesA := createInstances("ap-northeast-1a", 2)
+		oldInstanceB := createInstance("ap-northeast-1b")
+		oldInstanceC := createInstance("ap-northeast-1c")
+		oldInstances := []autoscalingtypes.Instance{oldInstancesA[0], oldInstancesA[1], oldInstanceB, oldInstanceC}
+		oldReservations := []ec2types.Reservation{
+			createReservation(oldInstancesA[0], now.Add(-48*time.Hour)),
+			createReservation(oldInstancesA[1], now.Add(-24*time.Hour)),
+			createReservation(oldInstanceB, now.Add(-48*time.Hour)),
+			createReservation(oldInstanceC, now.Add(-24*time.Hour)),
+		}
+
+		firstNewInstances := []autoscalingtypes.Instance{createInstance("ap-northeast-1b"), createInstance("ap-northeast-1c")}
+		firstNewReservations := createReservations(firstNewInstances, now.Add(time.Hour))
+		secondNewInstances := []autoscalingtypes.Instance{createInstance("ap-northeast-1b"), createInstance("ap-northeast-1c")}
+		secondNewReservations := createReservations(secondNewInstances, now.Add(time.Hour))
+
+		firstOldInstances := []autoscalingtypes.Instance{oldInstancesA[0], oldInstanceB}
+		firstOldReservations := []ec2types.Reservation{oldReservations[0], oldReservations[2]}
+		secondOldInstances := []autoscalingtypes.Instance{oldInstancesA[1], oldInstanceC}
+		secondOldReservations := []ec2types.Reservation{oldReservations[1], oldReservations[3]}
+
+		instancesAfterFirstWave := append(slices.Clone(secondOldInstances), firstNewInstances...)
+		reservationsAfterFirstWave := append(slices.Clone(secondOldReservations), firstNewReservations...)
+		newInstances := append(slices.Clone(firstNewInstances), secondNewInstances...)
+		newReservations := append(slices.Clone(firstNewReservations), secondNewReservations...)
+
+		gomock.InOrder(
+			asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+				AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
 					{
-						Instances: instances,
+						AutoScalingGroupName: aws.String("autoscaling-group-name"),
+						AvailabilityZones: []string{
+							"ap-northeast-1a",
+							"ap-northeast-1b",
+							"ap-northeast-1c",
+						},
+						DesiredCapacity: aws.Int32(desiredCapacity),
+						Instances:       oldInstances,
+						MaxSize:         aws.Int32(maxSize),
+						SuspendedProcesses: []autoscalingtypes.SuspendedProcess{
+							{ProcessName: aws.String("AZRebalance")},
+						},
 					},
 				},
-			}, nil
-		}),
+			}, nil),
 
-		// Call `reload` at the end of the method
+			// The first wave launches only maxSurge instances even though the desired capacity is not a multiple of
+			// the number of availability zones
+			ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+				Reservations: oldReservations,
+			}, nil),
+			expectLaunchNewInstances(t, ctx, asMock, oldInstances, firstNewInstances, desiredCapacity, maxSize, stateSavedAt, map[string]string{"ecsmec:MaxSurge": fmt.Sprint(maxSurge)}),
+			clusterMock.EXPECT().WaitUntilContainerInstancesRegistered(ctx, instanceIDs(firstNewInstances)),
+			expectTerminateInstances(t, ctx, asMock, ec2Mock, drainerMock, firstOldInstances, instancesAfterFirstWave, firstOldReservations, reservationsAfterFirstWave, desiredCapacity, desiredCapacity+maxSurge, tags),
+
+			// The second wave terminates the old instances in ap-northeast-1a and ap-northeast-1c though
+			// ap-northeast-1b has more instances than ap-northeast-1a
+			ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+				Reservations: reservationsAfterFirstWave,
+			}, nil),
+			expectLaunchNewInstances(t, ctx, asMock, instancesAfterFirstWave, secondNewInstances, desiredCapacity, maxSize, stateSavedAt, map[string]string{"ecsmec:MaxSurge": fmt.Sprint(maxSurge)}),
+			clusterMock.EXPECT().WaitUntilContainerInstancesRegistered(ctx, instanceIDs(newInstances)),
+			expectTerminateInstances(t, ctx, asMock, ec2Mock, drainerMock, secondOldInstances, newInstances, secondOldReservations, newReservations, desiredCapacity, desiredCapacity+maxSurge, tags),
+
+			// No old instances remain
+			ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+				Reservations: newReservations,
+			}, nil),
+			expectRestoreState(t, ctx, asMock, desiredCapacity, maxSize, stateSavedAt, map[string]string{"ecsmec:MaxSurge": fmt.Sprint(maxSurge)}),
+		)
+
+		group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := group.ReplaceInstances(ctx, drainerMock, clusterMock, capacity.WithMaxSurge(maxSurge)); err != nil {
+			t.Errorf("err = %#v; want nil", err)
+		}
+	})
+
+	t.Run("with max surge and AZRebalance is not suspended", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+		ec2Mock := capacitymock.NewMockEC2API(ctrl)
+		drainerMock := capacitymock.NewMockDrainer(ctrl)
+		clusterMock := capacitymock.NewMockCluster(ctrl)
+
+		instances := append(createInstances("ap-northeast-1a", 1), createInstances("ap-northeast-1c", 1)...)
 		asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
 			AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
 				{
 					AutoScalingGroupName: aws.String("autoscaling-group-name"),
-					DesiredCapacity:      aws.Int32(int32(len(instancesToKeep))),
-					Instances:            instancesToKeep,
-					MaxSize:              aws.Int32(int32(len(allInstances))),
+					AvailabilityZones:    []string{"ap-northeast-1a", "ap-northeast-1c"},
+					DesiredCapacity:      aws.Int32(int32(len(instances))),
+					Instances:            instances,
+					MaxSize:              aws.Int32(int32(len(instances))),
 				},
 			},
-		}, nil),
-	)
+		}, nil)
 
-	group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
-	if err != nil {
-		t.Fatal(err)
-	}
+		group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	if err := group.ReduceCapacity(ctx, int32(len(instancesToTerminate)), drainerMock); err != nil {
-		t.Errorf("err = %#v; want nil", err)
-	}
+		// No new instances must be launched
+		if err := group.ReplaceInstances(ctx, drainerMock, clusterMock, capacity.WithMaxSurge(1)); err == nil {
+			t.Errorf("err = nil; want non-nil")
+		}
+	})
+
+	t.Run("with drifted only", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		desiredCapacity := int32(4)
+		maxSize := int32(4)
+
+		asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+		ec2Mock := capacitymock.NewMockEC2API(ctrl)
+		expectNoTerminationProtection(ec2Mock)
+		drainerMock := capacitymock.NewMockDrainer(ctrl)
+		clusterMock := capacitymock.NewMockCluster(ctrl)
+		clusterMock.EXPECT().Name()
+
+		now := time.Now().UTC()
+		stateSavedAt := now.Format(time.RFC3339)
+
+		// One uses the old launch template version and the other uses the old AMI
+		driftedInstances := append(
+			createInstances("ap-northeast-1a", 1),
+			createInstances("ap-northeast-1c", 1)...,
+		)
+		driftedInstances[0].LaunchTemplate = &autoscalingtypes.LaunchTemplateSpecification{LaunchTemplateId: aws.String("lt-0123456789"), Version: aws.String("1")}
+		driftedInstances[1].LaunchTemplate = &autoscalingtypes.LaunchTemplateSpecification{LaunchTemplateId: aws.String("lt-0123456789"), Version: aws.String("2")}
+		driftedReservations := createReservations(driftedInstances, now.Add(-24*time.Hour))
+		driftedReservations[0].Instances[0].ImageId = aws.String("ami-old")
+		driftedReservations[1].Instances[0].ImageId = aws.String("ami-old")
+
+		upToDateInstances := append(
+			createInstances("ap-northeast-1a", 1),
+			createInstances("ap-northeast-1c", 1)...,
+		)
+		for i := range upToDateInstances {
+			upToDateInstances[i].LaunchTemplate = &autoscalingtypes.LaunchTemplateSpecification{LaunchTemplateId: aws.String("lt-0123456789"), Version: aws.String("2")}
+		}
+		upToDateReservations := createReservations(upToDateInstances, now.Add(-24*time.Hour))
+		for _, r := range upToDateReservations {
+			r.Instances[0].ImageId = aws.String("ami-new")
+		}
+
+		newInstances := append(
+			createInstances("ap-northeast-1a", 1),
+			createInstances("ap-northeast-1c", 1)...,
+		)
+		instancesToKeep := append(slices.Clone(upToDateInstances), newInstances...)
+		reservationsToKeep := append(slices.Clone(upToDateReservations), createReservations(newInstances, now.Add(time.Hour))...)
+
+		gomock.InOrder(
+			asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+				AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+					{
+						AutoScalingGroupName: aws.String("autoscaling-group-name"),
+						AvailabilityZones: []string{
+							"ap-northeast-1a",
+							"ap-northeast-1c",
+						},
+						DesiredCapacity: aws.Int32(desiredCapacity),
+						Instances:       append(slices.Clone(driftedInstances), upToDateInstances...),
+						LaunchTemplate: &autoscalingtypes.LaunchTemplateSpecification{
+							LaunchTemplateId: aws.String("lt-0123456789"),
+							Version:          aws.String("$Latest"),
+						},
+						MaxSize: aws.Int32(maxSize),
+					},
+				},
+			}, nil),
+
+			ec2Mock.EXPECT().DescribeLaunchTemplateVersions(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *ec2.DescribeLaunchTemplateVersionsInput, _ ...func(*ec2.Options)) (*ec2.DescribeLaunchTemplateVersionsOutput, error) {
+				if !slices.Equal(input.Versions, []string{"$Latest"}) {
+					t.Errorf("input.Versions = %v; want %v", input.Versions, []string{"$Latest"})
+				}
+				return &ec2.DescribeLaunchTemplateVersionsOutput{
+					LaunchTemplateVersions: []ec2types.LaunchTemplateVersion{
+						{
+							LaunchTemplateData: &ec2types.ResponseLaunchTemplateData{
+								ImageId: aws.String("ami-new"),
+							},
+							LaunchTemplateId: aws.String("lt-0123456789"),
+							VersionNumber:    aws.Int64(2),
+						},
+					},
+				}, nil
+			}),
+
+			// For fetchInstances
+			ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+				Reservations: append(slices.Clone(driftedReservations), upToDateReservations...),
+			}, nil),
+
+			expectLaunchNewInstances(t, ctx, asMock, append(slices.Clone(driftedInstances), upToDateInstances...), newInstances, desiredCapacity, maxSize, stateSavedAt, map[string]string{"ecsmec:DriftedOnly": "true"}),
+			clusterMock.EXPECT().WaitUntilContainerInstancesRegistered(ctx, instanceIDs(newInstances)),
+			expectTerminateInstances(t, ctx, asMock, ec2Mock, drainerMock, driftedInstances, instancesToKeep, driftedReservations, reservationsToKeep, desiredCapacity, maxSize, nil),
+			expectRestoreState(t, ctx, asMock, desiredCapacity, maxSize, stateSavedAt, map[string]string{"ecsmec:DriftedOnly": "true"}),
+		)
+
+		group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := group.ReplaceInstances(ctx, drainerMock, clusterMock, capacity.WithDriftedOnly()); err != nil {
+			t.Errorf("err = %#v; want nil", err)
+		}
+	})
+
+	t.Run("with drifted only and all the instances are up to date", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+		ec2Mock := capacitymock.NewMockEC2API(ctrl)
+		expectNoTerminationProtection(ec2Mock)
+		drainerMock := capacitymock.NewMockDrainer(ctrl)
+		clusterMock := capacitymock.NewMockCluster(ctrl)
+
+		instances := append(
+			createInstances("ap-northeast-1a", 1),
+			createInstances("ap-northeast-1c", 1)...,
+		)
+		for i := range instances {
+			instances[i].LaunchTemplate = &autoscalingtypes.LaunchTemplateSpecification{LaunchTemplateId: aws.String("lt-0123456789"), Version: aws.String("1")}
+		}
+		reservations := createReservations(instances, time.Now().Add(-24*time.Hour))
+		for _, r := range reservations {
+			r.Instances[0].ImageId = aws.String("ami-0123456789")
+			r.Instances[0].InstanceType = ec2types.InstanceTypeM5Large
+		}
+
+		gomock.InOrder(
+			asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+				AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+					{
+						AutoScalingGroupName: aws.String("autoscaling-group-name"),
+						DesiredCapacity:      aws.Int32(int32(len(instances))),
+						Instances:            instances,
+						MaxSize:              aws.Int32(int32(len(instances))),
+						MixedInstancesPolicy: &autoscalingtypes.MixedInstancesPolicy{
+							LaunchTemplate: &autoscalingtypes.LaunchTemplate{
+								LaunchTemplateSpecification: &autoscalingtypes.LaunchTemplateSpecification{
+									LaunchTemplateName: aws.String("launch-template-name"),
+								},
+								Overrides: []autoscalingtypes.LaunchTemplateOverrides{
+									{InstanceType: aws.String("m5.large")},
+									{InstanceType: aws.String("m6i.large")},
+								},
+							},
+						},
+					},
+				},
+			}, nil),
+
+			ec2Mock.EXPECT().DescribeLaunchTemplateVersions(ctx, gomock.Any()).Return(&ec2.DescribeLaunchTemplateVersionsOutput{
+				LaunchTemplateVersions: []ec2types.LaunchTemplateVersion{
+					{
+						LaunchTemplateData: &ec2types.ResponseLaunchTemplateData{
+							ImageId: aws.String("ami-0123456789"),
+						},
+						LaunchTemplateId: aws.String("lt-0123456789"),
+						VersionNumber:    aws.Int64(1),
+					},
+				},
+			}, nil),
+
+			// For fetchInstances
+			ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+				Reservations: reservations,
+			}, nil),
+		)
+
+		group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := group.ReplaceInstances(ctx, drainerMock, clusterMock, capacity.WithDriftedOnly()); err != nil {
+			t.Errorf("err = %#v; want nil", err)
+		}
+	})
+}
+
+func TestAutoScalingGroup_ReduceCapacity(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+
+	asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+	ec2Mock := capacitymock.NewMockEC2API(ctrl)
+	expectNoTerminationProtection(ec2Mock)
+	drainerMock := capacitymock.NewMockDrainer(ctrl)
+
+	now := time.Now().UTC()
+
+	instancesToTerminate := append(
+		append(
+			createInstances("ap-northeast-1a", autoscalingconst.MaxDetachableInstances),
+			createInstances("ap-northeast-1c", autoscalingconst.MaxDetachableInstances+1)...,
+		),
+		createInstances("ap-northeast-1d", autoscalingconst.MaxDetachableInstances)...,
+	)
+	reservationsToTerminate := createReservations(instancesToTerminate, now.Add(-24*time.Hour))
+
+	instancesToKeep := append(
+		append(
+			createInstances("ap-northeast-1a", 2),
+			createInstances("ap-northeast-1c", 2)...,
+		),
+		createInstances("ap-northeast-1d", 2)...,
+	)
+	reservationsToKeep := createReservations(instancesToKeep, now)
+
+	allInstances := append(instancesToTerminate, instancesToKeep...)
+	detachedInstanceIds := make([]string, 0, len(instancesToTerminate))
+	terminatedInstanceIds := make([]string, 0, len(instancesToTerminate))
+
+	gomock.InOrder(
+		asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+				{
+					AutoScalingGroupName: aws.String("autoscaling-group-name"),
+					DesiredCapacity:      aws.Int32(int32(len(allInstances))),
+					Instances:            allInstances,
+					MaxSize:              aws.Int32(int32(len(allInstances))),
+				},
+			},
+		}, nil),
+
+		ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+			Reservations: append(reservationsToTerminate, reservationsToKeep...),
+		}, nil),
+
+		drainerMock.EXPECT().Drain(ctx, gomock.Len(len(instancesToTerminate))),
+
+		asMock.EXPECT().DetachInstances(ctx, gomock.Any()).Times(4).Do(func(_ context.Context, input *autoscaling.DetachInstancesInput, _ ...func(options *autoscaling.Options)) {
+			detachedInstanceIds = append(detachedInstanceIds, input.InstanceIds...)
+		}),
+
+		ec2Mock.EXPECT().TerminateInstances(ctx, gomock.Any()).Do(func(_ context.Context, input *ec2.TerminateInstancesInput, _ ...func(*ec2.Options)) {
+			terminatedInstanceIds = append(terminatedInstanceIds, input.InstanceIds...)
+		}),
+
+		// For InstanceTerminatedWaiter
+		ec2Mock.EXPECT().DescribeInstances(testutil.AnyContext(), gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, input *ec2.DescribeInstancesInput, _ ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+			if !testutil.MatchSlice(input.InstanceIds, terminatedInstanceIds) {
+				t.Errorf("input.InstanceIds = %v; want %v", input.InstanceIds, terminatedInstanceIds)
+			}
+
+			instances := make([]ec2types.Instance, len(terminatedInstanceIds))
+			for i, id := range terminatedInstanceIds {
+				instances[i] = ec2types.Instance{
+					InstanceId: aws.String(id),
+					State: &ec2types.InstanceState{
+						Name: "terminated",
+					},
+				}
+			}
+
+			return &ec2.DescribeInstancesOutput{
+				Reservations: []ec2types.Reservation{
+					{
+						Instances: instances,
+					},
+				},
+			}, nil
+		}),
+
+		// Call `reload` at the end of the method
+		asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+				{
+					AutoScalingGroupName: aws.String("autoscaling-group-name"),
+					DesiredCapacity:      aws.Int32(int32(len(instancesToKeep))),
+					Instances:            instancesToKeep,
+					MaxSize:              aws.Int32(int32(len(allInstances))),
+				},
+			},
+		}, nil),
+	)
+
+	group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := group.ReduceCapacity(ctx, int32(len(instancesToTerminate)), drainerMock); err != nil {
+		t.Errorf("err = %#v; want nil", err)
+	}
 
 	instanceIdsToTerminate := make([]string, len(instancesToTerminate))
 	for i, instance := range instancesToTerminate {
@@ -806,3 +1440,660 @@ func TestAutoScalingGroup_ReduceCapacity(t *testing.T) {
 	}
 
 }
+
+func TestAutoScalingGroup_ReduceCapacityWithSelectionStrategy(t *testing.T) {
+	now := time.Now().UTC()
+
+	// The first instance in each availability zone is older, runs more tasks, reserves more resources, and is a Spot
+	// instance, so every strategy except "oldest" and "prefer-spot" selects the second one
+	instances := append(createInstances("ap-northeast-1a", 2), createInstances("ap-northeast-1c", 2)...)
+	reservations := make([]ec2types.Reservation, len(instances))
+	containerInstances := make([]ecstypes.ContainerInstance, len(instances))
+	for i, instance := range instances {
+		isFirst := i%2 == 0
+		launchTime := now
+		taskCount := int32(1)
+		remainingCPU := int32(1024)
+		if isFirst {
+			launchTime = now.Add(-time.Hour)
+			taskCount = 3
+			remainingCPU = 0
+		}
+		reservations[i] = createReservation(instance, launchTime)
+		if isFirst {
+			reservations[i].Instances[0].InstanceLifecycle = ec2types.InstanceLifecycleTypeSpot
+		}
+		containerInstances[i] = ecstypes.ContainerInstance{
+			Ec2InstanceId:       instance.InstanceId,
+			RegisteredResources: []ecstypes.Resource{{Name: aws.String("CPU"), IntegerValue: 2048}},
+			RemainingResources:  []ecstypes.Resource{{Name: aws.String("CPU"), IntegerValue: remainingCPU}},
+			RunningTasksCount:   taskCount,
+		}
+	}
+	firstInstanceIDs := []string{*instances[0].InstanceId, *instances[2].InstanceId}
+	secondInstanceIDs := []string{*instances[1].InstanceId, *instances[3].InstanceId}
+
+	tests := []struct {
+		strategy            capacity.SelectionStrategy
+		terminationPolicies []string
+		want                []string
+	}{
+		{strategy: capacity.SelectionStrategyOldest, want: firstInstanceIDs},
+		{strategy: capacity.SelectionStrategyFewestTasks, want: secondInstanceIDs},
+		{strategy: capacity.SelectionStrategyLeastUtilized, want: secondInstanceIDs},
+		{strategy: capacity.SelectionStrategyPreferOnDemand, want: secondInstanceIDs},
+		{strategy: capacity.SelectionStrategyPreferSpot, want: firstInstanceIDs},
+		{strategy: capacity.SelectionStrategyRespectTerminationPolicies, terminationPolicies: []string{"NewestInstance"}, want: secondInstanceIDs},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.strategy), func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx := context.Background()
+
+			asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+			ec2Mock := capacitymock.NewMockEC2API(ctrl)
+			expectNoTerminationProtection(ec2Mock)
+			drainerMock := capacitymock.NewMockDrainer(ctrl)
+			clusterMock := capacitymock.NewMockCluster(ctrl)
+			clusterMock.EXPECT().ContainerInstances(ctx, gomock.Len(len(instances))).Return(containerInstances, nil).AnyTimes()
+
+			asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+				AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+					{
+						AutoScalingGroupName: aws.String("autoscaling-group-name"),
+						DesiredCapacity:      aws.Int32(int32(len(instances))),
+						Instances:            instances,
+						MaxSize:              aws.Int32(int32(len(instances))),
+						TerminationPolicies:  tt.terminationPolicies,
+					},
+				},
+			}, nil)
+			ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+				Reservations: reservations,
+			}, nil)
+
+			// Stop the process after the instances are selected
+			errStop := errors.New("stop")
+			drainerMock.EXPECT().Drain(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, ids []string) error {
+				if !testutil.MatchSlice(ids, tt.want) {
+					t.Errorf("ids = %v; want %v", ids, tt.want)
+				}
+				return errStop
+			})
+
+			group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = group.ReduceCapacity(ctx, 2, drainerMock, capacity.WithSelectionStrategy(tt.strategy, clusterMock))
+			if !errors.Is(err, errStop) {
+				t.Errorf("err = %#v; want %#v", err, errStop)
+			}
+		})
+	}
+}
+
+func TestAutoScalingGroup_ReduceCapacityWithOldInstancesInOneAvailabilityZone(t *testing.T) {
+	now := time.Now().UTC()
+
+	// Only the instances in ap-northeast-1a use the old AMI
+	instances := append(
+		append(
+			createInstances("ap-northeast-1a", 3),
+			createInstances("ap-northeast-1c", 2)...,
+		),
+		createInstances("ap-northeast-1d", 2)...,
+	)
+	for i := range instances {
+		instances[i].LaunchTemplate = &autoscalingtypes.LaunchTemplateSpecification{LaunchTemplateId: aws.String("lt-0123456789"), Version: aws.String("2")}
+	}
+
+	tests := []struct {
+		name          string
+		strategy      capacity.SelectionStrategy
+		oldLaunchTime time.Time
+		newLaunchTime time.Time
+	}{
+		{
+			name:          "the old instances are older",
+			strategy:      capacity.SelectionStrategyOldest,
+			oldLaunchTime: now.Add(-48 * time.Hour),
+			newLaunchTime: now.Add(-time.Hour),
+		},
+		{
+			name:          "the old instances are drifted",
+			strategy:      capacity.SelectionStrategyRespectTerminationPolicies,
+			oldLaunchTime: now.Add(-time.Hour),
+			newLaunchTime: now.Add(-48 * time.Hour),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx := context.Background()
+
+			asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+			ec2Mock := capacitymock.NewMockEC2API(ctrl)
+			expectNoTerminationProtection(ec2Mock)
+			drainerMock := capacitymock.NewMockDrainer(ctrl)
+			clusterMock := capacitymock.NewMockCluster(ctrl)
+
+			reservations := append(
+				createReservations(instances[:3], tt.oldLaunchTime),
+				createReservations(instances[3:], tt.newLaunchTime)...,
+			)
+			for i, r := range reservations {
+				r.Instances[0].ImageId = aws.String("ami-new")
+				if i < 3 {
+					r.Instances[0].ImageId = aws.String("ami-old")
+				}
+			}
+
+			asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+				AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+					{
+						AutoScalingGroupName: aws.String("autoscaling-group-name"),
+						AvailabilityZones:    []string{"ap-northeast-1a", "ap-northeast-1c", "ap-northeast-1d"},
+						DesiredCapacity:      aws.Int32(int32(len(instances))),
+						Instances:            instances,
+						LaunchTemplate: &autoscalingtypes.LaunchTemplateSpecification{
+							LaunchTemplateId: aws.String("lt-0123456789"),
+							Version:          aws.String("$Latest"),
+						},
+						MaxSize: aws.Int32(int32(len(instances))),
+					},
+				},
+			}, nil)
+			ec2Mock.EXPECT().DescribeLaunchTemplateVersions(ctx, gomock.Any()).Return(&ec2.DescribeLaunchTemplateVersionsOutput{
+				LaunchTemplateVersions: []ec2types.LaunchTemplateVersion{
+					{
+						LaunchTemplateData: &ec2types.ResponseLaunchTemplateData{
+							ImageId: aws.String("ami-new"),
+						},
+						LaunchTemplateId: aws.String("lt-0123456789"),
+						VersionNumber:    aws.Int64(2),
+					},
+				},
+			}, nil).AnyTimes()
+			ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+				Reservations: reservations,
+			}, nil)
+
+			// Two old instances are selected from ap-northeast-1a because the availability zones are still balanced
+			// after terminating them
+			errStop := errors.New("stop")
+			want := []string{*instances[0].InstanceId, *instances[1].InstanceId}
+			drainerMock.EXPECT().Drain(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, ids []string) error {
+				if !testutil.MatchSlice(ids, want) {
+					t.Errorf("ids = %v; want %v", ids, want)
+				}
+				return errStop
+			})
+
+			group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = group.ReduceCapacity(ctx, 2, drainerMock, capacity.WithSelectionStrategy(tt.strategy, clusterMock))
+			if !errors.Is(err, errStop) {
+				t.Errorf("err = %#v; want %#v", err, errStop)
+			}
+		})
+	}
+}
+
+func TestAutoScalingGroup_ReduceCapacityWithTargets(t *testing.T) {
+	now := time.Now().UTC()
+
+	// The first instance in each availability zone is older
+	instances := append(createInstances("ap-northeast-1a", 2), createInstances("ap-northeast-1c", 2)...)
+	reservations := make([]ec2types.Reservation, len(instances))
+	for i, instance := range instances {
+		launchTime := now
+		if i%2 == 0 {
+			launchTime = now.Add(-time.Hour)
+		}
+		reservations[i] = createReservation(instance, launchTime)
+	}
+
+	tests := []struct {
+		name    string
+		amount  int32
+		opts    func(capacity.Cluster) []capacity.ReduceOption
+		filter  []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "with instance IDs",
+			amount: 0,
+			opts: func(capacity.Cluster) []capacity.ReduceOption {
+				return []capacity.ReduceOption{capacity.WithTargetInstances([]string{*instances[1].InstanceId})}
+			},
+			want: []string{*instances[1].InstanceId},
+		},
+		{
+			name:   "with an availability zone and the amount",
+			amount: 1,
+			opts: func(capacity.Cluster) []capacity.ReduceOption {
+				return []capacity.ReduceOption{capacity.WithTargetAvailabilityZone("ap-northeast-1c")}
+			},
+			want: []string{*instances[2].InstanceId},
+		},
+		{
+			name:   "with a container instance filter",
+			amount: 0,
+			opts: func(cluster capacity.Cluster) []capacity.ReduceOption {
+				return []capacity.ReduceOption{capacity.WithContainerInstanceFilter("attribute:ecs.instance-type == t3.large", cluster)}
+			},
+			filter: []string{*instances[1].InstanceId, *instances[3].InstanceId},
+			want:   []string{*instances[1].InstanceId, *instances[3].InstanceId},
+		},
+		{
+			name:   "with instance IDs not belonging to the group",
+			amount: 0,
+			opts: func(capacity.Cluster) []capacity.ReduceOption {
+				return []capacity.ReduceOption{capacity.WithTargetInstances([]string{"i-unknown"})}
+			},
+			wantErr: true,
+		},
+		{
+			name:   "with the amount larger than the number of the target instances",
+			amount: 3,
+			opts: func(capacity.Cluster) []capacity.ReduceOption {
+				return []capacity.ReduceOption{capacity.WithTargetAvailabilityZone("ap-northeast-1c")}
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx := context.Background()
+
+			asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+			ec2Mock := capacitymock.NewMockEC2API(ctrl)
+			expectNoTerminationProtection(ec2Mock)
+			drainerMock := capacitymock.NewMockDrainer(ctrl)
+			clusterMock := capacitymock.NewMockCluster(ctrl)
+			if tt.filter != nil {
+				containerInstances := make([]ecstypes.ContainerInstance, len(tt.filter))
+				for i, id := range tt.filter {
+					containerInstances[i] = ecstypes.ContainerInstance{Ec2InstanceId: aws.String(id)}
+				}
+				clusterMock.EXPECT().ContainerInstancesByFilter(ctx, "attribute:ecs.instance-type == t3.large").Return(containerInstances, nil)
+			}
+
+			asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+				AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+					{
+						AutoScalingGroupName: aws.String("autoscaling-group-name"),
+						AvailabilityZones:    []string{"ap-northeast-1a", "ap-northeast-1c"},
+						DesiredCapacity:      aws.Int32(int32(len(instances))),
+						Instances:            instances,
+						MaxSize:              aws.Int32(int32(len(instances))),
+					},
+				},
+			}, nil)
+			ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+				Reservations: reservations,
+			}, nil).AnyTimes()
+
+			// Stop the process after the instances are selected
+			errStop := errors.New("stop")
+			if !tt.wantErr {
+				drainerMock.EXPECT().Drain(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, ids []string) error {
+					if !testutil.MatchSlice(ids, tt.want) {
+						t.Errorf("ids = %v; want %v", ids, tt.want)
+					}
+					return errStop
+				})
+			}
+
+			group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = group.ReduceCapacity(ctx, tt.amount, drainerMock, tt.opts(clusterMock)...)
+			if tt.wantErr && (err == nil || errors.Is(err, errStop)) {
+				t.Errorf("err = %#v; want an error before draining", err)
+			}
+			if !tt.wantErr && !errors.Is(err, errStop) {
+				t.Errorf("err = %#v; want %#v", err, errStop)
+			}
+		})
+	}
+}
+
+func TestAutoScalingGroup_RollbackReplacement(t *testing.T) {
+	t.Run("the replacement is interrupted after new instances are launched", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		desiredCapacity := int32(4)
+		maxSize := int32(4)
+
+		asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+		// For loadLaunchedInstanceIDs
+		asMock.EXPECT().DescribeScalingActivities(gomock.Any(), gomock.Any(), gomock.Any()).Return(&autoscaling.DescribeScalingActivitiesOutput{}, nil)
+		ec2Mock := capacitymock.NewMockEC2API(ctrl)
+		expectNoTerminationProtection(ec2Mock)
+		drainerMock := capacitymock.NewMockDrainer(ctrl)
+		clusterMock := capacitymock.NewMockCluster(ctrl)
+
+		now := time.Now().UTC()
+		stateSavedAt := now.Format(time.RFC3339)
+
+		oldInstances := append(
+			createInstances("ap-northeast-1a", int(desiredCapacity/2)),
+			createInstances("ap-northeast-1c", int(desiredCapacity/2))...,
+		)
+		newInstances := append(
+			createInstances("ap-northeast-1a", int(desiredCapacity/2)),
+			createInstances("ap-northeast-1c", int(desiredCapacity/2))...,
+		)
+		oldInstanceIDs := make([]string, len(oldInstances))
+		for i, instance := range oldInstances {
+			oldInstanceIDs[i] = *instance.InstanceId
+		}
+
+		tags := createTagDescriptions(desiredCapacity, maxSize, stateSavedAt)
+
+		clusterMock.EXPECT().ReactivateContainerInstances(ctx, oldInstanceIDs)
+		clusterMock.EXPECT().ContainerInstances(ctx, gomock.Len(len(newInstances))).Return(createContainerInstances(newInstances), nil)
+
+		gomock.InOrder(
+			asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+				AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+					{
+						AutoScalingGroupName: aws.String("autoscaling-group-name"),
+						DesiredCapacity:      aws.Int32(desiredCapacity * 2),
+						Instances:            append(oldInstances, newInstances...),
+						MaxSize:              aws.Int32(desiredCapacity * 2),
+						Tags:                 tags,
+					},
+				},
+			}, nil),
+
+			expectTerminateInstances(
+				t, ctx, asMock, ec2Mock, drainerMock,
+				newInstances, oldInstances,
+				createReservations(newInstances, now), createReservations(oldInstances, now.Add(-24*time.Hour)),
+				desiredCapacity, desiredCapacity*2, tags,
+			),
+			expectRestoreState(t, ctx, asMock, desiredCapacity, maxSize, stateSavedAt, nil),
+		)
+
+		group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := group.RollbackReplacement(ctx, drainerMock, clusterMock); err != nil {
+			t.Errorf("err = %#v; want nil", err)
+		}
+	})
+
+	t.Run("some new instances are not registered in the cluster", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		desiredCapacity := int32(2)
+		maxSize := int32(2)
+
+		asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+		// For loadLaunchedInstanceIDs
+		asMock.EXPECT().DescribeScalingActivities(gomock.Any(), gomock.Any(), gomock.Any()).Return(&autoscaling.DescribeScalingActivitiesOutput{}, nil)
+		ec2Mock := capacitymock.NewMockEC2API(ctrl)
+		expectNoTerminationProtection(ec2Mock)
+		drainerMock := capacitymock.NewMockDrainer(ctrl)
+		clusterMock := capacitymock.NewMockCluster(ctrl)
+
+		now := time.Now().UTC()
+		stateSavedAt := now.Format(time.RFC3339)
+
+		oldInstances := []autoscalingtypes.Instance{
+			createInstance("ap-northeast-1a"),
+			createInstance("ap-northeast-1c"),
+		}
+		registeredInstance := createInstance("ap-northeast-1a")
+		unregisteredInstance := createInstance("ap-northeast-1c")
+		newInstances := []autoscalingtypes.Instance{registeredInstance, unregisteredInstance}
+
+		tags := createTagDescriptions(desiredCapacity, maxSize, stateSavedAt)
+
+		clusterMock.EXPECT().ReactivateContainerInstances(ctx, instanceIDs(oldInstances))
+		clusterMock.EXPECT().ContainerInstances(ctx, gomock.Len(len(newInstances))).Return(createContainerInstances([]autoscalingtypes.Instance{registeredInstance}), nil)
+
+		gomock.InOrder(
+			asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+				AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+					{
+						AutoScalingGroupName: aws.String("autoscaling-group-name"),
+						DesiredCapacity:      aws.Int32(desiredCapacity * 2),
+						Instances:            append(oldInstances, newInstances...),
+						MaxSize:              aws.Int32(desiredCapacity * 2),
+						Tags:                 tags,
+					},
+				},
+			}, nil),
+
+			ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+				Reservations: append(createReservations(newInstances, now), createReservations(oldInstances, now.Add(-24*time.Hour))...),
+			}, nil),
+
+			// The unregistered instance is terminated without draining
+			drainerMock.EXPECT().Drain(ctx, []string{*registeredInstance.InstanceId}),
+
+			asMock.EXPECT().DetachInstances(ctx, gomock.Any()).Do(func(_ context.Context, input *autoscaling.DetachInstancesInput, _ ...func(*autoscaling.Options)) {
+				if want := instanceIDs(newInstances); !testutil.MatchSlice(want, input.InstanceIds) {
+					t.Errorf("input.InstanceIds = %v; want %v", input.InstanceIds, want)
+				}
+			}),
+
+			ec2Mock.EXPECT().TerminateInstances(ctx, gomock.Any()).Do(func(_ context.Context, input *ec2.TerminateInstancesInput, _ ...func(options *ec2.Options)) {
+				if want := instanceIDs(newInstances); !testutil.MatchSlice(want, input.InstanceIds) {
+					t.Errorf("input.InstanceIds = %v; want %v", input.InstanceIds, want)
+				}
+			}),
+
+			// For InstanceTerminatedWaiter
+			ec2Mock.EXPECT().DescribeInstances(testutil.AnyContext(), gomock.Any(), gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+				Reservations: []ec2types.Reservation{
+					{
+						Instances: []ec2types.Instance{
+							{InstanceId: registeredInstance.InstanceId, State: &ec2types.InstanceState{Name: "terminated"}},
+							{InstanceId: unregisteredInstance.InstanceId, State: &ec2types.InstanceState{Name: "terminated"}},
+						},
+					},
+				},
+			}, nil),
+
+			asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+				AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+					{
+						AutoScalingGroupName: aws.String("autoscaling-group-name"),
+						DesiredCapacity:      aws.Int32(desiredCapacity),
+						Instances:            oldInstances,
+						MaxSize:              aws.Int32(desiredCapacity * 2),
+						Tags:                 tags,
+					},
+				},
+			}, nil),
+
+			expectRestoreState(t, ctx, asMock, desiredCapacity, maxSize, stateSavedAt, nil),
+		)
+
+		group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := group.RollbackReplacement(ctx, drainerMock, clusterMock); err != nil {
+			t.Errorf("err = %#v; want nil", err)
+		}
+	})
+
+	t.Run("there is no replacement to roll back", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+		ec2Mock := capacitymock.NewMockEC2API(ctrl)
+		expectNoTerminationProtection(ec2Mock)
+		drainerMock := capacitymock.NewMockDrainer(ctrl)
+		clusterMock := capacitymock.NewMockCluster(ctrl)
+
+		instances := createInstances("ap-northeast-1a", 2)
+
+		asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+				{
+					AutoScalingGroupName: aws.String("autoscaling-group-name"),
+					DesiredCapacity:      aws.Int32(int32(len(instances))),
+					Instances:            instances,
+					MaxSize:              aws.Int32(int32(len(instances))),
+				},
+			},
+		}, nil)
+
+		group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := group.RollbackReplacement(ctx, drainerMock, clusterMock); err == nil {
+			t.Errorf("err = nil; want non-nil")
+		}
+	})
+}
+
+func TestAutoScalingGroup_SuspendAndResumeProcesses(t *testing.T) {
+	tests := []struct {
+		name          string
+		suspended     []string
+		tags          []autoscalingtypes.TagDescription
+		wantOriginal  []string
+		wantTagsSaved bool
+		wantResumed   []string
+	}{
+		{
+			name:          "without the interrupted operation",
+			suspended:     []string{"ScheduledActions"},
+			wantOriginal:  []string{"ScheduledActions"},
+			wantTagsSaved: true,
+			wantResumed:   []string{"AZRebalance"},
+		},
+		{
+			name:      "with the interrupted operation",
+			suspended: []string{"AZRebalance", "ScheduledActions"},
+			tags: []autoscalingtypes.TagDescription{
+				{Key: aws.String("ecsmec:OriginalSuspendedProcesses"), Value: aws.String("")},
+			},
+			wantOriginal: []string{},
+			wantResumed:  []string{"AZRebalance", "ScheduledActions"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx := context.Background()
+
+			asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+			ec2Mock := capacitymock.NewMockEC2API(ctrl)
+
+			suspended := slices.Clone(tt.suspended)
+			tags := slices.Clone(tt.tags)
+			asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, _ *autoscaling.DescribeAutoScalingGroupsInput, _ ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+				processes := make([]autoscalingtypes.SuspendedProcess, len(suspended))
+				for i, p := range suspended {
+					processes[i] = autoscalingtypes.SuspendedProcess{ProcessName: aws.String(p)}
+				}
+				return &autoscaling.DescribeAutoScalingGroupsOutput{
+					AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+						{
+							AutoScalingGroupName: aws.String("autoscaling-group-name"),
+							DesiredCapacity:      aws.Int32(1),
+							MaxSize:              aws.Int32(1),
+							SuspendedProcesses:   processes,
+							Tags:                 slices.Clone(tags),
+						},
+					},
+				}, nil
+			}).AnyTimes()
+
+			if tt.wantTagsSaved {
+				asMock.EXPECT().CreateOrUpdateTags(ctx, gomock.Any()).Do(func(_ context.Context, params *autoscaling.CreateOrUpdateTagsInput, _ ...func(*autoscaling.Options)) {
+					if *params.Tags[0].Value != strings.Join(tt.wantOriginal, ",") {
+						t.Errorf("Value = %s; want %s", *params.Tags[0].Value, strings.Join(tt.wantOriginal, ","))
+					}
+					tags = append(tags, autoscalingtypes.TagDescription{Key: params.Tags[0].Key, Value: params.Tags[0].Value})
+				})
+			}
+			asMock.EXPECT().SuspendProcesses(ctx, gomock.Any()).Do(func(_ context.Context, params *autoscaling.SuspendProcessesInput, _ ...func(*autoscaling.Options)) {
+				for _, p := range params.ScalingProcesses {
+					if !slices.Contains(suspended, p) {
+						suspended = append(suspended, p)
+					}
+				}
+			})
+			asMock.EXPECT().ResumeProcesses(ctx, gomock.Any()).Do(func(_ context.Context, params *autoscaling.ResumeProcessesInput, _ ...func(*autoscaling.Options)) {
+				if !testutil.MatchSlice(params.ScalingProcesses, tt.wantResumed) {
+					t.Errorf("ScalingProcesses = %v; want %v", params.ScalingProcesses, tt.wantResumed)
+				}
+				suspended = slices.DeleteFunc(suspended, func(p string) bool {
+					return slices.Contains(params.ScalingProcesses, p)
+				})
+			})
+			asMock.EXPECT().DeleteTags(ctx, gomock.Any()).Do(func(_ context.Context, params *autoscaling.DeleteTagsInput, _ ...func(*autoscaling.Options)) {
+				if *params.Tags[0].Key != "ecsmec:OriginalSuspendedProcesses" {
+					t.Errorf("Key = %s; want %s", *params.Tags[0].Key, "ecsmec:OriginalSuspendedProcesses")
+				}
+				tags = nil
+			})
+
+			group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := group.SuspendProcesses(ctx, []string{"AZRebalance", "ScheduledActions"}); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(group.OriginalSuspendedProcesses, tt.wantOriginal) {
+				t.Errorf("OriginalSuspendedProcesses = %v; want %v", group.OriginalSuspendedProcesses, tt.wantOriginal)
+			}
+
+			if err := group.ResumeProcesses(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if group.OriginalSuspendedProcesses != nil {
+				t.Errorf("OriginalSuspendedProcesses = %v; want nil", group.OriginalSuspendedProcesses)
+			}
+			if !testutil.MatchSlice(suspended, tt.wantOriginal) {
+				t.Errorf("suspended = %v; want %v", suspended, tt.wantOriginal)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package capacity
+
+import (
+	"context"
+	"log"
+	"maps"
+	"math"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"golang.org/x/xerrors"
+
+	"github.com/abicky/ecsmec/internal/const/ecsconst"
+)
+
+// processServiceAwareBatches calls the callback with each batch of container instances formed so that no service
+// loses more tasks at once than its deployment configuration tolerates. The batches are replanned before each batch
+// because the tasks move to the remaining instances and the services may not be fully running while draining.
+func (d *drainer) processServiceAwareBatches(ctx context.Context, instanceIDs []string, callback func([]ecstypes.ContainerInstance) error) error {
+	instances := make([]ecstypes.ContainerInstance, 0, len(instanceIDs))
+	err := d.processContainerInstances(ctx, instanceIDs, func(page []ecstypes.ContainerInstance) error {
+		instances = append(instances, page...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	reportedServiceNames := make([]string, 0)
+	for len(instances) > 0 {
+		taskCounts, serviceNames, err := d.countServiceTasks(ctx, instances)
+		if err != nil {
+			return err
+		}
+
+		tolerableCounts, err := d.fetchTolerableStoppedTaskCounts(ctx, serviceNames)
+		if err != nil {
+			return xerrors.Errorf("failed to fetch tolerable stopped task counts: %w", err)
+		}
+
+		batches, constrainingServiceNames := planBatches(instances, taskCounts, tolerableCounts, int(d.batchSize))
+		constrainingServiceNames = slices.DeleteFunc(constrainingServiceNames, func(name string) bool {
+			return slices.Contains(reportedServiceNames, name)
+		})
+		if len(constrainingServiceNames) > 0 {
+			log.Printf("The batch size is limited by the following services in the cluster %q:\n", d.cluster)
+			for _, name := range constrainingServiceNames {
+				log.Printf("\t%s (up to %d tasks at once)\n", name, tolerableCounts[name])
+			}
+			reportedServiceNames = append(reportedServiceNames, constrainingServiceNames...)
+		}
+
+		batch := batches[0]
+		if err := callback(batch); err != nil {
+			return xerrors.Errorf("failed to execute the callback: %w", err)
+		}
+
+		instances = slices.DeleteFunc(instances, func(instance ecstypes.ContainerInstance) bool {
+			return slices.ContainsFunc(batch, func(i ecstypes.ContainerInstance) bool {
+				return *i.ContainerInstanceArn == *instance.ContainerInstanceArn
+			})
+		})
+	}
+
+	return nil
+}
+
+// countServiceTasks returns the number of tasks of each service running on each instance and the names of the services.
+func (d *drainer) countServiceTasks(ctx context.Context, instances []ecstypes.ContainerInstance) ([]map[string]int, []string, error) {
+	taskCounts := make([]map[string]int, len(instances))
+	serviceNames := make([]string, 0)
+	for i, instance := range instances {
+		taskCounts[i] = make(map[string]int)
+		err := d.processTasks(ctx, instance.ContainerInstanceArn, func(t ecstypes.Task) error {
+			if serviceName, ok := getServiceName(t); ok {
+				taskCounts[i][serviceName]++
+				if !slices.Contains(serviceNames, serviceName) {
+					serviceNames = append(serviceNames, serviceName)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return taskCounts, serviceNames, nil
+}
+
+// fetchTolerableStoppedTaskCounts returns the number of tasks that each service can lose at once without going below
+// its minimum healthy percent. The count is based on the running tasks because tasks stopped by the previous batches
+// may not have been replaced yet. Daemon services are not included because their tasks are never replaced.
+func (d *drainer) fetchTolerableStoppedTaskCounts(ctx context.Context, serviceNames []string) (map[string]int, error) {
+	counts := make(map[string]int, len(serviceNames))
+	for names := range slices.Chunk(serviceNames, ecsconst.MaxDescribableServices) {
+		resp, err := d.ecsSvc.DescribeServices(ctx, &ecs.DescribeServicesInput{
+			Cluster:  aws.String(d.cluster),
+			Services: names,
+		})
+		if err != nil {
+			return nil, xerrors.Errorf("failed to describe services: %w", err)
+		}
+
+		for _, s := range resp.Services {
+			if s.SchedulingStrategy == ecstypes.SchedulingStrategyDaemon {
+				continue
+			}
+
+			minimumHealthyPercent := int32(100)
+			if s.DeploymentConfiguration != nil && s.DeploymentConfiguration.MinimumHealthyPercent != nil {
+				minimumHealthyPercent = *s.DeploymentConfiguration.MinimumHealthyPercent
+			}
+			minimumHealthyCount := int(math.Ceil(float64(s.DesiredCount) * float64(minimumHealthyPercent) / 100))
+			// Drain at least one task at a time, otherwise the instances can never be drained
+			counts[*s.ServiceName] = max(int(min(s.RunningCount, s.DesiredCount))-minimumHealthyCount, 1)
+		}
+	}
+
+	return counts, nil
+}
+
+// planBatches splits the instances into batches of up to batchSize instances so that the number of tasks of each
+// service in a batch doesn't exceed its tolerable count, and returns the names of the services that split batches.
+// An instance is put in a batch alone if its own tasks exceed the tolerable count.
+func planBatches(instances []ecstypes.ContainerInstance, taskCounts []map[string]int, tolerableCounts map[string]int, batchSize int) ([][]ecstypes.ContainerInstance, []string) {
+	batches := make([][]ecstypes.ContainerInstance, 0)
+	constrainingServiceNames := make([]string, 0)
+
+	remaining := make([]int, len(instances))
+	for i := range instances {
+		remaining[i] = i
+	}
+	for len(remaining) > 0 {
+		batch := make([]ecstypes.ContainerInstance, 0, batchSize)
+		batchTaskCounts := make(map[string]int)
+		deferred := make([]int, 0)
+		for _, i := range remaining {
+			if len(batch) >= batchSize {
+				deferred = append(deferred, i)
+				continue
+			}
+
+			exceeded := false
+			for _, name := range slices.Sorted(maps.Keys(taskCounts[i])) {
+				tolerableCount, ok := tolerableCounts[name]
+				if ok && len(batch) > 0 && batchTaskCounts[name]+taskCounts[i][name] > tolerableCount {
+					exceeded = true
+					if !slices.Contains(constrainingServiceNames, name) {
+						constrainingServiceNames = append(constrainingServiceNames, name)
+					}
+				}
+			}
+			if exceeded {
+				deferred = append(deferred, i)
+				continue
+			}
+
+			batch = append(batch, instances[i])
+			for name, count := range taskCounts[i] {
+				batchTaskCounts[name] += count
+			}
+		}
+		batches = append(batches, batch)
+		remaining = deferred
+	}
+
+	return batches, constrainingServiceNames
+}
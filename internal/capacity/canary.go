@@ -0,0 +1,107 @@
+package capacity
+
+import (
+	"context"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"golang.org/x/xerrors"
+
+	"github.com/abicky/ecsmec/internal/const/ecsconst"
+	"github.com/abicky/ecsmec/internal/serviceevent"
+)
+
+const maxSoakPollInterval = 15 * time.Second
+
+// DrainCanary drains the container instances on the specified EC2 instances like Drain, and then keeps watching
+// the services whose tasks were running on them for soakPeriod. It returns an error as soon as the running count of
+// any of the services drops below both the count at the start of the soak period and its desired count, or the
+// rollout of any of the services fails.
+func (d *drainer) DrainCanary(ctx context.Context, instanceIDs []string, soakPeriod time.Duration) error {
+	// The tasks are gone after draining, so the services must be collected beforehand
+	serviceNames := make([]string, 0)
+	err := d.processContainerInstances(ctx, instanceIDs, func(instances []ecstypes.ContainerInstance) error {
+		for _, instance := range instances {
+			err := d.processTasks(ctx, instance.ContainerInstanceArn, func(t ecstypes.Task) error {
+				if serviceName, ok := getServiceName(t); ok && !slices.Contains(serviceNames, serviceName) {
+					serviceNames = append(serviceNames, serviceName)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return xerrors.Errorf("failed to collect the services on the canary instances: %w", err)
+	}
+
+	if err := d.Drain(ctx, instanceIDs); err != nil {
+		return err
+	}
+
+	if err := d.soak(ctx, serviceNames, soakPeriod); err != nil {
+		return xerrors.Errorf("the canary failed: %w", err)
+	}
+
+	return nil
+}
+
+// soak watches the services until soakPeriod elapses.
+func (d *drainer) soak(ctx context.Context, serviceNames []string, soakPeriod time.Duration) error {
+	if len(serviceNames) == 0 {
+		log.Printf("No services were running on the canary instances in the cluster %q\n", d.cluster)
+		return nil
+	}
+
+	deadline := time.Now().Add(soakPeriod)
+	watcher := serviceevent.NewWatcher(time.Now())
+	initialRunningCounts := make(map[string]int32, len(serviceNames))
+	log.Printf("Watch the following services in the cluster %q until %s:\n", d.cluster, deadline.Format(time.RFC3339))
+	for _, name := range serviceNames {
+		log.Printf("\t%s\n", name)
+	}
+
+	for {
+		for names := range slices.Chunk(serviceNames, ecsconst.MaxDescribableServices) {
+			resp, err := d.ecsSvc.DescribeServices(ctx, &ecs.DescribeServicesInput{
+				Cluster:  aws.String(d.cluster),
+				Services: names,
+			})
+			if err != nil {
+				return xerrors.Errorf("failed to describe services: %w", err)
+			}
+			if err := watcher.Watch(resp.Services); err != nil {
+				return err
+			}
+
+			for _, s := range resp.Services {
+				initial, ok := initialRunningCounts[*s.ServiceName]
+				if !ok {
+					initialRunningCounts[*s.ServiceName] = s.RunningCount
+					continue
+				}
+				if s.RunningCount < initial && s.RunningCount < s.DesiredCount {
+					return xerrors.Errorf("the running count of the service %q dropped from %d to %d (desired: %d)", *s.ServiceName, initial, s.RunningCount, s.DesiredCount)
+				}
+			}
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil
+		}
+
+		select {
+		case <-time.After(min(maxSoakPollInterval, remaining)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
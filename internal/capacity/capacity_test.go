@@ -1,6 +1,7 @@
 package capacity_test
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -10,6 +11,11 @@ import (
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	autoscalingtypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"go.uber.org/mock/gomock"
+
+	"github.com/abicky/ecsmec/internal/testing/capacitymock"
 )
 
 func TestMain(m *testing.M) {
@@ -34,3 +40,21 @@ func createInstances(az string, size int) []autoscalingtypes.Instance {
 
 	return instances
 }
+
+func instanceIDs(instances []autoscalingtypes.Instance) []string {
+	ids := make([]string, len(instances))
+	for i, instance := range instances {
+		ids[i] = *instance.InstanceId
+	}
+	return ids
+}
+
+// expectNoTerminationProtection makes ec2Mock report that no instances are protected from termination.
+func expectNoTerminationProtection(ec2Mock *capacitymock.MockEC2API) {
+	ec2Mock.EXPECT().DescribeInstanceAttribute(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, input *ec2.DescribeInstanceAttributeInput, _ ...func(*ec2.Options)) (*ec2.DescribeInstanceAttributeOutput, error) {
+		return &ec2.DescribeInstanceAttributeOutput{
+			DisableApiTermination: &ec2types.AttributeBooleanValue{Value: aws.Bool(false)},
+			InstanceId:            input.InstanceId,
+		}, nil
+	}).AnyTimes()
+}
@@ -0,0 +1,151 @@
+package capacity
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	autoscalingtypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"golang.org/x/xerrors"
+)
+
+// DisableManagedScaling disables the managed scaling of the capacity provider backed by the auto scaling group
+// for the duration of an operation, so that the capacity provider doesn't change the desired capacity behind
+// ecsmec's back. Managed termination protection is also disabled because it requires managed scaling.
+// The name of the capacity provider and its original managed termination protection are saved in the tags
+// "ecsmec:CapacityProvider" and "ecsmec:OriginalManagedTerminationProtection" so that RestoreManagedScaling can
+// restore them even if the operation is interrupted.
+//
+// If the capacity provider uses managed termination protection, the instances to be removed are unprotected from
+// scale in before they are detached.
+//
+// If describing capacity providers is not allowed, the auto scaling group is assumed not to back any capacity
+// provider so that users who don't use capacity providers don't need the permission.
+func (asg *AutoScalingGroup) DisableManagedScaling(ctx context.Context, ecsSvc ECSAPI) error {
+	if asg.CapacityProviderName != nil {
+		// The settings have been changed by the interrupted operation
+		asg.managedTerminationProtection = asg.OriginalManagedTerminationProtection == string(ecstypes.ManagedTerminationProtectionEnabled)
+		return nil
+	}
+
+	cp, err := findCapacityProvider(ctx, ecsSvc, func(cp ecstypes.CapacityProvider) bool {
+		return aws.ToString(cp.AutoScalingGroupProvider.AutoScalingGroupArn) == aws.ToString(asg.AutoScalingGroupARN)
+	})
+	if err != nil {
+		var accessDenied *ecstypes.AccessDeniedException
+		if !errors.As(err, &accessDenied) {
+			return err
+		}
+		log.Printf("[WARNING] Assume that no capacity provider uses the auto scaling group %q because describing capacity providers is not allowed: %v\n", asg.name, err)
+		return nil
+	}
+	if cp == nil {
+		return nil
+	}
+
+	provider := cp.AutoScalingGroupProvider
+	asg.managedTerminationProtection = provider.ManagedTerminationProtection == ecstypes.ManagedTerminationProtectionEnabled
+	if provider.ManagedScaling == nil || provider.ManagedScaling.Status != ecstypes.ManagedScalingStatusEnabled {
+		return nil
+	}
+
+	_, err = asg.asSvc.CreateOrUpdateTags(ctx, &autoscaling.CreateOrUpdateTagsInput{
+		Tags: []autoscalingtypes.Tag{
+			asg.createTag("ecsmec:CapacityProvider", *cp.Name),
+			asg.createTag("ecsmec:OriginalManagedTerminationProtection", string(provider.ManagedTerminationProtection)),
+		},
+	})
+	if err != nil {
+		return xerrors.Errorf("failed to create or update tags: %w", err)
+	}
+
+	managedScaling := *provider.ManagedScaling
+	managedScaling.Status = ecstypes.ManagedScalingStatusDisabled
+	log.Printf("Disable the managed scaling of the capacity provider %q\n", *cp.Name)
+	_, err = ecsSvc.UpdateCapacityProvider(ctx, &ecs.UpdateCapacityProviderInput{
+		Name: cp.Name,
+		AutoScalingGroupProvider: &ecstypes.AutoScalingGroupProviderUpdate{
+			ManagedScaling:               &managedScaling,
+			ManagedTerminationProtection: ecstypes.ManagedTerminationProtectionDisabled,
+		},
+	})
+	if err != nil {
+		return xerrors.Errorf("failed to update the capacity provider %q: %w", *cp.Name, err)
+	}
+
+	return asg.reload(ctx)
+}
+
+// RestoreManagedScaling enables the managed scaling disabled by DisableManagedScaling and restores the original
+// managed termination protection.
+func (asg *AutoScalingGroup) RestoreManagedScaling(ctx context.Context, ecsSvc ECSAPI) error {
+	if asg.CapacityProviderName == nil {
+		return nil
+	}
+
+	name := *asg.CapacityProviderName
+	cp, err := findCapacityProvider(ctx, ecsSvc, func(cp ecstypes.CapacityProvider) bool {
+		return *cp.Name == name
+	})
+	if err != nil {
+		return err
+	}
+	if cp == nil {
+		return xerrors.Errorf("the capacity provider %q doesn't exist", name)
+	}
+
+	// Keep the other settings such as the target capacity
+	managedScaling := ecstypes.ManagedScaling{}
+	if cp.AutoScalingGroupProvider.ManagedScaling != nil {
+		managedScaling = *cp.AutoScalingGroupProvider.ManagedScaling
+	}
+	managedScaling.Status = ecstypes.ManagedScalingStatusEnabled
+	log.Printf("Enable the managed scaling of the capacity provider %q\n", name)
+	_, err = ecsSvc.UpdateCapacityProvider(ctx, &ecs.UpdateCapacityProviderInput{
+		Name: aws.String(name),
+		AutoScalingGroupProvider: &ecstypes.AutoScalingGroupProviderUpdate{
+			ManagedScaling:               &managedScaling,
+			ManagedTerminationProtection: ecstypes.ManagedTerminationProtection(asg.OriginalManagedTerminationProtection),
+		},
+	})
+	if err != nil {
+		return xerrors.Errorf("failed to update the capacity provider %q: %w", name, err)
+	}
+
+	_, err = asg.asSvc.DeleteTags(ctx, &autoscaling.DeleteTagsInput{
+		Tags: []autoscalingtypes.Tag{
+			asg.createTag("ecsmec:CapacityProvider", name),
+			asg.createTag("ecsmec:OriginalManagedTerminationProtection", asg.OriginalManagedTerminationProtection),
+		},
+	})
+	if err != nil {
+		return xerrors.Errorf("failed to delete tags: %w", err)
+	}
+
+	return asg.reload(ctx)
+}
+
+func findCapacityProvider(ctx context.Context, ecsSvc ECSAPI, match func(ecstypes.CapacityProvider) bool) (*ecstypes.CapacityProvider, error) {
+	params := &ecs.DescribeCapacityProvidersInput{}
+	for {
+		resp, err := ecsSvc.DescribeCapacityProviders(ctx, params)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to describe capacity providers: %w", err)
+		}
+
+		for _, cp := range resp.CapacityProviders {
+			if cp.AutoScalingGroupProvider != nil && match(cp) {
+				return &cp, nil
+			}
+		}
+
+		if resp.NextToken == nil {
+			return nil, nil
+		}
+		params.NextToken = resp.NextToken
+	}
+}
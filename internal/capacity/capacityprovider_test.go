@@ -0,0 +1,326 @@
+package capacity_test
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	autoscalingtypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"go.uber.org/mock/gomock"
+
+	"github.com/abicky/ecsmec/internal/capacity"
+	"github.com/abicky/ecsmec/internal/testing/capacitymock"
+	"github.com/abicky/ecsmec/internal/testing/testutil"
+)
+
+const autoScalingGroupARN = "arn:aws:autoscaling:ap-northeast-1:123456789012:autoScalingGroup:uuid:autoScalingGroupName/autoscaling-group-name"
+
+func TestAutoScalingGroup_DisableAndRestoreManagedScaling(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+
+	asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+	ec2Mock := capacitymock.NewMockEC2API(ctrl)
+	ecsMock := capacitymock.NewMockECSAPI(ctrl)
+
+	tags := make([]autoscalingtypes.TagDescription, 0)
+	asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, _ *autoscaling.DescribeAutoScalingGroupsInput, _ ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+		return &autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+				{
+					AutoScalingGroupARN:  aws.String(autoScalingGroupARN),
+					AutoScalingGroupName: aws.String("autoscaling-group-name"),
+					DesiredCapacity:      aws.Int32(1),
+					MaxSize:              aws.Int32(1),
+					Tags:                 slices.Clone(tags),
+				},
+			},
+		}, nil
+	}).AnyTimes()
+
+	provider := ecstypes.CapacityProvider{
+		Name: aws.String("provider"),
+		AutoScalingGroupProvider: &ecstypes.AutoScalingGroupProvider{
+			AutoScalingGroupArn: aws.String(autoScalingGroupARN),
+			ManagedScaling: &ecstypes.ManagedScaling{
+				Status:         ecstypes.ManagedScalingStatusEnabled,
+				TargetCapacity: aws.Int32(90),
+			},
+			ManagedTerminationProtection: ecstypes.ManagedTerminationProtectionEnabled,
+		},
+	}
+
+	gomock.InOrder(
+		ecsMock.EXPECT().DescribeCapacityProviders(ctx, gomock.Any()).Return(&ecs.DescribeCapacityProvidersOutput{
+			CapacityProviders: []ecstypes.CapacityProvider{
+				{Name: aws.String("FARGATE")},
+				{
+					Name: aws.String("another-provider"),
+					AutoScalingGroupProvider: &ecstypes.AutoScalingGroupProvider{
+						AutoScalingGroupArn: aws.String("arn:aws:autoscaling:ap-northeast-1:123456789012:autoScalingGroup:uuid:autoScalingGroupName/another"),
+					},
+				},
+			},
+			NextToken: aws.String("token"),
+		}, nil),
+		ecsMock.EXPECT().DescribeCapacityProviders(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *ecs.DescribeCapacityProvidersInput, _ ...func(*ecs.Options)) (*ecs.DescribeCapacityProvidersOutput, error) {
+			if aws.ToString(input.NextToken) != "token" {
+				t.Errorf("NextToken = %v; want %s", input.NextToken, "token")
+			}
+			return &ecs.DescribeCapacityProvidersOutput{
+				CapacityProviders: []ecstypes.CapacityProvider{provider},
+			}, nil
+		}),
+
+		asMock.EXPECT().CreateOrUpdateTags(ctx, gomock.Any()).Do(func(_ context.Context, input *autoscaling.CreateOrUpdateTagsInput, _ ...func(*autoscaling.Options)) {
+			for _, tag := range input.Tags {
+				tags = append(tags, autoscalingtypes.TagDescription{Key: tag.Key, Value: tag.Value})
+			}
+		}),
+
+		ecsMock.EXPECT().UpdateCapacityProvider(ctx, gomock.Any()).Do(func(_ context.Context, input *ecs.UpdateCapacityProviderInput, _ ...func(*ecs.Options)) {
+			update := input.AutoScalingGroupProvider
+			if update.ManagedScaling.Status != ecstypes.ManagedScalingStatusDisabled {
+				t.Errorf("ManagedScaling.Status = %s; want %s", update.ManagedScaling.Status, ecstypes.ManagedScalingStatusDisabled)
+			}
+			if aws.ToInt32(update.ManagedScaling.TargetCapacity) != 90 {
+				t.Errorf("ManagedScaling.TargetCapacity = %d; want %d", aws.ToInt32(update.ManagedScaling.TargetCapacity), 90)
+			}
+			if update.ManagedTerminationProtection != ecstypes.ManagedTerminationProtectionDisabled {
+				t.Errorf("ManagedTerminationProtection = %s; want %s", update.ManagedTerminationProtection, ecstypes.ManagedTerminationProtectionDisabled)
+			}
+			provider.AutoScalingGroupProvider.ManagedScaling = update.ManagedScaling
+			provider.AutoScalingGroupProvider.ManagedTerminationProtection = update.ManagedTerminationProtection
+		}),
+
+		ecsMock.EXPECT().DescribeCapacityProviders(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, _ *ecs.DescribeCapacityProvidersInput, _ ...func(*ecs.Options)) (*ecs.DescribeCapacityProvidersOutput, error) {
+			return &ecs.DescribeCapacityProvidersOutput{
+				CapacityProviders: []ecstypes.CapacityProvider{provider},
+			}, nil
+		}),
+
+		ecsMock.EXPECT().UpdateCapacityProvider(ctx, gomock.Any()).Do(func(_ context.Context, input *ecs.UpdateCapacityProviderInput, _ ...func(*ecs.Options)) {
+			update := input.AutoScalingGroupProvider
+			if update.ManagedScaling.Status != ecstypes.ManagedScalingStatusEnabled {
+				t.Errorf("ManagedScaling.Status = %s; want %s", update.ManagedScaling.Status, ecstypes.ManagedScalingStatusEnabled)
+			}
+			if aws.ToInt32(update.ManagedScaling.TargetCapacity) != 90 {
+				t.Errorf("ManagedScaling.TargetCapacity = %d; want %d", aws.ToInt32(update.ManagedScaling.TargetCapacity), 90)
+			}
+			if update.ManagedTerminationProtection != ecstypes.ManagedTerminationProtectionEnabled {
+				t.Errorf("ManagedTerminationProtection = %s; want %s", update.ManagedTerminationProtection, ecstypes.ManagedTerminationProtectionEnabled)
+			}
+		}),
+
+		asMock.EXPECT().DeleteTags(ctx, gomock.Any()).Do(func(_ context.Context, input *autoscaling.DeleteTagsInput, _ ...func(*autoscaling.Options)) {
+			if len(input.Tags) != 2 {
+				t.Errorf("len(input.Tags) = %d; want %d", len(input.Tags), 2)
+			}
+			tags = tags[:0]
+		}),
+	)
+
+	group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := group.DisableManagedScaling(ctx, ecsMock); err != nil {
+		t.Fatal(err)
+	}
+	if aws.ToString(group.CapacityProviderName) != "provider" {
+		t.Errorf("CapacityProviderName = %v; want %s", group.CapacityProviderName, "provider")
+	}
+	if group.OriginalManagedTerminationProtection != string(ecstypes.ManagedTerminationProtectionEnabled) {
+		t.Errorf("OriginalManagedTerminationProtection = %s; want %s", group.OriginalManagedTerminationProtection, ecstypes.ManagedTerminationProtectionEnabled)
+	}
+
+	if err := group.RestoreManagedScaling(ctx, ecsMock); err != nil {
+		t.Fatal(err)
+	}
+	if group.CapacityProviderName != nil {
+		t.Errorf("CapacityProviderName = %v; want nil", *group.CapacityProviderName)
+	}
+}
+
+func TestAutoScalingGroup_DisableManagedScalingWithError(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		wantErr bool
+	}{
+		{
+			name:    "access is denied",
+			err:     &ecstypes.AccessDeniedException{},
+			wantErr: false,
+		},
+		{
+			name:    "another error occurs",
+			err:     &ecstypes.ServerException{},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx := context.Background()
+
+			asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+			ec2Mock := capacitymock.NewMockEC2API(ctrl)
+			ecsMock := capacitymock.NewMockECSAPI(ctrl)
+
+			asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+				AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+					{
+						AutoScalingGroupARN:  aws.String(autoScalingGroupARN),
+						AutoScalingGroupName: aws.String("autoscaling-group-name"),
+						DesiredCapacity:      aws.Int32(1),
+						MaxSize:              aws.Int32(1),
+					},
+				},
+			}, nil)
+			ecsMock.EXPECT().DescribeCapacityProviders(ctx, gomock.Any()).Return(nil, tt.err)
+
+			group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = group.DisableManagedScaling(ctx, ecsMock)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %#v; want error: %t", err, tt.wantErr)
+			}
+			if group.CapacityProviderName != nil {
+				t.Errorf("CapacityProviderName = %v; want nil", *group.CapacityProviderName)
+			}
+		})
+	}
+}
+
+func TestAutoScalingGroup_ReduceCapacityWithManagedTerminationProtection(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+
+	asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+	ec2Mock := capacitymock.NewMockEC2API(ctrl)
+	expectNoTerminationProtection(ec2Mock)
+	ecsMock := capacitymock.NewMockECSAPI(ctrl)
+	drainerMock := capacitymock.NewMockDrainer(ctrl)
+
+	now := time.Now().UTC()
+	instances := createInstances("ap-northeast-1a", 2)
+	for i := range instances {
+		instances[i].ProtectedFromScaleIn = aws.Bool(true)
+	}
+	reservations := []ec2types.Reservation{
+		createReservation(instances[0], now.Add(-time.Hour)),
+		createReservation(instances[1], now),
+	}
+	instanceIDToTerminate := *instances[0].InstanceId
+
+	gomock.InOrder(
+		asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+				{
+					AutoScalingGroupARN:  aws.String(autoScalingGroupARN),
+					AutoScalingGroupName: aws.String("autoscaling-group-name"),
+					DesiredCapacity:      aws.Int32(2),
+					Instances:            instances,
+					MaxSize:              aws.Int32(2),
+				},
+			},
+		}, nil),
+
+		// Managed scaling is disabled, so only managed termination protection is detected
+		ecsMock.EXPECT().DescribeCapacityProviders(ctx, gomock.Any()).Return(&ecs.DescribeCapacityProvidersOutput{
+			CapacityProviders: []ecstypes.CapacityProvider{
+				{
+					Name: aws.String("provider"),
+					AutoScalingGroupProvider: &ecstypes.AutoScalingGroupProvider{
+						AutoScalingGroupArn: aws.String(autoScalingGroupARN),
+						ManagedScaling: &ecstypes.ManagedScaling{
+							Status: ecstypes.ManagedScalingStatusDisabled,
+						},
+						ManagedTerminationProtection: ecstypes.ManagedTerminationProtectionEnabled,
+					},
+				},
+			},
+		}, nil),
+
+		ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+			Reservations: reservations,
+		}, nil),
+
+		drainerMock.EXPECT().Drain(ctx, []string{instanceIDToTerminate}),
+
+		asMock.EXPECT().SetInstanceProtection(ctx, gomock.Any()).Do(func(_ context.Context, input *autoscaling.SetInstanceProtectionInput, _ ...func(*autoscaling.Options)) {
+			if !slices.Equal(input.InstanceIds, []string{instanceIDToTerminate}) {
+				t.Errorf("InstanceIds = %v; want %v", input.InstanceIds, []string{instanceIDToTerminate})
+			}
+			if aws.ToBool(input.ProtectedFromScaleIn) {
+				t.Errorf("ProtectedFromScaleIn = true; want false")
+			}
+		}),
+
+		asMock.EXPECT().DetachInstances(ctx, gomock.Any()),
+
+		ec2Mock.EXPECT().TerminateInstances(ctx, gomock.Any()),
+
+		// For InstanceTerminatedWaiter
+		ec2Mock.EXPECT().DescribeInstances(testutil.AnyContext(), gomock.Any(), gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+			Reservations: []ec2types.Reservation{
+				{
+					Instances: []ec2types.Instance{
+						{
+							InstanceId: aws.String(instanceIDToTerminate),
+							State:      &ec2types.InstanceState{Name: "terminated"},
+						},
+					},
+				},
+			},
+		}, nil),
+
+		// Call `reload` at the end of the method
+		asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+				{
+					AutoScalingGroupARN:  aws.String(autoScalingGroupARN),
+					AutoScalingGroupName: aws.String("autoscaling-group-name"),
+					DesiredCapacity:      aws.Int32(1),
+					Instances:            instances[1:],
+					MaxSize:              aws.Int32(2),
+				},
+			},
+		}, nil),
+	)
+
+	group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := group.DisableManagedScaling(ctx, ecsMock); err != nil {
+		t.Fatal(err)
+	}
+	if group.CapacityProviderName != nil {
+		t.Errorf("CapacityProviderName = %v; want nil", *group.CapacityProviderName)
+	}
+
+	if err := group.ReduceCapacity(ctx, 1, drainerMock); err != nil {
+		t.Errorf("err = %#v; want nil", err)
+	}
+}
@@ -1,63 +1,188 @@
 package capacity
 
 import (
+	"cmp"
 	"context"
 	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
 	"golang.org/x/xerrors"
+
+	"github.com/abicky/ecsmec/internal/const/ecsconst"
+	"github.com/abicky/ecsmec/internal/timeout"
 )
 
 type Cluster interface {
 	Name() string
-	WaitUntilContainerInstancesRegistered(context.Context, int, *time.Time) error
+	ContainerInstances(context.Context, []string) ([]ecstypes.ContainerInstance, error)
+	ContainerInstancesByFilter(context.Context, string) ([]ecstypes.ContainerInstance, error)
+	ReactivateContainerInstances(context.Context, []string) error
+	WaitUntilContainerInstancesRegistered(context.Context, []string) error
 }
 
 type cluster struct {
-	name   string
-	ecsSvc ECSAPI
+	name               string
+	ecsSvc             ECSAPI
+	minAgentVersion    string
+	requiredAttributes []ecstypes.Attribute
+}
+
+type ClusterOption func(*cluster)
+
+// WithMinimumAgentVersion makes WaitUntilContainerInstancesRegistered regard container instances whose ECS agent is
+// older than version as unhealthy.
+func WithMinimumAgentVersion(version string) ClusterOption {
+	return func(c *cluster) {
+		c.minAgentVersion = version
+	}
+}
+
+// WithRequiredAttributes makes WaitUntilContainerInstancesRegistered regard container instances without the
+// attributes as unhealthy. An attribute whose value is nil only needs to exist.
+func WithRequiredAttributes(attributes ...ecstypes.Attribute) ClusterOption {
+	return func(c *cluster) {
+		c.requiredAttributes = append(c.requiredAttributes, attributes...)
+	}
 }
 
-func NewCluster(name string, ecsSvc ECSAPI) Cluster {
-	return &cluster{
+func NewCluster(name string, ecsSvc ECSAPI, opts ...ClusterOption) Cluster {
+	c := &cluster{
 		name:   name,
 		ecsSvc: ecsSvc,
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
 }
 
 func (c *cluster) Name() string {
 	return c.name
 }
 
-func (c *cluster) WaitUntilContainerInstancesRegistered(ctx context.Context, count int, registeredAt *time.Time) error {
-	if count == 0 {
+// ContainerInstances returns the container instances running on the specified EC2 instances.
+func (c *cluster) ContainerInstances(ctx context.Context, instanceIDs []string) ([]ecstypes.ContainerInstance, error) {
+	containerInstances := make([]ecstypes.ContainerInstance, 0, len(instanceIDs))
+	for ids := range slices.Chunk(instanceIDs, ecsconst.MaxListableContainerInstances) {
+		instances, err := c.ContainerInstancesByFilter(ctx, fmt.Sprintf("ec2InstanceId in [%s]", strings.Join(ids, ",")))
+		if err != nil {
+			return nil, err
+		}
+		containerInstances = append(containerInstances, instances...)
+	}
+
+	return containerInstances, nil
+}
+
+// ContainerInstancesByFilter returns the container instances that match the filter written in the cluster query
+// language.
+func (c *cluster) ContainerInstancesByFilter(ctx context.Context, filter string) ([]ecstypes.ContainerInstance, error) {
+	containerInstances := make([]ecstypes.ContainerInstance, 0)
+	params := &ecs.ListContainerInstancesInput{
+		Cluster: aws.String(c.name),
+		Filter:  aws.String(filter),
+	}
+
+	paginator := ecs.NewListContainerInstancesPaginator(c.ecsSvc, params)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to list container instances: %w", err)
+		}
+		if len(page.ContainerInstanceArns) == 0 {
+			break
+		}
+
+		resp, err := c.ecsSvc.DescribeContainerInstances(ctx, &ecs.DescribeContainerInstancesInput{
+			Cluster:            aws.String(c.name),
+			ContainerInstances: page.ContainerInstanceArns,
+		})
+		if err != nil {
+			return nil, xerrors.Errorf("failed to describe container instances: %w", err)
+		}
+
+		containerInstances = append(containerInstances, resp.ContainerInstances...)
+	}
+
+	return containerInstances, nil
+}
+
+// ReactivateContainerInstances updates the status of the container instances to ACTIVE if they are DRAINING.
+func (c *cluster) ReactivateContainerInstances(ctx context.Context, instanceIDs []string) error {
+	containerInstances, err := c.ContainerInstances(ctx, instanceIDs)
+	if err != nil {
+		return err
+	}
+
+	arns := make([]string, 0)
+	for _, instance := range containerInstances {
+		if aws.ToString(instance.Status) == string(ecstypes.ContainerInstanceStatusDraining) {
+			arns = append(arns, *instance.ContainerInstanceArn)
+		}
+	}
+
+	for arns := range slices.Chunk(arns, ecsconst.MaxUpdatableContainerInstancesState) {
+		log.Printf("Reactivate the following container instances in the cluster %q:\n", c.name)
+		for _, arn := range arns {
+			log.Printf("\t%s\n", getContainerInstanceID(arn))
+		}
+		_, err := c.ecsSvc.UpdateContainerInstancesState(ctx, &ecs.UpdateContainerInstancesStateInput{
+			Cluster:            aws.String(c.name),
+			ContainerInstances: arns,
+			Status:             ecstypes.ContainerInstanceStatusActive,
+		})
+		if err != nil {
+			return xerrors.Errorf("failed to update the container instances' state: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// WaitUntilContainerInstancesRegistered waits until all the specified EC2 instances are registered in the cluster as
+// healthy container instances, that is, ACTIVE ones whose agent is connected and satisfies the requirements specified
+// by the options of NewCluster. Container instances running on other EC2 instances are ignored.
+func (c *cluster) WaitUntilContainerInstancesRegistered(ctx context.Context, instanceIDs []string) error {
+	if len(instanceIDs) == 0 {
 		return nil
 	}
 
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
 
-	timeout := 5 * time.Minute
-	timer := time.NewTimer(timeout)
+	maxWait := timeout.Get(ctx, timeout.PhaseInstanceLaunch)
+	timer := time.NewTimer(maxWait)
 	defer timer.Stop()
 
-	params := &ecs.ListContainerInstancesInput{
-		Cluster: aws.String(c.name),
-		Filter:  aws.String(fmt.Sprintf("registeredAt >= %s", registeredAt.UTC().Format(time.RFC3339))),
-	}
 	for {
-		foundCount := 0
-		paginator := ecs.NewListContainerInstancesPaginator(c.ecsSvc, params)
-		for paginator.HasMorePages() {
-			page, err := paginator.NextPage(ctx)
-			if err != nil {
-				return xerrors.Errorf("failed to list container instances: %w", err)
+		containerInstances, err := c.ContainerInstances(ctx, instanceIDs)
+		if err != nil {
+			return err
+		}
+
+		instances := make(map[string]ecstypes.ContainerInstance, len(containerInstances))
+		for _, ci := range containerInstances {
+			instances[aws.ToString(ci.Ec2InstanceId)] = ci
+		}
+		problems := make([]string, 0)
+		for _, id := range instanceIDs {
+			ci, ok := instances[id]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s (not registered)", id))
+				continue
+			}
+			if problem := c.checkHealth(ci); problem != "" {
+				problems = append(problems, fmt.Sprintf("%s (%s)", id, problem))
 			}
-			foundCount += len(page.ContainerInstanceArns)
 		}
-		if foundCount == count {
+		if len(problems) == 0 {
 			return nil
 		}
 
@@ -65,9 +190,63 @@ func (c *cluster) WaitUntilContainerInstancesRegistered(ctx context.Context, cou
 		case <-ticker.C:
 			continue
 		case <-timer.C:
-			return xerrors.Errorf("%d container instances expected to be registered but only %d instances were registered within %v", count, foundCount, timeout)
+			return &timeout.Error{
+				Phase:   timeout.PhaseInstanceLaunch,
+				Timeout: maxWait,
+				Err:     xerrors.Errorf("the following instances didn't join the cluster as healthy container instances: %s", strings.Join(problems, ", ")),
+			}
 		case <-ctx.Done():
-			return ctx.Err()
+			return timeout.Wrap(ctx, timeout.PhaseInstanceLaunch, ctx.Err())
+		}
+	}
+}
+
+// checkHealth returns the reason why the container instance isn't healthy, or an empty string if it is healthy.
+func (c *cluster) checkHealth(ci ecstypes.ContainerInstance) string {
+	if status := aws.ToString(ci.Status); status != string(ecstypes.ContainerInstanceStatusActive) {
+		return fmt.Sprintf("status: %s", status)
+	}
+	if !ci.AgentConnected {
+		return "agent disconnected"
+	}
+	if c.minAgentVersion != "" {
+		var version string
+		if ci.VersionInfo != nil {
+			version = aws.ToString(ci.VersionInfo.AgentVersion)
+		}
+		if compareAgentVersions(version, c.minAgentVersion) < 0 {
+			return fmt.Sprintf("agent version %q is older than %q", version, c.minAgentVersion)
+		}
+	}
+	for _, required := range c.requiredAttributes {
+		i := slices.IndexFunc(ci.Attributes, func(a ecstypes.Attribute) bool {
+			return *a.Name == *required.Name
+		})
+		if i < 0 {
+			return fmt.Sprintf("attribute %q missing", *required.Name)
+		}
+		if required.Value != nil && aws.ToString(ci.Attributes[i].Value) != *required.Value {
+			return fmt.Sprintf("attribute %q is %q instead of %q", *required.Name, aws.ToString(ci.Attributes[i].Value), *required.Value)
+		}
+	}
+	return ""
+}
+
+// compareAgentVersions compares versions like "1.80.0" numerically, treating missing or non-numeric parts as 0.
+func compareAgentVersions(a, b string) int {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+	for i := range max(len(aParts), len(bParts)) {
+		var x, y int
+		if i < len(aParts) {
+			x, _ = strconv.Atoi(aParts[i])
+		}
+		if i < len(bParts) {
+			y, _ = strconv.Atoi(bParts[i])
+		}
+		if x != y {
+			return cmp.Compare(x, y)
 		}
 	}
+	return 0
 }
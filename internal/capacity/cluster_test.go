@@ -2,16 +2,200 @@ package capacity
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/abicky/ecsmec/internal/testing/capacitymock"
+	"github.com/abicky/ecsmec/internal/timeout"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
 	"go.uber.org/mock/gomock"
 )
 
 func TestCluster_WaitUntilContainerInstancesRegistered(t *testing.T) {
+	newContainerInstance := func(instanceID string) ecstypes.ContainerInstance {
+		return ecstypes.ContainerInstance{
+			AgentConnected:       true,
+			Attributes:           []ecstypes.Attribute{{Name: aws.String("ecs.capability.foo")}},
+			ContainerInstanceArn: aws.String("arn:aws:ecs:ap-northeast-1:1234:container-instance/test/" + instanceID),
+			Ec2InstanceId:        aws.String(instanceID),
+			Status:               aws.String("ACTIVE"),
+			VersionInfo:          &ecstypes.VersionInfo{AgentVersion: aws.String("1.80.0")},
+		}
+	}
+
+	expectContainerInstances := func(ctx context.Context, ecsMock *capacitymock.MockECSAPI, containerInstances ...ecstypes.ContainerInstance) {
+		arns := make([]string, len(containerInstances))
+		for i, ci := range containerInstances {
+			arns[i] = *ci.ContainerInstanceArn
+		}
+		ecsMock.EXPECT().ListContainerInstances(ctx, gomock.Any(), gomock.Any()).Return(&ecs.ListContainerInstancesOutput{
+			ContainerInstanceArns: arns,
+		}, nil)
+		if len(containerInstances) > 0 {
+			ecsMock.EXPECT().DescribeContainerInstances(ctx, gomock.Any()).Return(&ecs.DescribeContainerInstancesOutput{
+				ContainerInstances: containerInstances,
+			}, nil)
+		}
+	}
+
+	t.Run("when the instances are registered", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		ecsMock := capacitymock.NewMockECSAPI(ctrl)
+
+		ecsMock.EXPECT().ListContainerInstances(ctx, gomock.Any(), gomock.Any()).
+			DoAndReturn(func(_ context.Context, params *ecs.ListContainerInstancesInput, _ ...func(options *ecs.Options)) (*ecs.ListContainerInstancesOutput, error) {
+				if *params.Filter != "ec2InstanceId in [i-1,i-2]" {
+					t.Errorf("Filter = %s; want %s", *params.Filter, "ec2InstanceId in [i-1,i-2]")
+				}
+				return &ecs.ListContainerInstancesOutput{
+					ContainerInstanceArns: []string{
+						"arn:aws:ecs:ap-northeast-1:1234:container-instance/test/i-1",
+						"arn:aws:ecs:ap-northeast-1:1234:container-instance/test/i-2",
+					},
+				}, nil
+			})
+		// The container instance of another instance doesn't matter
+		ecsMock.EXPECT().DescribeContainerInstances(ctx, gomock.Any()).Return(&ecs.DescribeContainerInstancesOutput{
+			ContainerInstances: []ecstypes.ContainerInstance{
+				newContainerInstance("i-1"),
+				newContainerInstance("i-2"),
+				newContainerInstance("i-3"),
+			},
+		}, nil)
+
+		cluster := NewCluster("cluster", ecsMock, WithMinimumAgentVersion("1.9.0"), WithRequiredAttributes(ecstypes.Attribute{Name: aws.String("ecs.capability.foo")}))
+		if err := cluster.WaitUntilContainerInstancesRegistered(ctx, []string{"i-1", "i-2"}); err != nil {
+			t.Errorf("err = %#v; want nil", err)
+		}
+	})
+
+	t.Run("when the instances aren't registered within the timeout", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := timeout.WithTimeouts(context.Background(), map[timeout.Phase]time.Duration{
+			timeout.PhaseInstanceLaunch: 10 * time.Millisecond,
+		})
+
+		ecsMock := capacitymock.NewMockECSAPI(ctrl)
+
+		expectContainerInstances(ctx, ecsMock, newContainerInstance("i-1"))
+
+		cluster := NewCluster("cluster", ecsMock)
+		err := cluster.WaitUntilContainerInstancesRegistered(ctx, []string{"i-1", "i-2"})
+		var terr *timeout.Error
+		if !errors.As(err, &terr) || terr.Phase != timeout.PhaseInstanceLaunch || terr.Timeout != 10*time.Millisecond {
+			t.Errorf("err = %#v; want a timeout error of the phase %q", err, timeout.PhaseInstanceLaunch)
+		}
+		if err != nil && (!strings.Contains(err.Error(), "i-2 (not registered)") || strings.Contains(err.Error(), "i-1")) {
+			t.Errorf("err = %q; want an error including only i-2", err)
+		}
+	})
+
+	t.Run("when the container instances are unhealthy", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			modify  func(*ecstypes.ContainerInstance)
+			problem string
+		}{
+			{
+				name:    "the agent is disconnected",
+				modify:  func(ci *ecstypes.ContainerInstance) { ci.AgentConnected = false },
+				problem: "agent disconnected",
+			},
+			{
+				name:    "the status is not ACTIVE",
+				modify:  func(ci *ecstypes.ContainerInstance) { ci.Status = aws.String("DRAINING") },
+				problem: "status: DRAINING",
+			},
+			{
+				name:    "the agent is old",
+				modify:  func(ci *ecstypes.ContainerInstance) { ci.VersionInfo.AgentVersion = aws.String("1.79.9") },
+				problem: `agent version "1.79.9" is older than "1.80.0"`,
+			},
+			{
+				name:    "the required attribute is missing",
+				modify:  func(ci *ecstypes.ContainerInstance) { ci.Attributes = nil },
+				problem: `attribute "ecs.capability.foo" missing`,
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				ctx := timeout.WithTimeouts(context.Background(), map[timeout.Phase]time.Duration{
+					timeout.PhaseInstanceLaunch: 10 * time.Millisecond,
+				})
+
+				ecsMock := capacitymock.NewMockECSAPI(ctrl)
+
+				ci := newContainerInstance("i-1")
+				tt.modify(&ci)
+				expectContainerInstances(ctx, ecsMock, ci)
+
+				cluster := NewCluster("cluster", ecsMock, WithMinimumAgentVersion("1.80.0"), WithRequiredAttributes(ecstypes.Attribute{Name: aws.String("ecs.capability.foo")}))
+				err := cluster.WaitUntilContainerInstancesRegistered(ctx, []string{"i-1"})
+				if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("i-1 (%s)", tt.problem)) {
+					t.Errorf("err = %v; want an error including %q", err, tt.problem)
+				}
+			})
+		}
+	})
+
+	t.Run("when the deadline is exceeded", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		ecsMock := capacitymock.NewMockECSAPI(ctrl)
+
+		expectContainerInstances(ctx, ecsMock)
+
+		cluster := NewCluster("cluster", ecsMock)
+		err := cluster.WaitUntilContainerInstancesRegistered(ctx, []string{"i-1"})
+		var terr *timeout.Error
+		if !errors.As(err, &terr) || terr.Phase != timeout.PhaseInstanceLaunch || terr.Timeout != 0 {
+			t.Errorf("err = %#v; want a deadline error of the phase %q", err, timeout.PhaseInstanceLaunch)
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("err = %#v; want an error wrapping context.DeadlineExceeded", err)
+		}
+	})
+}
+
+func TestCompareAgentVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.80.0", "1.80.0", 0},
+		{"1.80.0", "1.9.0", 1},
+		{"1.9.0", "1.80.0", -1},
+		{"1.80", "1.80.0", 0},
+		{"", "1.0.0", -1},
+	}
+	for _, tt := range tests {
+		if got := compareAgentVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareAgentVersions(%q, %q) = %d; want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestCluster_ReactivateContainerInstances(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
@@ -19,18 +203,39 @@ func TestCluster_WaitUntilContainerInstancesRegistered(t *testing.T) {
 
 	ecsMock := capacitymock.NewMockECSAPI(ctrl)
 
-	ecsMock.EXPECT().ListContainerInstances(ctx, gomock.Any(), gomock.Any()).
-		DoAndReturn(func(_ context.Context, params *ecs.ListContainerInstancesInput, _ ...func(options *ecs.Options)) (*ecs.ListContainerInstancesOutput, error) {
-			return &ecs.ListContainerInstancesOutput{
-				ContainerInstanceArns: []string{
-					fmt.Sprintf("arn:aws:ecs:ap-northeast-1:1234:container-instance/test/xxxxxxxxxx"),
-				},
-			}, nil
-		})
+	activeArn := "arn:aws:ecs:ap-northeast-1:1234:container-instance/test/active"
+	drainingArn := "arn:aws:ecs:ap-northeast-1:1234:container-instance/test/draining"
+
+	gomock.InOrder(
+		ecsMock.EXPECT().ListContainerInstances(ctx, gomock.Any(), gomock.Any()).
+			DoAndReturn(func(_ context.Context, params *ecs.ListContainerInstancesInput, _ ...func(options *ecs.Options)) (*ecs.ListContainerInstancesOutput, error) {
+				if *params.Filter != "ec2InstanceId in [i-active,i-draining]" {
+					t.Errorf("Filter = %s; want %s", *params.Filter, "ec2InstanceId in [i-active,i-draining]")
+				}
+				return &ecs.ListContainerInstancesOutput{
+					ContainerInstanceArns: []string{activeArn, drainingArn},
+				}, nil
+			}),
+
+		ecsMock.EXPECT().DescribeContainerInstances(ctx, gomock.Any()).Return(&ecs.DescribeContainerInstancesOutput{
+			ContainerInstances: []ecstypes.ContainerInstance{
+				{ContainerInstanceArn: aws.String(activeArn), Status: aws.String("ACTIVE")},
+				{ContainerInstanceArn: aws.String(drainingArn), Status: aws.String("DRAINING")},
+			},
+		}, nil),
+
+		ecsMock.EXPECT().UpdateContainerInstancesState(ctx, gomock.Any()).Do(func(_ context.Context, params *ecs.UpdateContainerInstancesStateInput, _ ...func(options *ecs.Options)) {
+			if !reflect.DeepEqual(params.ContainerInstances, []string{drainingArn}) {
+				t.Errorf("ContainerInstances = %v; want %v", params.ContainerInstances, []string{drainingArn})
+			}
+			if params.Status != ecstypes.ContainerInstanceStatusActive {
+				t.Errorf("Status = %s; want %s", params.Status, ecstypes.ContainerInstanceStatusActive)
+			}
+		}),
+	)
 
 	cluster := NewCluster("cluster", ecsMock)
-	now := time.Now()
-	if err := cluster.WaitUntilContainerInstancesRegistered(ctx, 1, &now); err != nil {
+	if err := cluster.ReactivateContainerInstances(ctx, []string{"i-active", "i-draining"}); err != nil {
 		t.Errorf("err = %#v; want nil", err)
 	}
 }
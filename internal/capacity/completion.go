@@ -0,0 +1,100 @@
+package capacity
+
+import (
+	"context"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"golang.org/x/xerrors"
+
+	"github.com/abicky/ecsmec/internal/const/ecsconst"
+)
+
+const maxStandaloneTaskPollInterval = 15 * time.Second
+
+// isCompletionWaitTarget returns true if the drainer should wait for the standalone task to finish on its own.
+func (d *drainer) isCompletionWaitTarget(t ecstypes.Task) bool {
+	if len(d.completionGroups) == 0 && len(d.completionTags) == 0 {
+		return true
+	}
+	if slices.Contains(d.completionGroups, aws.ToString(t.Group)) {
+		return true
+	}
+	for _, tag := range t.Tags {
+		if v, ok := d.completionTags[aws.ToString(tag.Key)]; ok && v == aws.ToString(tag.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForStandaloneTasks waits until the tasks stop on their own, up to the deadline,
+// and returns the tasks that are still running at the deadline.
+func (d *drainer) waitForStandaloneTasks(ctx context.Context, tasks []ecstypes.Task, deadline time.Time) ([]ecstypes.Task, error) {
+	for {
+		runningTasks, err := d.fetchRunningTasks(ctx, tasks)
+		if err != nil {
+			return nil, err
+		}
+		if len(runningTasks) == 0 {
+			return nil, nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			log.Printf("%d tasks in the cluster %q are still running at the deadline\n", len(runningTasks), d.cluster)
+			return runningTasks, nil
+		}
+
+		log.Printf("Wait for the following tasks in the cluster %q to stop on their own until %s:\n", d.cluster, deadline.Format(time.RFC3339))
+		for _, t := range runningTasks {
+			log.Printf("\t%s (%s)\n", *t.TaskArn, aws.ToString(t.Group))
+		}
+
+		select {
+		case <-time.After(min(maxStandaloneTaskPollInterval, remaining)):
+			tasks = runningTasks
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// fetchRunningTasks returns the tasks that haven't stopped yet.
+// The returned tasks are the given ones so that they keep the information required to relaunch them.
+func (d *drainer) fetchRunningTasks(ctx context.Context, tasks []ecstypes.Task) ([]ecstypes.Task, error) {
+	runningTasks := make([]ecstypes.Task, 0)
+	for chunk := range slices.Chunk(tasks, ecsconst.MaxDescribableTasks) {
+		arns := make([]string, len(chunk))
+		for i, t := range chunk {
+			arns[i] = *t.TaskArn
+		}
+
+		resp, err := d.ecsSvc.DescribeTasks(ctx, &ecs.DescribeTasksInput{
+			Cluster: aws.String(d.cluster),
+			Tasks:   arns,
+		})
+		if err != nil {
+			return nil, xerrors.Errorf("failed to describe tasks: %w", err)
+		}
+
+		// Tasks that are missing from the response have already stopped and been deleted
+		runningArns := make([]string, 0, len(resp.Tasks))
+		for _, t := range resp.Tasks {
+			if aws.ToString(t.LastStatus) != string(ecstypes.DesiredStatusStopped) {
+				runningArns = append(runningArns, *t.TaskArn)
+			}
+		}
+		for _, t := range chunk {
+			if slices.Contains(runningArns, *t.TaskArn) {
+				runningTasks = append(runningTasks, t)
+			}
+		}
+	}
+
+	return runningTasks, nil
+}
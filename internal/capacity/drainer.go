@@ -3,8 +3,11 @@ package capacity
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"slices"
 	"strings"
 	"time"
@@ -16,17 +19,107 @@ import (
 	"golang.org/x/xerrors"
 
 	"github.com/abicky/ecsmec/internal/const/ecsconst"
+	"github.com/abicky/ecsmec/internal/serviceevent"
+	"github.com/abicky/ecsmec/internal/timeout"
 )
 
 type Drainer interface {
 	Drain(context.Context, []string) error
+	DrainCanary(context.Context, []string, time.Duration) error
 	ProcessInterruptions(context.Context, []sqstypes.Message) ([]sqstypes.DeleteMessageBatchRequestEntry, error)
 }
 
 type drainer struct {
-	cluster   string
-	batchSize int32
-	ecsSvc    ECSAPI
+	cluster      string
+	batchSize    int32
+	ecsSvc       ECSAPI
+	approver     Approver
+	serviceAware bool
+	preflight    bool
+	force        bool
+
+	taskProtectionTimeout time.Duration
+
+	relaunch bool
+	ec2Svc   EC2API
+
+	completionTimeout time.Duration
+	completionGroups  []string
+	completionTags    map[string]string
+
+	progressOut io.Writer
+	// logLines is non-nil if the progress report is redrawn interactively
+	logLines LineCounter
+}
+
+type DrainerOption func(*drainer)
+
+// WithApprover sets the Approver that approves each batch of container instances before they are drained.
+// By default, the drainer asks for approval on the terminal.
+func WithApprover(approver Approver) DrainerOption {
+	return func(d *drainer) {
+		d.approver = approver
+	}
+}
+
+// WithServiceAwareBatching makes the drainer form batches of container instances so that no service loses more tasks
+// at once than its minimum healthy percent tolerates.
+func WithServiceAwareBatching() DrainerOption {
+	return func(d *drainer) {
+		d.serviceAware = true
+	}
+}
+
+// WithPreflightCheck makes the drainer check whether the tasks of the services running on each batch of container
+// instances fit on the remaining ACTIVE container instances before draining the batch.
+// If the tasks don't fit, Drain returns an error wrapping ErrInsufficientCapacity, or only prints a warning if force
+// is true.
+func WithPreflightCheck(force bool) DrainerOption {
+	return func(d *drainer) {
+		d.preflight = true
+		d.force = force
+	}
+}
+
+// WithTaskProtectionTimeout makes the drainer wait until the scale-in protection of the tasks on each batch of
+// container instances expires or is cleared before stopping them, up to timeout.
+// If timeout is 0, the drainer doesn't check the protection.
+func WithTaskProtectionTimeout(timeout time.Duration) DrainerOption {
+	return func(d *drainer) {
+		d.taskProtectionTimeout = timeout
+	}
+}
+
+// WithStandaloneTaskRelaunch makes the drainer run the same tasks on other container instances after stopping the
+// tasks that don't belong to a service. ec2Svc is used to get the security groups of tasks using the awsvpc network mode.
+func WithStandaloneTaskRelaunch(ec2Svc EC2API) DrainerOption {
+	return func(d *drainer) {
+		d.relaunch = true
+		d.ec2Svc = ec2Svc
+	}
+}
+
+// WithStandaloneTaskCompletionWait makes the drainer let the tasks that don't belong to a service finish on their own
+// instead of stopping them immediately. The tasks still running when timeout has elapsed since Drain started are stopped.
+// If groups or tags are specified, only the tasks whose task group is one of groups or that have any of tags are waited
+// for, and the other tasks are stopped immediately.
+func WithStandaloneTaskCompletionWait(timeout time.Duration, groups []string, tags map[string]string) DrainerOption {
+	return func(d *drainer) {
+		d.completionTimeout = timeout
+		d.completionGroups = groups
+		d.completionTags = tags
+	}
+}
+
+// WithProgressReport makes the drainer report the progress of each service periodically while waiting for the tasks
+// on the draining container instances to stop and the services to become stable.
+// If logLines is not nil, the report is redrawn on out unless lines have been logged since the previous report,
+// otherwise it is logged.
+func WithProgressReport(out io.Writer, logLines LineCounter) DrainerOption {
+	return func(d *drainer) {
+		d.progressOut = out
+		d.logLines = logLines
+	}
 }
 
 // cf. https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/spot-interruptions.html
@@ -38,33 +131,67 @@ type interruptionWarningDetail struct {
 	InstanceID string `json:"instance-id"`
 }
 
-func NewDrainer(cluster string, batchSize int32, ecsSvc ECSAPI) (Drainer, error) {
+func NewDrainer(cluster string, batchSize int32, ecsSvc ECSAPI, opts ...DrainerOption) (Drainer, error) {
 	if batchSize > ecsconst.MaxListableContainerInstances {
 		return nil, xerrors.Errorf("batchSize greater than %d is not supported", ecsconst.MaxListableContainerInstances)
 	}
-	return &drainer{
+	d := &drainer{
 		cluster:   cluster,
 		batchSize: batchSize,
 		ecsSvc:    ecsSvc,
-	}, nil
+		approver:  NewTTYApprover(os.Stdin, os.Stdout),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d, nil
 }
 
 func (d *drainer) Drain(ctx context.Context, instanceIDs []string) error {
+	// The deadline is shared by all the batches so that the whole run doesn't take too long,
+	// but the time waiting for approval doesn't count
+	var completionDeadline time.Time
 	processedCount := 0
-	err := d.processContainerInstances(ctx, instanceIDs, func(instances []ecstypes.ContainerInstance) error {
+	drainBatch := func(instances []ecstypes.ContainerInstance) error {
 		processedCount += len(instances)
 
+		if d.preflight {
+			if err := d.checkCapacity(ctx, instances); err != nil {
+				if !d.force || !errors.Is(err, ErrInsufficientCapacity) {
+					return xerrors.Errorf("failed to pass the preflight check: %w", err)
+				}
+				log.Printf("[WARNING] %v\n", err)
+			}
+		}
+
 		arns := make([]*string, len(instances))
-		fmt.Printf("Drain the following %d container instances in the cluster \"%s\":\n", len(instances), d.cluster)
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "Drain the following %d container instances in the cluster \"%s\":\n", len(instances), d.cluster)
 		for i, instance := range instances {
 			arns[i] = instance.ContainerInstanceArn
-			fmt.Printf("\t%s (%s)\n", getContainerInstanceID(*instance.ContainerInstanceArn), *instance.Ec2InstanceId)
+			fmt.Fprintf(&sb, "\t%s (%s)\n", getContainerInstanceID(*instance.ContainerInstanceArn), *instance.Ec2InstanceId)
 		}
-		fmt.Printf("\nPress ENTER to continue ")
-		fmt.Scanln()
+		fmt.Print(sb.String())
 
-		return d.drainContainerInstances(ctx, arns, true)
-	})
+		approvalStartedAt := time.Now()
+		if err := d.approver.Approve(ctx, sb.String()); err != nil {
+			return xerrors.Errorf("failed to get approval: %w", err)
+		}
+		if completionDeadline.IsZero() {
+			completionDeadline = time.Now().Add(d.completionTimeout)
+		} else {
+			completionDeadline = completionDeadline.Add(time.Since(approvalStartedAt))
+		}
+
+		return d.drainContainerInstances(ctx, arns, true, completionDeadline)
+	}
+
+	var err error
+	if d.serviceAware {
+		err = d.processServiceAwareBatches(ctx, instanceIDs, drainBatch)
+	} else {
+		err = d.processContainerInstances(ctx, instanceIDs, drainBatch)
+	}
 	if err != nil {
 		return xerrors.Errorf("failed to drain container instances: %w", err)
 	}
@@ -103,7 +230,7 @@ func (d *drainer) ProcessInterruptions(ctx context.Context, messages []sqstypes.
 			log.Printf("\t%s (%s)\n", getContainerInstanceID(*instance.ContainerInstanceArn), *instance.Ec2InstanceId)
 		}
 
-		if err := d.drainContainerInstances(ctx, arns, false); err != nil {
+		if err := d.drainContainerInstances(ctx, arns, false, time.Time{}); err != nil {
 			return xerrors.Errorf("failed to drain container instances: %w", err)
 		}
 
@@ -123,58 +250,29 @@ func (d *drainer) ProcessInterruptions(ctx context.Context, messages []sqstypes.
 	return entries, nil
 }
 
-func (d *drainer) drainContainerInstances(ctx context.Context, arns []*string, wait bool) error {
+func (d *drainer) drainContainerInstances(ctx context.Context, arns []*string, wait bool, completionDeadline time.Time) error {
+	// Events before draining are irrelevant
+	watcher := serviceevent.NewWatcher(time.Now())
+	allTasks := make([]ecstypes.Task, 0)
 	allTaskArns := make([]string, 0)
 	allServiceNames := make([]string, 0)
+	standaloneTasks := make([]ecstypes.Task, 0)
 	for _, arn := range arns {
-		params := &ecs.ListTasksInput{
-			Cluster:           aws.String(d.cluster),
-			ContainerInstance: arn,
-		}
-
-		paginator := ecs.NewListTasksPaginator(d.ecsSvc, params)
-		for paginator.HasMorePages() {
-			page, err := paginator.NextPage(ctx)
-			if err != nil {
-				return xerrors.Errorf("failed to list tasks: %w", err)
-			}
-			if len(page.TaskArns) == 0 {
-				break
-			}
-
-			resp, err := d.ecsSvc.DescribeTasks(ctx, &ecs.DescribeTasksInput{
-				Cluster: aws.String(d.cluster),
-				Tasks:   page.TaskArns,
-			})
-			if err != nil {
-				return xerrors.Errorf("failed to describe tasks: %w", err)
-			}
-
-			for _, t := range resp.Tasks {
-				// The task group name of a task starting with "service:" means the task belongs to a service,
-				// because other tasks can't have such a task group name due to the error "Invalid namespace for group".
-				if strings.HasPrefix(*t.Group, "service:") {
-					// Remove "service:" prefix
-					serviceName := (*t.Group)[8:]
-					if !slices.Contains(allServiceNames, serviceName) {
-						allServiceNames = append(allServiceNames, serviceName)
-					}
-				} else {
-					// Stop tasks manually because tasks that don't belong to a service won't stop
-					// even after their cluster instance's status becomes "DRAINING"
-					log.Printf("Stop the task \"%s\"\n", *t.TaskArn)
-					_, err := d.ecsSvc.StopTask(ctx, &ecs.StopTaskInput{
-						Cluster: t.ClusterArn,
-						Reason:  aws.String("Task stopped by ecsmec"),
-						Task:    t.TaskArn,
-					})
-					if err != nil {
-						return xerrors.Errorf("failed to stop the task: %w", err)
-					}
+		err := d.processTasks(ctx, arn, func(t ecstypes.Task) error {
+			if serviceName, ok := getServiceName(t); ok {
+				if !slices.Contains(allServiceNames, serviceName) {
+					allServiceNames = append(allServiceNames, serviceName)
 				}
+			} else {
+				standaloneTasks = append(standaloneTasks, t)
 			}
 
-			allTaskArns = append(allTaskArns, page.TaskArns...)
+			allTasks = append(allTasks, t)
+			allTaskArns = append(allTaskArns, *t.TaskArn)
+			return nil
+		})
+		if err != nil {
+			return err
 		}
 	}
 
@@ -189,11 +287,42 @@ func (d *drainer) drainContainerInstances(ctx context.Context, arns []*string, w
 		}
 	}
 
+	// Interrupted instances can't wait for the protection to expire
+	if wait && d.taskProtectionTimeout > 0 {
+		if err := d.waitUntilTasksUnprotected(ctx, allTaskArns); err != nil {
+			return xerrors.Errorf("failed to wait for the task protection to expire: %w", err)
+		}
+	}
+
+	tasksToWaitFor := make([]ecstypes.Task, 0)
+	for _, t := range standaloneTasks {
+		if wait && d.completionTimeout > 0 && d.isCompletionWaitTarget(t) {
+			tasksToWaitFor = append(tasksToWaitFor, t)
+			continue
+		}
+		if err := d.stopTask(ctx, t); err != nil {
+			return err
+		}
+	}
+
+	if len(tasksToWaitFor) > 0 {
+		runningTasks, err := d.waitForStandaloneTasks(ctx, tasksToWaitFor, completionDeadline)
+		if err != nil {
+			return xerrors.Errorf("failed to wait for the standalone tasks to stop: %w", err)
+		}
+		for _, t := range runningTasks {
+			if err := d.stopTask(ctx, t); err != nil {
+				return err
+			}
+		}
+	}
+
 	if !wait {
 		return nil
 	}
 
 	log.Printf("Wait for all the tasks in the cluster \"%s\" to stop\n", d.cluster)
+	stopProgressReport := d.startProgressReportIfEnabled(ctx, allTasks, allServiceNames)
 	tasksStoppedWaiter := ecs.NewTasksStoppedWaiter(d.ecsSvc, func(o *ecs.TasksStoppedWaiterOptions) {
 		o.MaxDelay = 6 * time.Second
 	})
@@ -201,24 +330,64 @@ func (d *drainer) drainContainerInstances(ctx context.Context, arns []*string, w
 		err := tasksStoppedWaiter.Wait(ctx, &ecs.DescribeTasksInput{
 			Cluster: aws.String(d.cluster),
 			Tasks:   arns,
-		}, 10*time.Minute)
+		}, timeout.Get(ctx, timeout.PhaseTaskStop))
 		if err != nil {
-			return xerrors.Errorf("failed to wait for tasks to stop: %w", err)
+			stopProgressReport()
+			return xerrors.Errorf("failed to wait for tasks to stop: %w", timeout.Wrap(ctx, timeout.PhaseTaskStop, err))
 		}
 	}
+	stopProgressReport()
 
 	log.Printf("Wait for all the services in the cluster \"%s\" to become stable\n", d.cluster)
+	stopProgressReport = d.startProgressReportIfEnabled(ctx, allTasks, allServiceNames)
+	defer stopProgressReport()
 	servicesStableWaiter := ecs.NewServicesStableWaiter(d.ecsSvc, func(o *ecs.ServicesStableWaiterOptions) {
 		o.MaxDelay = 15 * time.Second
+		o.Retryable = watcher.Retryable(o.Retryable)
 	})
 	for names := range slices.Chunk(allServiceNames, ecsconst.MaxDescribableServices) {
 		err := servicesStableWaiter.Wait(ctx, &ecs.DescribeServicesInput{
 			Cluster:  aws.String(d.cluster),
 			Services: names,
-		}, 10*time.Minute)
+		}, timeout.Get(ctx, timeout.PhaseServiceStabilization))
+		if err != nil {
+			return xerrors.Errorf("failed to wait for the services to become stable: %w", timeout.Wrap(ctx, timeout.PhaseServiceStabilization, err))
+		}
+	}
+
+	return nil
+}
+
+// stopTask stops the task, and relaunches it if the drainer is configured to do so.
+func (d *drainer) stopTask(ctx context.Context, t ecstypes.Task) error {
+	var runTaskParams *ecs.RunTaskInput
+	if d.relaunch {
+		var err error
+		runTaskParams, err = d.newRunTaskInput(ctx, t)
+		if err != nil {
+			return xerrors.Errorf("failed to prepare for relaunching the task %q: %w", *t.TaskArn, err)
+		}
+	}
+
+	// Stop tasks manually because tasks that don't belong to a service won't stop
+	// even after their cluster instance's status becomes "DRAINING"
+	log.Printf("Stop the task \"%s\"\n", *t.TaskArn)
+	_, err := d.ecsSvc.StopTask(ctx, &ecs.StopTaskInput{
+		Cluster: t.ClusterArn,
+		Reason:  aws.String("Task stopped by ecsmec"),
+		Task:    t.TaskArn,
+	})
+	if err != nil {
+		return xerrors.Errorf("failed to stop the task: %w", err)
+	}
+
+	if runTaskParams != nil {
+		// The new task is never placed on the container instances being drained
+		newTaskArn, err := d.runTask(ctx, runTaskParams)
 		if err != nil {
-			return xerrors.Errorf("failed to wait for the services to become stable: %w", err)
+			return xerrors.Errorf("failed to relaunch the task %q: %w", *t.TaskArn, err)
 		}
+		log.Printf("Relaunched the task \"%s\" as \"%s\"\n", *t.TaskArn, newTaskArn)
 	}
 
 	return nil
@@ -257,6 +426,48 @@ func (d *drainer) processContainerInstances(ctx context.Context, instanceIDs []s
 	return nil
 }
 
+func (d *drainer) processTasks(ctx context.Context, containerInstanceArn *string, callback func(ecstypes.Task) error) error {
+	params := &ecs.ListTasksInput{
+		Cluster:           aws.String(d.cluster),
+		ContainerInstance: containerInstanceArn,
+	}
+
+	paginator := ecs.NewListTasksPaginator(d.ecsSvc, params)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return xerrors.Errorf("failed to list tasks: %w", err)
+		}
+		if len(page.TaskArns) == 0 {
+			break
+		}
+
+		resp, err := d.ecsSvc.DescribeTasks(ctx, &ecs.DescribeTasksInput{
+			Cluster: aws.String(d.cluster),
+			Include: []ecstypes.TaskField{ecstypes.TaskFieldTags},
+			Tasks:   page.TaskArns,
+		})
+		if err != nil {
+			return xerrors.Errorf("failed to describe tasks: %w", err)
+		}
+
+		for _, t := range resp.Tasks {
+			if err := callback(t); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// getServiceName returns the name of the service that the task belongs to.
+func getServiceName(t ecstypes.Task) (string, bool) {
+	// The task group name of a task starting with "service:" means the task belongs to a service,
+	// because other tasks can't have such a task group name due to the error "Invalid namespace for group".
+	return strings.CutPrefix(aws.ToString(t.Group), "service:")
+}
+
 func getContainerInstanceID(arn string) string {
 	return arn[strings.LastIndex(arn, "/")+1:]
 }
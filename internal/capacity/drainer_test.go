@@ -1,12 +1,18 @@
 package capacity_test
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
 	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
 	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
@@ -121,6 +127,1009 @@ func TestDrainer_Drain(t *testing.T) {
 		}
 	})
 
+	t.Run("when the approver rejects", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		ecsMock := capacitymock.NewMockECSAPI(ctrl)
+		approverMock := capacitymock.NewMockApprover(ctrl)
+
+		instance := createInstance("ap-northeast-1a")
+		arn := fmt.Sprintf("arn:aws:ecs:ap-northeast-1:1234:container-instance/test/%s", *instance.InstanceId)
+
+		// For ListContainerInstancesPaginator
+		ecsMock.EXPECT().ListContainerInstances(ctx, gomock.Any(), gomock.Any()).Return(&ecs.ListContainerInstancesOutput{
+			ContainerInstanceArns: []string{arn},
+		}, nil)
+
+		ecsMock.EXPECT().DescribeContainerInstances(ctx, gomock.Any()).Return(&ecs.DescribeContainerInstancesOutput{
+			ContainerInstances: []ecstypes.ContainerInstance{
+				{
+					ContainerInstanceArn: aws.String(arn),
+					Ec2InstanceId:        instance.InstanceId,
+				},
+			},
+		}, nil)
+
+		approverMock.EXPECT().Approve(ctx, gomock.Any()).Return(capacity.ErrNotApproved)
+
+		drainer, err := capacity.NewDrainer("test", 10, ecsMock, capacity.WithApprover(approverMock))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := drainer.Drain(ctx, []string{*instance.InstanceId}); !errors.Is(err, capacity.ErrNotApproved) {
+			t.Errorf("err = %#v; want %#v", err, capacity.ErrNotApproved)
+		}
+	})
+
+	t.Run("with service-aware batching", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		ecsMock := capacitymock.NewMockECSAPI(ctrl)
+
+		instances := append(createInstances("ap-northeast-1a", 2), createInstances("ap-northeast-1c", 1)...)
+		instanceIDs := make([]string, len(instances))
+		containerInstanceArns := make([]string, len(instances))
+		containerInstances := make([]ecstypes.ContainerInstance, len(instances))
+		for i, instance := range instances {
+			instanceIDs[i] = *instance.InstanceId
+			arn := fmt.Sprintf("arn:aws:ecs:ap-northeast-1:1234:container-instance/test/%s", *instance.InstanceId)
+			containerInstanceArns[i] = arn
+			containerInstances[i] = ecstypes.ContainerInstance{
+				ContainerInstanceArn: aws.String(arn),
+				Ec2InstanceId:        instance.InstanceId,
+			}
+		}
+
+		// For ListContainerInstancesPaginator
+		ecsMock.EXPECT().ListContainerInstances(ctx, gomock.Any(), gomock.Any()).Return(&ecs.ListContainerInstancesOutput{
+			ContainerInstanceArns: containerInstanceArns,
+		}, nil)
+
+		ecsMock.EXPECT().DescribeContainerInstances(ctx, gomock.Any()).Return(&ecs.DescribeContainerInstancesOutput{
+			ContainerInstances: containerInstances,
+		}, nil)
+
+		// Each instance runs a task of the service "foo", and the first instance also runs a task of the service "bar"
+		ecsMock.EXPECT().ListTasks(ctx, gomock.Any(), gomock.Any()).AnyTimes().
+			DoAndReturn(func(_ context.Context, params *ecs.ListTasksInput, _ ...func(*ecs.Options)) (*ecs.ListTasksOutput, error) {
+				output := &ecs.ListTasksOutput{TaskArns: []string{"foo/" + *params.ContainerInstance}}
+				if *params.ContainerInstance == containerInstanceArns[0] {
+					output.TaskArns = append(output.TaskArns, "bar/"+*params.ContainerInstance)
+				}
+				return output, nil
+			})
+		ecsMock.EXPECT().DescribeTasks(ctx, gomock.Any()).AnyTimes().
+			DoAndReturn(func(_ context.Context, input *ecs.DescribeTasksInput, _ ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error) {
+				tasks := make([]ecstypes.Task, len(input.Tasks))
+				for i, arn := range input.Tasks {
+					tasks[i] = ecstypes.Task{
+						Group:   aws.String("service:" + arn[:3]),
+						TaskArn: aws.String(arn),
+					}
+				}
+				return &ecs.DescribeTasksOutput{Tasks: tasks}, nil
+			})
+
+		// The batches are replanned before each batch
+		ecsMock.EXPECT().DescribeServices(ctx, gomock.Any()).Times(len(instances)).Return(&ecs.DescribeServicesOutput{
+			Services: []ecstypes.Service{
+				{
+					DeploymentConfiguration: &ecstypes.DeploymentConfiguration{
+						MinimumHealthyPercent: aws.Int32(50),
+					},
+					DesiredCount: 3,
+					RunningCount: 3,
+					ServiceName:  aws.String("foo"),
+				},
+				{
+					DeploymentConfiguration: &ecstypes.DeploymentConfiguration{
+						MinimumHealthyPercent: aws.Int32(50),
+					},
+					DesiredCount: 10,
+					RunningCount: 10,
+					ServiceName:  aws.String("bar"),
+				},
+			},
+		}, nil)
+
+		// The service "foo" can lose only one task at once
+		drainedArns := make([]string, 0, len(instances))
+		ecsMock.EXPECT().UpdateContainerInstancesState(ctx, gomock.Any()).Times(len(instances)).
+			DoAndReturn(func(_ context.Context, input *ecs.UpdateContainerInstancesStateInput, _ ...func(*ecs.Options)) (*ecs.UpdateContainerInstancesStateOutput, error) {
+				if len(input.ContainerInstances) != 1 {
+					t.Errorf("len(input.ContainerInstances) = %d; want 1", len(input.ContainerInstances))
+				}
+				drainedArns = append(drainedArns, input.ContainerInstances...)
+				return &ecs.UpdateContainerInstancesStateOutput{}, nil
+			})
+		// For ecs.TasksStoppedWaiter
+		ecsMock.EXPECT().DescribeTasks(testutil.AnyContext(), gomock.Any(), gomock.Any()).Times(len(instances)).Return(&ecs.DescribeTasksOutput{
+			Tasks: []ecstypes.Task{
+				{
+					LastStatus: aws.String("STOPPED"),
+				},
+			},
+		}, nil)
+		// For ecs.ServicesStableWaiter
+		ecsMock.EXPECT().DescribeServices(testutil.AnyContext(), gomock.Any(), gomock.Any()).AnyTimes().Return(&ecs.DescribeServicesOutput{
+			Services: []ecstypes.Service{
+				{
+					Deployments:  make([]ecstypes.Deployment, 1),
+					DesiredCount: 0,
+					RunningCount: 0,
+					Status:       aws.String("ACTIVE"),
+				},
+			},
+		}, nil)
+
+		drainer, err := capacity.NewDrainer("test", 10, ecsMock, capacity.WithApprover(capacity.NewAutoApprover()), capacity.WithServiceAwareBatching())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := drainer.Drain(ctx, instanceIDs); err != nil {
+			t.Errorf("err = %#v; want nil", err)
+		}
+		if !reflect.DeepEqual(drainedArns, containerInstanceArns) {
+			t.Errorf("drainedArns = %v; want %v", drainedArns, containerInstanceArns)
+		}
+	})
+
+	t.Run("with service-aware batching when a service is not fully running", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		ecsMock := capacitymock.NewMockECSAPI(ctrl)
+
+		instances := createInstances("ap-northeast-1a", 3)
+		instanceIDs := make([]string, len(instances))
+		containerInstanceArns := make([]string, len(instances))
+		containerInstances := make([]ecstypes.ContainerInstance, len(instances))
+		for i, instance := range instances {
+			instanceIDs[i] = *instance.InstanceId
+			arn := fmt.Sprintf("arn:aws:ecs:ap-northeast-1:1234:container-instance/test/%s", *instance.InstanceId)
+			containerInstanceArns[i] = arn
+			containerInstances[i] = ecstypes.ContainerInstance{
+				ContainerInstanceArn: aws.String(arn),
+				Ec2InstanceId:        instance.InstanceId,
+			}
+		}
+
+		// For ListContainerInstancesPaginator
+		ecsMock.EXPECT().ListContainerInstances(ctx, gomock.Any(), gomock.Any()).Return(&ecs.ListContainerInstancesOutput{
+			ContainerInstanceArns: containerInstanceArns,
+		}, nil)
+
+		ecsMock.EXPECT().DescribeContainerInstances(ctx, gomock.Any()).Return(&ecs.DescribeContainerInstancesOutput{
+			ContainerInstances: containerInstances,
+		}, nil)
+
+		// Each instance runs a task of the service "foo"
+		ecsMock.EXPECT().ListTasks(ctx, gomock.Any(), gomock.Any()).AnyTimes().
+			DoAndReturn(func(_ context.Context, params *ecs.ListTasksInput, _ ...func(*ecs.Options)) (*ecs.ListTasksOutput, error) {
+				return &ecs.ListTasksOutput{TaskArns: []string{"foo/" + *params.ContainerInstance}}, nil
+			})
+		ecsMock.EXPECT().DescribeTasks(ctx, gomock.Any()).AnyTimes().
+			DoAndReturn(func(_ context.Context, input *ecs.DescribeTasksInput, _ ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error) {
+				tasks := make([]ecstypes.Task, len(input.Tasks))
+				for i, arn := range input.Tasks {
+					tasks[i] = ecstypes.Task{
+						Group:   aws.String("service:foo"),
+						TaskArn: aws.String(arn),
+					}
+				}
+				return &ecs.DescribeTasksOutput{Tasks: tasks}, nil
+			})
+
+		// The service "foo" can lose only one task at first because one of its tasks is not running,
+		// and two tasks after the task starts running
+		describeServicesOutput := func(runningCount int32) *ecs.DescribeServicesOutput {
+			return &ecs.DescribeServicesOutput{
+				Services: []ecstypes.Service{
+					{
+						DeploymentConfiguration: &ecstypes.DeploymentConfiguration{
+							MinimumHealthyPercent: aws.Int32(50),
+						},
+						DesiredCount: 4,
+						RunningCount: runningCount,
+						ServiceName:  aws.String("foo"),
+					},
+				},
+			}
+		}
+		gomock.InOrder(
+			ecsMock.EXPECT().DescribeServices(ctx, gomock.Any()).Return(describeServicesOutput(3), nil),
+			ecsMock.EXPECT().DescribeServices(ctx, gomock.Any()).Return(describeServicesOutput(4), nil),
+		)
+
+		drainedArns := make([][]string, 0)
+		ecsMock.EXPECT().UpdateContainerInstancesState(ctx, gomock.Any()).Times(2).
+			DoAndReturn(func(_ context.Context, input *ecs.UpdateContainerInstancesStateInput, _ ...func(*ecs.Options)) (*ecs.UpdateContainerInstancesStateOutput, error) {
+				drainedArns = append(drainedArns, input.ContainerInstances)
+				return &ecs.UpdateContainerInstancesStateOutput{}, nil
+			})
+		// For ecs.TasksStoppedWaiter
+		ecsMock.EXPECT().DescribeTasks(testutil.AnyContext(), gomock.Any(), gomock.Any()).Times(2).Return(&ecs.DescribeTasksOutput{
+			Tasks: []ecstypes.Task{
+				{
+					LastStatus: aws.String("STOPPED"),
+				},
+			},
+		}, nil)
+		// For ecs.ServicesStableWaiter
+		ecsMock.EXPECT().DescribeServices(testutil.AnyContext(), gomock.Any(), gomock.Any()).AnyTimes().Return(&ecs.DescribeServicesOutput{
+			Services: []ecstypes.Service{
+				{
+					Deployments:  make([]ecstypes.Deployment, 1),
+					DesiredCount: 0,
+					RunningCount: 0,
+					Status:       aws.String("ACTIVE"),
+				},
+			},
+		}, nil)
+
+		drainer, err := capacity.NewDrainer("test", 10, ecsMock, capacity.WithApprover(capacity.NewAutoApprover()), capacity.WithServiceAwareBatching())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := drainer.Drain(ctx, instanceIDs); err != nil {
+			t.Errorf("err = %#v; want nil", err)
+		}
+		want := [][]string{containerInstanceArns[:1], containerInstanceArns[1:]}
+		if !reflect.DeepEqual(drainedArns, want) {
+			t.Errorf("drainedArns = %v; want %v", drainedArns, want)
+		}
+	})
+
+	t.Run("when the tasks don't fit on the remaining instances", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		ecsMock := capacitymock.NewMockECSAPI(ctrl)
+
+		instance := createInstance("ap-northeast-1a")
+		arn := fmt.Sprintf("arn:aws:ecs:ap-northeast-1:1234:container-instance/test/%s", *instance.InstanceId)
+		anotherArn := "arn:aws:ecs:ap-northeast-1:1234:container-instance/test/another"
+		taskArn := "arn:aws:ecs:ap-northeast-1:123:task/test/00000000000000000000000000000000"
+
+		gomock.InOrder(
+			// For ListContainerInstancesPaginator
+			ecsMock.EXPECT().ListContainerInstances(ctx, gomock.Any(), gomock.Any()).Return(&ecs.ListContainerInstancesOutput{
+				ContainerInstanceArns: []string{arn},
+			}, nil),
+
+			ecsMock.EXPECT().DescribeContainerInstances(ctx, gomock.Any()).Return(&ecs.DescribeContainerInstancesOutput{
+				ContainerInstances: []ecstypes.ContainerInstance{
+					{
+						ContainerInstanceArn: aws.String(arn),
+						Ec2InstanceId:        instance.InstanceId,
+					},
+				},
+			}, nil),
+
+			ecsMock.EXPECT().ListTasks(ctx, gomock.Any(), gomock.Any()).Return(&ecs.ListTasksOutput{
+				TaskArns: []string{taskArn},
+			}, nil),
+
+			ecsMock.EXPECT().DescribeTasks(ctx, gomock.Any()).Return(&ecs.DescribeTasksOutput{
+				Tasks: []ecstypes.Task{
+					{
+						Cpu:     aws.String("512"),
+						Group:   aws.String("service:foo"),
+						Memory:  aws.String("1024"),
+						TaskArn: aws.String(taskArn),
+					},
+				},
+			}, nil),
+
+			ecsMock.EXPECT().DescribeServices(ctx, gomock.Any()).Return(&ecs.DescribeServicesOutput{
+				Services: []ecstypes.Service{
+					{
+						DesiredCount: 2,
+						PlacementConstraints: []ecstypes.PlacementConstraint{
+							{Type: ecstypes.PlacementConstraintTypeDistinctInstance},
+						},
+						ServiceName: aws.String("foo"),
+					},
+				},
+			}, nil),
+
+			ecsMock.EXPECT().ListContainerInstances(ctx, gomock.Any(), gomock.Any()).
+				DoAndReturn(func(_ context.Context, params *ecs.ListContainerInstancesInput, _ ...func(*ecs.Options)) (*ecs.ListContainerInstancesOutput, error) {
+					if params.Status != ecstypes.ContainerInstanceStatusActive {
+						t.Errorf("Status = %s; want %s", params.Status, ecstypes.ContainerInstanceStatusActive)
+					}
+					return &ecs.ListContainerInstancesOutput{
+						ContainerInstanceArns: []string{arn, anotherArn},
+					}, nil
+				}),
+
+			ecsMock.EXPECT().DescribeContainerInstances(ctx, gomock.Any()).Return(&ecs.DescribeContainerInstancesOutput{
+				ContainerInstances: []ecstypes.ContainerInstance{
+					{
+						ContainerInstanceArn: aws.String(arn),
+						Status:               aws.String("ACTIVE"),
+					},
+					{
+						ContainerInstanceArn: aws.String(anotherArn),
+						RemainingResources: []ecstypes.Resource{
+							{Name: aws.String("CPU"), IntegerValue: 1024},
+							{Name: aws.String("MEMORY"), IntegerValue: 512},
+						},
+						Status: aws.String("ACTIVE"),
+					},
+				},
+			}, nil),
+		)
+
+		drainer, err := capacity.NewDrainer("test", 10, ecsMock, capacity.WithApprover(capacity.NewAutoApprover()), capacity.WithPreflightCheck(false))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = drainer.Drain(ctx, []string{*instance.InstanceId})
+		if !errors.Is(err, capacity.ErrInsufficientCapacity) {
+			t.Fatalf("err = %#v; want %#v", err, capacity.ErrInsufficientCapacity)
+		}
+		for _, want := range []string{`the service "foo" requires 2 distinct instances but only 1 instances will remain`, `1 tasks of the service "foo" don't fit`} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("err = %s; want to contain %q", err, want)
+			}
+		}
+	})
+
+	t.Run("when the standalone tasks to relaunch don't fit on the remaining instances", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		ecsMock := capacitymock.NewMockECSAPI(ctrl)
+		ec2Mock := capacitymock.NewMockEC2API(ctrl)
+
+		instance := createInstance("ap-northeast-1a")
+		arn := fmt.Sprintf("arn:aws:ecs:ap-northeast-1:1234:container-instance/test/%s", *instance.InstanceId)
+		anotherArn := "arn:aws:ecs:ap-northeast-1:1234:container-instance/test/another"
+		taskArn := "arn:aws:ecs:ap-northeast-1:123:task/test/00000000000000000000000000000000"
+
+		gomock.InOrder(
+			// For ListContainerInstancesPaginator
+			ecsMock.EXPECT().ListContainerInstances(ctx, gomock.Any(), gomock.Any()).Return(&ecs.ListContainerInstancesOutput{
+				ContainerInstanceArns: []string{arn},
+			}, nil),
+
+			ecsMock.EXPECT().DescribeContainerInstances(ctx, gomock.Any()).Return(&ecs.DescribeContainerInstancesOutput{
+				ContainerInstances: []ecstypes.ContainerInstance{
+					{
+						ContainerInstanceArn: aws.String(arn),
+						Ec2InstanceId:        instance.InstanceId,
+					},
+				},
+			}, nil),
+
+			ecsMock.EXPECT().ListTasks(ctx, gomock.Any(), gomock.Any()).Return(&ecs.ListTasksOutput{
+				TaskArns: []string{taskArn},
+			}, nil),
+
+			ecsMock.EXPECT().DescribeTasks(ctx, gomock.Any()).Return(&ecs.DescribeTasksOutput{
+				Tasks: []ecstypes.Task{
+					{
+						Cpu:     aws.String("512"),
+						Group:   aws.String("family:bar"),
+						Memory:  aws.String("1024"),
+						TaskArn: aws.String(taskArn),
+					},
+				},
+			}, nil),
+
+			ecsMock.EXPECT().ListContainerInstances(ctx, gomock.Any(), gomock.Any()).Return(&ecs.ListContainerInstancesOutput{
+				ContainerInstanceArns: []string{arn, anotherArn},
+			}, nil),
+
+			ecsMock.EXPECT().DescribeContainerInstances(ctx, gomock.Any()).Return(&ecs.DescribeContainerInstancesOutput{
+				ContainerInstances: []ecstypes.ContainerInstance{
+					{
+						ContainerInstanceArn: aws.String(arn),
+						Status:               aws.String("ACTIVE"),
+					},
+					{
+						ContainerInstanceArn: aws.String(anotherArn),
+						RemainingResources: []ecstypes.Resource{
+							{Name: aws.String("CPU"), IntegerValue: 1024},
+							{Name: aws.String("MEMORY"), IntegerValue: 512},
+						},
+						Status: aws.String("ACTIVE"),
+					},
+				},
+			}, nil),
+		)
+
+		drainer, err := capacity.NewDrainer("test", 10, ecsMock, capacity.WithApprover(capacity.NewAutoApprover()), capacity.WithPreflightCheck(false), capacity.WithStandaloneTaskRelaunch(ec2Mock))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = drainer.Drain(ctx, []string{*instance.InstanceId})
+		if !errors.Is(err, capacity.ErrInsufficientCapacity) {
+			t.Fatalf("err = %#v; want %#v", err, capacity.ErrInsufficientCapacity)
+		}
+		if want := "1 standalone tasks to relaunch don't fit"; !strings.Contains(err.Error(), want) {
+			t.Errorf("err = %s; want to contain %q", err, want)
+		}
+	})
+
+	t.Run("with protected tasks", func(t *testing.T) {
+		instance := createInstance("ap-northeast-1a")
+		arn := fmt.Sprintf("arn:aws:ecs:ap-northeast-1:1234:container-instance/test/%s", *instance.InstanceId)
+		taskArn := "arn:aws:ecs:ap-northeast-1:123:task/test/00000000000000000000000000000000"
+
+		expectDescribeTasks := func(ctx context.Context, ecsMock *capacitymock.MockECSAPI) *gomock.Call {
+			return testutil.InOrder(
+				// For ListContainerInstancesPaginator
+				ecsMock.EXPECT().ListContainerInstances(ctx, gomock.Any(), gomock.Any()).Return(&ecs.ListContainerInstancesOutput{
+					ContainerInstanceArns: []string{arn},
+				}, nil),
+
+				ecsMock.EXPECT().DescribeContainerInstances(ctx, gomock.Any()).Return(&ecs.DescribeContainerInstancesOutput{
+					ContainerInstances: []ecstypes.ContainerInstance{
+						{
+							ContainerInstanceArn: aws.String(arn),
+							Ec2InstanceId:        instance.InstanceId,
+						},
+					},
+				}, nil),
+
+				ecsMock.EXPECT().ListTasks(ctx, gomock.Any(), gomock.Any()).Return(&ecs.ListTasksOutput{
+					TaskArns: []string{taskArn},
+				}, nil),
+
+				ecsMock.EXPECT().DescribeTasks(ctx, gomock.Any()).Return(&ecs.DescribeTasksOutput{
+					Tasks: []ecstypes.Task{
+						{
+							Group:   aws.String("family:bar"),
+							TaskArn: aws.String(taskArn),
+						},
+					},
+				}, nil),
+
+				ecsMock.EXPECT().UpdateContainerInstancesState(ctx, gomock.Any()).Return(&ecs.UpdateContainerInstancesStateOutput{}, nil),
+			)
+		}
+
+		t.Run("the protection expires", func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx := context.Background()
+
+			ecsMock := capacitymock.NewMockECSAPI(ctrl)
+
+			gomock.InOrder(
+				expectDescribeTasks(ctx, ecsMock),
+
+				ecsMock.EXPECT().GetTaskProtection(ctx, gomock.Any()).Return(&ecs.GetTaskProtectionOutput{
+					ProtectedTasks: []ecstypes.ProtectedTask{
+						{
+							ExpirationDate:    aws.Time(time.Now().Add(10 * time.Millisecond)),
+							ProtectionEnabled: true,
+							TaskArn:           aws.String(taskArn),
+						},
+					},
+				}, nil),
+
+				ecsMock.EXPECT().GetTaskProtection(ctx, gomock.Any()).Return(&ecs.GetTaskProtectionOutput{
+					ProtectedTasks: []ecstypes.ProtectedTask{
+						{
+							ProtectionEnabled: false,
+							TaskArn:           aws.String(taskArn),
+						},
+					},
+				}, nil),
+
+				ecsMock.EXPECT().StopTask(ctx, gomock.Any()).Return(&ecs.StopTaskOutput{}, nil),
+
+				// For ecs.TasksStoppedWaiter
+				ecsMock.EXPECT().DescribeTasks(testutil.AnyContext(), gomock.Any(), gomock.Any()).Return(&ecs.DescribeTasksOutput{
+					Tasks: []ecstypes.Task{
+						{
+							LastStatus: aws.String("STOPPED"),
+						},
+					},
+				}, nil),
+			)
+
+			drainer, err := capacity.NewDrainer("test", 10, ecsMock, capacity.WithApprover(capacity.NewAutoApprover()), capacity.WithTaskProtectionTimeout(time.Minute))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := drainer.Drain(ctx, []string{*instance.InstanceId}); err != nil {
+				t.Errorf("err = %#v; want nil", err)
+			}
+		})
+
+		t.Run("the protection doesn't expire within the timeout", func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx := context.Background()
+
+			ecsMock := capacitymock.NewMockECSAPI(ctrl)
+
+			gomock.InOrder(
+				expectDescribeTasks(ctx, ecsMock),
+
+				ecsMock.EXPECT().GetTaskProtection(ctx, gomock.Any()).Return(&ecs.GetTaskProtectionOutput{
+					ProtectedTasks: []ecstypes.ProtectedTask{
+						{
+							ExpirationDate:    aws.Time(time.Now().Add(time.Hour)),
+							ProtectionEnabled: true,
+							TaskArn:           aws.String(taskArn),
+						},
+					},
+				}, nil),
+			)
+
+			drainer, err := capacity.NewDrainer("test", 10, ecsMock, capacity.WithApprover(capacity.NewAutoApprover()), capacity.WithTaskProtectionTimeout(10*time.Millisecond))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = drainer.Drain(ctx, []string{*instance.InstanceId})
+			if err == nil || !strings.Contains(err.Error(), taskArn) {
+				t.Errorf("err = %#v; want an error including %s", err, taskArn)
+			}
+		})
+	})
+
+	t.Run("with standalone task relaunch", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		ecsMock := capacitymock.NewMockECSAPI(ctrl)
+		ec2Mock := capacitymock.NewMockEC2API(ctrl)
+
+		instance := createInstance("ap-northeast-1a")
+		arn := fmt.Sprintf("arn:aws:ecs:ap-northeast-1:1234:container-instance/test/%s", *instance.InstanceId)
+		taskArn := "arn:aws:ecs:ap-northeast-1:123:task/test/00000000000000000000000000000000"
+		newTaskArn := "arn:aws:ecs:ap-northeast-1:123:task/test/11111111111111111111111111111111"
+
+		gomock.InOrder(
+			// For ListContainerInstancesPaginator
+			ecsMock.EXPECT().ListContainerInstances(ctx, gomock.Any(), gomock.Any()).Return(&ecs.ListContainerInstancesOutput{
+				ContainerInstanceArns: []string{arn},
+			}, nil),
+
+			ecsMock.EXPECT().DescribeContainerInstances(ctx, gomock.Any()).Return(&ecs.DescribeContainerInstancesOutput{
+				ContainerInstances: []ecstypes.ContainerInstance{
+					{
+						ContainerInstanceArn: aws.String(arn),
+						Ec2InstanceId:        instance.InstanceId,
+					},
+				},
+			}, nil),
+
+			ecsMock.EXPECT().ListTasks(ctx, gomock.Any(), gomock.Any()).Return(&ecs.ListTasksOutput{
+				TaskArns: []string{taskArn},
+			}, nil),
+
+			ecsMock.EXPECT().DescribeTasks(ctx, gomock.Any()).Return(&ecs.DescribeTasksOutput{
+				Tasks: []ecstypes.Task{
+					{
+						Attachments: []ecstypes.Attachment{
+							{
+								Details: []ecstypes.KeyValuePair{
+									{Name: aws.String("subnetId"), Value: aws.String("subnet-0123")},
+									{Name: aws.String("networkInterfaceId"), Value: aws.String("eni-0123")},
+								},
+								Type: aws.String("ElasticNetworkInterface"),
+							},
+						},
+						ClusterArn: aws.String("arn:aws:ecs:ap-northeast-1:123:cluster/test"),
+						Group:      aws.String("family:bar"),
+						LaunchType: ecstypes.LaunchTypeEc2,
+						StartedBy:  aws.String("scheduler"),
+						Tags: []ecstypes.Tag{
+							{Key: aws.String("aws:ecs:clusterName"), Value: aws.String("test")},
+							{Key: aws.String("team"), Value: aws.String("foo")},
+						},
+						TaskArn:           aws.String(taskArn),
+						TaskDefinitionArn: aws.String("arn:aws:ecs:ap-northeast-1:123:task-definition/bar:1"),
+					},
+				},
+			}, nil),
+
+			ecsMock.EXPECT().UpdateContainerInstancesState(ctx, gomock.Any()).Return(&ecs.UpdateContainerInstancesStateOutput{}, nil),
+
+			ec2Mock.EXPECT().DescribeNetworkInterfaces(ctx, gomock.Any()).Return(&ec2.DescribeNetworkInterfacesOutput{
+				NetworkInterfaces: []ec2types.NetworkInterface{
+					{
+						Groups: []ec2types.GroupIdentifier{
+							{GroupId: aws.String("sg-0123")},
+						},
+					},
+				},
+			}, nil),
+
+			ecsMock.EXPECT().StopTask(ctx, gomock.Any()).Return(&ecs.StopTaskOutput{}, nil),
+
+			ecsMock.EXPECT().RunTask(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *ecs.RunTaskInput, _ ...func(*ecs.Options)) (*ecs.RunTaskOutput, error) {
+				if *input.TaskDefinition != "arn:aws:ecs:ap-northeast-1:123:task-definition/bar:1" {
+					t.Errorf("TaskDefinition = %s; want %s", *input.TaskDefinition, "arn:aws:ecs:ap-northeast-1:123:task-definition/bar:1")
+				}
+				if input.Group != nil {
+					t.Errorf("Group = %s; want nil", *input.Group)
+				}
+				if *input.StartedBy != "scheduler" {
+					t.Errorf("StartedBy = %s; want %s", *input.StartedBy, "scheduler")
+				}
+				if input.LaunchType != ecstypes.LaunchTypeEc2 {
+					t.Errorf("LaunchType = %s; want %s", input.LaunchType, ecstypes.LaunchTypeEc2)
+				}
+				// The reserved tag must not be specified
+				wantTags := []ecstypes.Tag{{Key: aws.String("team"), Value: aws.String("foo")}}
+				if !reflect.DeepEqual(input.Tags, wantTags) {
+					t.Errorf("Tags = %#v; want %#v", input.Tags, wantTags)
+				}
+				if !input.EnableECSManagedTags {
+					t.Errorf("EnableECSManagedTags = false; want true")
+				}
+				want := &ecstypes.AwsVpcConfiguration{
+					SecurityGroups: []string{"sg-0123"},
+					Subnets:        []string{"subnet-0123"},
+				}
+				if !reflect.DeepEqual(input.NetworkConfiguration.AwsvpcConfiguration, want) {
+					t.Errorf("AwsvpcConfiguration = %#v; want %#v", input.NetworkConfiguration.AwsvpcConfiguration, want)
+				}
+				return &ecs.RunTaskOutput{
+					Tasks: []ecstypes.Task{
+						{TaskArn: aws.String(newTaskArn)},
+					},
+				}, nil
+			}),
+
+			// For ecs.TasksStoppedWaiter
+			ecsMock.EXPECT().DescribeTasks(testutil.AnyContext(), gomock.Any(), gomock.Any()).Return(&ecs.DescribeTasksOutput{
+				Tasks: []ecstypes.Task{
+					{
+						LastStatus: aws.String("STOPPED"),
+					},
+				},
+			}, nil),
+		)
+
+		drainer, err := capacity.NewDrainer("test", 10, ecsMock, capacity.WithApprover(capacity.NewAutoApprover()), capacity.WithStandaloneTaskRelaunch(ec2Mock))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := drainer.Drain(ctx, []string{*instance.InstanceId}); err != nil {
+			t.Errorf("err = %#v; want nil", err)
+		}
+	})
+
+	t.Run("with standalone task completion wait", func(t *testing.T) {
+		instance := createInstance("ap-northeast-1a")
+		arn := fmt.Sprintf("arn:aws:ecs:ap-northeast-1:1234:container-instance/test/%s", *instance.InstanceId)
+		batchTaskArn := "arn:aws:ecs:ap-northeast-1:123:task/test/00000000000000000000000000000000"
+		otherTaskArn := "arn:aws:ecs:ap-northeast-1:123:task/test/11111111111111111111111111111111"
+
+		expectStopTask := func(ctx context.Context, ecsMock *capacitymock.MockECSAPI, taskArn string) *gomock.Call {
+			return ecsMock.EXPECT().StopTask(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *ecs.StopTaskInput, _ ...func(*ecs.Options)) (*ecs.StopTaskOutput, error) {
+				if *input.Task != taskArn {
+					t.Errorf("Task = %s; want %s", *input.Task, taskArn)
+				}
+				return &ecs.StopTaskOutput{}, nil
+			})
+		}
+
+		expectStopOtherTask := func(ctx context.Context, ecsMock *capacitymock.MockECSAPI) *gomock.Call {
+			return testutil.InOrder(
+				// For ListContainerInstancesPaginator
+				ecsMock.EXPECT().ListContainerInstances(ctx, gomock.Any(), gomock.Any()).Return(&ecs.ListContainerInstancesOutput{
+					ContainerInstanceArns: []string{arn},
+				}, nil),
+
+				ecsMock.EXPECT().DescribeContainerInstances(ctx, gomock.Any()).Return(&ecs.DescribeContainerInstancesOutput{
+					ContainerInstances: []ecstypes.ContainerInstance{
+						{
+							ContainerInstanceArn: aws.String(arn),
+							Ec2InstanceId:        instance.InstanceId,
+						},
+					},
+				}, nil),
+
+				ecsMock.EXPECT().ListTasks(ctx, gomock.Any(), gomock.Any()).Return(&ecs.ListTasksOutput{
+					TaskArns: []string{batchTaskArn, otherTaskArn},
+				}, nil),
+
+				ecsMock.EXPECT().DescribeTasks(ctx, gomock.Any()).Return(&ecs.DescribeTasksOutput{
+					Tasks: []ecstypes.Task{
+						{
+							Group:   aws.String("batch"),
+							TaskArn: aws.String(batchTaskArn),
+						},
+						{
+							Group:   aws.String("family:bar"),
+							TaskArn: aws.String(otherTaskArn),
+						},
+					},
+				}, nil),
+
+				ecsMock.EXPECT().UpdateContainerInstancesState(ctx, gomock.Any()).Return(&ecs.UpdateContainerInstancesStateOutput{}, nil),
+
+				expectStopTask(ctx, ecsMock, otherTaskArn),
+			)
+		}
+
+		t.Run("the tasks finish before the deadline", func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx := context.Background()
+
+			ecsMock := capacitymock.NewMockECSAPI(ctrl)
+
+			gomock.InOrder(
+				expectStopOtherTask(ctx, ecsMock),
+
+				ecsMock.EXPECT().DescribeTasks(ctx, gomock.Any()).Return(&ecs.DescribeTasksOutput{
+					Tasks: []ecstypes.Task{
+						{
+							LastStatus: aws.String("STOPPED"),
+							TaskArn:    aws.String(batchTaskArn),
+						},
+					},
+				}, nil),
+
+				// For ecs.TasksStoppedWaiter
+				ecsMock.EXPECT().DescribeTasks(testutil.AnyContext(), gomock.Any(), gomock.Any()).Return(&ecs.DescribeTasksOutput{
+					Tasks: []ecstypes.Task{
+						{
+							LastStatus: aws.String("STOPPED"),
+						},
+					},
+				}, nil),
+			)
+
+			drainer, err := capacity.NewDrainer("test", 10, ecsMock, capacity.WithApprover(capacity.NewAutoApprover()), capacity.WithStandaloneTaskCompletionWait(time.Minute, []string{"batch"}, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := drainer.Drain(ctx, []string{*instance.InstanceId}); err != nil {
+				t.Errorf("err = %#v; want nil", err)
+			}
+		})
+
+		t.Run("the tasks are still running at the deadline", func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx := context.Background()
+
+			ecsMock := capacitymock.NewMockECSAPI(ctrl)
+
+			gomock.InOrder(
+				expectStopOtherTask(ctx, ecsMock),
+
+				ecsMock.EXPECT().DescribeTasks(ctx, gomock.Any()).MinTimes(1).Return(&ecs.DescribeTasksOutput{
+					Tasks: []ecstypes.Task{
+						{
+							LastStatus: aws.String("RUNNING"),
+							TaskArn:    aws.String(batchTaskArn),
+						},
+					},
+				}, nil),
+
+				expectStopTask(ctx, ecsMock, batchTaskArn),
+
+				// For ecs.TasksStoppedWaiter
+				ecsMock.EXPECT().DescribeTasks(testutil.AnyContext(), gomock.Any(), gomock.Any()).Return(&ecs.DescribeTasksOutput{
+					Tasks: []ecstypes.Task{
+						{
+							LastStatus: aws.String("STOPPED"),
+						},
+					},
+				}, nil),
+			)
+
+			drainer, err := capacity.NewDrainer("test", 10, ecsMock, capacity.WithApprover(capacity.NewAutoApprover()), capacity.WithStandaloneTaskCompletionWait(10*time.Millisecond, []string{"batch"}, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := drainer.Drain(ctx, []string{*instance.InstanceId}); err != nil {
+				t.Errorf("err = %#v; want nil", err)
+			}
+		})
+
+		t.Run("the approval takes longer than the timeout", func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx := context.Background()
+
+			ecsMock := capacitymock.NewMockECSAPI(ctrl)
+
+			gomock.InOrder(
+				expectStopOtherTask(ctx, ecsMock),
+
+				ecsMock.EXPECT().DescribeTasks(ctx, gomock.Any()).Return(&ecs.DescribeTasksOutput{
+					Tasks: []ecstypes.Task{
+						{
+							LastStatus: aws.String("RUNNING"),
+							TaskArn:    aws.String(batchTaskArn),
+						},
+					},
+				}, nil),
+
+				ecsMock.EXPECT().DescribeTasks(ctx, gomock.Any()).Return(&ecs.DescribeTasksOutput{
+					Tasks: []ecstypes.Task{
+						{
+							LastStatus: aws.String("STOPPED"),
+							TaskArn:    aws.String(batchTaskArn),
+						},
+					},
+				}, nil),
+
+				// For ecs.TasksStoppedWaiter
+				ecsMock.EXPECT().DescribeTasks(testutil.AnyContext(), gomock.Any(), gomock.Any()).Return(&ecs.DescribeTasksOutput{
+					Tasks: []ecstypes.Task{
+						{
+							LastStatus: aws.String("STOPPED"),
+						},
+					},
+				}, nil),
+			)
+
+			drainer, err := capacity.NewDrainer("test", 10, ecsMock, capacity.WithApprover(&slowApprover{delay: 100 * time.Millisecond}), capacity.WithStandaloneTaskCompletionWait(50*time.Millisecond, []string{"batch"}, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := drainer.Drain(ctx, []string{*instance.InstanceId}); err != nil {
+				t.Errorf("err = %#v; want nil", err)
+			}
+		})
+	})
+
+	t.Run("with progress report", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		ecsMock := capacitymock.NewMockECSAPI(ctrl)
+
+		instance := createInstance("ap-northeast-1a")
+		arn := fmt.Sprintf("arn:aws:ecs:ap-northeast-1:1234:container-instance/test/%s", *instance.InstanceId)
+		taskArn := "arn:aws:ecs:ap-northeast-1:123:task/test/00000000000000000000000000000000"
+
+		expectListTasks := func(taskArns []string) *gomock.Call {
+			return ecsMock.EXPECT().ListTasks(ctx, gomock.Any(), gomock.Any()).Return(&ecs.ListTasksOutput{
+				TaskArns: taskArns,
+			}, nil)
+		}
+		expectDescribeTasks := func(lastStatus string) *gomock.Call {
+			return ecsMock.EXPECT().DescribeTasks(ctx, gomock.Any()).Return(&ecs.DescribeTasksOutput{
+				Tasks: []ecstypes.Task{
+					{
+						Group:      aws.String("service:foo"),
+						LastStatus: aws.String(lastStatus),
+						TaskArn:    aws.String(taskArn),
+					},
+				},
+			}, nil)
+		}
+		expectDescribeServices := func(running, pending int32, rolloutState ecstypes.DeploymentRolloutState) *gomock.Call {
+			return ecsMock.EXPECT().DescribeServices(ctx, gomock.Any()).Return(&ecs.DescribeServicesOutput{
+				Services: []ecstypes.Service{
+					{
+						Deployments: []ecstypes.Deployment{
+							{
+								RolloutState: rolloutState,
+								Status:       aws.String("PRIMARY"),
+							},
+						},
+						DesiredCount: 2,
+						PendingCount: pending,
+						RunningCount: running,
+						ServiceName:  aws.String("foo"),
+					},
+				},
+			}, nil)
+		}
+
+		gomock.InOrder(
+			// For ListContainerInstancesPaginator
+			ecsMock.EXPECT().ListContainerInstances(ctx, gomock.Any(), gomock.Any()).Return(&ecs.ListContainerInstancesOutput{
+				ContainerInstanceArns: []string{arn},
+			}, nil),
+
+			ecsMock.EXPECT().DescribeContainerInstances(ctx, gomock.Any()).Return(&ecs.DescribeContainerInstancesOutput{
+				ContainerInstances: []ecstypes.ContainerInstance{
+					{
+						ContainerInstanceArn: aws.String(arn),
+						Ec2InstanceId:        instance.InstanceId,
+					},
+				},
+			}, nil),
+
+			expectListTasks([]string{taskArn}),
+			expectDescribeTasks("RUNNING"),
+
+			ecsMock.EXPECT().UpdateContainerInstancesState(ctx, gomock.Any()).Return(&ecs.UpdateContainerInstancesStateOutput{}, nil),
+
+			// For the progress report while waiting for the tasks to stop
+			expectDescribeTasks("RUNNING"),
+			expectDescribeServices(1, 1, ecstypes.DeploymentRolloutStateInProgress),
+
+			// For ecs.TasksStoppedWaiter
+			ecsMock.EXPECT().DescribeTasks(testutil.AnyContext(), gomock.Any(), gomock.Any()).Return(&ecs.DescribeTasksOutput{
+				Tasks: []ecstypes.Task{
+					{
+						LastStatus: aws.String("STOPPED"),
+					},
+				},
+			}, nil),
+
+			// For the progress report while waiting for the services to become stable
+			expectDescribeTasks("STOPPED"),
+			expectDescribeServices(2, 0, ecstypes.DeploymentRolloutStateCompleted),
+
+			// For ecs.ServicesStableWaiter
+			ecsMock.EXPECT().DescribeServices(testutil.AnyContext(), gomock.Any(), gomock.Any()).Return(&ecs.DescribeServicesOutput{
+				Services: []ecstypes.Service{
+					{
+						Deployments:  make([]ecstypes.Deployment, 1),
+						DesiredCount: 2,
+						RunningCount: 2,
+						Status:       aws.String("ACTIVE"),
+					},
+				},
+			}, nil),
+		)
+
+		var out bytes.Buffer
+		drainer, err := capacity.NewDrainer("test", 10, ecsMock, capacity.WithApprover(capacity.NewAutoApprover()), capacity.WithProgressReport(&out, &fakeLineCounter{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := drainer.Drain(ctx, []string{*instance.InstanceId}); err != nil {
+			t.Errorf("err = %#v; want nil", err)
+		}
+
+		rows := make([][]string, 0)
+		for _, line := range strings.Split(out.String(), "\n") {
+			if fields := strings.Fields(line); len(fields) > 0 && fields[0] == "foo" {
+				rows = append(rows, fields)
+			}
+		}
+		want := [][]string{
+			{"foo", "1", "1", "2", "IN_PROGRESS", "1"},
+			{"foo", "2", "0", "2", "COMPLETED", "0"},
+		}
+		if !reflect.DeepEqual(rows, want) {
+			t.Errorf("rows = %v; want %v", rows, want)
+		}
+	})
+
 	t.Run("without container instances", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
@@ -154,6 +1163,107 @@ func TestDrainer_Drain(t *testing.T) {
 	})
 }
 
+func TestDrainer_DrainCanary(t *testing.T) {
+	tests := []struct {
+		name          string
+		runningCounts []int32
+		wantErr       bool
+	}{
+		{
+			name:          "the services stay healthy",
+			runningCounts: []int32{2, 2},
+			wantErr:       false,
+		},
+		{
+			name:          "the running count drops",
+			runningCounts: []int32{2, 1},
+			wantErr:       true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx := context.Background()
+
+			ecsMock := capacitymock.NewMockECSAPI(ctrl)
+
+			instance := createInstance("ap-northeast-1a")
+			containerInstanceArn := fmt.Sprintf("arn:aws:ecs:ap-northeast-1:1234:container-instance/test/%s", *instance.InstanceId)
+			taskArn := "arn:aws:ecs:ap-northeast-1:123:task/test/00000000000000000000000000000000"
+
+			// For collecting the services and for Drain
+			ecsMock.EXPECT().ListContainerInstances(ctx, gomock.Any(), gomock.Any()).Times(2).Return(&ecs.ListContainerInstancesOutput{
+				ContainerInstanceArns: []string{containerInstanceArn},
+			}, nil)
+			ecsMock.EXPECT().DescribeContainerInstances(ctx, gomock.Any()).Times(2).Return(&ecs.DescribeContainerInstancesOutput{
+				ContainerInstances: []ecstypes.ContainerInstance{
+					{ContainerInstanceArn: aws.String(containerInstanceArn), Ec2InstanceId: instance.InstanceId},
+				},
+			}, nil)
+			ecsMock.EXPECT().ListTasks(ctx, gomock.Any(), gomock.Any()).Times(2).Return(&ecs.ListTasksOutput{
+				TaskArns: []string{taskArn},
+			}, nil)
+			ecsMock.EXPECT().DescribeTasks(ctx, gomock.Any()).Times(2).Return(&ecs.DescribeTasksOutput{
+				Tasks: []ecstypes.Task{
+					{Group: aws.String("service:foo"), TaskArn: aws.String(taskArn)},
+				},
+			}, nil)
+
+			ecsMock.EXPECT().UpdateContainerInstancesState(ctx, gomock.Any()).Return(&ecs.UpdateContainerInstancesStateOutput{}, nil)
+			// For ecs.TasksStoppedWaiter
+			ecsMock.EXPECT().DescribeTasks(testutil.AnyContext(), gomock.Any(), gomock.Any()).Return(&ecs.DescribeTasksOutput{
+				Tasks: []ecstypes.Task{{LastStatus: aws.String("STOPPED")}},
+			}, nil)
+			// For ecs.ServicesStableWaiter
+			ecsMock.EXPECT().DescribeServices(testutil.AnyContext(), gomock.Any(), gomock.Any()).Return(&ecs.DescribeServicesOutput{
+				Services: []ecstypes.Service{
+					{
+						Deployments:  make([]ecstypes.Deployment, 1),
+						DesiredCount: 2,
+						RunningCount: 2,
+						ServiceName:  aws.String("foo"),
+						Status:       aws.String("ACTIVE"),
+					},
+				},
+			}, nil)
+
+			// For the soak period
+			for _, count := range tt.runningCounts {
+				ecsMock.EXPECT().DescribeServices(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *ecs.DescribeServicesInput, _ ...func(*ecs.Options)) (*ecs.DescribeServicesOutput, error) {
+					if !reflect.DeepEqual(input.Services, []string{"foo"}) {
+						t.Errorf("Services = %v; want %v", input.Services, []string{"foo"})
+					}
+					return &ecs.DescribeServicesOutput{
+						Services: []ecstypes.Service{
+							{
+								DesiredCount: 2,
+								RunningCount: count,
+								ServiceName:  aws.String("foo"),
+							},
+						},
+					}, nil
+				})
+			}
+
+			drainer, err := capacity.NewDrainer("test", 10, ecsMock)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = drainer.DrainCanary(ctx, []string{*instance.InstanceId}, 10*time.Millisecond)
+			if tt.wantErr && err == nil {
+				t.Errorf("err = nil; want non-nil")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("err = %#v; want nil", err)
+			}
+		})
+	}
+}
+
 func TestDrainer_ProcessInterruptions(t *testing.T) {
 	t.Run("with container instances", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
@@ -312,3 +1422,18 @@ func TestDrainer_ProcessInterruptions(t *testing.T) {
 		}
 	})
 }
+
+type fakeLineCounter struct{}
+
+func (c *fakeLineCounter) CountLines() int {
+	return 0
+}
+
+type slowApprover struct {
+	delay time.Duration
+}
+
+func (a *slowApprover) Approve(ctx context.Context, description string) error {
+	time.Sleep(a.delay)
+	return nil
+}
@@ -0,0 +1,113 @@
+package capacity
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	autoscalingtypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"golang.org/x/xerrors"
+)
+
+// launchSpec represents what the auto scaling group launches now.
+type launchSpec struct {
+	launchTemplateID string
+	version          string
+	imageID          string
+	// instanceTypes is empty if any instance type is allowed
+	instanceTypes []string
+}
+
+func (asg *AutoScalingGroup) fetchLaunchSpec(ctx context.Context) (*launchSpec, error) {
+	var spec *autoscalingtypes.LaunchTemplateSpecification
+	instanceTypes := make([]string, 0)
+	anyInstanceType := false
+	switch {
+	case asg.LaunchTemplate != nil:
+		spec = asg.LaunchTemplate
+	case asg.MixedInstancesPolicy != nil && asg.MixedInstancesPolicy.LaunchTemplate != nil:
+		spec = asg.MixedInstancesPolicy.LaunchTemplate.LaunchTemplateSpecification
+		for _, o := range asg.MixedInstancesPolicy.LaunchTemplate.Overrides {
+			if o.LaunchTemplateSpecification != nil {
+				return nil, xerrors.New("launch templates specified in overrides are not supported")
+			}
+			if o.InstanceRequirements != nil {
+				// Any instance type that satisfies the requirements can be launched
+				anyInstanceType = true
+			}
+			if o.InstanceType != nil {
+				instanceTypes = append(instanceTypes, *o.InstanceType)
+			}
+		}
+	}
+	if spec == nil {
+		return nil, xerrors.Errorf("the auto scaling group %q doesn't use any launch template", *asg.AutoScalingGroupName)
+	}
+
+	version := aws.ToString(spec.Version)
+	if version == "" {
+		version = "$Default"
+	}
+	resp, err := asg.ec2Svc.DescribeLaunchTemplateVersions(ctx, &ec2.DescribeLaunchTemplateVersionsInput{
+		LaunchTemplateId:   spec.LaunchTemplateId,
+		LaunchTemplateName: spec.LaunchTemplateName,
+		ResolveAlias:       aws.Bool(true),
+		Versions:           []string{version},
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("failed to describe launch template versions: %w", err)
+	}
+	if len(resp.LaunchTemplateVersions) == 0 {
+		return nil, xerrors.Errorf("the version %s of the launch template doesn't exist", version)
+	}
+
+	v := resp.LaunchTemplateVersions[0]
+	ls := &launchSpec{
+		launchTemplateID: *v.LaunchTemplateId,
+		version:          fmt.Sprint(*v.VersionNumber),
+	}
+	if v.LaunchTemplateData != nil {
+		ls.imageID = aws.ToString(v.LaunchTemplateData.ImageId)
+		if len(instanceTypes) == 0 && v.LaunchTemplateData.InstanceType != "" {
+			instanceTypes = append(instanceTypes, string(v.LaunchTemplateData.InstanceType))
+		}
+	}
+	if !anyInstanceType {
+		ls.instanceTypes = instanceTypes
+	}
+
+	return ls, nil
+}
+
+// newDriftDetector returns a function that reports whether the instance differs from what the auto scaling group
+// launches now in the launch template version, the AMI ID, or the instance type.
+func (asg *AutoScalingGroup) newDriftDetector(ctx context.Context) (func(ec2types.Instance) bool, error) {
+	spec, err := asg.fetchLaunchSpec(ctx)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to fetch the launch specification: %w", err)
+	}
+
+	idToInstance := make(map[string]autoscalingtypes.Instance, len(asg.Instances))
+	for _, i := range asg.Instances {
+		idToInstance[*i.InstanceId] = i
+	}
+
+	return func(i ec2types.Instance) bool {
+		lt := idToInstance[*i.InstanceId].LaunchTemplate
+		if lt == nil || aws.ToString(lt.LaunchTemplateId) != spec.launchTemplateID {
+			return true
+		}
+		// Versions such as "$Latest" can't be compared, so rely on the AMI ID and the instance type in that case
+		if !strings.HasPrefix(aws.ToString(lt.Version), "$") && aws.ToString(lt.Version) != spec.version {
+			return true
+		}
+		if spec.imageID != "" && aws.ToString(i.ImageId) != spec.imageID {
+			return true
+		}
+		return len(spec.instanceTypes) > 0 && !slices.Contains(spec.instanceTypes, string(i.InstanceType))
+	}, nil
+}
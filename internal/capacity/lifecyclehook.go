@@ -0,0 +1,196 @@
+package capacity
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	autoscalingtypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"golang.org/x/xerrors"
+)
+
+const lifecycleTransitionTerminating = "autoscaling:EC2_INSTANCE_TERMINATING"
+
+// cf. https://docs.aws.amazon.com/autoscaling/ec2/userguide/prepare-for-lifecycle-notifications.html
+type lifecycleActionEvent struct {
+	Detail lifecycleActionDetail `json:"detail"`
+}
+
+type lifecycleActionDetail struct {
+	AutoScalingGroupName string `json:"AutoScalingGroupName"`
+	EC2InstanceID        string `json:"EC2InstanceId"`
+	LifecycleActionToken string `json:"LifecycleActionToken"`
+	LifecycleHookName    string `json:"LifecycleHookName"`
+	LifecycleTransition  string `json:"LifecycleTransition"`
+}
+
+// DrainTerminatingInstances keeps draining instances notified by the lifecycle hook for
+// "autoscaling:EC2_INSTANCE_TERMINATING" and completing their lifecycle actions until ctx is canceled.
+func (asg *AutoScalingGroup) DrainTerminatingInstances(ctx context.Context, drainer Drainer, cluster Cluster, poller Poller, heartbeatInterval time.Duration) {
+	log.Printf("Wait for instances in the auto scaling group %q to be terminated\n", *asg.AutoScalingGroupName)
+	poller.Poll(ctx, func(messages []sqstypes.Message) ([]sqstypes.DeleteMessageBatchRequestEntry, error) {
+		return asg.processLifecycleActions(ctx, messages, drainer, cluster, heartbeatInterval)
+	})
+}
+
+// processLifecycleActions returns the entries of only the messages whose lifecycle actions are handled, so that the
+// other messages become visible again. If draining fails, the lifecycle actions aren't completed and are retried
+// because completing them terminates the instances whose tasks haven't been drained. The lifecycle actions of the
+// instances not registered in the cluster are completed without draining because they have nothing to drain.
+func (asg *AutoScalingGroup) processLifecycleActions(ctx context.Context, messages []sqstypes.Message, drainer Drainer, cluster Cluster, heartbeatInterval time.Duration) ([]sqstypes.DeleteMessageBatchRequestEntry, error) {
+	if len(messages) == 0 {
+		return nil, nil
+	}
+
+	actions := make([]lifecycleActionDetail, 0, len(messages))
+	actionEntries := make([]sqstypes.DeleteMessageBatchRequestEntry, 0, len(messages))
+	for _, m := range messages {
+		var e lifecycleActionEvent
+		if err := json.Unmarshal([]byte(*m.Body), &e); err != nil {
+			return nil, xerrors.Errorf("failed to parse the message: %s: %w", *m.Body, err)
+		}
+
+		if e.Detail.AutoScalingGroupName != *asg.AutoScalingGroupName || e.Detail.LifecycleTransition != lifecycleTransitionTerminating {
+			log.Printf("Ignore the lifecycle action %q of the instance %s in the auto scaling group %q\n",
+				e.Detail.LifecycleTransition, e.Detail.EC2InstanceID, e.Detail.AutoScalingGroupName)
+			continue
+		}
+		actions = append(actions, e.Detail)
+		actionEntries = append(actionEntries, sqstypes.DeleteMessageBatchRequestEntry{
+			Id:            m.MessageId,
+			ReceiptHandle: m.ReceiptHandle,
+		})
+	}
+
+	if len(actions) == 0 {
+		return nil, nil
+	}
+
+	// The lifecycle actions of the instances that are no longer waiting have timed out or have been completed
+	// by others, so their messages are deleted without draining the instances
+	if err := asg.reload(ctx); err != nil {
+		return nil, err
+	}
+	entries := make([]sqstypes.DeleteMessageBatchRequestEntry, 0, len(actions))
+	waitingActions := make([]lifecycleActionDetail, 0, len(actions))
+	waitingEntries := make([]sqstypes.DeleteMessageBatchRequestEntry, 0, len(actions))
+	instanceIDs := make([]string, 0, len(actions))
+	for i, a := range actions {
+		if !asg.isWaitingForTermination(a.EC2InstanceID) {
+			log.Printf("Ignore the lifecycle action of the instance %s that is no longer waiting\n", a.EC2InstanceID)
+			entries = append(entries, actionEntries[i])
+			continue
+		}
+		waitingActions = append(waitingActions, a)
+		waitingEntries = append(waitingEntries, actionEntries[i])
+		instanceIDs = append(instanceIDs, a.EC2InstanceID)
+	}
+
+	if len(waitingActions) == 0 {
+		return entries, nil
+	}
+
+	// Draining fails if any of the instances isn't registered in the cluster, e.g. an unhealthy instance that has
+	// never joined it, so such instances are terminated right away
+	containerInstances, err := cluster.ContainerInstances(ctx, instanceIDs)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to fetch container instances: %w", err)
+	}
+	registered := make(map[string]bool, len(containerInstances))
+	for _, ci := range containerInstances {
+		registered[aws.ToString(ci.Ec2InstanceId)] = true
+	}
+	registeredActions := make([]lifecycleActionDetail, 0, len(waitingActions))
+	registeredEntries := make([]sqstypes.DeleteMessageBatchRequestEntry, 0, len(waitingActions))
+	registeredInstanceIDs := make([]string, 0, len(waitingActions))
+	for i, a := range waitingActions {
+		if !registered[a.EC2InstanceID] {
+			log.Printf("The instance %s isn't registered in the cluster, so it is terminated without draining\n", a.EC2InstanceID)
+			asg.completeLifecycleAction(ctx, a)
+			entries = append(entries, waitingEntries[i])
+			continue
+		}
+		registeredActions = append(registeredActions, a)
+		registeredEntries = append(registeredEntries, waitingEntries[i])
+		registeredInstanceIDs = append(registeredInstanceIDs, a.EC2InstanceID)
+	}
+
+	if len(registeredActions) == 0 {
+		return entries, nil
+	}
+
+	ctxForHeartbeat, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		asg.recordLifecycleActionHeartbeats(ctxForHeartbeat, registeredActions, heartbeatInterval)
+	}()
+
+	err = drainer.Drain(ctx, registeredInstanceIDs)
+	cancel()
+	wg.Wait()
+	if err != nil {
+		log.Printf("[WARNING] Failed to drain the instances %v, so their lifecycle actions will be retried until the lifecycle hook times out: %+v\n", registeredInstanceIDs, err)
+		return entries, nil
+	}
+
+	for _, a := range registeredActions {
+		asg.completeLifecycleAction(ctx, a)
+	}
+
+	return append(entries, registeredEntries...), nil
+}
+
+func (asg *AutoScalingGroup) completeLifecycleAction(ctx context.Context, a lifecycleActionDetail) {
+	log.Printf("Complete the lifecycle action of the instance %s\n", a.EC2InstanceID)
+	_, err := asg.asSvc.CompleteLifecycleAction(ctx, &autoscaling.CompleteLifecycleActionInput{
+		AutoScalingGroupName:  aws.String(a.AutoScalingGroupName),
+		InstanceId:            aws.String(a.EC2InstanceID),
+		LifecycleActionResult: aws.String("CONTINUE"),
+		LifecycleActionToken:  aws.String(a.LifecycleActionToken),
+		LifecycleHookName:     aws.String(a.LifecycleHookName),
+	})
+	if err != nil {
+		log.Printf("[WARNING] failed to complete the lifecycle action of the instance %s: %+v\n", a.EC2InstanceID, err)
+	}
+}
+
+// isWaitingForTermination reports whether the instance is waiting for its lifecycle action to be completed.
+func (asg *AutoScalingGroup) isWaitingForTermination(instanceID string) bool {
+	for _, i := range asg.Instances {
+		if *i.InstanceId == instanceID {
+			return i.LifecycleState == autoscalingtypes.LifecycleStateTerminating || i.LifecycleState == autoscalingtypes.LifecycleStateTerminatingWait
+		}
+	}
+	return false
+}
+
+func (asg *AutoScalingGroup) recordLifecycleActionHeartbeats(ctx context.Context, actions []lifecycleActionDetail, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, a := range actions {
+				_, err := asg.asSvc.RecordLifecycleActionHeartbeat(ctx, &autoscaling.RecordLifecycleActionHeartbeatInput{
+					AutoScalingGroupName: aws.String(a.AutoScalingGroupName),
+					InstanceId:           aws.String(a.EC2InstanceID),
+					LifecycleActionToken: aws.String(a.LifecycleActionToken),
+					LifecycleHookName:    aws.String(a.LifecycleHookName),
+				})
+				if err != nil && ctx.Err() == nil {
+					log.Printf("[WARNING] failed to record the heartbeat of the instance %s: %+v\n", a.EC2InstanceID, err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package capacity_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	autoscalingtypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"go.uber.org/mock/gomock"
+
+	"github.com/abicky/ecsmec/internal/capacity"
+	"github.com/abicky/ecsmec/internal/testing/capacitymock"
+	"github.com/abicky/ecsmec/internal/testing/testutil"
+)
+
+func createLifecycleActionMessage(groupName, instanceID, transition string) sqstypes.Message {
+	return sqstypes.Message{
+		Body: aws.String(fmt.Sprintf(`{
+  "version": "0",
+  "detail-type": "EC2 Instance-terminate Lifecycle Action",
+  "source": "aws.autoscaling",
+  "detail": {
+    "LifecycleActionToken": "token-%[2]s",
+    "AutoScalingGroupName": "%[1]s",
+    "LifecycleHookName": "hook-name",
+    "EC2InstanceId": "%[2]s",
+    "LifecycleTransition": "%[3]s"
+  }
+}`, groupName, instanceID, transition)),
+		MessageId:     aws.String("message-" + instanceID),
+		ReceiptHandle: aws.String("receipt-handle-" + instanceID),
+	}
+}
+
+func TestAutoScalingGroup_DrainTerminatingInstances(t *testing.T) {
+	instances := append(
+		createInstances("ap-northeast-1a", 1),
+		createInstances("ap-northeast-1c", 1)...,
+	)
+	instanceIDs := []string{*instances[0].InstanceId, *instances[1].InstanceId}
+
+	terminatingInstances := slices.Clone(instances)
+	for i := range terminatingInstances {
+		terminatingInstances[i].LifecycleState = autoscalingtypes.LifecycleStateTerminatingWait
+	}
+
+	messages := []sqstypes.Message{
+		createLifecycleActionMessage("autoscaling-group-name", instanceIDs[0], "autoscaling:EC2_INSTANCE_TERMINATING"),
+		createLifecycleActionMessage("another-autoscaling-group-name", "i-000000000000", "autoscaling:EC2_INSTANCE_TERMINATING"),
+		createLifecycleActionMessage("autoscaling-group-name", instanceIDs[1], "autoscaling:EC2_INSTANCE_TERMINATING"),
+		createLifecycleActionMessage("autoscaling-group-name", "i-111111111111", "autoscaling:EC2_INSTANCE_LAUNCHING"),
+	}
+	handledMessageIDs := []string{*messages[0].MessageId, *messages[2].MessageId}
+
+	expectDescribeAutoScalingGroups := func(asMock *capacitymock.MockAutoScalingAPI, instances []autoscalingtypes.Instance) *gomock.Call {
+		return asMock.EXPECT().DescribeAutoScalingGroups(gomock.Any(), gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+				{
+					AutoScalingGroupName: aws.String("autoscaling-group-name"),
+					DesiredCapacity:      aws.Int32(int32(len(instances))),
+					Instances:            instances,
+					MaxSize:              aws.Int32(int32(len(instances))),
+				},
+			},
+		}, nil)
+	}
+
+	messageIDs := func(entries []sqstypes.DeleteMessageBatchRequestEntry) []string {
+		ids := make([]string, len(entries))
+		for i, e := range entries {
+			ids[i] = *e.Id
+		}
+		return ids
+	}
+
+	t.Run("the instances are drained", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+		ec2Mock := capacitymock.NewMockEC2API(ctrl)
+		drainerMock := capacitymock.NewMockDrainer(ctrl)
+		pollerMock := capacitymock.NewMockPoller(ctrl)
+		clusterMock := capacitymock.NewMockCluster(ctrl)
+		clusterMock.EXPECT().ContainerInstances(ctx, gomock.Any()).Return(createContainerInstances(instances), nil).AnyTimes()
+
+		gomock.InOrder(
+			expectDescribeAutoScalingGroups(asMock, instances),
+			expectDescribeAutoScalingGroups(asMock, terminatingInstances),
+		)
+
+		asMock.EXPECT().RecordLifecycleActionHeartbeat(testutil.AnyContext(), gomock.Any()).MinTimes(len(instanceIDs)).Do(func(_ context.Context, input *autoscaling.RecordLifecycleActionHeartbeatInput, _ ...func(*autoscaling.Options)) {
+			if *input.LifecycleActionToken != "token-"+*input.InstanceId {
+				t.Errorf("LifecycleActionToken = %s; want %s", *input.LifecycleActionToken, "token-"+*input.InstanceId)
+			}
+		})
+
+		pollerMock.EXPECT().Poll(ctx, gomock.Any()).Do(func(_ context.Context, callback func([]sqstypes.Message) ([]sqstypes.DeleteMessageBatchRequestEntry, error)) {
+			entries, err := callback(messages)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The ignored messages must not be deleted so that they become visible again
+			if got := messageIDs(entries); !testutil.MatchSlice(got, handledMessageIDs) {
+				t.Errorf("message IDs = %v; want %v", got, handledMessageIDs)
+			}
+		})
+
+		gomock.InOrder(
+			drainerMock.EXPECT().Drain(ctx, instanceIDs).Do(func(_ context.Context, _ []string) {
+				// Wait for heartbeats to be recorded
+				time.Sleep(50 * time.Millisecond)
+			}),
+
+			asMock.EXPECT().CompleteLifecycleAction(ctx, gomock.Any()).Times(len(instanceIDs)).Do(func(_ context.Context, input *autoscaling.CompleteLifecycleActionInput, _ ...func(*autoscaling.Options)) {
+				if *input.AutoScalingGroupName != "autoscaling-group-name" {
+					t.Errorf("AutoScalingGroupName = %s; want %s", *input.AutoScalingGroupName, "autoscaling-group-name")
+				}
+				if *input.LifecycleHookName != "hook-name" {
+					t.Errorf("LifecycleHookName = %s; want %s", *input.LifecycleHookName, "hook-name")
+				}
+				if *input.LifecycleActionResult != "CONTINUE" {
+					t.Errorf("LifecycleActionResult = %s; want %s", *input.LifecycleActionResult, "CONTINUE")
+				}
+			}),
+		)
+
+		group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		group.DrainTerminatingInstances(ctx, drainerMock, clusterMock, pollerMock, 10*time.Millisecond)
+	})
+
+	t.Run("draining fails", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+		ec2Mock := capacitymock.NewMockEC2API(ctrl)
+		drainerMock := capacitymock.NewMockDrainer(ctrl)
+		pollerMock := capacitymock.NewMockPoller(ctrl)
+		clusterMock := capacitymock.NewMockCluster(ctrl)
+		clusterMock.EXPECT().ContainerInstances(ctx, gomock.Any()).Return(createContainerInstances(instances), nil).AnyTimes()
+
+		gomock.InOrder(
+			expectDescribeAutoScalingGroups(asMock, instances),
+			expectDescribeAutoScalingGroups(asMock, terminatingInstances),
+		)
+		asMock.EXPECT().RecordLifecycleActionHeartbeat(testutil.AnyContext(), gomock.Any()).AnyTimes()
+
+		pollerMock.EXPECT().Poll(ctx, gomock.Any()).Do(func(_ context.Context, callback func([]sqstypes.Message) ([]sqstypes.DeleteMessageBatchRequestEntry, error)) {
+			entries, err := callback(messages)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The messages must not be deleted so that the lifecycle actions are retried
+			if len(entries) != 0 {
+				t.Errorf("message IDs = %v; want none", messageIDs(entries))
+			}
+		})
+
+		// The lifecycle actions must not be completed, otherwise the instances are terminated without being drained
+		drainerMock.EXPECT().Drain(ctx, instanceIDs).Return(errors.New("failed to drain"))
+
+		group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		group.DrainTerminatingInstances(ctx, drainerMock, clusterMock, pollerMock, 10*time.Millisecond)
+	})
+
+	t.Run("some instances are not registered in the cluster", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+		ec2Mock := capacitymock.NewMockEC2API(ctrl)
+		drainerMock := capacitymock.NewMockDrainer(ctrl)
+		pollerMock := capacitymock.NewMockPoller(ctrl)
+		clusterMock := capacitymock.NewMockCluster(ctrl)
+
+		gomock.InOrder(
+			expectDescribeAutoScalingGroups(asMock, instances),
+			expectDescribeAutoScalingGroups(asMock, terminatingInstances),
+		)
+		asMock.EXPECT().RecordLifecycleActionHeartbeat(testutil.AnyContext(), gomock.Any()).AnyTimes()
+
+		pollerMock.EXPECT().Poll(ctx, gomock.Any()).Do(func(_ context.Context, callback func([]sqstypes.Message) ([]sqstypes.DeleteMessageBatchRequestEntry, error)) {
+			entries, err := callback(messages)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := messageIDs(entries); !testutil.MatchSlice(got, handledMessageIDs) {
+				t.Errorf("message IDs = %v; want %v", got, handledMessageIDs)
+			}
+		})
+
+		// The first instance has never joined the cluster
+		completedInstanceIDs := make([]string, 0)
+		gomock.InOrder(
+			clusterMock.EXPECT().ContainerInstances(ctx, instanceIDs).Return(createContainerInstances(instances[1:]), nil),
+			asMock.EXPECT().CompleteLifecycleAction(ctx, gomock.Any()).Do(func(_ context.Context, input *autoscaling.CompleteLifecycleActionInput, _ ...func(*autoscaling.Options)) {
+				completedInstanceIDs = append(completedInstanceIDs, *input.InstanceId)
+			}),
+			drainerMock.EXPECT().Drain(ctx, instanceIDs[1:]),
+			asMock.EXPECT().CompleteLifecycleAction(ctx, gomock.Any()).Do(func(_ context.Context, input *autoscaling.CompleteLifecycleActionInput, _ ...func(*autoscaling.Options)) {
+				completedInstanceIDs = append(completedInstanceIDs, *input.InstanceId)
+			}),
+		)
+
+		group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		group.DrainTerminatingInstances(ctx, drainerMock, clusterMock, pollerMock, 10*time.Millisecond)
+
+		if !slices.Equal(completedInstanceIDs, instanceIDs) {
+			t.Errorf("completed instance IDs = %v; want %v", completedInstanceIDs, instanceIDs)
+		}
+	})
+
+	t.Run("the lifecycle action is no longer waiting", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+		ec2Mock := capacitymock.NewMockEC2API(ctrl)
+		drainerMock := capacitymock.NewMockDrainer(ctrl)
+		pollerMock := capacitymock.NewMockPoller(ctrl)
+		clusterMock := capacitymock.NewMockCluster(ctrl)
+		clusterMock.EXPECT().ContainerInstances(ctx, gomock.Any()).Return(createContainerInstances(instances), nil).AnyTimes()
+
+		// The lifecycle action of the first instance has timed out
+		gomock.InOrder(
+			expectDescribeAutoScalingGroups(asMock, instances),
+			expectDescribeAutoScalingGroups(asMock, terminatingInstances[1:]),
+		)
+		asMock.EXPECT().RecordLifecycleActionHeartbeat(testutil.AnyContext(), gomock.Any()).AnyTimes()
+
+		pollerMock.EXPECT().Poll(ctx, gomock.Any()).Do(func(_ context.Context, callback func([]sqstypes.Message) ([]sqstypes.DeleteMessageBatchRequestEntry, error)) {
+			entries, err := callback(messages)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := messageIDs(entries); !testutil.MatchSlice(got, handledMessageIDs) {
+				t.Errorf("message IDs = %v; want %v", got, handledMessageIDs)
+			}
+		})
+
+		gomock.InOrder(
+			drainerMock.EXPECT().Drain(ctx, instanceIDs[1:]),
+			asMock.EXPECT().CompleteLifecycleAction(ctx, gomock.Any()).Do(func(_ context.Context, input *autoscaling.CompleteLifecycleActionInput, _ ...func(*autoscaling.Options)) {
+				if *input.InstanceId != instanceIDs[1] {
+					t.Errorf("InstanceId = %s; want %s", *input.InstanceId, instanceIDs[1])
+				}
+			}),
+		)
+
+		group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		group.DrainTerminatingInstances(ctx, drainerMock, clusterMock, pollerMock, 10*time.Millisecond)
+	})
+}
@@ -0,0 +1,209 @@
+package capacity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"golang.org/x/xerrors"
+
+	"github.com/abicky/ecsmec/internal/const/ecsconst"
+)
+
+var ErrInsufficientCapacity = errors.New("insufficient capacity")
+
+type taskResources struct {
+	// serviceName is empty if the task doesn't belong to a service
+	serviceName string
+	cpu         int
+	memory      int
+}
+
+type instanceResources struct {
+	cpu    int
+	memory int
+}
+
+// checkCapacity checks whether the tasks of the services running on the container instances fit on the remaining
+// ACTIVE container instances, and returns an error wrapping ErrInsufficientCapacity if they don't.
+// Tasks of daemon services are ignored because they are not replaced, and so are tasks that don't belong to a service
+// unless the drainer relaunches them.
+func (d *drainer) checkCapacity(ctx context.Context, instances []ecstypes.ContainerInstance) error {
+	arns := make([]string, len(instances))
+	for i, instance := range instances {
+		arns[i] = *instance.ContainerInstanceArn
+	}
+
+	tasks := make([]taskResources, 0)
+	serviceNames := make([]string, 0)
+	for _, instance := range instances {
+		err := d.processTasks(ctx, instance.ContainerInstanceArn, func(t ecstypes.Task) error {
+			serviceName, ok := getServiceName(t)
+			if !ok {
+				if !d.relaunch {
+					return nil
+				}
+				serviceName = ""
+			} else if !slices.Contains(serviceNames, serviceName) {
+				serviceNames = append(serviceNames, serviceName)
+			}
+			cpu, memory := getTaskResources(t)
+			tasks = append(tasks, taskResources{serviceName: serviceName, cpu: cpu, memory: memory})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(tasks) == 0 {
+		return nil
+	}
+
+	services := make(map[string]ecstypes.Service, len(serviceNames))
+	for names := range slices.Chunk(serviceNames, ecsconst.MaxDescribableServices) {
+		resp, err := d.ecsSvc.DescribeServices(ctx, &ecs.DescribeServicesInput{
+			Cluster:  aws.String(d.cluster),
+			Services: names,
+		})
+		if err != nil {
+			return xerrors.Errorf("failed to describe services: %w", err)
+		}
+		for _, s := range resp.Services {
+			services[*s.ServiceName] = s
+		}
+	}
+
+	remaining, err := d.fetchRemainingResources(ctx, arns)
+	if err != nil {
+		return xerrors.Errorf("failed to fetch remaining resources: %w", err)
+	}
+
+	problems := make([]string, 0)
+	for _, name := range serviceNames {
+		s := services[name]
+		if s.SchedulingStrategy == ecstypes.SchedulingStrategyDaemon {
+			continue
+		}
+		for _, c := range s.PlacementConstraints {
+			if c.Type == ecstypes.PlacementConstraintTypeDistinctInstance && int(s.DesiredCount) > len(remaining) {
+				problems = append(problems, fmt.Sprintf("the service %q requires %d distinct instances but only %d instances will remain", name, s.DesiredCount, len(remaining)))
+			}
+		}
+	}
+
+	// Place larger tasks first (first-fit decreasing) to reduce the effect of fragmentation
+	slices.SortStableFunc(tasks, func(a, b taskResources) int {
+		if a.memory != b.memory {
+			return b.memory - a.memory
+		}
+		return b.cpu - a.cpu
+	})
+	unplacedCounts := make(map[string]int)
+	for _, t := range tasks {
+		if t.serviceName != "" && services[t.serviceName].SchedulingStrategy == ecstypes.SchedulingStrategyDaemon {
+			continue
+		}
+		placed := false
+		for i := range remaining {
+			if remaining[i].cpu >= t.cpu && remaining[i].memory >= t.memory {
+				remaining[i].cpu -= t.cpu
+				remaining[i].memory -= t.memory
+				placed = true
+				break
+			}
+		}
+		if !placed {
+			unplacedCounts[t.serviceName]++
+		}
+	}
+	for _, name := range serviceNames {
+		if count := unplacedCounts[name]; count > 0 {
+			problems = append(problems, fmt.Sprintf("%d tasks of the service %q don't fit on the remaining instances", count, name))
+		}
+	}
+	if count := unplacedCounts[""]; count > 0 {
+		problems = append(problems, fmt.Sprintf("%d standalone tasks to relaunch don't fit on the remaining instances", count))
+	}
+
+	if len(problems) > 0 {
+		return xerrors.Errorf("%s: %w", strings.Join(problems, ", "), ErrInsufficientCapacity)
+	}
+	return nil
+}
+
+// fetchRemainingResources returns the remaining resources of the ACTIVE container instances except the specified ones.
+func (d *drainer) fetchRemainingResources(ctx context.Context, excludedArns []string) ([]instanceResources, error) {
+	resources := make([]instanceResources, 0)
+	params := &ecs.ListContainerInstancesInput{
+		Cluster: aws.String(d.cluster),
+		Status:  ecstypes.ContainerInstanceStatusActive,
+	}
+
+	paginator := ecs.NewListContainerInstancesPaginator(d.ecsSvc, params)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to list container instances: %w", err)
+		}
+		if len(page.ContainerInstanceArns) == 0 {
+			break
+		}
+
+		resp, err := d.ecsSvc.DescribeContainerInstances(ctx, &ecs.DescribeContainerInstancesInput{
+			Cluster:            aws.String(d.cluster),
+			ContainerInstances: page.ContainerInstanceArns,
+		})
+		if err != nil {
+			return nil, xerrors.Errorf("failed to describe container instances: %w", err)
+		}
+
+		for _, instance := range resp.ContainerInstances {
+			// The status might have been changed after the instances were listed
+			if aws.ToString(instance.Status) != string(ecstypes.ContainerInstanceStatusActive) || slices.Contains(excludedArns, *instance.ContainerInstanceArn) {
+				continue
+			}
+
+			var r instanceResources
+			for _, resource := range instance.RemainingResources {
+				switch aws.ToString(resource.Name) {
+				case "CPU":
+					r.cpu = int(resource.IntegerValue)
+				case "MEMORY":
+					r.memory = int(resource.IntegerValue)
+				}
+			}
+			resources = append(resources, r)
+		}
+	}
+
+	return resources, nil
+}
+
+// getTaskResources returns the CPU units and the memory (MiB) reserved by the task.
+// If the task doesn't have task-level values, the values of its containers are summed up.
+func getTaskResources(t ecstypes.Task) (int, int) {
+	cpu, cpuErr := strconv.Atoi(aws.ToString(t.Cpu))
+	memory, memoryErr := strconv.Atoi(aws.ToString(t.Memory))
+	if cpuErr == nil && memoryErr == nil {
+		return cpu, memory
+	}
+
+	cpu, memory = 0, 0
+	for _, c := range t.Containers {
+		if v, err := strconv.Atoi(aws.ToString(c.Cpu)); err == nil {
+			cpu += v
+		}
+		if v, err := strconv.Atoi(aws.ToString(c.Memory)); err == nil {
+			memory += v
+		} else if v, err := strconv.Atoi(aws.ToString(c.MemoryReservation)); err == nil {
+			memory += v
+		}
+	}
+	return cpu, memory
+}
@@ -0,0 +1,100 @@
+package capacity
+
+import (
+	"context"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	autoscalingtypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"golang.org/x/xerrors"
+)
+
+// DefaultSuspendedProcesses are the scaling processes that change the desired capacity or terminate instances
+// on their own, which conflicts with the operations of ecsmec.
+var DefaultSuspendedProcesses = []string{"AZRebalance", "AlarmNotification", "ScheduledActions"}
+
+// SuspendProcesses suspends the scaling processes for the duration of an operation.
+// The processes suspended beforehand are saved in the tag "ecsmec:OriginalSuspendedProcesses" unless they have been
+// saved by the interrupted operation, so that ResumeProcesses can restore them exactly.
+func (asg *AutoScalingGroup) SuspendProcesses(ctx context.Context, processes []string) error {
+	if len(processes) == 0 {
+		return nil
+	}
+
+	if asg.OriginalSuspendedProcesses == nil {
+		original := make([]string, len(asg.SuspendedProcesses))
+		for i, p := range asg.SuspendedProcesses {
+			original[i] = *p.ProcessName
+		}
+
+		// Save the tag first so that the original processes can be restored even if the operation is interrupted
+		_, err := asg.asSvc.CreateOrUpdateTags(ctx, &autoscaling.CreateOrUpdateTagsInput{
+			Tags: []autoscalingtypes.Tag{
+				asg.createTag("ecsmec:OriginalSuspendedProcesses", strings.Join(original, ",")),
+			},
+		})
+		if err != nil {
+			return xerrors.Errorf("failed to create or update tags: %w", err)
+		}
+	}
+
+	log.Printf("Suspend the processes of the auto scaling group %q: %v\n", *asg.AutoScalingGroupName, processes)
+	_, err := asg.asSvc.SuspendProcesses(ctx, &autoscaling.SuspendProcessesInput{
+		AutoScalingGroupName: asg.AutoScalingGroupName,
+		ScalingProcesses:     processes,
+	})
+	if err != nil {
+		return xerrors.Errorf("failed to suspend processes: %w", err)
+	}
+
+	return asg.reload(ctx)
+}
+
+// ResumeProcesses resumes the scaling processes suspended by SuspendProcesses, keeping the ones suspended beforehand.
+func (asg *AutoScalingGroup) ResumeProcesses(ctx context.Context) error {
+	if asg.OriginalSuspendedProcesses == nil {
+		return nil
+	}
+
+	// The processes might have been changed during the operation
+	if err := asg.reload(ctx); err != nil {
+		return err
+	}
+
+	processes := make([]string, 0)
+	for _, p := range asg.SuspendedProcesses {
+		if !slices.Contains(asg.OriginalSuspendedProcesses, *p.ProcessName) {
+			processes = append(processes, *p.ProcessName)
+		}
+	}
+
+	if len(processes) > 0 {
+		log.Printf("Resume the processes of the auto scaling group %q: %v\n", *asg.AutoScalingGroupName, processes)
+		_, err := asg.asSvc.ResumeProcesses(ctx, &autoscaling.ResumeProcessesInput{
+			AutoScalingGroupName: asg.AutoScalingGroupName,
+			ScalingProcesses:     processes,
+		})
+		if err != nil {
+			return xerrors.Errorf("failed to resume processes: %w", err)
+		}
+	}
+
+	_, err := asg.asSvc.DeleteTags(ctx, &autoscaling.DeleteTagsInput{
+		Tags: []autoscalingtypes.Tag{
+			asg.createTag("ecsmec:OriginalSuspendedProcesses", strings.Join(asg.OriginalSuspendedProcesses, ",")),
+		},
+	})
+	if err != nil {
+		return xerrors.Errorf("failed to delete tags: %w", err)
+	}
+
+	return asg.reload(ctx)
+}
+
+func (asg *AutoScalingGroup) isProcessSuspended(name string) bool {
+	return slices.ContainsFunc(asg.SuspendedProcesses, func(p autoscalingtypes.SuspendedProcess) bool {
+		return *p.ProcessName == name
+	})
+}
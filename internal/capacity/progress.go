@@ -0,0 +1,193 @@
+package capacity
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"golang.org/x/xerrors"
+
+	"github.com/abicky/ecsmec/internal/const/ecsconst"
+)
+
+const (
+	interactiveProgressInterval = 5 * time.Second
+	plainProgressInterval       = 30 * time.Second
+	standaloneTasksLabel        = "(standalone tasks)"
+)
+
+type serviceProgress struct {
+	name         string
+	running      int32
+	pending      int32
+	desired      int32
+	rolloutState string
+	// remaining is the number of the tasks left on the draining container instances
+	remaining int
+}
+
+// LineCounter counts the lines logged so that the interactive progress report doesn't erase the logs printed after it.
+type LineCounter interface {
+	// CountLines returns the number of lines logged since the last call.
+	CountLines() int
+}
+
+type progressReporter struct {
+	d *drainer
+	// tasks is the tasks on the draining container instances that haven't stopped as of the previous report
+	tasks        []ecstypes.Task
+	serviceNames []string
+	// lineCount is the number of lines printed last time, which are erased on redraw
+	lineCount int
+}
+
+// startProgressReportIfEnabled starts reporting the progress if the drainer is configured to do so, and returns the
+// function to stop it.
+func (d *drainer) startProgressReportIfEnabled(ctx context.Context, tasks []ecstypes.Task, serviceNames []string) func() {
+	if d.progressOut == nil {
+		return func() {}
+	}
+	return d.startProgressReport(ctx, tasks, serviceNames)
+}
+
+// startProgressReport reports the progress of draining the container instances immediately and then periodically
+// until the returned function is called.
+func (d *drainer) startProgressReport(ctx context.Context, tasks []ecstypes.Task, serviceNames []string) func() {
+	r := &progressReporter{d: d, tasks: tasks, serviceNames: serviceNames}
+	if d.logLines != nil {
+		// Lines logged before the first report don't matter
+		d.logLines.CountLines()
+	}
+	r.report(ctx)
+
+	interval := plainProgressInterval
+	if d.logLines != nil {
+		interval = interactiveProgressInterval
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.report(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+func (r *progressReporter) report(ctx context.Context) {
+	progress, err := r.fetchProgress(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("[WARNING] failed to fetch the progress: %v\n", err)
+		}
+		return
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Progress of draining in the cluster %q at %s:\n", r.d.cluster, time.Now().Format(time.RFC3339))
+	w := tabwriter.NewWriter(&sb, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tRUNNING\tPENDING\tDESIRED\tROLLOUT\tLEFT ON DRAINING INSTANCES")
+	for _, p := range progress {
+		if p.name == standaloneTasksLabel {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t-\t%d\n", p.name, p.remaining)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t%d\n", p.name, p.running, p.pending, p.desired, p.rolloutState, p.remaining)
+	}
+	w.Flush()
+	text := sb.String()
+
+	if r.d.logLines == nil {
+		for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+			log.Println(line)
+		}
+		return
+	}
+
+	// If something has been logged since the previous report, the report is no longer at the bottom, so it is left
+	// as it is and the new report is printed below the logs
+	if r.lineCount > 0 && r.d.logLines.CountLines() == 0 {
+		// Move the cursor to the beginning of the previous report and erase it
+		fmt.Fprintf(r.d.progressOut, "\x1b[%dA\x1b[J", r.lineCount)
+	}
+	fmt.Fprint(r.d.progressOut, text)
+	r.lineCount = strings.Count(text, "\n")
+}
+
+func (r *progressReporter) fetchProgress(ctx context.Context) ([]serviceProgress, error) {
+	// Only the tasks known at the start are polled because no tasks are placed on draining container instances,
+	// which saves listing the tasks of each instance on every report
+	runningTasks, err := r.d.fetchRunningTasks(ctx, r.tasks)
+	if err != nil {
+		return nil, err
+	}
+	// Stopped tasks never run again
+	r.tasks = runningTasks
+
+	remainingCounts := make(map[string]int)
+	for _, t := range runningTasks {
+		if serviceName, ok := getServiceName(t); ok {
+			remainingCounts[serviceName]++
+		} else {
+			remainingCounts[standaloneTasksLabel]++
+		}
+	}
+
+	progress := make([]serviceProgress, 0, len(r.serviceNames)+1)
+	for names := range slices.Chunk(r.serviceNames, ecsconst.MaxDescribableServices) {
+		resp, err := r.d.ecsSvc.DescribeServices(ctx, &ecs.DescribeServicesInput{
+			Cluster:  aws.String(r.d.cluster),
+			Services: names,
+		})
+		if err != nil {
+			return nil, xerrors.Errorf("failed to describe services: %w", err)
+		}
+		for _, s := range resp.Services {
+			rolloutState := "-"
+			for _, deployment := range s.Deployments {
+				if aws.ToString(deployment.Status) == "PRIMARY" && deployment.RolloutState != "" {
+					rolloutState = string(deployment.RolloutState)
+				}
+			}
+			progress = append(progress, serviceProgress{
+				name:         *s.ServiceName,
+				running:      s.RunningCount,
+				pending:      s.PendingCount,
+				desired:      s.DesiredCount,
+				rolloutState: rolloutState,
+				remaining:    remainingCounts[*s.ServiceName],
+			})
+		}
+	}
+	slices.SortFunc(progress, func(a, b serviceProgress) int {
+		return strings.Compare(a.name, b.name)
+	})
+
+	if count := remainingCounts[standaloneTasksLabel]; count > 0 {
+		progress = append(progress, serviceProgress{name: standaloneTasksLabel, remaining: count})
+	}
+
+	return progress, nil
+}
@@ -0,0 +1,158 @@
+package capacity
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/abicky/ecsmec/internal/testing/capacitymock"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"go.uber.org/mock/gomock"
+)
+
+func TestProgressReporter_Report(t *testing.T) {
+	expectDescribeServices := func(ctx context.Context, ecsMock *capacitymock.MockECSAPI) {
+		ecsMock.EXPECT().DescribeServices(ctx, gomock.Any()).Return(&ecs.DescribeServicesOutput{
+			Services: []ecstypes.Service{
+				{
+					DesiredCount: 2,
+					PendingCount: 1,
+					RunningCount: 1,
+					ServiceName:  aws.String("foo"),
+				},
+			},
+		}, nil).AnyTimes()
+	}
+
+	t.Run("plain", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		ecsMock := capacitymock.NewMockECSAPI(ctrl)
+		expectDescribeServices(ctx, ecsMock)
+
+		var logs, out bytes.Buffer
+		log.SetOutput(&logs)
+		defer log.SetOutput(io.Discard)
+
+		d := &drainer{cluster: "test", ecsSvc: ecsMock, progressOut: &out}
+		r := &progressReporter{d: d, serviceNames: []string{"foo"}}
+		r.report(ctx)
+		r.report(ctx)
+
+		if out.Len() > 0 {
+			t.Errorf("out = %q; want empty", out.String())
+		}
+		if got := strings.Count(logs.String(), "Progress of draining in the cluster \"test\""); got != 2 {
+			t.Errorf("the number of reports = %d; want 2", got)
+		}
+		if strings.Contains(logs.String(), "\x1b[") {
+			t.Errorf("logs = %q; want no escape sequences", logs.String())
+		}
+	})
+
+	t.Run("interactive", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		ecsMock := capacitymock.NewMockECSAPI(ctrl)
+		expectDescribeServices(ctx, ecsMock)
+
+		var out bytes.Buffer
+		logLines := &fakeLineCounter{}
+		d := &drainer{cluster: "test", ecsSvc: ecsMock, progressOut: &out, logLines: logLines}
+		r := &progressReporter{d: d, serviceNames: []string{"foo"}}
+
+		r.report(ctx)
+		// The previous report is erased
+		r.report(ctx)
+		logLines.count = 1
+		// The previous report is left because it is followed by the log
+		r.report(ctx)
+
+		reports := strings.Split(out.String(), "Progress of draining in the cluster \"test\"")[1:]
+		if len(reports) != 3 {
+			t.Fatalf("the number of reports = %d; want 3", len(reports))
+		}
+		erase := "\x1b[3A\x1b[J"
+		if !strings.HasSuffix(reports[0], erase) {
+			t.Errorf("reports[0] = %q; want the suffix %q", reports[0], erase)
+		}
+		if strings.Contains(reports[1], "\x1b[") {
+			t.Errorf("reports[1] = %q; want no escape sequences", reports[1])
+		}
+	})
+
+	t.Run("only the running tasks are polled", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		ecsMock := capacitymock.NewMockECSAPI(ctrl)
+		expectDescribeServices(ctx, ecsMock)
+
+		tasks := []ecstypes.Task{
+			{Group: aws.String("service:foo"), TaskArn: aws.String("task-1")},
+			{Group: aws.String("service:foo"), TaskArn: aws.String("task-2")},
+		}
+		gomock.InOrder(
+			ecsMock.EXPECT().DescribeTasks(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *ecs.DescribeTasksInput, _ ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error) {
+				if !slices.Equal(input.Tasks, []string{"task-1", "task-2"}) {
+					t.Errorf("Tasks = %v; want %v", input.Tasks, []string{"task-1", "task-2"})
+				}
+				return &ecs.DescribeTasksOutput{
+					Tasks: []ecstypes.Task{
+						{LastStatus: aws.String("STOPPED"), TaskArn: aws.String("task-1")},
+						{LastStatus: aws.String("RUNNING"), TaskArn: aws.String("task-2")},
+					},
+				}, nil
+			}),
+			ecsMock.EXPECT().DescribeTasks(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *ecs.DescribeTasksInput, _ ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error) {
+				if !slices.Equal(input.Tasks, []string{"task-2"}) {
+					t.Errorf("Tasks = %v; want %v", input.Tasks, []string{"task-2"})
+				}
+				return &ecs.DescribeTasksOutput{
+					Tasks: []ecstypes.Task{
+						{LastStatus: aws.String("STOPPED"), TaskArn: aws.String("task-2")},
+					},
+				}, nil
+			}),
+		)
+
+		var logs bytes.Buffer
+		log.SetOutput(&logs)
+		defer log.SetOutput(io.Discard)
+
+		d := &drainer{cluster: "test", ecsSvc: ecsMock, progressOut: io.Discard}
+		r := &progressReporter{d: d, tasks: tasks, serviceNames: []string{"foo"}}
+		r.report(ctx)
+		r.report(ctx)
+		// No tasks are polled once all of them have stopped
+		r.report(ctx)
+
+		if !strings.Contains(logs.String(), "foo      1        1        2        -        1") {
+			t.Errorf("logs = %q; want the report with 1 task left", logs.String())
+		}
+	})
+}
+
+type fakeLineCounter struct {
+	count int
+}
+
+func (c *fakeLineCounter) CountLines() int {
+	count := c.count
+	c.count = 0
+	return count
+}
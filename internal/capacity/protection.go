@@ -0,0 +1,123 @@
+package capacity
+
+import (
+	"context"
+	"log"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"golang.org/x/xerrors"
+
+	"github.com/abicky/ecsmec/internal/const/autoscalingconst"
+)
+
+// isProtectedFromScaleIn reports whether the instance is protected from scale in. The protection set by managed
+// termination protection of the capacity provider is ignored because ecsmec removes it anyway.
+func (asg *AutoScalingGroup) isProtectedFromScaleIn(instanceID string) bool {
+	if asg.managedTerminationProtection {
+		return false
+	}
+	for _, i := range asg.Instances {
+		if *i.InstanceId == instanceID {
+			return aws.ToBool(i.ProtectedFromScaleIn)
+		}
+	}
+	return false
+}
+
+// isProtectedFromTermination reports whether the instance is protected from termination. The result is cached
+// because the instances are checked both when they are selected and before they are drained.
+func (asg *AutoScalingGroup) isProtectedFromTermination(ctx context.Context, instanceID string) (bool, error) {
+	if protected, ok := asg.terminationProtection[instanceID]; ok {
+		return protected, nil
+	}
+
+	resp, err := asg.ec2Svc.DescribeInstanceAttribute(ctx, &ec2.DescribeInstanceAttributeInput{
+		Attribute:  ec2types.InstanceAttributeNameDisableApiTermination,
+		InstanceId: aws.String(instanceID),
+	})
+	if err != nil {
+		return false, xerrors.Errorf("failed to describe the attribute of the instance %s: %w", instanceID, err)
+	}
+
+	protected := resp.DisableApiTermination != nil && aws.ToBool(resp.DisableApiTermination.Value)
+	if asg.terminationProtection == nil {
+		asg.terminationProtection = make(map[string]bool)
+	}
+	asg.terminationProtection[instanceID] = protected
+	return protected, nil
+}
+
+// isProtected reports whether the instance is protected from scale in or termination.
+func (asg *AutoScalingGroup) isProtected(ctx context.Context, instanceID string) (bool, error) {
+	if asg.isProtectedFromScaleIn(instanceID) {
+		return true, nil
+	}
+	return asg.isProtectedFromTermination(ctx, instanceID)
+}
+
+// checkProtection returns an error if any of the instances is protected from scale in or termination unless
+// overrideProtection is true, so that protected instances are never drained in vain. It returns the IDs of the
+// instances protected from termination to be unprotected.
+func (asg *AutoScalingGroup) checkProtection(ctx context.Context, instanceIDs []string, overrideProtection bool) ([]string, error) {
+	scaleInProtectedIDs := make([]string, 0)
+	terminationProtectedIDs := make([]string, 0)
+	for _, id := range instanceIDs {
+		if asg.isProtectedFromScaleIn(id) {
+			scaleInProtectedIDs = append(scaleInProtectedIDs, id)
+		}
+		protected, err := asg.isProtectedFromTermination(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if protected {
+			terminationProtectedIDs = append(terminationProtectedIDs, id)
+		}
+	}
+
+	if !overrideProtection && len(scaleInProtectedIDs)+len(terminationProtectedIDs) > 0 {
+		return nil, xerrors.Errorf("some instances are protected (from scale in: %v, from termination: %v)", scaleInProtectedIDs, terminationProtectedIDs)
+	}
+
+	return terminationProtectedIDs, nil
+}
+
+// unprotectInstances removes the scale-in protection of the instances and the termination protection of
+// the instances specified by terminationProtectedIDs so that they can be detached and terminated.
+func (asg *AutoScalingGroup) unprotectInstances(ctx context.Context, instanceIDs []string, terminationProtectedIDs []string) error {
+	scaleInProtectedIDs := make([]string, 0)
+	for _, i := range asg.Instances {
+		if aws.ToBool(i.ProtectedFromScaleIn) && slices.Contains(instanceIDs, *i.InstanceId) {
+			scaleInProtectedIDs = append(scaleInProtectedIDs, *i.InstanceId)
+		}
+	}
+
+	for ids := range slices.Chunk(scaleInProtectedIDs, autoscalingconst.MaxProtectableInstances) {
+		log.Println("Remove the scale-in protection of instances:", ids)
+		_, err := asg.asSvc.SetInstanceProtection(ctx, &autoscaling.SetInstanceProtectionInput{
+			AutoScalingGroupName: asg.AutoScalingGroupName,
+			InstanceIds:          ids,
+			ProtectedFromScaleIn: aws.Bool(false),
+		})
+		if err != nil {
+			return xerrors.Errorf("failed to set instance protection: %w", err)
+		}
+	}
+
+	for _, id := range terminationProtectedIDs {
+		log.Println("Remove the termination protection of the instance:", id)
+		_, err := asg.ec2Svc.ModifyInstanceAttribute(ctx, &ec2.ModifyInstanceAttributeInput{
+			DisableApiTermination: &ec2types.AttributeBooleanValue{Value: aws.Bool(false)},
+			InstanceId:            aws.String(id),
+		})
+		if err != nil {
+			return xerrors.Errorf("failed to modify the attribute of the instance %s: %w", id, err)
+		}
+		asg.terminationProtection[id] = false
+	}
+
+	return nil
+}
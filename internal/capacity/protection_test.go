@@ -0,0 +1,381 @@
+package capacity_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	autoscalingtypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"go.uber.org/mock/gomock"
+
+	"github.com/abicky/ecsmec/internal/capacity"
+	"github.com/abicky/ecsmec/internal/testing/capacitymock"
+)
+
+func expectTerminationProtection(ec2Mock *capacitymock.MockEC2API, protectedIDs []string) {
+	ec2Mock.EXPECT().DescribeInstanceAttribute(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, input *ec2.DescribeInstanceAttributeInput, _ ...func(*ec2.Options)) (*ec2.DescribeInstanceAttributeOutput, error) {
+		if input.Attribute != ec2types.InstanceAttributeNameDisableApiTermination {
+			return nil, errors.New("unexpected attribute")
+		}
+		return &ec2.DescribeInstanceAttributeOutput{
+			DisableApiTermination: &ec2types.AttributeBooleanValue{Value: aws.Bool(slices.Contains(protectedIDs, *input.InstanceId))},
+			InstanceId:            input.InstanceId,
+		}, nil
+	}).AnyTimes()
+}
+
+func TestAutoScalingGroup_ReduceCapacityWithProtectedInstances(t *testing.T) {
+	now := time.Now().UTC()
+
+	// The first instance in each availability zone is older
+	instances := append(createInstances("ap-northeast-1a", 2), createInstances("ap-northeast-1c", 2)...)
+	reservations := make([]ec2types.Reservation, len(instances))
+	for i, instance := range instances {
+		launchTime := now
+		if i%2 == 0 {
+			launchTime = now.Add(-time.Hour)
+		}
+		reservations[i] = createReservation(instance, launchTime)
+	}
+	instances[0].ProtectedFromScaleIn = aws.Bool(true)
+	terminationProtectedIDs := []string{*instances[2].InstanceId}
+
+	t.Run("protected instances are skipped", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+		ec2Mock := capacitymock.NewMockEC2API(ctrl)
+		drainerMock := capacitymock.NewMockDrainer(ctrl)
+
+		// The termination protection is described once per instance even though it is checked again before draining
+		describedIDs := make([]string, 0)
+		ec2Mock.EXPECT().DescribeInstanceAttribute(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *ec2.DescribeInstanceAttributeInput, _ ...func(*ec2.Options)) (*ec2.DescribeInstanceAttributeOutput, error) {
+			if slices.Contains(describedIDs, *input.InstanceId) {
+				t.Errorf("the attribute of the instance %s is described more than once", *input.InstanceId)
+			}
+			describedIDs = append(describedIDs, *input.InstanceId)
+			return &ec2.DescribeInstanceAttributeOutput{
+				DisableApiTermination: &ec2types.AttributeBooleanValue{Value: aws.Bool(slices.Contains(terminationProtectedIDs, *input.InstanceId))},
+				InstanceId:            input.InstanceId,
+			}, nil
+		}).AnyTimes()
+
+		asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+				{
+					AutoScalingGroupName: aws.String("autoscaling-group-name"),
+					AvailabilityZones:    []string{"ap-northeast-1a", "ap-northeast-1c"},
+					DesiredCapacity:      aws.Int32(int32(len(instances))),
+					Instances:            instances,
+					MaxSize:              aws.Int32(int32(len(instances))),
+				},
+			},
+		}, nil)
+		ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+			Reservations: reservations,
+		}, nil)
+
+		// Stop the process after the instances are selected
+		errStop := errors.New("stop")
+		want := []string{*instances[1].InstanceId, *instances[3].InstanceId}
+		drainerMock.EXPECT().Drain(ctx, want).Return(errStop)
+
+		group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := group.ReduceCapacity(ctx, 2, drainerMock); !errors.Is(err, errStop) {
+			t.Errorf("err = %#v; want %#v", err, errStop)
+		}
+	})
+
+	t.Run("with protection override", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+		ec2Mock := capacitymock.NewMockEC2API(ctrl)
+		expectTerminationProtection(ec2Mock, terminationProtectedIDs)
+		drainerMock := capacitymock.NewMockDrainer(ctrl)
+
+		want := []string{*instances[0].InstanceId, *instances[2].InstanceId}
+
+		// Stop the process after the protection is removed
+		errStop := errors.New("stop")
+		gomock.InOrder(
+			asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+				AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+					{
+						AutoScalingGroupName: aws.String("autoscaling-group-name"),
+						AvailabilityZones:    []string{"ap-northeast-1a", "ap-northeast-1c"},
+						DesiredCapacity:      aws.Int32(int32(len(instances))),
+						Instances:            instances,
+						MaxSize:              aws.Int32(int32(len(instances))),
+					},
+				},
+			}, nil),
+
+			ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+				Reservations: reservations,
+			}, nil),
+
+			drainerMock.EXPECT().Drain(ctx, want),
+
+			asMock.EXPECT().SetInstanceProtection(ctx, gomock.Any()).Do(func(_ context.Context, input *autoscaling.SetInstanceProtectionInput, _ ...func(*autoscaling.Options)) {
+				if !slices.Equal(input.InstanceIds, []string{*instances[0].InstanceId}) {
+					t.Errorf("InstanceIds = %v; want %v", input.InstanceIds, []string{*instances[0].InstanceId})
+				}
+				if aws.ToBool(input.ProtectedFromScaleIn) {
+					t.Errorf("ProtectedFromScaleIn = true; want false")
+				}
+			}),
+
+			ec2Mock.EXPECT().ModifyInstanceAttribute(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *ec2.ModifyInstanceAttributeInput, _ ...func(*ec2.Options)) (*ec2.ModifyInstanceAttributeOutput, error) {
+				if *input.InstanceId != *instances[2].InstanceId {
+					t.Errorf("InstanceId = %s; want %s", *input.InstanceId, *instances[2].InstanceId)
+				}
+				if aws.ToBool(input.DisableApiTermination.Value) {
+					t.Errorf("DisableApiTermination = true; want false")
+				}
+				return nil, errStop
+			}),
+		)
+
+		group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := group.ReduceCapacity(ctx, 2, drainerMock, capacity.WithProtectionOverride()); !errors.Is(err, errStop) {
+			t.Errorf("err = %#v; want %#v", err, errStop)
+		}
+	})
+
+	t.Run("the target instance is protected", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+		ec2Mock := capacitymock.NewMockEC2API(ctrl)
+		expectTerminationProtection(ec2Mock, terminationProtectedIDs)
+		drainerMock := capacitymock.NewMockDrainer(ctrl)
+
+		asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+				{
+					AutoScalingGroupName: aws.String("autoscaling-group-name"),
+					AvailabilityZones:    []string{"ap-northeast-1a", "ap-northeast-1c"},
+					DesiredCapacity:      aws.Int32(int32(len(instances))),
+					Instances:            instances,
+					MaxSize:              aws.Int32(int32(len(instances))),
+				},
+			},
+		}, nil)
+		ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+			Reservations: reservations,
+		}, nil).AnyTimes()
+
+		group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := group.ReduceCapacity(ctx, 1, drainerMock, capacity.WithTargetInstances(terminationProtectedIDs)); err == nil {
+			t.Errorf("err = nil; want non-nil")
+		}
+	})
+}
+
+func TestAutoScalingGroup_ReduceCapacityWithProtectedInstancesInLargerAvailabilityZone(t *testing.T) {
+	now := time.Now().UTC()
+
+	// ap-northeast-1a has one more instance, so the instance to terminate must be selected from it
+	instances := append(createInstances("ap-northeast-1a", 3), createInstances("ap-northeast-1c", 2)...)
+	reservations := createReservations(instances, now)
+
+	tests := []struct {
+		name           string
+		protectedCount int
+		want           []string
+	}{
+		{
+			name:           "some instances in the availability zone are protected",
+			protectedCount: 2,
+			want:           []string{*instances[2].InstanceId},
+		},
+		{
+			name:           "all the instances in the availability zone are protected",
+			protectedCount: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx := context.Background()
+
+			asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+			ec2Mock := capacitymock.NewMockEC2API(ctrl)
+			expectTerminationProtection(ec2Mock, nil)
+			drainerMock := capacitymock.NewMockDrainer(ctrl)
+
+			groupInstances := slices.Clone(instances)
+			for i := range tt.protectedCount {
+				groupInstances[i].ProtectedFromScaleIn = aws.Bool(true)
+			}
+
+			asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+				AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+					{
+						AutoScalingGroupName: aws.String("autoscaling-group-name"),
+						AvailabilityZones:    []string{"ap-northeast-1a", "ap-northeast-1c"},
+						DesiredCapacity:      aws.Int32(int32(len(groupInstances))),
+						Instances:            groupInstances,
+						MaxSize:              aws.Int32(int32(len(groupInstances))),
+					},
+				},
+			}, nil)
+			ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+				Reservations: reservations,
+			}, nil)
+
+			// Stop the process after the instances are selected
+			errStop := errors.New("stop")
+			if tt.want != nil {
+				drainerMock.EXPECT().Drain(ctx, tt.want).Return(errStop)
+			}
+
+			group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = group.ReduceCapacity(ctx, 1, drainerMock)
+			if tt.want != nil {
+				if !errors.Is(err, errStop) {
+					t.Errorf("err = %#v; want %#v", err, errStop)
+				}
+			} else if err == nil {
+				t.Errorf("err = nil; want non-nil")
+			}
+		})
+	}
+}
+
+func TestAutoScalingGroup_ReplaceInstancesWithProtectedInstances(t *testing.T) {
+	for _, maxSurge := range []int32{0, 1} {
+		t.Run(fmt.Sprintf("max surge %d", maxSurge), func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx := context.Background()
+
+			asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+			ec2Mock := capacitymock.NewMockEC2API(ctrl)
+			drainerMock := capacitymock.NewMockDrainer(ctrl)
+			clusterMock := capacitymock.NewMockCluster(ctrl)
+			clusterMock.EXPECT().Name().Return("test").AnyTimes()
+
+			instances := append(createInstances("ap-northeast-1a", 1), createInstances("ap-northeast-1c", 1)...)
+			expectTerminationProtection(ec2Mock, []string{*instances[1].InstanceId})
+
+			asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+				AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+					{
+						AutoScalingGroupName: aws.String("autoscaling-group-name"),
+						AvailabilityZones:    []string{"ap-northeast-1a", "ap-northeast-1c"},
+						DesiredCapacity:      aws.Int32(int32(len(instances))),
+						Instances:            instances,
+						MaxSize:              aws.Int32(int32(len(instances))),
+						SuspendedProcesses: []autoscalingtypes.SuspendedProcess{
+							{ProcessName: aws.String("AZRebalance")},
+						},
+					},
+				},
+			}, nil)
+			ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+				Reservations: createReservations(instances, time.Now().Add(-time.Hour)),
+			}, nil)
+
+			group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// No new instances must be launched
+			if err := group.ReplaceInstances(ctx, drainerMock, clusterMock, capacity.WithMaxSurge(maxSurge)); err == nil {
+				t.Errorf("err = nil; want non-nil")
+			}
+		})
+	}
+}
+
+func TestAutoScalingGroup_RollbackReplacementWithProtectedInstances(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+
+	asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+	// For loadLaunchedInstanceIDs
+	asMock.EXPECT().DescribeScalingActivities(gomock.Any(), gomock.Any(), gomock.Any()).Return(&autoscaling.DescribeScalingActivitiesOutput{}, nil)
+	ec2Mock := capacitymock.NewMockEC2API(ctrl)
+	drainerMock := capacitymock.NewMockDrainer(ctrl)
+	clusterMock := capacitymock.NewMockCluster(ctrl)
+
+	now := time.Now().UTC()
+	stateSavedAt := now.Format(time.RFC3339)
+
+	oldInstances := createInstances("ap-northeast-1a", 2)
+	newInstances := createInstances("ap-northeast-1a", 2)
+	newInstances[0].ProtectedFromScaleIn = aws.Bool(true)
+
+	expectTerminationProtection(ec2Mock, nil)
+	clusterMock.EXPECT().ReactivateContainerInstances(ctx, instanceIDs(oldInstances))
+	clusterMock.EXPECT().ContainerInstances(ctx, gomock.Len(len(newInstances))).Return(createContainerInstances(newInstances), nil)
+
+	asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+		AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+			{
+				AutoScalingGroupName: aws.String("autoscaling-group-name"),
+				DesiredCapacity:      aws.Int32(4),
+				Instances:            append(oldInstances, newInstances...),
+				MaxSize:              aws.Int32(4),
+				Tags:                 createTagDescriptions(2, 2, stateSavedAt),
+			},
+		},
+	}, nil)
+	ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+		Reservations: append(
+			createReservations(oldInstances, now.Add(-24*time.Hour)),
+			createReservations(newInstances, now)...,
+		),
+	}, nil)
+
+	group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The protected instance must not be drained
+	if err := group.RollbackReplacement(ctx, drainerMock, clusterMock); err == nil {
+		t.Errorf("err = nil; want non-nil")
+	}
+}
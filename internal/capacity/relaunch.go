@@ -0,0 +1,115 @@
+package capacity
+
+import (
+	"context"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"golang.org/x/xerrors"
+)
+
+// newRunTaskInput returns the parameters to run the same task as the specified one.
+// This method must be called before the task stops because the network interface of the task is deleted after that.
+func (d *drainer) newRunTaskInput(ctx context.Context, t ecstypes.Task) (*ecs.RunTaskInput, error) {
+	params := &ecs.RunTaskInput{
+		Cluster:              t.ClusterArn,
+		Count:                aws.Int32(1),
+		EnableExecuteCommand: t.EnableExecuteCommand,
+		Overrides:            t.Overrides,
+		StartedBy:            t.StartedBy,
+		TaskDefinition:       t.TaskDefinitionArn,
+	}
+	// Tags with the prefix "aws:" are reserved and rejected by RunTask. They exist only if the task was run with
+	// Amazon ECS managed tags, and tags propagated from the task definition or the service are copied as they are.
+	for _, tag := range t.Tags {
+		if strings.HasPrefix(aws.ToString(tag.Key), "aws:") {
+			params.EnableECSManagedTags = true
+			continue
+		}
+		params.Tags = append(params.Tags, tag)
+	}
+	// The default group is "family:<family>", which can't be specified explicitly
+	if !strings.HasPrefix(aws.ToString(t.Group), "family:") {
+		params.Group = t.Group
+	}
+	if t.CapacityProviderName != nil {
+		params.CapacityProviderStrategy = []ecstypes.CapacityProviderStrategyItem{
+			{
+				CapacityProvider: t.CapacityProviderName,
+				Weight:           1,
+			},
+		}
+	} else {
+		params.LaunchType = t.LaunchType
+	}
+
+	networkConfiguration, err := d.fetchNetworkConfiguration(ctx, t)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to fetch the network configuration: %w", err)
+	}
+	params.NetworkConfiguration = networkConfiguration
+
+	return params, nil
+}
+
+// fetchNetworkConfiguration returns the network configuration of the task using the awsvpc network mode,
+// or nil if the task uses another network mode.
+func (d *drainer) fetchNetworkConfiguration(ctx context.Context, t ecstypes.Task) (*ecstypes.NetworkConfiguration, error) {
+	for _, a := range t.Attachments {
+		if aws.ToString(a.Type) != "ElasticNetworkInterface" {
+			continue
+		}
+
+		var subnetID, networkInterfaceID string
+		for _, detail := range a.Details {
+			switch aws.ToString(detail.Name) {
+			case "subnetId":
+				subnetID = aws.ToString(detail.Value)
+			case "networkInterfaceId":
+				networkInterfaceID = aws.ToString(detail.Value)
+			}
+		}
+
+		resp, err := d.ec2Svc.DescribeNetworkInterfaces(ctx, &ec2.DescribeNetworkInterfacesInput{
+			NetworkInterfaceIds: []string{networkInterfaceID},
+		})
+		if err != nil {
+			return nil, xerrors.Errorf("failed to describe the network interface %q: %w", networkInterfaceID, err)
+		}
+
+		securityGroups := make([]string, 0)
+		for _, ni := range resp.NetworkInterfaces {
+			for _, g := range ni.Groups {
+				securityGroups = append(securityGroups, *g.GroupId)
+			}
+		}
+
+		return &ecstypes.NetworkConfiguration{
+			AwsvpcConfiguration: &ecstypes.AwsVpcConfiguration{
+				SecurityGroups: securityGroups,
+				Subnets:        []string{subnetID},
+			},
+		}, nil
+	}
+
+	return nil, nil
+}
+
+func (d *drainer) runTask(ctx context.Context, params *ecs.RunTaskInput) (string, error) {
+	resp, err := d.ecsSvc.RunTask(ctx, params)
+	if err != nil {
+		return "", xerrors.Errorf("failed to run the task: %w", err)
+	}
+	if len(resp.Failures) > 0 {
+		f := resp.Failures[0]
+		return "", xerrors.Errorf("failed to run the task: %s: %s", aws.ToString(f.Reason), aws.ToString(f.Detail))
+	}
+	if len(resp.Tasks) == 0 {
+		return "", xerrors.New("failed to run the task: no tasks were started")
+	}
+
+	return *resp.Tasks[0].TaskArn, nil
+}
@@ -0,0 +1,316 @@
+package capacity
+
+import (
+	"cmp"
+	"context"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	autoscalingtypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"golang.org/x/xerrors"
+)
+
+// SelectionStrategy decides which instances ReduceCapacity terminates first.
+// Whatever the strategy is, instances are selected so that the availability zones stay balanced
+// and AZRebalance doesn't terminate instances unexpectedly.
+type SelectionStrategy string
+
+const (
+	// SelectionStrategyOldest selects older instances first.
+	SelectionStrategyOldest SelectionStrategy = "oldest"
+	// SelectionStrategyFewestTasks selects instances running fewer tasks first.
+	SelectionStrategyFewestTasks SelectionStrategy = "fewest-tasks"
+	// SelectionStrategyLeastUtilized selects instances whose CPU or memory is less reserved first.
+	SelectionStrategyLeastUtilized SelectionStrategy = "least-utilized"
+	// SelectionStrategyPreferOnDemand selects On-Demand instances first.
+	SelectionStrategyPreferOnDemand SelectionStrategy = "prefer-on-demand"
+	// SelectionStrategyPreferSpot selects Spot instances first.
+	SelectionStrategyPreferSpot SelectionStrategy = "prefer-spot"
+	// SelectionStrategyRespectTerminationPolicies selects instances according to the termination policies of the
+	// auto scaling group as far as possible.
+	SelectionStrategyRespectTerminationPolicies SelectionStrategy = "respect-asg-termination-policies"
+)
+
+// SelectionStrategies is the list of all the selection strategies.
+var SelectionStrategies = []SelectionStrategy{
+	SelectionStrategyOldest,
+	SelectionStrategyFewestTasks,
+	SelectionStrategyLeastUtilized,
+	SelectionStrategyPreferOnDemand,
+	SelectionStrategyPreferSpot,
+	SelectionStrategyRespectTerminationPolicies,
+}
+
+type ReduceOption func(*reduceOptions)
+
+type reduceOptions struct {
+	strategy SelectionStrategy
+	cluster  Cluster
+
+	targetInstanceIDs       []string
+	targetAvailabilityZone  string
+	containerInstanceFilter string
+
+	overrideProtection bool
+	returnToWarmPool   bool
+}
+
+func (o reduceOptions) isTargeted() bool {
+	return len(o.targetInstanceIDs) > 0 || o.targetAvailabilityZone != "" || o.containerInstanceFilter != ""
+}
+
+// WithSelectionStrategy makes ReduceCapacity select instances to terminate with the strategy.
+// cluster is used to fetch the container instances for the strategies based on tasks or resources.
+func WithSelectionStrategy(strategy SelectionStrategy, cluster Cluster) ReduceOption {
+	return func(o *reduceOptions) {
+		o.strategy = strategy
+		o.cluster = cluster
+	}
+}
+
+// WithTargetInstances makes ReduceCapacity terminate only the specified instances.
+func WithTargetInstances(instanceIDs []string) ReduceOption {
+	return func(o *reduceOptions) {
+		o.targetInstanceIDs = instanceIDs
+	}
+}
+
+// WithTargetAvailabilityZone makes ReduceCapacity terminate only instances in the availability zone.
+func WithTargetAvailabilityZone(az string) ReduceOption {
+	return func(o *reduceOptions) {
+		o.targetAvailabilityZone = az
+	}
+}
+
+// WithContainerInstanceFilter makes ReduceCapacity terminate only instances whose container instances in cluster
+// match the filter written in the cluster query language.
+func WithContainerInstanceFilter(filter string, cluster Cluster) ReduceOption {
+	return func(o *reduceOptions) {
+		o.containerInstanceFilter = filter
+		o.cluster = cluster
+	}
+}
+
+// WithProtectionOverride makes ReduceCapacity remove the scale-in protection and the termination protection of
+// the selected instances instead of skipping protected instances.
+func WithProtectionOverride() ReduceOption {
+	return func(o *reduceOptions) {
+		o.overrideProtection = true
+	}
+}
+
+// WithWarmPoolReturn makes ReduceCapacity return the selected instances to the warm pool instead of terminating them.
+// The warm pool must reuse instances on scale in, and cluster is used to reactivate the container instances once
+// the instances are stopped or hibernated in the warm pool.
+func WithWarmPoolReturn(cluster Cluster) ReduceOption {
+	return func(o *reduceOptions) {
+		o.returnToWarmPool = true
+		o.cluster = cluster
+	}
+}
+
+// newTargetMatcher returns a function that reports whether the instance satisfies all the targeting options,
+// or nil if no targeting options are specified.
+func (asg *AutoScalingGroup) newTargetMatcher(ctx context.Context, o reduceOptions) (func(ec2types.Instance) bool, error) {
+	if !o.isTargeted() {
+		return nil, nil
+	}
+
+	matchers := make([]func(ec2types.Instance) bool, 0, 3)
+	if len(o.targetInstanceIDs) > 0 {
+		unknownIDs := make([]string, 0)
+		for _, id := range o.targetInstanceIDs {
+			if !slices.ContainsFunc(asg.Instances, func(i autoscalingtypes.Instance) bool { return *i.InstanceId == id }) {
+				unknownIDs = append(unknownIDs, id)
+			}
+		}
+		if len(unknownIDs) > 0 {
+			return nil, xerrors.Errorf("the following instances don't belong to the auto scaling group %q: %v", *asg.AutoScalingGroupName, unknownIDs)
+		}
+		matchers = append(matchers, func(i ec2types.Instance) bool {
+			return slices.Contains(o.targetInstanceIDs, *i.InstanceId)
+		})
+	}
+
+	if o.targetAvailabilityZone != "" {
+		if !slices.Contains(asg.AvailabilityZones, o.targetAvailabilityZone) {
+			return nil, xerrors.Errorf("the auto scaling group %q doesn't use the availability zone %q", *asg.AutoScalingGroupName, o.targetAvailabilityZone)
+		}
+		matchers = append(matchers, func(i ec2types.Instance) bool {
+			return i.Placement != nil && aws.ToString(i.Placement.AvailabilityZone) == o.targetAvailabilityZone
+		})
+	}
+
+	if o.containerInstanceFilter != "" {
+		containerInstances, err := o.cluster.ContainerInstancesByFilter(ctx, o.containerInstanceFilter)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to filter container instances: %w", err)
+		}
+		matchedIDs := make(map[string]bool, len(containerInstances))
+		for _, ci := range containerInstances {
+			matchedIDs[aws.ToString(ci.Ec2InstanceId)] = true
+		}
+		matchers = append(matchers, func(i ec2types.Instance) bool {
+			return matchedIDs[*i.InstanceId]
+		})
+	}
+
+	return func(i ec2types.Instance) bool {
+		for _, match := range matchers {
+			if !match(i) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// compareLaunchTimes orders instances from the oldest.
+func compareLaunchTimes(a, b ec2types.Instance) int {
+	return a.LaunchTime.Compare(*b.LaunchTime)
+}
+
+// newInstanceComparator returns a function that orders instances in the same availability zone by the priority of
+// termination according to the strategy. Ties are broken by the launch times.
+func (asg *AutoScalingGroup) newInstanceComparator(ctx context.Context, o reduceOptions) (func(a, b ec2types.Instance) int, error) {
+	var compare func(a, b ec2types.Instance) int
+	switch o.strategy {
+	case "", SelectionStrategyOldest:
+		return compareLaunchTimes, nil
+	case SelectionStrategyFewestTasks, SelectionStrategyLeastUtilized:
+		ids := make([]string, len(asg.Instances))
+		for i, instance := range asg.Instances {
+			ids[i] = *instance.InstanceId
+		}
+		containerInstances, err := o.cluster.ContainerInstances(ctx, ids)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to fetch container instances: %w", err)
+		}
+
+		// Instances that aren't registered in the cluster have no tasks, so they are selected first
+		scores := make(map[string]float64, len(containerInstances))
+		for _, ci := range containerInstances {
+			if o.strategy == SelectionStrategyFewestTasks {
+				scores[aws.ToString(ci.Ec2InstanceId)] = float64(ci.RunningTasksCount + ci.PendingTasksCount)
+			} else {
+				scores[aws.ToString(ci.Ec2InstanceId)] = utilization(ci)
+			}
+		}
+		compare = func(a, b ec2types.Instance) int {
+			return cmp.Compare(scores[*a.InstanceId], scores[*b.InstanceId])
+		}
+	case SelectionStrategyPreferOnDemand, SelectionStrategyPreferSpot:
+		spotFirst := o.strategy == SelectionStrategyPreferSpot
+		compare = func(a, b ec2types.Instance) int {
+			aFirst := isSpotInstance(a) == spotFirst
+			bFirst := isSpotInstance(b) == spotFirst
+			return compareBools(aFirst, bFirst)
+		}
+	case SelectionStrategyRespectTerminationPolicies:
+		var err error
+		compare, err = asg.newTerminationPolicyComparator(ctx)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, xerrors.Errorf("unknown selection strategy %q", o.strategy)
+	}
+
+	return func(a, b ec2types.Instance) int {
+		return cmp.Or(compare(a, b), compareLaunchTimes(a, b))
+	}, nil
+}
+
+// newTerminationPolicyComparator returns a function that orders instances according to the termination policies
+// except for the ones that don't make sense or can't be emulated, such as ClosestToNextInstanceHour and custom
+// termination policies using Lambda functions.
+func (asg *AutoScalingGroup) newTerminationPolicyComparator(ctx context.Context) (func(a, b ec2types.Instance) int, error) {
+	policies := asg.TerminationPolicies
+	if len(policies) == 0 {
+		policies = []string{"Default"}
+	}
+
+	var isDrifted func(ec2types.Instance) bool
+	comparators := make([]func(a, b ec2types.Instance) int, 0, len(policies))
+	for _, policy := range policies {
+		switch policy {
+		case "OldestInstance":
+			comparators = append(comparators, compareLaunchTimes)
+		case "NewestInstance":
+			comparators = append(comparators, func(a, b ec2types.Instance) int {
+				return compareLaunchTimes(b, a)
+			})
+		case "OldestLaunchConfiguration", "OldestLaunchTemplate", "Default":
+			// The default termination policy also prioritizes instances with the oldest launch configuration or template
+			// after balancing instances across availability zones
+			if isDrifted == nil {
+				var err error
+				isDrifted, err = asg.newDriftDetector(ctx)
+				if err != nil {
+					return nil, xerrors.Errorf("failed to detect drifted instances: %w", err)
+				}
+			}
+			comparators = append(comparators, func(a, b ec2types.Instance) int {
+				return compareBools(isDrifted(a), isDrifted(b))
+			})
+		case "ClosestToNextInstanceHour", "AllocationStrategy":
+			// Most instances are billed per second, and the allocation strategy can't be emulated
+		default:
+			if strings.HasPrefix(policy, "arn:") {
+				log.Printf("[WARNING] The custom termination policy %q is ignored\n", policy)
+			}
+		}
+	}
+
+	return func(a, b ec2types.Instance) int {
+		for _, compare := range comparators {
+			if c := compare(a, b); c != 0 {
+				return c
+			}
+		}
+		return 0
+	}, nil
+}
+
+// utilization returns the largest ratio of the reserved CPU or memory of the container instance.
+func utilization(ci ecstypes.ContainerInstance) float64 {
+	result := 0.0
+	for _, name := range []string{"CPU", "MEMORY"} {
+		registered := findIntegerResource(ci.RegisteredResources, name)
+		if registered == 0 {
+			continue
+		}
+		remaining := findIntegerResource(ci.RemainingResources, name)
+		result = max(result, float64(registered-remaining)/float64(registered))
+	}
+	return result
+}
+
+func findIntegerResource(resources []ecstypes.Resource, name string) int32 {
+	for _, r := range resources {
+		if aws.ToString(r.Name) == name {
+			return r.IntegerValue
+		}
+	}
+	return 0
+}
+
+func isSpotInstance(i ec2types.Instance) bool {
+	return i.InstanceLifecycle == ec2types.InstanceLifecycleTypeSpot
+}
+
+// compareBools orders true before false.
+func compareBools(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return -1
+	default:
+		return 1
+	}
+}
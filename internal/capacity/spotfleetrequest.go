@@ -12,6 +12,8 @@ import (
 	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
 	"golang.org/x/xerrors"
+
+	"github.com/abicky/ecsmec/internal/timeout"
 )
 
 type SpotFleetRequest struct {
@@ -62,9 +64,9 @@ func (sfr *SpotFleetRequest) TerminateAllInstances(ctx context.Context, drainer
 	})
 	err = waiter.Wait(ctx, &ec2.DescribeInstancesInput{
 		InstanceIds: instanceIDs,
-	}, 10*time.Minute)
+	}, timeout.Get(ctx, timeout.PhaseInstanceTermination))
 	if err != nil {
-		return xerrors.Errorf("failed to terminate the instances: %w", err)
+		return xerrors.Errorf("failed to terminate the instances: %w", timeout.Wrap(ctx, timeout.PhaseInstanceTermination, err))
 	}
 
 	return nil
@@ -98,6 +100,7 @@ func (sfr *SpotFleetRequest) ReduceCapacity(ctx context.Context, amount int32, d
 		})
 	}()
 
+	watcher := newSpotFleetHistoryWatcher(sfr.ec2Svc, sfr.id, time.Now())
 	newTargetCapacity := *sfr.SpotFleetRequestConfigData.TargetCapacity - amount
 	log.Printf("Modify the spot fleet request \"%s\": TargetCapacity: %d\n", sfr.id, newTargetCapacity)
 	_, err = sfr.ec2Svc.ModifySpotFleetRequest(ctx, &ec2.ModifySpotFleetRequestInput{
@@ -108,21 +111,33 @@ func (sfr *SpotFleetRequest) ReduceCapacity(ctx context.Context, amount int32, d
 		return xerrors.Errorf("failed to modify the spot fleet request: %w", err)
 	}
 
-	timeout := 5 * time.Minute
-	timer := time.NewTimer(timeout)
+	maxWait := timeout.Get(ctx, timeout.PhaseInstanceDrain)
+	timer := time.NewTimer(maxWait)
 	defer timer.Stop()
 
+	historyTicker := time.NewTicker(10 * time.Second)
+	defer historyTicker.Stop()
+
 	log.Printf("Wait for instances to be drained")
 	for {
 		if drainedCount.Load() > amount-capacityPerInstance {
 			break
 		}
-		time.Sleep(100 * time.Millisecond)
 
 		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-historyTicker.C:
+			if err := watcher.watch(ctx); err != nil {
+				return err
+			}
 		case <-timer.C:
-			return xerrors.Errorf("all the spot fleet instances weren't drained within %v", timeout)
-		default:
+			return &timeout.Error{
+				Phase:   timeout.PhaseInstanceDrain,
+				Timeout: maxWait,
+				Err:     xerrors.New("all the spot fleet instances weren't drained"),
+			}
+		case <-ctx.Done():
+			return timeout.Wrap(ctx, timeout.PhaseInstanceDrain, ctx.Err())
 		}
 	}
 
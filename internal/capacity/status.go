@@ -0,0 +1,101 @@
+package capacity
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	autoscalingtypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"golang.org/x/xerrors"
+)
+
+const (
+	ReplacementPhaseLaunching   = "launching new instances"
+	ReplacementPhaseTerminating = "draining and terminating old instances"
+	ReplacementPhaseRestoring   = "restoring the original state"
+)
+
+type ReplacementStatus struct {
+	Phase          string
+	OldInstanceIDs []string
+	NewInstanceIDs []string
+}
+
+// FindAutoScalingGroupsInProgress returns the auto scaling groups whose replacement has not finished yet,
+// that is, the groups that have the tag "ecsmec:StateSavedAt".
+func FindAutoScalingGroupsInProgress(ctx context.Context, asSvc AutoScalingAPI, ec2Svc EC2API) ([]*AutoScalingGroup, error) {
+	groups := make([]*AutoScalingGroup, 0)
+	paginator := autoscaling.NewDescribeAutoScalingGroupsPaginator(asSvc, &autoscaling.DescribeAutoScalingGroupsInput{
+		Filters: []autoscalingtypes.Filter{
+			{
+				Name:   aws.String("tag-key"),
+				Values: []string{"ecsmec:StateSavedAt"},
+			},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to describe auto scaling groups: %w", err)
+		}
+
+		for _, g := range page.AutoScalingGroups {
+			asg := AutoScalingGroup{asSvc: asSvc, ec2Svc: ec2Svc, name: *g.AutoScalingGroupName}
+			if err := asg.load(g); err != nil {
+				return nil, xerrors.Errorf("failed to load the auto scaling group %q: %w", *g.AutoScalingGroupName, err)
+			}
+			groups = append(groups, &asg)
+		}
+	}
+
+	return groups, nil
+}
+
+// ReplacementStatus returns the status of the replacement in progress.
+// Instances launched before the state was saved are regarded as old ones,
+// excluding up-to-date instances if only drifted instances are replaced.
+func (asg *AutoScalingGroup) ReplacementStatus(ctx context.Context) (*ReplacementStatus, error) {
+	if asg.StateSavedAt == nil {
+		return nil, xerrors.Errorf("the auto scaling group %q has no replacement in progress", *asg.AutoScalingGroupName)
+	}
+
+	isDrifted := func(ec2types.Instance) bool { return true }
+	if asg.DriftedOnly {
+		var err error
+		isDrifted, err = asg.newDriftDetector(ctx)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to detect drifted instances: %w", err)
+		}
+	}
+
+	status := ReplacementStatus{
+		OldInstanceIDs: make([]string, 0),
+		NewInstanceIDs: make([]string, 0),
+	}
+	if len(asg.Instances) > 0 {
+		err := asg.fetchInstances(ctx, func(i ec2types.Instance) error {
+			if !i.LaunchTime.Before(*asg.StateSavedAt) {
+				status.NewInstanceIDs = append(status.NewInstanceIDs, *i.InstanceId)
+			} else if isDrifted(i) {
+				status.OldInstanceIDs = append(status.OldInstanceIDs, *i.InstanceId)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, xerrors.Errorf("failed to fetch instances: %w", err)
+		}
+	}
+
+	switch {
+	case *asg.DesiredCapacity > *asg.OriginalDesiredCapacity:
+		status.Phase = ReplacementPhaseTerminating
+	case len(status.OldInstanceIDs) > 0:
+		// In waves, the desired capacity is restored every time old instances are terminated
+		status.Phase = ReplacementPhaseLaunching
+	default:
+		status.Phase = ReplacementPhaseRestoring
+	}
+
+	return &status, nil
+}
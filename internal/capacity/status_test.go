@@ -0,0 +1,130 @@
+package capacity_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	autoscalingtypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"go.uber.org/mock/gomock"
+
+	"github.com/abicky/ecsmec/internal/capacity"
+	"github.com/abicky/ecsmec/internal/testing/capacitymock"
+	"github.com/abicky/ecsmec/internal/testing/testutil"
+)
+
+func TestFindAutoScalingGroupsInProgress(t *testing.T) {
+	now := time.Now().UTC()
+	stateSavedAt := now.Format(time.RFC3339)
+
+	oldInstances := append(
+		createInstances("ap-northeast-1a", 2),
+		createInstances("ap-northeast-1c", 2)...,
+	)
+	newInstances := append(
+		createInstances("ap-northeast-1a", 1),
+		createInstances("ap-northeast-1c", 1)...,
+	)
+	oldInstanceIDs := make([]string, len(oldInstances))
+	for i, instance := range oldInstances {
+		oldInstanceIDs[i] = *instance.InstanceId
+	}
+
+	tests := []struct {
+		name            string
+		desiredCapacity int32
+		instances       []autoscalingtypes.Instance
+		oldInstanceIDs  []string
+		phase           string
+	}{
+		{
+			name:            "new instances are launched",
+			desiredCapacity: 6,
+			instances:       append(oldInstances, newInstances...),
+			oldInstanceIDs:  oldInstanceIDs,
+			phase:           capacity.ReplacementPhaseTerminating,
+		},
+		{
+			name:            "old instances are terminated in the first wave",
+			desiredCapacity: 4,
+			instances:       append(oldInstances[2:], newInstances...),
+			oldInstanceIDs:  oldInstanceIDs[2:],
+			phase:           capacity.ReplacementPhaseLaunching,
+		},
+		{
+			name:            "all the old instances are terminated",
+			desiredCapacity: 4,
+			instances:       newInstances,
+			oldInstanceIDs:  []string{},
+			phase:           capacity.ReplacementPhaseRestoring,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx := context.Background()
+
+			asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+			ec2Mock := capacitymock.NewMockEC2API(ctrl)
+
+			gomock.InOrder(
+				asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, input *autoscaling.DescribeAutoScalingGroupsInput, _ ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+					if len(input.Filters) != 1 || *input.Filters[0].Name != "tag-key" || input.Filters[0].Values[0] != "ecsmec:StateSavedAt" {
+						t.Errorf("input.Filters = %v; want the filter for the tag key \"ecsmec:StateSavedAt\"", input.Filters)
+					}
+					return &autoscaling.DescribeAutoScalingGroupsOutput{
+						AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+							{
+								AutoScalingGroupName: aws.String("autoscaling-group-name"),
+								DesiredCapacity:      aws.Int32(tt.desiredCapacity),
+								Instances:            tt.instances,
+								MaxSize:              aws.Int32(6),
+								Tags:                 createTagDescriptions(4, 4, stateSavedAt),
+							},
+						},
+					}, nil
+				}),
+
+				ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *ec2.DescribeInstancesInput, _ ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+					reservations := createReservations(newInstances, now)
+					for _, instance := range oldInstances {
+						for _, id := range input.InstanceIds {
+							if *instance.InstanceId == id {
+								reservations = append(reservations, createReservation(instance, now.Add(-24*time.Hour)))
+							}
+						}
+					}
+					return &ec2.DescribeInstancesOutput{Reservations: reservations}, nil
+				}),
+			)
+
+			groups, err := capacity.FindAutoScalingGroupsInProgress(ctx, asMock, ec2Mock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(groups) != 1 {
+				t.Fatalf("len(groups) = %d; want 1", len(groups))
+			}
+			if *groups[0].OriginalDesiredCapacity != 4 {
+				t.Errorf("OriginalDesiredCapacity = %d; want 4", *groups[0].OriginalDesiredCapacity)
+			}
+
+			status, err := groups[0].ReplacementStatus(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.Phase != tt.phase {
+				t.Errorf("status.Phase = %s; want %s", status.Phase, tt.phase)
+			}
+			if !testutil.MatchSlice(status.OldInstanceIDs, tt.oldInstanceIDs) {
+				t.Errorf("status.OldInstanceIDs = %v; want %v", status.OldInstanceIDs, tt.oldInstanceIDs)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package capacity
+
+import (
+	"context"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"golang.org/x/xerrors"
+
+	"github.com/abicky/ecsmec/internal/const/ecsconst"
+)
+
+const (
+	maxTaskProtectionPollInterval = 15 * time.Second
+	minTaskProtectionPollInterval = 100 * time.Millisecond
+)
+
+// waitUntilTasksUnprotected waits until the scale-in protection of all the tasks expires or is cleared.
+func (d *drainer) waitUntilTasksUnprotected(ctx context.Context, taskArns []string) error {
+	timer := time.NewTimer(d.taskProtectionTimeout)
+	defer timer.Stop()
+
+	for {
+		protectedTasks, err := d.fetchProtectedTasks(ctx, taskArns)
+		if err != nil {
+			return err
+		}
+		if len(protectedTasks) == 0 {
+			return nil
+		}
+
+		log.Printf("Wait for the scale-in protection of the following tasks in the cluster %q to expire or be cleared:\n", d.cluster)
+		interval := maxTaskProtectionPollInterval
+		for _, t := range protectedTasks {
+			if t.ExpirationDate == nil {
+				log.Printf("\t%s\n", *t.TaskArn)
+				continue
+			}
+			log.Printf("\t%s (expires at %s)\n", *t.TaskArn, t.ExpirationDate.Format(time.RFC3339))
+			interval = min(interval, time.Until(*t.ExpirationDate))
+		}
+		interval = max(interval, minTaskProtectionPollInterval)
+
+		select {
+		case <-time.After(interval):
+			// The protected tasks will be checked again
+			taskArns = make([]string, len(protectedTasks))
+			for i, t := range protectedTasks {
+				taskArns[i] = *t.TaskArn
+			}
+		case <-timer.C:
+			arns := make([]string, len(protectedTasks))
+			for i, t := range protectedTasks {
+				arns[i] = *t.TaskArn
+			}
+			return xerrors.Errorf("the following tasks are still protected after %v: %v", d.taskProtectionTimeout, arns)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (d *drainer) fetchProtectedTasks(ctx context.Context, taskArns []string) ([]ecstypes.ProtectedTask, error) {
+	protectedTasks := make([]ecstypes.ProtectedTask, 0)
+	for arns := range slices.Chunk(taskArns, ecsconst.MaxTaskProtectionTasks) {
+		resp, err := d.ecsSvc.GetTaskProtection(ctx, &ecs.GetTaskProtectionInput{
+			Cluster: aws.String(d.cluster),
+			Tasks:   arns,
+		})
+		if err != nil {
+			return nil, xerrors.Errorf("failed to get the task protection: %w", err)
+		}
+
+		for _, t := range resp.ProtectedTasks {
+			if t.ProtectionEnabled {
+				protectedTasks = append(protectedTasks, t)
+			}
+		}
+	}
+
+	return protectedTasks, nil
+}
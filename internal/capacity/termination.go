@@ -0,0 +1,115 @@
+package capacity
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	autoscalingtypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"golang.org/x/xerrors"
+
+	"github.com/abicky/ecsmec/internal/timeout"
+)
+
+// TerminationMode decides how AutoScalingGroup terminates drained instances.
+type TerminationMode string
+
+const (
+	// TerminationModeDetach detaches instances from the auto scaling group and then terminates them,
+	// which bypasses termination lifecycle hooks.
+	TerminationModeDetach TerminationMode = "detach"
+	// TerminationModeAutoScalingGroup terminates instances through the auto scaling group so that
+	// termination lifecycle hooks run.
+	TerminationModeAutoScalingGroup TerminationMode = "auto-scaling-group"
+)
+
+// TerminationModes is the list of all the termination modes.
+var TerminationModes = []TerminationMode{
+	TerminationModeDetach,
+	TerminationModeAutoScalingGroup,
+}
+
+type AutoScalingGroupOption func(*AutoScalingGroup)
+
+// WithTerminationMode makes AutoScalingGroup terminate instances in the mode.
+func WithTerminationMode(mode TerminationMode) AutoScalingGroupOption {
+	return func(asg *AutoScalingGroup) {
+		asg.terminationMode = mode
+	}
+}
+
+// terminateInstancesInGroup terminates the instances one by one in the given order with
+// TerminateInstanceInAutoScalingGroup and waits until they go through the termination lifecycle hooks.
+func (asg *AutoScalingGroup) terminateInstancesInGroup(ctx context.Context, sortedInstanceIDs []string) error {
+	for _, id := range sortedInstanceIDs {
+		log.Println("Terminate the instance in the auto scaling group:", id)
+		_, err := asg.asSvc.TerminateInstanceInAutoScalingGroup(ctx, &autoscaling.TerminateInstanceInAutoScalingGroupInput{
+			InstanceId:                     aws.String(id),
+			ShouldDecrementDesiredCapacity: aws.Bool(true),
+		})
+		if err != nil {
+			return xerrors.Errorf("failed to terminate the instance %s in the auto scaling group: %w", id, err)
+		}
+	}
+
+	if err := asg.waitUntilInstancesTerminated(ctx, sortedInstanceIDs); err != nil {
+		return xerrors.Errorf("failed to terminate the instances: %w", err)
+	}
+
+	return nil
+}
+
+// waitUntilInstancesTerminated waits until the instances are removed from the auto scaling group,
+// which happens after the termination lifecycle hooks complete and the instances are terminated
+// or returned to the warm pool.
+func (asg *AutoScalingGroup) waitUntilInstancesTerminated(ctx context.Context, instanceIDs []string) error {
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	maxWait := timeout.Get(ctx, timeout.PhaseInstanceTermination)
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+
+	prevStates := ""
+	for {
+		resp, err := asg.asSvc.DescribeAutoScalingGroups(ctx, &autoscaling.DescribeAutoScalingGroupsInput{
+			AutoScalingGroupNames: []string{*asg.AutoScalingGroupName},
+		})
+		if err != nil {
+			return xerrors.Errorf("failed to describe the auto scaling group: %w", err)
+		}
+
+		states := make([]string, 0)
+		for _, i := range resp.AutoScalingGroups[0].Instances {
+			if slices.Contains(instanceIDs, *i.InstanceId) && i.LifecycleState != autoscalingtypes.LifecycleStateTerminated && !isWarmed(i) {
+				states = append(states, fmt.Sprintf("%s (%s)", *i.InstanceId, i.LifecycleState))
+			}
+		}
+		if len(states) == 0 {
+			return nil
+		}
+		// e.g. "i-00000000000000000 (Terminating:Wait), i-11111111111111111 (Terminating:Proceed)"
+		if s := strings.Join(states, ", "); s != prevStates {
+			log.Println("Wait for the instances to be terminated:", s)
+			prevStates = s
+		}
+
+		select {
+		case <-ticker.C:
+			continue
+		case <-timer.C:
+			return &timeout.Error{
+				Phase:   timeout.PhaseInstanceTermination,
+				Timeout: maxWait,
+				Err:     xerrors.Errorf("%d instances are still terminating", len(states)),
+			}
+		case <-ctx.Done():
+			return timeout.Wrap(ctx, timeout.PhaseInstanceTermination, ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package capacity_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	autoscalingtypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"go.uber.org/mock/gomock"
+
+	"github.com/abicky/ecsmec/internal/capacity"
+	"github.com/abicky/ecsmec/internal/testing/capacitymock"
+)
+
+func TestAutoScalingGroup_ReduceCapacityWithTerminationModeAutoScalingGroup(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+
+	asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+	ec2Mock := capacitymock.NewMockEC2API(ctrl)
+	expectNoTerminationProtection(ec2Mock)
+	drainerMock := capacitymock.NewMockDrainer(ctrl)
+
+	now := time.Now().UTC()
+
+	// The first instance in each availability zone is older
+	instances := append(createInstances("ap-northeast-1a", 2), createInstances("ap-northeast-1c", 2)...)
+	reservations := make([]ec2types.Reservation, len(instances))
+	for i, instance := range instances {
+		launchTime := now
+		if i%2 == 0 {
+			launchTime = now.Add(-time.Hour)
+		}
+		reservations[i] = createReservation(instance, launchTime)
+	}
+	instanceIDsToTerminate := []string{*instances[0].InstanceId, *instances[2].InstanceId}
+
+	terminatingInstances := make([]autoscalingtypes.Instance, 0, len(instances))
+	for i, instance := range instances {
+		if i%2 == 0 {
+			instance.LifecycleState = autoscalingtypes.LifecycleStateTerminated
+		}
+		terminatingInstances = append(terminatingInstances, instance)
+	}
+
+	calls := []any{
+		asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+				{
+					AutoScalingGroupName: aws.String("autoscaling-group-name"),
+					AvailabilityZones:    []string{"ap-northeast-1a", "ap-northeast-1c"},
+					DesiredCapacity:      aws.Int32(4),
+					Instances:            instances,
+					MaxSize:              aws.Int32(4),
+				},
+			},
+		}, nil),
+
+		ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+			Reservations: reservations,
+		}, nil),
+
+		drainerMock.EXPECT().Drain(ctx, instanceIDsToTerminate),
+	}
+
+	// The instances are terminated one by one in the AZ-sorted order without being detached
+	for _, id := range instanceIDsToTerminate {
+		calls = append(calls, asMock.EXPECT().TerminateInstanceInAutoScalingGroup(ctx, gomock.Any()).Do(func(_ context.Context, input *autoscaling.TerminateInstanceInAutoScalingGroupInput, _ ...func(*autoscaling.Options)) {
+			if *input.InstanceId != id {
+				t.Errorf("InstanceId = %s; want %s", *input.InstanceId, id)
+			}
+			if !aws.ToBool(input.ShouldDecrementDesiredCapacity) {
+				t.Errorf("ShouldDecrementDesiredCapacity = false; want true")
+			}
+		}))
+	}
+
+	calls = append(calls,
+		// For waitUntilInstancesTerminated
+		asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+				{
+					AutoScalingGroupName: aws.String("autoscaling-group-name"),
+					AvailabilityZones:    []string{"ap-northeast-1a", "ap-northeast-1c"},
+					DesiredCapacity:      aws.Int32(2),
+					Instances:            terminatingInstances,
+					MaxSize:              aws.Int32(4),
+				},
+			},
+		}, nil),
+
+		// Call `reload` at the end of the method
+		asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+				{
+					AutoScalingGroupName: aws.String("autoscaling-group-name"),
+					AvailabilityZones:    []string{"ap-northeast-1a", "ap-northeast-1c"},
+					DesiredCapacity:      aws.Int32(2),
+					Instances:            []autoscalingtypes.Instance{instances[1], instances[3]},
+					MaxSize:              aws.Int32(4),
+				},
+			},
+		}, nil),
+	)
+	gomock.InOrder(calls...)
+
+	group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock, capacity.WithTerminationMode(capacity.TerminationModeAutoScalingGroup))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := group.ReduceCapacity(ctx, 2, drainerMock); err != nil {
+		t.Errorf("err = %#v; want nil", err)
+	}
+}
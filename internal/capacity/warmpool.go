@@ -0,0 +1,188 @@
+package capacity
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	autoscalingtypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"golang.org/x/xerrors"
+
+	"github.com/abicky/ecsmec/internal/timeout"
+)
+
+// isWarmed reports whether the instance is in the warm pool.
+func isWarmed(i autoscalingtypes.Instance) bool {
+	return strings.HasPrefix(string(i.LifecycleState), "Warmed:")
+}
+
+func (asg *AutoScalingGroup) fetchWarmPoolInstances(ctx context.Context) ([]autoscalingtypes.Instance, error) {
+	instances := make([]autoscalingtypes.Instance, 0)
+	params := &autoscaling.DescribeWarmPoolInput{
+		AutoScalingGroupName: asg.AutoScalingGroupName,
+	}
+	for {
+		resp, err := asg.asSvc.DescribeWarmPool(ctx, params)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to describe the warm pool: %w", err)
+		}
+		instances = append(instances, resp.Instances...)
+
+		if resp.NextToken == nil {
+			return instances, nil
+		}
+		params.NextToken = resp.NextToken
+	}
+}
+
+// refreshWarmPool terminates the instances in the warm pool whose AMI differs from what the auto scaling group
+// launches now, so that the warm pool is replenished with new instances and the old AMI doesn't come back into
+// service. The replenishment isn't waited for.
+func (asg *AutoScalingGroup) refreshWarmPool(ctx context.Context) error {
+	if asg.WarmPoolConfiguration == nil {
+		return nil
+	}
+
+	spec, err := asg.fetchLaunchSpec(ctx)
+	if err != nil {
+		return xerrors.Errorf("failed to fetch the launch specification: %w", err)
+	}
+	if spec.imageID == "" {
+		log.Printf("[WARNING] Skip refreshing the warm pool because the AMI of the launch template is unknown\n")
+		return nil
+	}
+
+	instances, err := asg.fetchWarmPoolInstances(ctx)
+	if err != nil {
+		return err
+	}
+	ids := make([]string, len(instances))
+	for i, instance := range instances {
+		ids[i] = *instance.InstanceId
+	}
+
+	oldInstanceIDs := make([]string, 0)
+	err = asg.describeInstances(ctx, ids, func(i ec2types.Instance) error {
+		if aws.ToString(i.ImageId) != spec.imageID {
+			oldInstanceIDs = append(oldInstanceIDs, *i.InstanceId)
+		}
+		return nil
+	})
+	if err != nil {
+		return xerrors.Errorf("failed to fetch instances in the warm pool: %w", err)
+	}
+
+	for _, id := range oldInstanceIDs {
+		log.Println("Terminate the instance with the old AMI in the warm pool:", id)
+		_, err := asg.asSvc.TerminateInstanceInAutoScalingGroup(ctx, &autoscaling.TerminateInstanceInAutoScalingGroupInput{
+			InstanceId:                     aws.String(id),
+			ShouldDecrementDesiredCapacity: aws.Bool(false),
+		})
+		if err != nil {
+			return xerrors.Errorf("failed to terminate the instance %s in the warm pool: %w", id, err)
+		}
+	}
+
+	return nil
+}
+
+// checkWarmPoolReuse returns an error unless instances can be returned to the warm pool on scale in.
+func (asg *AutoScalingGroup) checkWarmPoolReuse() error {
+	config := asg.WarmPoolConfiguration
+	if config == nil {
+		return xerrors.Errorf("the auto scaling group %q has no warm pool", *asg.AutoScalingGroupName)
+	}
+	if config.InstanceReusePolicy == nil || !aws.ToBool(config.InstanceReusePolicy.ReuseOnScaleIn) {
+		return xerrors.Errorf("the warm pool of the auto scaling group %q doesn't reuse instances on scale in", *asg.AutoScalingGroupName)
+	}
+	// Container instances in a running warm pool would receive tasks once they are reactivated
+	if config.PoolState == autoscalingtypes.WarmPoolStateRunning {
+		return xerrors.Errorf("instances can't be returned to the warm pool in the %s state", config.PoolState)
+	}
+	return nil
+}
+
+// returnInstanceIDsToWarmPool drains the instances and returns them to the warm pool by scaling in the auto scaling
+// group. Once they are stopped or hibernated, their container instances are reactivated so that they can run tasks
+// again when they are reused.
+func (asg *AutoScalingGroup) returnInstanceIDsToWarmPool(ctx context.Context, sortedInstanceIDs []string, drainer Drainer, overrideProtection bool, cluster Cluster) error {
+	if err := asg.drainAndUnprotectInstances(ctx, sortedInstanceIDs, sortedInstanceIDs, drainer, overrideProtection); err != nil {
+		return err
+	}
+
+	for _, id := range sortedInstanceIDs {
+		log.Println("Return the instance to the warm pool:", id)
+		_, err := asg.asSvc.TerminateInstanceInAutoScalingGroup(ctx, &autoscaling.TerminateInstanceInAutoScalingGroupInput{
+			InstanceId:                     aws.String(id),
+			ShouldDecrementDesiredCapacity: aws.Bool(true),
+		})
+		if err != nil {
+			return xerrors.Errorf("failed to return the instance %s to the warm pool: %w", id, err)
+		}
+	}
+
+	state := autoscalingtypes.LifecycleState("Warmed:" + string(asg.WarmPoolConfiguration.PoolState))
+	if err := asg.waitUntilInstancesWarmed(ctx, sortedInstanceIDs, state); err != nil {
+		return xerrors.Errorf("failed to return the instances to the warm pool: %w", err)
+	}
+
+	if err := cluster.ReactivateContainerInstances(ctx, sortedInstanceIDs); err != nil {
+		return xerrors.Errorf("failed to reactivate container instances: %w", err)
+	}
+
+	return asg.reload(ctx)
+}
+
+// waitUntilInstancesWarmed waits until all the instances are in the warm pool in the lifecycle state.
+func (asg *AutoScalingGroup) waitUntilInstancesWarmed(ctx context.Context, instanceIDs []string, state autoscalingtypes.LifecycleState) error {
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	maxWait := timeout.Get(ctx, timeout.PhaseInstanceTermination)
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+
+	prevStates := ""
+	for {
+		instances, err := asg.fetchWarmPoolInstances(ctx)
+		if err != nil {
+			return err
+		}
+
+		states := make([]string, 0)
+		for _, id := range instanceIDs {
+			idx := slices.IndexFunc(instances, func(i autoscalingtypes.Instance) bool { return *i.InstanceId == id })
+			if idx == -1 {
+				states = append(states, fmt.Sprintf("%s (not in the warm pool)", id))
+			} else if instances[idx].LifecycleState != state {
+				states = append(states, fmt.Sprintf("%s (%s)", id, instances[idx].LifecycleState))
+			}
+		}
+		if len(states) == 0 {
+			return nil
+		}
+		if s := strings.Join(states, ", "); s != prevStates {
+			log.Println("Wait for the instances to be warmed:", s)
+			prevStates = s
+		}
+
+		select {
+		case <-ticker.C:
+			continue
+		case <-timer.C:
+			return &timeout.Error{
+				Phase:   timeout.PhaseInstanceTermination,
+				Timeout: maxWait,
+				Err:     xerrors.Errorf("%d instances are not %s yet", len(states), state),
+			}
+		case <-ctx.Done():
+			return timeout.Wrap(ctx, timeout.PhaseInstanceTermination, ctx.Err())
+		}
+	}
+}
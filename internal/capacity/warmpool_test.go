@@ -0,0 +1,412 @@
+package capacity_test
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	autoscalingtypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"go.uber.org/mock/gomock"
+
+	"github.com/abicky/ecsmec/internal/capacity"
+	"github.com/abicky/ecsmec/internal/testing/capacitymock"
+)
+
+func TestNewAutoScalingGroup_WithWarmedInstances(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+	ec2Mock := capacitymock.NewMockEC2API(ctrl)
+
+	instances := createInstances("ap-northeast-1a", 3)
+	instances[1].LifecycleState = autoscalingtypes.LifecycleStateWarmedStopped
+
+	asMock.EXPECT().DescribeAutoScalingGroups(gomock.Any(), gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+		AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+			{
+				AutoScalingGroupName: aws.String("autoscaling-group-name"),
+				DesiredCapacity:      aws.Int32(2),
+				Instances:            instances,
+				MaxSize:              aws.Int32(3),
+			},
+		},
+	}, nil)
+
+	group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{*instances[0].InstanceId, *instances[2].InstanceId}
+	if got := instanceIDs(group.Instances); !slices.Equal(got, want) {
+		t.Errorf("Instances = %v; want %v", got, want)
+	}
+}
+
+func TestAutoScalingGroup_ReplaceInstancesWithWarmPoolRefresh(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+
+	asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+	ec2Mock := capacitymock.NewMockEC2API(ctrl)
+	drainerMock := capacitymock.NewMockDrainer(ctrl)
+	clusterMock := capacitymock.NewMockCluster(ctrl)
+
+	now := time.Now().UTC()
+
+	// All the instances in service are up to date, so only the warm pool is refreshed
+	instances := createInstances("ap-northeast-1a", 2)
+	warmedInstances := createInstances("ap-northeast-1a", 2)
+	for i := range warmedInstances {
+		warmedInstances[i].LifecycleState = autoscalingtypes.LifecycleStateWarmedStopped
+	}
+
+	gomock.InOrder(
+		asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+				{
+					AutoScalingGroupName: aws.String("autoscaling-group-name"),
+					AvailabilityZones:    []string{"ap-northeast-1a"},
+					DesiredCapacity:      aws.Int32(2),
+					Instances:            instances,
+					LaunchTemplate: &autoscalingtypes.LaunchTemplateSpecification{
+						LaunchTemplateId: aws.String("lt-0123456789"),
+						Version:          aws.String("$Latest"),
+					},
+					MaxSize: aws.Int32(4),
+					WarmPoolConfiguration: &autoscalingtypes.WarmPoolConfiguration{
+						PoolState: autoscalingtypes.WarmPoolStateStopped,
+					},
+				},
+			},
+		}, nil),
+
+		ec2Mock.EXPECT().DescribeLaunchTemplateVersions(ctx, gomock.Any()).Return(&ec2.DescribeLaunchTemplateVersionsOutput{
+			LaunchTemplateVersions: []ec2types.LaunchTemplateVersion{
+				{
+					LaunchTemplateData: &ec2types.ResponseLaunchTemplateData{
+						ImageId: aws.String("ami-new"),
+					},
+					LaunchTemplateId: aws.String("lt-0123456789"),
+					VersionNumber:    aws.Int64(2),
+				},
+			},
+		}, nil),
+
+		asMock.EXPECT().DescribeWarmPool(ctx, gomock.Any()).Return(&autoscaling.DescribeWarmPoolOutput{
+			Instances: warmedInstances,
+		}, nil),
+
+		ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, input *ec2.DescribeInstancesInput, _ ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+			if want := instanceIDs(warmedInstances); !slices.Equal(input.InstanceIds, want) {
+				t.Errorf("InstanceIds = %v; want %v", input.InstanceIds, want)
+			}
+			reservations := createReservations(warmedInstances, now.Add(-24*time.Hour))
+			reservations[0].Instances[0].ImageId = aws.String("ami-old")
+			reservations[1].Instances[0].ImageId = aws.String("ami-new")
+			return &ec2.DescribeInstancesOutput{Reservations: reservations}, nil
+		}),
+
+		asMock.EXPECT().TerminateInstanceInAutoScalingGroup(ctx, gomock.Any()).Do(func(_ context.Context, input *autoscaling.TerminateInstanceInAutoScalingGroupInput, _ ...func(*autoscaling.Options)) {
+			if *input.InstanceId != *warmedInstances[0].InstanceId {
+				t.Errorf("InstanceId = %s; want %s", *input.InstanceId, *warmedInstances[0].InstanceId)
+			}
+			if aws.ToBool(input.ShouldDecrementDesiredCapacity) {
+				t.Errorf("ShouldDecrementDesiredCapacity = true; want false")
+			}
+		}),
+
+		// For fetchInstances
+		ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+			Reservations: createReservations(instances, now.Add(time.Hour)),
+		}, nil),
+	)
+
+	group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := group.ReplaceInstances(ctx, drainerMock, clusterMock, capacity.WithWarmPoolRefresh()); err != nil {
+		t.Errorf("err = %#v; want nil", err)
+	}
+}
+
+func TestAutoScalingGroup_ReplaceInstancesWithRunningWarmPool(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+
+	asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+	ec2Mock := capacitymock.NewMockEC2API(ctrl)
+	expectNoTerminationProtection(ec2Mock)
+	drainerMock := capacitymock.NewMockDrainer(ctrl)
+	clusterMock := capacitymock.NewMockCluster(ctrl)
+	clusterMock.EXPECT().Name()
+
+	now := time.Now().UTC()
+	stateSavedAt := now.Format(time.RFC3339)
+
+	desiredCapacity := int32(2)
+	maxSize := int32(4)
+	oldInstances := []autoscalingtypes.Instance{createInstance("ap-northeast-1a"), createInstance("ap-northeast-1c")}
+	newInstances := []autoscalingtypes.Instance{createInstance("ap-northeast-1a"), createInstance("ap-northeast-1c")}
+
+	oldReservations := createReservations(oldInstances, now.Add(-24*time.Hour))
+	newReservations := createReservations(newInstances, now)
+	// The instance taken from the running warm pool was launched before the old instances
+	newReservations[0].Instances[0].LaunchTime = aws.Time(now.Add(-48 * time.Hour))
+
+	gomock.InOrder(
+		asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+				{
+					AutoScalingGroupName: aws.String("autoscaling-group-name"),
+					AvailabilityZones:    []string{"ap-northeast-1a", "ap-northeast-1c"},
+					DesiredCapacity:      aws.Int32(desiredCapacity),
+					Instances:            oldInstances,
+					MaxSize:              aws.Int32(maxSize),
+					WarmPoolConfiguration: &autoscalingtypes.WarmPoolConfiguration{
+						PoolState: autoscalingtypes.WarmPoolStateRunning,
+					},
+				},
+			},
+		}, nil),
+
+		// For fetchInstances
+		ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+			Reservations: oldReservations,
+		}, nil),
+
+		expectLaunchNewInstances(t, ctx, asMock, oldInstances, newInstances, desiredCapacity, maxSize, stateSavedAt, nil),
+		clusterMock.EXPECT().WaitUntilContainerInstancesRegistered(ctx, instanceIDs(newInstances)),
+		// The old instances must be terminated even though the new instance looks older
+		expectTerminateInstances(t, ctx, asMock, ec2Mock, drainerMock, oldInstances, newInstances, oldReservations, newReservations, desiredCapacity, maxSize, nil),
+		expectRestoreState(t, ctx, asMock, desiredCapacity, maxSize, stateSavedAt, nil),
+	)
+
+	group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := group.ReplaceInstances(ctx, drainerMock, clusterMock); err != nil {
+		t.Errorf("err = %#v; want nil", err)
+	}
+}
+
+func TestAutoScalingGroup_RollbackReplacementWithRunningWarmPool(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+
+	desiredCapacity := int32(2)
+	maxSize := int32(2)
+
+	asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+	ec2Mock := capacitymock.NewMockEC2API(ctrl)
+	expectNoTerminationProtection(ec2Mock)
+	drainerMock := capacitymock.NewMockDrainer(ctrl)
+	clusterMock := capacitymock.NewMockCluster(ctrl)
+
+	now := time.Now().UTC()
+	stateSavedAt := now.Format(time.RFC3339)
+
+	oldInstances := append(createInstances("ap-northeast-1a", 1), createInstances("ap-northeast-1c", 1)...)
+	newInstances := append(createInstances("ap-northeast-1a", 1), createInstances("ap-northeast-1c", 1)...)
+	oldInstanceIDs := []string{*oldInstances[0].InstanceId, *oldInstances[1].InstanceId}
+	// The second new instance was taken from the warm pool, so it was launched before the replacement started
+	newReservations := []ec2types.Reservation{
+		createReservation(newInstances[0], now),
+		createReservation(newInstances[1], now.Add(-48*time.Hour)),
+	}
+
+	tags := createTagDescriptions(desiredCapacity, maxSize, stateSavedAt)
+
+	asMock.EXPECT().DescribeScalingActivities(ctx, gomock.Any(), gomock.Any()).Return(&autoscaling.DescribeScalingActivitiesOutput{
+		// Activities are sorted in descending order of their start time
+		Activities: []autoscalingtypes.Activity{
+			{
+				ActivityId:  aws.String("activity-id-2"),
+				Description: aws.String("Launching a new EC2 instance from warm pool: " + *newInstances[1].InstanceId),
+				StartTime:   aws.Time(now.Add(time.Minute)),
+			},
+			{
+				ActivityId:  aws.String("activity-id-1"),
+				Description: aws.String("Launching a new EC2 instance: " + *newInstances[0].InstanceId),
+				StartTime:   aws.Time(now.Add(time.Minute)),
+			},
+			{
+				ActivityId:  aws.String("activity-id-0"),
+				Description: aws.String("Launching a new EC2 instance: " + *oldInstances[0].InstanceId),
+				StartTime:   aws.Time(now.Add(-24 * time.Hour)),
+			},
+		},
+	}, nil)
+	clusterMock.EXPECT().ReactivateContainerInstances(ctx, oldInstanceIDs)
+	clusterMock.EXPECT().ContainerInstances(ctx, gomock.Len(len(newInstances))).Return(createContainerInstances(newInstances), nil)
+
+	gomock.InOrder(
+		asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+				{
+					AutoScalingGroupName: aws.String("autoscaling-group-name"),
+					DesiredCapacity:      aws.Int32(desiredCapacity * 2),
+					Instances:            append(slices.Clone(oldInstances), newInstances...),
+					MaxSize:              aws.Int32(desiredCapacity * 2),
+					Tags:                 tags,
+				},
+			},
+		}, nil),
+
+		expectTerminateInstances(
+			t, ctx, asMock, ec2Mock, drainerMock,
+			newInstances, oldInstances,
+			newReservations, createReservations(oldInstances, now.Add(-24*time.Hour)),
+			desiredCapacity, desiredCapacity*2, tags,
+		),
+		expectRestoreState(t, ctx, asMock, desiredCapacity, maxSize, stateSavedAt, nil),
+	)
+
+	group, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := group.RollbackReplacement(ctx, drainerMock, clusterMock); err != nil {
+		t.Errorf("err = %#v; want nil", err)
+	}
+}
+
+func TestAutoScalingGroup_ReduceCapacityWithWarmPoolReturn(t *testing.T) {
+	now := time.Now().UTC()
+
+	instances := createInstances("ap-northeast-1a", 2)
+	reservations := []ec2types.Reservation{
+		createReservation(instances[0], now.Add(-time.Hour)),
+		createReservation(instances[1], now),
+	}
+	instanceIDToReturn := *instances[0].InstanceId
+
+	t.Run("the warm pool reuses instances on scale in", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+		ec2Mock := capacitymock.NewMockEC2API(ctrl)
+		expectNoTerminationProtection(ec2Mock)
+		drainerMock := capacitymock.NewMockDrainer(ctrl)
+		clusterMock := capacitymock.NewMockCluster(ctrl)
+
+		group := autoscalingtypes.AutoScalingGroup{
+			AutoScalingGroupName: aws.String("autoscaling-group-name"),
+			AvailabilityZones:    []string{"ap-northeast-1a"},
+			DesiredCapacity:      aws.Int32(2),
+			Instances:            instances,
+			MaxSize:              aws.Int32(2),
+			WarmPoolConfiguration: &autoscalingtypes.WarmPoolConfiguration{
+				InstanceReusePolicy: &autoscalingtypes.InstanceReusePolicy{ReuseOnScaleIn: aws.Bool(true)},
+				PoolState:           autoscalingtypes.WarmPoolStateStopped,
+			},
+		}
+		reducedGroup := group
+		reducedGroup.DesiredCapacity = aws.Int32(1)
+		reducedGroup.Instances = instances[1:]
+
+		gomock.InOrder(
+			asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+				AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{group},
+			}, nil),
+
+			ec2Mock.EXPECT().DescribeInstances(ctx, gomock.Any()).Return(&ec2.DescribeInstancesOutput{
+				Reservations: reservations,
+			}, nil),
+
+			drainerMock.EXPECT().Drain(ctx, []string{instanceIDToReturn}),
+
+			// The instance is neither detached nor terminated
+			asMock.EXPECT().TerminateInstanceInAutoScalingGroup(ctx, gomock.Any()).Do(func(_ context.Context, input *autoscaling.TerminateInstanceInAutoScalingGroupInput, _ ...func(*autoscaling.Options)) {
+				if *input.InstanceId != instanceIDToReturn {
+					t.Errorf("InstanceId = %s; want %s", *input.InstanceId, instanceIDToReturn)
+				}
+				if !aws.ToBool(input.ShouldDecrementDesiredCapacity) {
+					t.Errorf("ShouldDecrementDesiredCapacity = false; want true")
+				}
+			}),
+
+			asMock.EXPECT().DescribeWarmPool(ctx, gomock.Any()).Return(&autoscaling.DescribeWarmPoolOutput{
+				Instances: []autoscalingtypes.Instance{
+					{
+						AvailabilityZone: aws.String("ap-northeast-1a"),
+						InstanceId:       aws.String(instanceIDToReturn),
+						LifecycleState:   autoscalingtypes.LifecycleStateWarmedStopped,
+					},
+				},
+			}, nil),
+
+			clusterMock.EXPECT().ReactivateContainerInstances(ctx, []string{instanceIDToReturn}),
+
+			// Call `reload` at the end of the method
+			asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+				AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{reducedGroup},
+			}, nil),
+		)
+
+		asg, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := asg.ReduceCapacity(ctx, 1, drainerMock, capacity.WithWarmPoolReturn(clusterMock)); err != nil {
+			t.Errorf("err = %#v; want nil", err)
+		}
+	})
+
+	t.Run("the warm pool doesn't reuse instances on scale in", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+		ec2Mock := capacitymock.NewMockEC2API(ctrl)
+		drainerMock := capacitymock.NewMockDrainer(ctrl)
+		clusterMock := capacitymock.NewMockCluster(ctrl)
+
+		asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+				{
+					AutoScalingGroupName: aws.String("autoscaling-group-name"),
+					DesiredCapacity:      aws.Int32(2),
+					Instances:            instances,
+					MaxSize:              aws.Int32(2),
+					WarmPoolConfiguration: &autoscalingtypes.WarmPoolConfiguration{
+						PoolState: autoscalingtypes.WarmPoolStateStopped,
+					},
+				},
+			},
+		}, nil)
+
+		asg, err := capacity.NewAutoScalingGroup("autoscaling-group-name", asMock, ec2Mock)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The instance must not be drained
+		if err := asg.ReduceCapacity(ctx, 1, drainerMock, capacity.WithWarmPoolReturn(clusterMock)); err == nil {
+			t.Errorf("err = nil; want non-nil")
+		}
+	})
+}
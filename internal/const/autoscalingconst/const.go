@@ -4,4 +4,22 @@ const (
 	// DetachInstances can detach instances up to this value
 	// cf. https://docs.aws.amazon.com/autoscaling/ec2/APIReference/API_DetachInstances.html
 	MaxDetachableInstances = 20
+
+	// SetInstanceProtection can set the protection of instances up to this value
+	// cf. https://docs.aws.amazon.com/autoscaling/ec2/APIReference/API_SetInstanceProtection.html
+	MaxProtectableInstances = 50
 )
+
+// ScalingProcesses are the processes that SuspendProcesses and ResumeProcesses accept
+// cf. https://docs.aws.amazon.com/autoscaling/ec2/userguide/as-suspend-resume-processes.html
+var ScalingProcesses = []string{
+	"Launch",
+	"Terminate",
+	"AddToLoadBalancer",
+	"AlarmNotification",
+	"AZRebalance",
+	"HealthCheck",
+	"InstanceRefresh",
+	"ReplaceUnhealthy",
+	"ScheduledActions",
+}
@@ -7,6 +7,9 @@ const (
 	// DescribeTasks can describe tasks up to this value
 	// cf. https://docs.aws.amazon.com/AmazonECS/latest/APIReference/API_DescribeTasks.html
 	MaxDescribableTasks = 100
+	// GetTaskProtection can get the protection status of tasks up to this value
+	// cf. https://docs.aws.amazon.com/AmazonECS/latest/APIReference/API_GetTaskProtection.html
+	MaxTaskProtectionTasks = 10
 	// ListContainerInstances can list container instances up to this value
 	// cf. https://docs.aws.amazon.com/AmazonECS/latest/APIReference/API_ListContainerInstances.html
 	MaxListableContainerInstances = 100
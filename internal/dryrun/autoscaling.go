@@ -0,0 +1,334 @@
+package dryrun
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	autoscalingtypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"golang.org/x/xerrors"
+
+	"github.com/abicky/ecsmec/internal/capacity"
+)
+
+type autoScalingClient struct {
+	svc capacity.AutoScalingAPI
+	r   *Recorder
+}
+
+// AutoScaling wraps svc so that the mutating calls are recorded instead of being sent.
+func (r *Recorder) AutoScaling(svc capacity.AutoScalingAPI) capacity.AutoScalingAPI {
+	return &autoScalingClient{svc: svc, r: r}
+}
+
+func (c *autoScalingClient) CompleteLifecycleAction(ctx context.Context, params *autoscaling.CompleteLifecycleActionInput, optFns ...func(*autoscaling.Options)) (*autoscaling.CompleteLifecycleActionOutput, error) {
+	c.r.Record("Complete the lifecycle action of the instance %s in the auto scaling group %q: %s", *params.InstanceId, *params.AutoScalingGroupName, *params.LifecycleActionResult)
+	return &autoscaling.CompleteLifecycleActionOutput{}, nil
+}
+
+func (c *autoScalingClient) CreateOrUpdateTags(ctx context.Context, params *autoscaling.CreateOrUpdateTagsInput, optFns ...func(*autoscaling.Options)) (*autoscaling.CreateOrUpdateTagsOutput, error) {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+
+	for _, t := range params.Tags {
+		c.r.record("Create or update the tag %q of the auto scaling group %q: %s", *t.Key, *t.ResourceId, *t.Value)
+		c.r.group(*t.ResourceId).tags[*t.Key] = t.Value
+	}
+	return &autoscaling.CreateOrUpdateTagsOutput{}, nil
+}
+
+func (c *autoScalingClient) DeleteTags(ctx context.Context, params *autoscaling.DeleteTagsInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DeleteTagsOutput, error) {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+
+	for _, t := range params.Tags {
+		c.r.record("Delete the tag %q of the auto scaling group %q", *t.Key, *t.ResourceId)
+		c.r.group(*t.ResourceId).tags[*t.Key] = nil
+	}
+	return &autoscaling.DeleteTagsOutput{}, nil
+}
+
+func (c *autoScalingClient) DescribeAutoScalingGroups(ctx context.Context, params *autoscaling.DescribeAutoScalingGroupsInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+	resp, err := c.svc.DescribeAutoScalingGroups(ctx, params, optFns...)
+	if err != nil {
+		return nil, err
+	}
+
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+
+	for i := range resp.AutoScalingGroups {
+		c.r.applyGroupState(&resp.AutoScalingGroups[i])
+	}
+	return resp, nil
+}
+
+func (c *autoScalingClient) DescribeScalingActivities(ctx context.Context, params *autoscaling.DescribeScalingActivitiesInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeScalingActivitiesOutput, error) {
+	return c.svc.DescribeScalingActivities(ctx, params, optFns...)
+}
+
+func (c *autoScalingClient) DescribeWarmPool(ctx context.Context, params *autoscaling.DescribeWarmPoolInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeWarmPoolOutput, error) {
+	// Resolve the instances terminated by TerminateInstanceInAutoScalingGroup, some of which might return to the warm pool
+	if _, err := c.DescribeAutoScalingGroups(ctx, &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []string{*params.AutoScalingGroupName},
+	}); err != nil {
+		return nil, xerrors.Errorf("failed to describe the auto scaling group: %w", err)
+	}
+
+	resp, err := c.svc.DescribeWarmPool(ctx, params, optFns...)
+	if err != nil {
+		return nil, err
+	}
+
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+
+	instances := make([]autoscalingtypes.Instance, 0, len(resp.Instances))
+	for _, i := range resp.Instances {
+		if !c.r.terminatedInstances[*i.InstanceId] {
+			instances = append(instances, i)
+		}
+	}
+	// Simulated instances are added only to the first page
+	if g, ok := c.r.groups[*params.AutoScalingGroupName]; ok && params.NextToken == nil && resp.WarmPoolConfiguration != nil {
+		for _, i := range g.warmedInstances {
+			i.LifecycleState = autoscalingtypes.LifecycleState("Warmed:" + string(resp.WarmPoolConfiguration.PoolState))
+			instances = append(instances, i)
+		}
+	}
+	resp.Instances = instances
+	return resp, nil
+}
+
+func (c *autoScalingClient) DetachInstances(ctx context.Context, params *autoscaling.DetachInstancesInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DetachInstancesOutput, error) {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+
+	c.r.record("Detach the instances %v from the auto scaling group %q", params.InstanceIds, *params.AutoScalingGroupName)
+	g := c.r.group(*params.AutoScalingGroupName)
+	for _, id := range params.InstanceIds {
+		g.detached[id] = true
+	}
+	if aws.ToBool(params.ShouldDecrementDesiredCapacity) && g.desiredCapacity != nil {
+		g.desiredCapacity = aws.Int32(*g.desiredCapacity - int32(len(params.InstanceIds)))
+	}
+	return &autoscaling.DetachInstancesOutput{}, nil
+}
+
+func (c *autoScalingClient) RecordLifecycleActionHeartbeat(ctx context.Context, params *autoscaling.RecordLifecycleActionHeartbeatInput, optFns ...func(*autoscaling.Options)) (*autoscaling.RecordLifecycleActionHeartbeatOutput, error) {
+	// Heartbeats don't change anything, so they aren't recorded
+	return &autoscaling.RecordLifecycleActionHeartbeatOutput{}, nil
+}
+
+func (c *autoScalingClient) ResumeProcesses(ctx context.Context, params *autoscaling.ResumeProcessesInput, optFns ...func(*autoscaling.Options)) (*autoscaling.ResumeProcessesOutput, error) {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+
+	c.r.record("Resume the processes of the auto scaling group %q: %v", *params.AutoScalingGroupName, params.ScalingProcesses)
+	g := c.r.group(*params.AutoScalingGroupName)
+	for _, p := range params.ScalingProcesses {
+		g.suspendedProcesses[p] = false
+	}
+	return &autoscaling.ResumeProcessesOutput{}, nil
+}
+
+func (c *autoScalingClient) SetInstanceProtection(ctx context.Context, params *autoscaling.SetInstanceProtectionInput, optFns ...func(*autoscaling.Options)) (*autoscaling.SetInstanceProtectionOutput, error) {
+	c.r.Record("Set the scale-in protection of the instances %v in the auto scaling group %q: %t", params.InstanceIds, *params.AutoScalingGroupName, aws.ToBool(params.ProtectedFromScaleIn))
+	return &autoscaling.SetInstanceProtectionOutput{}, nil
+}
+
+func (c *autoScalingClient) SuspendProcesses(ctx context.Context, params *autoscaling.SuspendProcessesInput, optFns ...func(*autoscaling.Options)) (*autoscaling.SuspendProcessesOutput, error) {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+
+	c.r.record("Suspend the processes of the auto scaling group %q: %v", *params.AutoScalingGroupName, params.ScalingProcesses)
+	g := c.r.group(*params.AutoScalingGroupName)
+	for _, p := range params.ScalingProcesses {
+		g.suspendedProcesses[p] = true
+	}
+	return &autoscaling.SuspendProcessesOutput{}, nil
+}
+
+func (c *autoScalingClient) TerminateInstanceInAutoScalingGroup(ctx context.Context, params *autoscaling.TerminateInstanceInAutoScalingGroupInput, optFns ...func(*autoscaling.Options)) (*autoscaling.TerminateInstanceInAutoScalingGroupOutput, error) {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+
+	c.r.record("Terminate the instance %s in its auto scaling group (ShouldDecrementDesiredCapacity: %t)", *params.InstanceId, aws.ToBool(params.ShouldDecrementDesiredCapacity))
+	// Lifecycle hooks are assumed to complete immediately
+	c.r.instancesTerminatedInGroup[*params.InstanceId] = aws.ToBool(params.ShouldDecrementDesiredCapacity)
+	c.r.terminatedInstances[*params.InstanceId] = true
+	return &autoscaling.TerminateInstanceInAutoScalingGroupOutput{}, nil
+}
+
+func (c *autoScalingClient) UpdateAutoScalingGroup(ctx context.Context, params *autoscaling.UpdateAutoScalingGroupInput, optFns ...func(*autoscaling.Options)) (*autoscaling.UpdateAutoScalingGroupOutput, error) {
+	// Fetch the current state to simulate instances launched by the new desired capacity
+	resp, err := c.DescribeAutoScalingGroups(ctx, &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []string{*params.AutoScalingGroupName},
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("failed to describe the auto scaling group: %w", err)
+	}
+	if len(resp.AutoScalingGroups) == 0 {
+		return nil, xerrors.Errorf("the auto scaling group \"%s\" doesn't exist", *params.AutoScalingGroupName)
+	}
+	current := resp.AutoScalingGroups[0]
+
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+
+	g := c.r.group(*params.AutoScalingGroupName)
+	if params.MaxSize != nil {
+		c.r.record("Update the auto scaling group %q: MaxSize: %d -> %d", *params.AutoScalingGroupName, aws.ToInt32(current.MaxSize), *params.MaxSize)
+		g.maxSize = params.MaxSize
+	}
+	if params.DesiredCapacity != nil {
+		c.r.record("Update the auto scaling group %q: DesiredCapacity: %d -> %d", *params.AutoScalingGroupName, aws.ToInt32(current.DesiredCapacity), *params.DesiredCapacity)
+		g.desiredCapacity = params.DesiredCapacity
+
+		instances := current.Instances
+		for i := len(current.Instances); i < int(*params.DesiredCapacity); i++ {
+			instance := c.r.launchInstance(current.AvailabilityZones, instances)
+			g.instances = append(g.instances, instance)
+			instances = append(instances, instance)
+		}
+	}
+	return &autoscaling.UpdateAutoScalingGroupOutput{}, nil
+}
+
+func (r *Recorder) group(name string) *groupState {
+	g, ok := r.groups[name]
+	if !ok {
+		g = &groupState{
+			detached:           make(map[string]bool),
+			tags:               make(map[string]*string),
+			suspendedProcesses: make(map[string]bool),
+		}
+		r.groups[name] = g
+	}
+	return g
+}
+
+func (r *Recorder) applyGroupState(group *autoscalingtypes.AutoScalingGroup) {
+	r.removeInstancesTerminatedInGroup(group)
+
+	g, ok := r.groups[*group.AutoScalingGroupName]
+	if !ok {
+		return
+	}
+
+	if g.desiredCapacity != nil {
+		group.DesiredCapacity = g.desiredCapacity
+	}
+	if g.maxSize != nil {
+		group.MaxSize = g.maxSize
+	}
+
+	instances := make([]autoscalingtypes.Instance, 0, len(group.Instances)+len(g.instances))
+	for _, i := range append(group.Instances, g.instances...) {
+		if !g.detached[*i.InstanceId] {
+			instances = append(instances, i)
+		}
+	}
+	group.Instances = instances
+
+	tags := make([]autoscalingtypes.TagDescription, 0, len(group.Tags)+len(g.tags))
+	for _, t := range group.Tags {
+		if _, ok := g.tags[*t.Key]; !ok {
+			tags = append(tags, t)
+		}
+	}
+	for k, v := range g.tags {
+		if v != nil {
+			tags = append(tags, autoscalingtypes.TagDescription{
+				Key:          aws.String(k),
+				ResourceId:   group.AutoScalingGroupName,
+				ResourceType: aws.String("auto-scaling-group"),
+				Value:        v,
+			})
+		}
+	}
+	slices.SortFunc(tags, func(a, b autoscalingtypes.TagDescription) int {
+		return cmp.Compare(*a.Key, *b.Key)
+	})
+	group.Tags = tags
+
+	processes := make([]autoscalingtypes.SuspendedProcess, 0, len(group.SuspendedProcesses)+len(g.suspendedProcesses))
+	for _, p := range group.SuspendedProcesses {
+		if _, ok := g.suspendedProcesses[*p.ProcessName]; !ok {
+			processes = append(processes, p)
+		}
+	}
+	for name, suspended := range g.suspendedProcesses {
+		if suspended {
+			processes = append(processes, autoscalingtypes.SuspendedProcess{
+				ProcessName:      aws.String(name),
+				SuspensionReason: aws.String("User suspended"),
+			})
+		}
+	}
+	slices.SortFunc(processes, func(a, b autoscalingtypes.SuspendedProcess) int {
+		return cmp.Compare(*a.ProcessName, *b.ProcessName)
+	})
+	group.SuspendedProcesses = processes
+}
+
+// removeInstancesTerminatedInGroup detaches the instances terminated by TerminateInstanceInAutoScalingGroup from
+// the group and decrements the desired capacity if requested. If the warm pool reuses instances on scale in,
+// the instances return to the warm pool instead of being terminated.
+func (r *Recorder) removeInstancesTerminatedInGroup(group *autoscalingtypes.AutoScalingGroup) {
+	instances := group.Instances
+	if g, ok := r.groups[*group.AutoScalingGroupName]; ok {
+		instances = append(slices.Clone(instances), g.instances...)
+	}
+
+	for _, i := range instances {
+		decrement, ok := r.instancesTerminatedInGroup[*i.InstanceId]
+		if !ok {
+			continue
+		}
+		delete(r.instancesTerminatedInGroup, *i.InstanceId)
+
+		g := r.group(*group.AutoScalingGroupName)
+		g.detached[*i.InstanceId] = true
+		if decrement {
+			if g.desiredCapacity == nil {
+				g.desiredCapacity = group.DesiredCapacity
+			}
+			g.desiredCapacity = aws.Int32(*g.desiredCapacity - 1)
+
+			if pool := group.WarmPoolConfiguration; pool != nil && pool.InstanceReusePolicy != nil && aws.ToBool(pool.InstanceReusePolicy.ReuseOnScaleIn) {
+				delete(r.terminatedInstances, *i.InstanceId)
+				g.warmedInstances = append(g.warmedInstances, i)
+			}
+		}
+	}
+}
+
+// launchInstance simulates an instance launched in the availability zone with the fewest instances
+// in the same way as Auto Scaling balances instances across availability zones.
+func (r *Recorder) launchInstance(azs []string, instances []autoscalingtypes.Instance) autoscalingtypes.Instance {
+	azToCount := make(map[string]int, len(azs))
+	for _, i := range instances {
+		azToCount[*i.AvailabilityZone]++
+	}
+	az := ""
+	for _, a := range azs {
+		if az == "" || azToCount[a] < azToCount[az] {
+			az = a
+		}
+	}
+
+	id := r.newInstanceID()
+	r.launchedInstances[id] = launchedInstance{
+		availabilityZone: az,
+		launchTime:       time.Now(),
+	}
+	return autoscalingtypes.Instance{
+		AvailabilityZone: aws.String(az),
+		InstanceId:       aws.String(id),
+		LifecycleState:   autoscalingtypes.LifecycleStateInService,
+	}
+}
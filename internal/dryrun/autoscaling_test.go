@@ -0,0 +1,283 @@
+package dryrun_test
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	autoscalingtypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"go.uber.org/mock/gomock"
+
+	"github.com/abicky/ecsmec/internal/dryrun"
+	"github.com/abicky/ecsmec/internal/testing/capacitymock"
+)
+
+func TestRecorder_AutoScaling(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+
+	asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+	ec2Mock := capacitymock.NewMockEC2API(ctrl)
+
+	asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).AnyTimes().DoAndReturn(func(_ context.Context, _ *autoscaling.DescribeAutoScalingGroupsInput, _ ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+		return &autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+				{
+					AutoScalingGroupName: aws.String("asg"),
+					AvailabilityZones:    []string{"ap-northeast-1a", "ap-northeast-1c"},
+					DesiredCapacity:      aws.Int32(1),
+					Instances: []autoscalingtypes.Instance{
+						{
+							AvailabilityZone: aws.String("ap-northeast-1a"),
+							InstanceId:       aws.String("i-000"),
+							LifecycleState:   autoscalingtypes.LifecycleStateInService,
+						},
+					},
+					MaxSize: aws.Int32(1),
+					Tags: []autoscalingtypes.TagDescription{
+						{Key: aws.String("Name"), Value: aws.String("test")},
+					},
+				},
+			},
+		}, nil
+	})
+
+	rec := dryrun.NewRecorder()
+	asSvc := rec.AutoScaling(asMock)
+	ec2Svc := rec.EC2(ec2Mock)
+
+	_, err := asSvc.CreateOrUpdateTags(ctx, &autoscaling.CreateOrUpdateTagsInput{
+		Tags: []autoscalingtypes.Tag{
+			{Key: aws.String("ecsmec:OriginalDesiredCapacity"), ResourceId: aws.String("asg"), Value: aws.String("1")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = asSvc.UpdateAutoScalingGroup(ctx, &autoscaling.UpdateAutoScalingGroupInput{
+		AutoScalingGroupName: aws.String("asg"),
+		DesiredCapacity:      aws.Int32(3),
+		MaxSize:              aws.Int32(3),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := asSvc.DescribeAutoScalingGroups(ctx, &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []string{"asg"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	group := resp.AutoScalingGroups[0]
+	if *group.DesiredCapacity != 3 {
+		t.Errorf("DesiredCapacity = %d; want %d", *group.DesiredCapacity, 3)
+	}
+	if len(group.Instances) != 3 {
+		t.Fatalf("len(Instances) = %d; want %d", len(group.Instances), 3)
+	}
+	if *group.Instances[1].AvailabilityZone != "ap-northeast-1c" {
+		t.Errorf("AvailabilityZone = %s; want %s", *group.Instances[1].AvailabilityZone, "ap-northeast-1c")
+	}
+	if len(group.Tags) != 2 {
+		t.Errorf("len(Tags) = %d; want %d", len(group.Tags), 2)
+	}
+
+	// The simulated instances must be described without calling the API
+	instances, err := ec2Svc.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []string{*group.Instances[1].InstanceId, *group.Instances[2].InstanceId},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances.Reservations) != 1 || len(instances.Reservations[0].Instances) != 2 {
+		t.Errorf("Reservations = %#v; want 2 instances", instances.Reservations)
+	}
+
+	_, err = asSvc.DetachInstances(ctx, &autoscaling.DetachInstancesInput{
+		AutoScalingGroupName:           aws.String("asg"),
+		InstanceIds:                    []string{"i-000"},
+		ShouldDecrementDesiredCapacity: aws.Bool(true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = asSvc.DescribeAutoScalingGroups(ctx, &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []string{"asg"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	group = resp.AutoScalingGroups[0]
+	if *group.DesiredCapacity != 2 {
+		t.Errorf("DesiredCapacity = %d; want %d", *group.DesiredCapacity, 2)
+	}
+	if len(group.Instances) != 2 {
+		t.Fatalf("len(Instances) = %d; want %d", len(group.Instances), 2)
+	}
+
+	// The group of the instance is resolved when the group is described
+	_, err = asSvc.TerminateInstanceInAutoScalingGroup(ctx, &autoscaling.TerminateInstanceInAutoScalingGroupInput{
+		InstanceId:                     group.Instances[0].InstanceId,
+		ShouldDecrementDesiredCapacity: aws.Bool(true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = asSvc.DescribeAutoScalingGroups(ctx, &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []string{"asg"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	group = resp.AutoScalingGroups[0]
+	if *group.DesiredCapacity != 1 {
+		t.Errorf("DesiredCapacity = %d; want %d", *group.DesiredCapacity, 1)
+	}
+	if len(group.Instances) != 1 {
+		t.Errorf("len(Instances) = %d; want %d", len(group.Instances), 1)
+	}
+
+	if got := len(rec.Actions()); got != 5 {
+		t.Errorf("len(Actions()) = %d; want %d: %v", got, 5, rec.Actions())
+	}
+}
+
+func TestRecorder_AutoScalingProcesses(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+
+	asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+
+	asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).AnyTimes().Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+		AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+			{
+				AutoScalingGroupName: aws.String("asg"),
+				SuspendedProcesses: []autoscalingtypes.SuspendedProcess{
+					{ProcessName: aws.String("ScheduledActions")},
+					{ProcessName: aws.String("Terminate")},
+				},
+			},
+		},
+	}, nil)
+
+	rec := dryrun.NewRecorder()
+	asSvc := rec.AutoScaling(asMock)
+
+	_, err := asSvc.SuspendProcesses(ctx, &autoscaling.SuspendProcessesInput{
+		AutoScalingGroupName: aws.String("asg"),
+		ScalingProcesses:     []string{"AZRebalance", "ScheduledActions"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = asSvc.ResumeProcesses(ctx, &autoscaling.ResumeProcessesInput{
+		AutoScalingGroupName: aws.String("asg"),
+		ScalingProcesses:     []string{"Terminate"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := asSvc.DescribeAutoScalingGroups(ctx, &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []string{"asg"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	processes := make([]string, 0)
+	for _, p := range resp.AutoScalingGroups[0].SuspendedProcesses {
+		processes = append(processes, *p.ProcessName)
+	}
+	want := []string{"AZRebalance", "ScheduledActions"}
+	if !slices.Equal(processes, want) {
+		t.Errorf("SuspendedProcesses = %v; want %v", processes, want)
+	}
+
+	if got := len(rec.Actions()); got != 2 {
+		t.Errorf("len(Actions()) = %d; want %d: %v", got, 2, rec.Actions())
+	}
+}
+
+func TestRecorder_AutoScalingWarmPool(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+
+	asMock := capacitymock.NewMockAutoScalingAPI(ctrl)
+
+	asMock.EXPECT().DescribeAutoScalingGroups(ctx, gomock.Any()).AnyTimes().Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+		AutoScalingGroups: []autoscalingtypes.AutoScalingGroup{
+			{
+				AutoScalingGroupName: aws.String("asg"),
+				DesiredCapacity:      aws.Int32(2),
+				Instances: []autoscalingtypes.Instance{
+					{InstanceId: aws.String("i-000"), LifecycleState: autoscalingtypes.LifecycleStateInService},
+					{InstanceId: aws.String("i-001"), LifecycleState: autoscalingtypes.LifecycleStateInService},
+				},
+				WarmPoolConfiguration: &autoscalingtypes.WarmPoolConfiguration{
+					InstanceReusePolicy: &autoscalingtypes.InstanceReusePolicy{ReuseOnScaleIn: aws.Bool(true)},
+					PoolState:           autoscalingtypes.WarmPoolStateStopped,
+				},
+			},
+		},
+	}, nil)
+	asMock.EXPECT().DescribeWarmPool(ctx, gomock.Any()).AnyTimes().Return(&autoscaling.DescribeWarmPoolOutput{
+		Instances: []autoscalingtypes.Instance{
+			{InstanceId: aws.String("i-100"), LifecycleState: autoscalingtypes.LifecycleStateWarmedStopped},
+		},
+		WarmPoolConfiguration: &autoscalingtypes.WarmPoolConfiguration{
+			InstanceReusePolicy: &autoscalingtypes.InstanceReusePolicy{ReuseOnScaleIn: aws.Bool(true)},
+			PoolState:           autoscalingtypes.WarmPoolStateStopped,
+		},
+	}, nil)
+
+	rec := dryrun.NewRecorder()
+	asSvc := rec.AutoScaling(asMock)
+
+	// The instance in service returns to the warm pool and the one in the warm pool is terminated
+	for _, id := range []string{"i-000", "i-100"} {
+		_, err := asSvc.TerminateInstanceInAutoScalingGroup(ctx, &autoscaling.TerminateInstanceInAutoScalingGroupInput{
+			InstanceId:                     aws.String(id),
+			ShouldDecrementDesiredCapacity: aws.Bool(id == "i-000"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := asSvc.DescribeWarmPool(ctx, &autoscaling.DescribeWarmPoolInput{
+		AutoScalingGroupName: aws.String("asg"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Instances) != 1 || *resp.Instances[0].InstanceId != "i-000" || resp.Instances[0].LifecycleState != autoscalingtypes.LifecycleStateWarmedStopped {
+		t.Errorf("Instances = %#v; want only i-000 in %s", resp.Instances, autoscalingtypes.LifecycleStateWarmedStopped)
+	}
+
+	groups, err := asSvc.DescribeAutoScalingGroups(ctx, &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []string{"asg"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	group := groups.AutoScalingGroups[0]
+	if *group.DesiredCapacity != 1 {
+		t.Errorf("DesiredCapacity = %d; want %d", *group.DesiredCapacity, 1)
+	}
+	if len(group.Instances) != 1 || *group.Instances[0].InstanceId != "i-001" {
+		t.Errorf("Instances = %#v; want only i-001", group.Instances)
+	}
+}
@@ -0,0 +1,175 @@
+package dryrun
+
+import (
+	"context"
+	"math"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"golang.org/x/xerrors"
+
+	"github.com/abicky/ecsmec/internal/capacity"
+)
+
+type ec2Client struct {
+	svc capacity.EC2API
+	r   *Recorder
+}
+
+// EC2 wraps svc so that the mutating calls are recorded instead of being sent.
+func (r *Recorder) EC2(svc capacity.EC2API) capacity.EC2API {
+	return &ec2Client{svc: svc, r: r}
+}
+
+func (c *ec2Client) DescribeInstanceAttribute(ctx context.Context, params *ec2.DescribeInstanceAttributeInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstanceAttributeOutput, error) {
+	c.r.mu.Lock()
+	launched := c.r.isLaunchedInstance(*params.InstanceId)
+	c.r.mu.Unlock()
+
+	// Simulated instances have no protection
+	if launched {
+		return &ec2.DescribeInstanceAttributeOutput{
+			DisableApiTermination: &ec2types.AttributeBooleanValue{Value: aws.Bool(false)},
+			InstanceId:            params.InstanceId,
+		}, nil
+	}
+	return c.svc.DescribeInstanceAttribute(ctx, params, optFns...)
+}
+
+func (c *ec2Client) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	c.r.mu.Lock()
+	realIDs := make([]string, 0, len(params.InstanceIds))
+	launchedIDs := make([]string, 0)
+	for _, id := range params.InstanceIds {
+		if c.r.isLaunchedInstance(id) {
+			launchedIDs = append(launchedIDs, id)
+		} else {
+			realIDs = append(realIDs, id)
+		}
+	}
+	c.r.mu.Unlock()
+
+	resp := &ec2.DescribeInstancesOutput{}
+	// Don't call the API if all the instances are simulated ones, otherwise all the instances are described
+	if len(realIDs) > 0 || len(params.InstanceIds) == 0 {
+		input := *params
+		input.InstanceIds = realIDs
+		var err error
+		resp, err = c.svc.DescribeInstances(ctx, &input, optFns...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+
+	for _, r := range resp.Reservations {
+		for i := range r.Instances {
+			if c.r.terminatedInstances[*r.Instances[i].InstanceId] {
+				r.Instances[i].State = &ec2types.InstanceState{Name: ec2types.InstanceStateNameTerminated}
+			}
+		}
+	}
+
+	if len(launchedIDs) > 0 {
+		instances := make([]ec2types.Instance, len(launchedIDs))
+		for i, id := range launchedIDs {
+			state := ec2types.InstanceStateNameRunning
+			if c.r.terminatedInstances[id] {
+				state = ec2types.InstanceStateNameTerminated
+			}
+			instances[i] = ec2types.Instance{
+				InstanceId: aws.String(id),
+				LaunchTime: aws.Time(c.r.launchedInstances[id].launchTime),
+				Placement: &ec2types.Placement{
+					AvailabilityZone: aws.String(c.r.launchedInstances[id].availabilityZone),
+				},
+				State: &ec2types.InstanceState{Name: state},
+			}
+		}
+		resp.Reservations = append(resp.Reservations, ec2types.Reservation{Instances: instances})
+	}
+
+	return resp, nil
+}
+
+func (c *ec2Client) DescribeLaunchTemplateVersions(ctx context.Context, params *ec2.DescribeLaunchTemplateVersionsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeLaunchTemplateVersionsOutput, error) {
+	return c.svc.DescribeLaunchTemplateVersions(ctx, params, optFns...)
+}
+
+func (c *ec2Client) DescribeNetworkInterfaces(ctx context.Context, params *ec2.DescribeNetworkInterfacesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeNetworkInterfacesOutput, error) {
+	return c.svc.DescribeNetworkInterfaces(ctx, params, optFns...)
+}
+
+func (c *ec2Client) DescribeSpotFleetInstances(ctx context.Context, params *ec2.DescribeSpotFleetInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSpotFleetInstancesOutput, error) {
+	return c.svc.DescribeSpotFleetInstances(ctx, params, optFns...)
+}
+
+func (c *ec2Client) DescribeSpotFleetRequestHistory(ctx context.Context, params *ec2.DescribeSpotFleetRequestHistoryInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSpotFleetRequestHistoryOutput, error) {
+	return c.svc.DescribeSpotFleetRequestHistory(ctx, params, optFns...)
+}
+
+func (c *ec2Client) DescribeSpotFleetRequests(ctx context.Context, params *ec2.DescribeSpotFleetRequestsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSpotFleetRequestsOutput, error) {
+	return c.svc.DescribeSpotFleetRequests(ctx, params, optFns...)
+}
+
+func (c *ec2Client) ModifyInstanceAttribute(ctx context.Context, params *ec2.ModifyInstanceAttributeInput, optFns ...func(*ec2.Options)) (*ec2.ModifyInstanceAttributeOutput, error) {
+	c.r.Record("Modify the attribute of the instance %s: DisableApiTermination: %t", *params.InstanceId, aws.ToBool(params.DisableApiTermination.Value))
+	return &ec2.ModifyInstanceAttributeOutput{}, nil
+}
+
+func (c *ec2Client) ModifySpotFleetRequest(ctx context.Context, params *ec2.ModifySpotFleetRequestInput, optFns ...func(*ec2.Options)) (*ec2.ModifySpotFleetRequestOutput, error) {
+	if params.TargetCapacity == nil {
+		c.r.Record("Modify the spot fleet request %q", *params.SpotFleetRequestId)
+		return &ec2.ModifySpotFleetRequestOutput{Return: aws.Bool(true)}, nil
+	}
+
+	reqs, err := c.svc.DescribeSpotFleetRequests(ctx, &ec2.DescribeSpotFleetRequestsInput{
+		SpotFleetRequestIds: []string{*params.SpotFleetRequestId},
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("failed to describe the spot fleet request: %w", err)
+	}
+	currentCapacity := *reqs.SpotFleetRequestConfigs[0].SpotFleetRequestConfig.TargetCapacity
+
+	resp, err := c.svc.DescribeSpotFleetInstances(ctx, &ec2.DescribeSpotFleetInstancesInput{
+		SpotFleetRequestId: params.SpotFleetRequestId,
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("failed to describe spot fleet instances: %w", err)
+	}
+	ids := make([]string, len(resp.ActiveInstances))
+	for i, instance := range resp.ActiveInstances {
+		ids[i] = *instance.InstanceId
+	}
+	slices.Sort(ids)
+
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+
+	c.r.record("Modify the spot fleet request %q: TargetCapacity: %d -> %d", *params.SpotFleetRequestId, currentCapacity, *params.TargetCapacity)
+
+	if *params.TargetCapacity < currentCapacity && currentCapacity > 0 {
+		// EC2 chooses the instances to interrupt, so simulate interruptions of as many instances as
+		// the reduced capacity in the order of instance IDs.
+		count := int(math.Ceil(float64(len(ids)) * float64(currentCapacity-*params.TargetCapacity) / float64(currentCapacity)))
+		c.r.record("Interruption warnings are expected for %d instances chosen by EC2 (simulated with %v)", count, ids[:count])
+		c.r.interruptions = append(c.r.interruptions, ids[:count]...)
+	}
+
+	return &ec2.ModifySpotFleetRequestOutput{Return: aws.Bool(true)}, nil
+}
+
+func (c *ec2Client) TerminateInstances(ctx context.Context, params *ec2.TerminateInstancesInput, optFns ...func(*ec2.Options)) (*ec2.TerminateInstancesOutput, error) {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+
+	c.r.record("Terminate the instances %v", params.InstanceIds)
+	for _, id := range params.InstanceIds {
+		c.r.terminatedInstances[id] = true
+	}
+	return &ec2.TerminateInstancesOutput{}, nil
+}
@@ -0,0 +1,406 @@
+package dryrun
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"golang.org/x/xerrors"
+
+	"github.com/abicky/ecsmec/internal/capacity"
+	"github.com/abicky/ecsmec/internal/service"
+)
+
+// ECSAPI is the union of the ECS APIs used by the capacity and service packages.
+type ECSAPI interface {
+	capacity.ECSAPI
+	service.ECSAPI
+}
+
+const (
+	containerInstanceArnPrefix = "arn:aws:ecs:dryrun:000000000000:container-instance/"
+	taskArnPrefix              = "arn:aws:ecs:dryrun:000000000000:task/"
+)
+
+var ec2InstanceIDFilterRegexp = regexp.MustCompile(`^ec2InstanceId in \[(.*)\]$`)
+
+type ecsClient struct {
+	svc ECSAPI
+	r   *Recorder
+}
+
+// ECS wraps svc so that the mutating calls are recorded instead of being sent.
+func (r *Recorder) ECS(svc ECSAPI) ECSAPI {
+	return &ecsClient{svc: svc, r: r}
+}
+
+func (c *ecsClient) CreateService(ctx context.Context, params *ecs.CreateServiceInput, optFns ...func(*ecs.Options)) (*ecs.CreateServiceOutput, error) {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+
+	c.r.record("Create the service %q with the task definition %q (DesiredCount: %d)",
+		*params.ServiceName, aws.ToString(params.TaskDefinition), aws.ToInt32(params.DesiredCount))
+
+	s := &ecstypes.Service{
+		CapacityProviderStrategy: params.CapacityProviderStrategy,
+		ClusterArn:               params.Cluster,
+		DeploymentConfiguration:  params.DeploymentConfiguration,
+		DeploymentController:     params.DeploymentController,
+		Deployments: []ecstypes.Deployment{
+			{
+				DesiredCount:                aws.ToInt32(params.DesiredCount),
+				RolloutState:                ecstypes.DeploymentRolloutStateCompleted,
+				RunningCount:                aws.ToInt32(params.DesiredCount),
+				ServiceConnectConfiguration: params.ServiceConnectConfiguration,
+				Status:                      aws.String("PRIMARY"),
+				TaskDefinition:              params.TaskDefinition,
+				VolumeConfigurations:        params.VolumeConfigurations,
+			},
+		},
+		DesiredCount:                  aws.ToInt32(params.DesiredCount),
+		EnableECSManagedTags:          params.EnableECSManagedTags,
+		EnableExecuteCommand:          params.EnableExecuteCommand,
+		HealthCheckGracePeriodSeconds: params.HealthCheckGracePeriodSeconds,
+		LaunchType:                    params.LaunchType,
+		LoadBalancers:                 params.LoadBalancers,
+		NetworkConfiguration:          params.NetworkConfiguration,
+		PlacementConstraints:          params.PlacementConstraints,
+		PlacementStrategy:             params.PlacementStrategy,
+		PlatformVersion:               params.PlatformVersion,
+		PropagateTags:                 params.PropagateTags,
+		RoleArn:                       params.Role,
+		RunningCount:                  aws.ToInt32(params.DesiredCount),
+		SchedulingStrategy:            params.SchedulingStrategy,
+		ServiceName:                   params.ServiceName,
+		ServiceRegistries:             params.ServiceRegistries,
+		Status:                        aws.String("ACTIVE"),
+		Tags:                          params.Tags,
+		TaskDefinition:                params.TaskDefinition,
+	}
+	c.r.services[*params.ServiceName] = s
+	c.r.createdServices[*params.ServiceName] = true
+
+	return &ecs.CreateServiceOutput{Service: s}, nil
+}
+
+func (c *ecsClient) DeleteService(ctx context.Context, params *ecs.DeleteServiceInput, optFns ...func(*ecs.Options)) (*ecs.DeleteServiceOutput, error) {
+	s, err := c.simulatedService(ctx, params.Cluster, *params.Service)
+	if err != nil {
+		return nil, err
+	}
+
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+
+	c.r.record("Delete the service %q", *params.Service)
+	s.Status = aws.String("INACTIVE")
+
+	return &ecs.DeleteServiceOutput{Service: s}, nil
+}
+
+func (c *ecsClient) DescribeCapacityProviders(ctx context.Context, params *ecs.DescribeCapacityProvidersInput, optFns ...func(*ecs.Options)) (*ecs.DescribeCapacityProvidersOutput, error) {
+	return c.svc.DescribeCapacityProviders(ctx, params, optFns...)
+}
+
+func (c *ecsClient) DescribeContainerInstances(ctx context.Context, params *ecs.DescribeContainerInstancesInput, optFns ...func(*ecs.Options)) (*ecs.DescribeContainerInstancesOutput, error) {
+	realArns := make([]string, 0, len(params.ContainerInstances))
+	simulatedArns := make([]string, 0)
+	for _, arn := range params.ContainerInstances {
+		if strings.HasPrefix(arn, containerInstanceArnPrefix) {
+			simulatedArns = append(simulatedArns, arn)
+		} else {
+			realArns = append(realArns, arn)
+		}
+	}
+
+	resp := &ecs.DescribeContainerInstancesOutput{}
+	if len(realArns) > 0 {
+		input := *params
+		input.ContainerInstances = realArns
+		var err error
+		resp, err = c.svc.DescribeContainerInstances(ctx, &input, optFns...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+
+	for _, arn := range simulatedArns {
+		id := arn[strings.LastIndex(arn, "/")+1:]
+		resp.ContainerInstances = append(resp.ContainerInstances, ecstypes.ContainerInstance{
+			AgentConnected:       true,
+			ContainerInstanceArn: aws.String(arn),
+			Ec2InstanceId:        aws.String(id),
+			RegisteredAt:         aws.Time(c.r.launchedInstances[id].launchTime),
+			Status:               aws.String("ACTIVE"),
+		})
+	}
+	for i, instance := range resp.ContainerInstances {
+		if c.r.drainedContainerInstances[*instance.ContainerInstanceArn] {
+			resp.ContainerInstances[i].Status = aws.String("DRAINING")
+		}
+	}
+
+	return resp, nil
+}
+
+func (c *ecsClient) DescribeServices(ctx context.Context, params *ecs.DescribeServicesInput, optFns ...func(*ecs.Options)) (*ecs.DescribeServicesOutput, error) {
+	c.r.mu.Lock()
+	realNames := make([]string, 0, len(params.Services))
+	for _, name := range params.Services {
+		if _, ok := c.r.services[name]; !ok {
+			realNames = append(realNames, name)
+		}
+	}
+	c.r.mu.Unlock()
+
+	resp := &ecs.DescribeServicesOutput{}
+	if len(realNames) > 0 {
+		input := *params
+		input.Services = realNames
+		var err error
+		resp, err = c.svc.DescribeServices(ctx, &input, optFns...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+
+	services := make([]ecstypes.Service, 0, len(params.Services))
+	for _, name := range params.Services {
+		if s, ok := c.r.services[name]; ok {
+			services = append(services, *s)
+			continue
+		}
+		for _, s := range resp.Services {
+			if *s.ServiceName == name || aws.ToString(s.ServiceArn) == name {
+				services = append(services, s)
+			}
+		}
+	}
+	resp.Services = services
+
+	return resp, nil
+}
+
+func (c *ecsClient) DescribeTasks(ctx context.Context, params *ecs.DescribeTasksInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error) {
+	resp, err := c.svc.DescribeTasks(ctx, params, optFns...)
+	if err != nil {
+		return nil, err
+	}
+
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+
+	for i, t := range resp.Tasks {
+		if c.r.isTaskStopped(t) {
+			resp.Tasks[i].DesiredStatus = aws.String("STOPPED")
+			resp.Tasks[i].LastStatus = aws.String("STOPPED")
+		}
+	}
+
+	return resp, nil
+}
+
+func (c *ecsClient) ListContainerInstances(ctx context.Context, params *ecs.ListContainerInstancesInput, optFns ...func(*ecs.Options)) (*ecs.ListContainerInstancesOutput, error) {
+	c.r.mu.Lock()
+	input := *params
+	simulatedIDs := make([]string, 0)
+	filter := aws.ToString(params.Filter)
+	if m := ec2InstanceIDFilterRegexp.FindStringSubmatch(filter); m != nil {
+		realIDs := make([]string, 0)
+		for _, id := range strings.Split(m[1], ",") {
+			if c.r.isLaunchedInstance(id) {
+				simulatedIDs = append(simulatedIDs, id)
+			} else {
+				realIDs = append(realIDs, id)
+			}
+		}
+		input.Filter = aws.String(fmt.Sprintf("ec2InstanceId in [%s]", strings.Join(realIDs, ",")))
+		if len(realIDs) == 0 {
+			input.Filter = nil
+		}
+	}
+	c.r.mu.Unlock()
+
+	resp := &ecs.ListContainerInstancesOutput{}
+	// Don't call the API if all the instances are simulated ones, otherwise all the instances are listed
+	if input.Filter != nil || params.Filter == nil {
+		var err error
+		resp, err = c.svc.ListContainerInstances(ctx, &input, optFns...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if params.NextToken == nil {
+		for _, id := range simulatedIDs {
+			resp.ContainerInstanceArns = append(resp.ContainerInstanceArns, containerInstanceArnPrefix+aws.ToString(params.Cluster)+"/"+id)
+		}
+	}
+
+	return resp, nil
+}
+
+func (c *ecsClient) GetTaskProtection(ctx context.Context, params *ecs.GetTaskProtectionInput, optFns ...func(*ecs.Options)) (*ecs.GetTaskProtectionOutput, error) {
+	resp, err := c.svc.GetTaskProtection(ctx, params, optFns...)
+	if err != nil {
+		return nil, err
+	}
+
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+
+	// Don't wait for the protection to expire, which is recorded instead
+	for i, t := range resp.ProtectedTasks {
+		if t.ProtectionEnabled {
+			c.r.record("Wait for the scale-in protection of the task %q to expire or be cleared", *t.TaskArn)
+			resp.ProtectedTasks[i].ProtectionEnabled = false
+		}
+	}
+
+	return resp, nil
+}
+
+func (c *ecsClient) ListTasks(ctx context.Context, params *ecs.ListTasksInput, optFns ...func(*ecs.Options)) (*ecs.ListTasksOutput, error) {
+	c.r.mu.Lock()
+	simulated := strings.HasPrefix(aws.ToString(params.ContainerInstance), containerInstanceArnPrefix) ||
+		c.r.createdServices[aws.ToString(params.ServiceName)]
+	c.r.mu.Unlock()
+
+	// Simulated resources have no tasks
+	if simulated {
+		return &ecs.ListTasksOutput{}, nil
+	}
+	return c.svc.ListTasks(ctx, params, optFns...)
+}
+
+func (c *ecsClient) RunTask(ctx context.Context, params *ecs.RunTaskInput, optFns ...func(*ecs.Options)) (*ecs.RunTaskOutput, error) {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+
+	c.r.record("Run a task with the task definition %q", aws.ToString(params.TaskDefinition))
+	c.r.taskSeq++
+	// params.Cluster can be either a name or an ARN
+	cluster := aws.ToString(params.Cluster)
+	cluster = cluster[strings.LastIndex(cluster, "/")+1:]
+
+	return &ecs.RunTaskOutput{
+		Tasks: []ecstypes.Task{
+			{
+				ClusterArn:        params.Cluster,
+				LastStatus:        aws.String("PROVISIONING"),
+				TaskArn:           aws.String(fmt.Sprintf("%s%s/dryrun%09d", taskArnPrefix, cluster, c.r.taskSeq)),
+				TaskDefinitionArn: params.TaskDefinition,
+			},
+		},
+	}, nil
+}
+
+func (c *ecsClient) StopTask(ctx context.Context, params *ecs.StopTaskInput, optFns ...func(*ecs.Options)) (*ecs.StopTaskOutput, error) {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+
+	c.r.record("Stop the task %q", *params.Task)
+	c.r.stoppedTasks[*params.Task] = true
+
+	return &ecs.StopTaskOutput{}, nil
+}
+
+func (c *ecsClient) UpdateCapacityProvider(ctx context.Context, params *ecs.UpdateCapacityProviderInput, optFns ...func(*ecs.Options)) (*ecs.UpdateCapacityProviderOutput, error) {
+	update := params.AutoScalingGroupProvider
+	c.r.Record("Update the capacity provider %q: ManagedScaling: %s, ManagedTerminationProtection: %s", *params.Name, update.ManagedScaling.Status, update.ManagedTerminationProtection)
+	return &ecs.UpdateCapacityProviderOutput{}, nil
+}
+
+func (c *ecsClient) UpdateContainerInstancesState(ctx context.Context, params *ecs.UpdateContainerInstancesStateInput, optFns ...func(*ecs.Options)) (*ecs.UpdateContainerInstancesStateOutput, error) {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+
+	ids := make([]string, len(params.ContainerInstances))
+	for i, arn := range params.ContainerInstances {
+		ids[i] = arn[strings.LastIndex(arn, "/")+1:]
+		if params.Status == ecstypes.ContainerInstanceStatusDraining {
+			c.r.drainedContainerInstances[arn] = true
+		} else {
+			delete(c.r.drainedContainerInstances, arn)
+		}
+	}
+	c.r.record("Update the status of the container instances %v to %s", ids, params.Status)
+
+	return &ecs.UpdateContainerInstancesStateOutput{}, nil
+}
+
+func (c *ecsClient) UpdateService(ctx context.Context, params *ecs.UpdateServiceInput, optFns ...func(*ecs.Options)) (*ecs.UpdateServiceOutput, error) {
+	s, err := c.simulatedService(ctx, params.Cluster, *params.Service)
+	if err != nil {
+		return nil, err
+	}
+
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+
+	if params.DesiredCount != nil {
+		c.r.record("Update the service %q: DesiredCount: %d -> %d", *params.Service, s.DesiredCount, *params.DesiredCount)
+		s.DesiredCount = *params.DesiredCount
+		s.RunningCount = *params.DesiredCount
+		for i := range s.Deployments {
+			s.Deployments[i].DesiredCount = *params.DesiredCount
+			s.Deployments[i].RunningCount = *params.DesiredCount
+		}
+	} else {
+		c.r.record("Update the service %q", *params.Service)
+	}
+
+	return &ecs.UpdateServiceOutput{Service: s}, nil
+}
+
+// simulatedService returns the simulated state of the service, which is initialized with the actual state.
+func (c *ecsClient) simulatedService(ctx context.Context, cluster *string, name string) (*ecstypes.Service, error) {
+	c.r.mu.Lock()
+	s, ok := c.r.services[name]
+	c.r.mu.Unlock()
+	if ok {
+		return s, nil
+	}
+
+	resp, err := c.svc.DescribeServices(ctx, &ecs.DescribeServicesInput{
+		Cluster:  cluster,
+		Services: []string{name},
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("failed to describe the service \"%s\": %w", name, err)
+	}
+	if len(resp.Services) == 0 {
+		return nil, xerrors.Errorf("the service \"%s\" doesn't exist", name)
+	}
+
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+
+	s = &resp.Services[0]
+	c.r.services[name] = s
+	return s, nil
+}
+
+func (r *Recorder) isTaskStopped(t ecstypes.Task) bool {
+	if r.stoppedTasks[aws.ToString(t.TaskArn)] || r.drainedContainerInstances[aws.ToString(t.ContainerInstanceArn)] {
+		return true
+	}
+
+	if group := aws.ToString(t.Group); strings.HasPrefix(group, "service:") {
+		if s, ok := r.services[group[8:]]; ok && !r.createdServices[group[8:]] {
+			return s.DesiredCount == 0 || aws.ToString(s.Status) != "ACTIVE"
+		}
+	}
+
+	return false
+}
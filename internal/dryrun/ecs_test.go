@@ -0,0 +1,157 @@
+package dryrun_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"go.uber.org/mock/gomock"
+
+	"github.com/abicky/ecsmec/internal/dryrun"
+	"github.com/abicky/ecsmec/internal/testing/dryrunmock"
+)
+
+func TestRecorder_ECS(t *testing.T) {
+	t.Run("draining", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		ecsMock := dryrunmock.NewMockECSAPI(ctrl)
+		ecsMock.EXPECT().DescribeTasks(ctx, gomock.Any()).Return(&ecs.DescribeTasksOutput{
+			Tasks: []ecstypes.Task{
+				{
+					ContainerInstanceArn: aws.String("arn:aws:ecs:ap-northeast-1:123:container-instance/test/aaa"),
+					Group:                aws.String("service:foo"),
+					LastStatus:           aws.String("RUNNING"),
+					TaskArn:              aws.String("arn:aws:ecs:ap-northeast-1:123:task/test/000"),
+				},
+				{
+					ContainerInstanceArn: aws.String("arn:aws:ecs:ap-northeast-1:123:container-instance/test/bbb"),
+					Group:                aws.String("family:bar"),
+					LastStatus:           aws.String("RUNNING"),
+					TaskArn:              aws.String("arn:aws:ecs:ap-northeast-1:123:task/test/111"),
+				},
+				{
+					ContainerInstanceArn: aws.String("arn:aws:ecs:ap-northeast-1:123:container-instance/test/bbb"),
+					Group:                aws.String("service:foo"),
+					LastStatus:           aws.String("RUNNING"),
+					TaskArn:              aws.String("arn:aws:ecs:ap-northeast-1:123:task/test/222"),
+				},
+			},
+		}, nil)
+
+		rec := dryrun.NewRecorder()
+		ecsSvc := rec.ECS(ecsMock)
+
+		_, err := ecsSvc.StopTask(ctx, &ecs.StopTaskInput{
+			Task: aws.String("arn:aws:ecs:ap-northeast-1:123:task/test/111"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ecsSvc.UpdateContainerInstancesState(ctx, &ecs.UpdateContainerInstancesStateInput{
+			ContainerInstances: []string{"arn:aws:ecs:ap-northeast-1:123:container-instance/test/aaa"},
+			Status:             ecstypes.ContainerInstanceStatusDraining,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := ecsSvc.DescribeTasks(ctx, &ecs.DescribeTasksInput{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"STOPPED", "STOPPED", "RUNNING"}
+		for i, task := range resp.Tasks {
+			if *task.LastStatus != want[i] {
+				t.Errorf("Tasks[%d].LastStatus = %s; want %s", i, *task.LastStatus, want[i])
+			}
+		}
+
+		if got := len(rec.Actions()); got != 2 {
+			t.Errorf("len(Actions()) = %d; want %d: %v", got, 2, rec.Actions())
+		}
+	})
+
+	t.Run("recreating a service", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		ecsMock := dryrunmock.NewMockECSAPI(ctrl)
+		ecsMock.EXPECT().DescribeServices(ctx, gomock.Any()).Return(&ecs.DescribeServicesOutput{
+			Services: []ecstypes.Service{
+				{
+					DesiredCount: 2,
+					ServiceName:  aws.String("foo"),
+					Status:       aws.String("ACTIVE"),
+				},
+			},
+		}, nil)
+
+		rec := dryrun.NewRecorder()
+		ecsSvc := rec.ECS(ecsMock)
+
+		_, err := ecsSvc.CreateService(ctx, &ecs.CreateServiceInput{
+			DesiredCount: aws.Int32(2),
+			ServiceName:  aws.String("foo-copied-by-ecsmec"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The simulated service must be described without calling the API
+		resp, err := ecsSvc.DescribeServices(ctx, &ecs.DescribeServicesInput{
+			Services: []string{"foo-copied-by-ecsmec"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := resp.Services[0]; s.RunningCount != 2 || len(s.Deployments) != 1 {
+			t.Errorf("Service = %#v; want a stable service", s)
+		}
+
+		tasks, err := ecsSvc.ListTasks(ctx, &ecs.ListTasksInput{
+			ServiceName: aws.String("foo-copied-by-ecsmec"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tasks.TaskArns) != 0 {
+			t.Errorf("len(TaskArns) = %d; want 0", len(tasks.TaskArns))
+		}
+
+		_, err = ecsSvc.UpdateService(ctx, &ecs.UpdateServiceInput{
+			DesiredCount: aws.Int32(0),
+			Service:      aws.String("foo"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ecsSvc.DeleteService(ctx, &ecs.DeleteServiceInput{
+			Service: aws.String("foo"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err = ecsSvc.DescribeServices(ctx, &ecs.DescribeServicesInput{
+			Services: []string{"foo"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := resp.Services[0]; *s.Status != "INACTIVE" || s.DesiredCount != 0 {
+			t.Errorf("Service = %#v; want an inactive service", s)
+		}
+
+		if got := len(rec.Actions()); got != 3 {
+			t.Errorf("len(Actions()) = %d; want %d: %v", got, 3, rec.Actions())
+		}
+	})
+}
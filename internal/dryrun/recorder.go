@@ -0,0 +1,108 @@
+package dryrun
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	autoscalingtypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// Recorder records the mutating API calls instead of sending them, and simulates the resulting state so that
+// subsequent read calls and waiters behave as if the calls had been sent.
+type Recorder struct {
+	mu      sync.Mutex
+	actions []string
+
+	// Auto Scaling
+	groups map[string]*groupState
+	// instancesTerminatedInGroup is resolved to their groups lazily because
+	// TerminateInstanceInAutoScalingGroup doesn't take the group name
+	instancesTerminatedInGroup map[string]bool
+
+	// EC2
+	launchedInstances   map[string]launchedInstance
+	terminatedInstances map[string]bool
+	interruptions       []string
+
+	// ECS
+	drainedContainerInstances map[string]bool
+	stoppedTasks              map[string]bool
+	services                  map[string]*ecstypes.Service
+	createdServices           map[string]bool
+
+	instanceSeq int
+	taskSeq     int
+}
+
+type groupState struct {
+	desiredCapacity *int32
+	maxSize         *int32
+	instances       []autoscalingtypes.Instance
+	detached        map[string]bool
+	tags            map[string]*string
+	// suspendedProcesses is whether each process is suspended (true) or resumed (false)
+	suspendedProcesses map[string]bool
+	// warmedInstances is the instances returned to the warm pool
+	warmedInstances []autoscalingtypes.Instance
+}
+
+type launchedInstance struct {
+	availabilityZone string
+	launchTime       time.Time
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{
+		groups:                     make(map[string]*groupState),
+		instancesTerminatedInGroup: make(map[string]bool),
+		launchedInstances:          make(map[string]launchedInstance),
+		terminatedInstances:        make(map[string]bool),
+		drainedContainerInstances:  make(map[string]bool),
+		stoppedTasks:               make(map[string]bool),
+		services:                   make(map[string]*ecstypes.Service),
+		createdServices:            make(map[string]bool),
+	}
+}
+
+// Record appends an action to the plan.
+func (r *Recorder) Record(format string, a ...any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record(format, a...)
+}
+
+func (r *Recorder) record(format string, a ...any) {
+	r.actions = append(r.actions, fmt.Sprintf(format, a...))
+}
+
+func (r *Recorder) Actions() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.actions...)
+}
+
+func (r *Recorder) PrintPlan(w io.Writer) {
+	actions := r.Actions()
+	if len(actions) == 0 {
+		fmt.Fprintln(w, "\nPlan (dry run): nothing to do")
+		return
+	}
+
+	fmt.Fprintln(w, "\nPlan (dry run):")
+	for i, a := range actions {
+		fmt.Fprintf(w, "%4d. %s\n", i+1, a)
+	}
+}
+
+func (r *Recorder) isLaunchedInstance(id string) bool {
+	_, ok := r.launchedInstances[id]
+	return ok
+}
+
+func (r *Recorder) newInstanceID() string {
+	r.instanceSeq++
+	return fmt.Sprintf("i-dryrun%09d", r.instanceSeq)
+}
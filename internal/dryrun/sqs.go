@@ -0,0 +1,71 @@
+package dryrun
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+
+	"github.com/abicky/ecsmec/internal/capacity"
+)
+
+type sqsClient struct {
+	r *Recorder
+}
+
+// SQS returns a client that records the mutating calls. Since no queue is created in dry-run mode,
+// ReceiveMessage returns the simulated interruption warnings instead of calling the API.
+func (r *Recorder) SQS() capacity.SQSAPI {
+	return &sqsClient{r: r}
+}
+
+func (c *sqsClient) DeleteMessageBatch(ctx context.Context, params *sqs.DeleteMessageBatchInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageBatchOutput, error) {
+	c.r.Record("Delete %d messages from the SQS queue %q", len(params.Entries), *params.QueueUrl)
+	return &sqs.DeleteMessageBatchOutput{}, nil
+}
+
+func (c *sqsClient) ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	timer := time.NewTimer(time.Duration(params.WaitTimeSeconds) * time.Second)
+	defer timer.Stop()
+
+	for {
+		if messages := c.popInterruptions(int(params.MaxNumberOfMessages)); len(messages) > 0 {
+			return &sqs.ReceiveMessageOutput{Messages: messages}, nil
+		}
+
+		select {
+		case <-ticker.C:
+			continue
+		case <-timer.C:
+			return &sqs.ReceiveMessageOutput{}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (c *sqsClient) popInterruptions(max int) []sqstypes.Message {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+
+	if max <= 0 {
+		max = 1
+	}
+	n := min(max, len(c.r.interruptions))
+	messages := make([]sqstypes.Message, n)
+	for i, id := range c.r.interruptions[:n] {
+		messages[i] = sqstypes.Message{
+			Body:          aws.String(fmt.Sprintf(`{"detail":{"instance-id":"%s"}}`, id)),
+			MessageId:     aws.String("dryrun-" + id),
+			ReceiptHandle: aws.String("dryrun-" + id),
+		}
+	}
+	c.r.interruptions = c.r.interruptions[n:]
+	return messages
+}
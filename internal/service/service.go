@@ -13,6 +13,8 @@ import (
 	"golang.org/x/xerrors"
 
 	"github.com/abicky/ecsmec/internal/const/ecsconst"
+	"github.com/abicky/ecsmec/internal/serviceevent"
+	"github.com/abicky/ecsmec/internal/timeout"
 )
 
 type Service struct {
@@ -88,19 +90,21 @@ func (s *Service) copy(ctx context.Context, cluster string, serviceName string,
 }
 
 func (s *Service) createAndWaitUntilStable(ctx context.Context, config *ecs.CreateServiceInput) error {
+	watcher := serviceevent.NewWatcher(time.Now())
 	if _, err := s.ecsSvc.CreateService(ctx, config); err != nil {
 		return xerrors.Errorf("failed to create the service \"%s\": %w", *config.ServiceName, err)
 	}
 
 	waiter := ecs.NewServicesStableWaiter(s.ecsSvc, func(o *ecs.ServicesStableWaiterOptions) {
 		o.MaxDelay = 15 * time.Second
+		o.Retryable = watcher.Retryable(o.Retryable)
 	})
 	err := waiter.Wait(ctx, &ecs.DescribeServicesInput{
 		Cluster:  config.Cluster,
 		Services: []string{*config.ServiceName},
-	}, 10*time.Minute)
+	}, timeout.Get(ctx, timeout.PhaseServiceStabilization))
 	if err != nil {
-		return xerrors.Errorf("failed to wait for the service \"%s\" to become stable: %w", *config.ServiceName, err)
+		return xerrors.Errorf("failed to wait for the service \"%s\" to become stable: %w", *config.ServiceName, timeout.Wrap(ctx, timeout.PhaseServiceStabilization, err))
 	}
 
 	return nil
@@ -153,9 +157,9 @@ func (s *Service) stopAndWaitUntilStopped(ctx context.Context, cluster string, s
 		err := waiter.Wait(ctx, &ecs.DescribeTasksInput{
 			Cluster: aws.String(cluster),
 			Tasks:   arns,
-		}, 10*time.Minute)
+		}, timeout.Get(ctx, timeout.PhaseTaskStop))
 		if err != nil {
-			return xerrors.Errorf("failed to wait for tasks to stop: %w", err)
+			return xerrors.Errorf("failed to wait for tasks to stop: %w", timeout.Wrap(ctx, timeout.PhaseTaskStop, err))
 		}
 	}
 
@@ -2,11 +2,13 @@ package service_test
 
 import (
 	"context"
+	"errors"
 	"io"
 	"log"
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
@@ -14,6 +16,7 @@ import (
 	"go.uber.org/mock/gomock"
 
 	"github.com/abicky/ecsmec/internal/service"
+	"github.com/abicky/ecsmec/internal/serviceevent"
 	"github.com/abicky/ecsmec/internal/testing/servicemock"
 	"github.com/abicky/ecsmec/internal/testing/testutil"
 )
@@ -211,6 +214,67 @@ func TestService_Recreate(t *testing.T) {
 		}
 	})
 
+	t.Run("when the rollout of the new service fails", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx := context.Background()
+
+		ecsMock := servicemock.NewMockECSAPI(ctrl)
+
+		newServiceName := "new-name"
+		message := "(service new-name) was unable to place a task because no container instance met all of its requirements."
+
+		gomock.InOrder(
+			ecsMock.EXPECT().DescribeServices(ctx, gomock.Any()).Return(&ecs.DescribeServicesOutput{
+				Services: []ecstypes.Service{
+					{
+						ClusterArn:  aws.String(cluster),
+						Deployments: make([]ecstypes.Deployment, 1),
+						ServiceName: aws.String(serviceName),
+						Status:      aws.String("ACTIVE"),
+					},
+				},
+			}, nil),
+
+			ecsMock.EXPECT().CreateService(ctx, gomock.Any()),
+
+			// For ecs.ServicesStableWaiter
+			ecsMock.EXPECT().DescribeServices(testutil.AnyContext(), gomock.Any(), gomock.Any()).Return(&ecs.DescribeServicesOutput{
+				Services: []ecstypes.Service{
+					{
+						Deployments: []ecstypes.Deployment{
+							{
+								CreatedAt:    aws.Time(time.Now().Add(time.Second)),
+								Id:           aws.String("ecs-svc/0123"),
+								RolloutState: ecstypes.DeploymentRolloutStateFailed,
+								Status:       aws.String("PRIMARY"),
+							},
+						},
+						Events: []ecstypes.ServiceEvent{
+							{
+								CreatedAt: aws.Time(time.Now().Add(time.Second)),
+								Message:   aws.String(message),
+							},
+						},
+						ServiceName: aws.String(newServiceName),
+						Status:      aws.String("ACTIVE"),
+					},
+				},
+			}, nil),
+		)
+
+		s := service.NewService(ecsMock)
+		err := s.Recreate(ctx, cluster, serviceName, service.Definition{ServiceName: aws.String(newServiceName)})
+		var rerr *serviceevent.RolloutFailedError
+		if !errors.As(err, &rerr) {
+			t.Fatalf("err = %#v; want *serviceevent.RolloutFailedError", err)
+		}
+		if rerr.Message != message {
+			t.Errorf("Message = %q; want %q", rerr.Message, message)
+		}
+	})
+
 	exceptionTests := []struct {
 		name     string
 		services []ecstypes.Service
@@ -0,0 +1,113 @@
+package serviceevent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// RolloutFailedError is returned when the rollout of a deployment of a service fails,
+// e.g. the deployment circuit breaker is triggered.
+type RolloutFailedError struct {
+	ServiceName  string
+	DeploymentID string
+	Message      string
+}
+
+func (e *RolloutFailedError) Error() string {
+	return fmt.Sprintf("the rollout of the deployment %q of the service %q failed: %s", e.DeploymentID, e.ServiceName, e.Message)
+}
+
+// Watcher logs the events of services that it hasn't seen yet and detects deployments whose rollout failed.
+type Watcher struct {
+	startedAt time.Time
+	// lastSeenAt is the creation time of the latest event seen for each service ARN
+	lastSeenAt map[string]time.Time
+	// rolloutStates is the rollout state of each deployment ID seen so far
+	rolloutStates map[string]ecstypes.DeploymentRolloutState
+}
+
+// NewWatcher returns a Watcher that ignores the events created before startedAt.
+func NewWatcher(startedAt time.Time) *Watcher {
+	return &Watcher{
+		startedAt:     startedAt,
+		lastSeenAt:    make(map[string]time.Time),
+		rolloutStates: make(map[string]ecstypes.DeploymentRolloutState),
+	}
+}
+
+// Retryable wraps retryable of ecs.ServicesStableWaiterOptions so that the waiter logs new events of the services
+// and stops with *RolloutFailedError as soon as the rollout of a deployment fails.
+func (w *Watcher) Retryable(retryable func(context.Context, *ecs.DescribeServicesInput, *ecs.DescribeServicesOutput, error) (bool, error)) func(context.Context, *ecs.DescribeServicesInput, *ecs.DescribeServicesOutput, error) (bool, error) {
+	return func(ctx context.Context, params *ecs.DescribeServicesInput, output *ecs.DescribeServicesOutput, err error) (bool, error) {
+		if err == nil && output != nil {
+			if err := w.Watch(output.Services); err != nil {
+				return false, err
+			}
+		}
+		return retryable(ctx, params, output, err)
+	}
+}
+
+// Watch logs the events of the services that haven't been seen yet, and returns *RolloutFailedError if the rollout
+// of a deployment of the services has failed since the watcher started. Deployments that had already failed before
+// are ignored because they are irrelevant to the operation being watched.
+func (w *Watcher) Watch(services []ecstypes.Service) error {
+	for _, s := range services {
+		lastSeenAt, ok := w.lastSeenAt[aws.ToString(s.ServiceArn)]
+		if !ok {
+			lastSeenAt = w.startedAt
+		}
+
+		newEvents := make([]ecstypes.ServiceEvent, 0)
+		for _, e := range s.Events {
+			if e.CreatedAt != nil && e.CreatedAt.After(lastSeenAt) {
+				newEvents = append(newEvents, e)
+			}
+		}
+		// Events are sorted in descending order of their creation time
+		slices.Reverse(newEvents)
+		for _, e := range newEvents {
+			log.Printf("[%s] %s\n", aws.ToString(s.ServiceName), aws.ToString(e.Message))
+		}
+		if len(newEvents) > 0 {
+			w.lastSeenAt[aws.ToString(s.ServiceArn)] = *newEvents[len(newEvents)-1].CreatedAt
+		}
+
+		for _, d := range s.Deployments {
+			prevState, seen := w.rolloutStates[aws.ToString(d.Id)]
+			w.rolloutStates[aws.ToString(d.Id)] = d.RolloutState
+			if d.RolloutState != ecstypes.DeploymentRolloutStateFailed {
+				continue
+			}
+			if !w.hasUpdatedSinceStarted(d) && (!seen || prevState == ecstypes.DeploymentRolloutStateFailed) {
+				continue
+			}
+			message := aws.ToString(d.RolloutStateReason)
+			if len(newEvents) > 0 {
+				message = aws.ToString(newEvents[len(newEvents)-1].Message)
+			}
+			return &RolloutFailedError{
+				ServiceName:  aws.ToString(s.ServiceName),
+				DeploymentID: aws.ToString(d.Id),
+				Message:      message,
+			}
+		}
+	}
+
+	return nil
+}
+
+func (w *Watcher) hasUpdatedSinceStarted(d ecstypes.Deployment) bool {
+	updatedAt := d.UpdatedAt
+	if updatedAt == nil {
+		updatedAt = d.CreatedAt
+	}
+	return updatedAt != nil && updatedAt.After(w.startedAt)
+}
@@ -0,0 +1,132 @@
+package serviceevent_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+
+	"github.com/abicky/ecsmec/internal/serviceevent"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+func TestWatcher_Watch(t *testing.T) {
+	startedAt := time.Now()
+	newService := func(deployments []ecstypes.Deployment, messages ...string) ecstypes.Service {
+		// Events are sorted in descending order of their creation time
+		events := make([]ecstypes.ServiceEvent, len(messages))
+		for i, m := range messages {
+			events[len(messages)-1-i] = ecstypes.ServiceEvent{
+				CreatedAt: aws.Time(startedAt.Add(time.Duration(2*i-1) * time.Second)),
+				Message:   aws.String(m),
+			}
+		}
+		return ecstypes.Service{
+			Deployments: deployments,
+			Events:      events,
+			ServiceArn:  aws.String("arn:aws:ecs:ap-northeast-1:123:service/test/foo"),
+			ServiceName: aws.String("foo"),
+		}
+	}
+
+	t.Run("with new events", func(t *testing.T) {
+		var buf bytes.Buffer
+		log.SetOutput(&buf)
+		defer log.SetOutput(io.Discard)
+
+		w := serviceevent.NewWatcher(startedAt)
+		if err := w.Watch([]ecstypes.Service{newService(nil, "old", "new1")}); err != nil {
+			t.Fatalf("err = %#v; want nil", err)
+		}
+		if err := w.Watch([]ecstypes.Service{newService(nil, "old", "new1", "new2")}); err != nil {
+			t.Fatalf("err = %#v; want nil", err)
+		}
+
+		got := strings.Count(buf.String(), "[foo]")
+		if got != 2 || !strings.Contains(buf.String(), "[foo] new1") || !strings.Contains(buf.String(), "[foo] new2") {
+			t.Errorf("log = %q; want the new events logged once", buf.String())
+		}
+	})
+
+	t.Run("with a failed deployment", func(t *testing.T) {
+		deployments := []ecstypes.Deployment{
+			{
+				Id:                 aws.String("ecs-svc/0123"),
+				RolloutState:       ecstypes.DeploymentRolloutStateFailed,
+				RolloutStateReason: aws.String("ECS deployment circuit breaker: tasks failed to start."),
+				Status:             aws.String("PRIMARY"),
+				UpdatedAt:          aws.Time(startedAt.Add(time.Second)),
+			},
+		}
+
+		w := serviceevent.NewWatcher(startedAt)
+		err := w.Watch([]ecstypes.Service{newService(deployments, "old", "unable to place a task")})
+		var rerr *serviceevent.RolloutFailedError
+		if !errors.As(err, &rerr) {
+			t.Fatalf("err = %#v; want *serviceevent.RolloutFailedError", err)
+		}
+		if rerr.Message != "unable to place a task" {
+			t.Errorf("Message = %q; want %q", rerr.Message, "unable to place a task")
+		}
+
+		err = w.Watch([]ecstypes.Service{newService(deployments, "old", "unable to place a task")})
+		if !errors.As(err, &rerr) {
+			t.Fatalf("err = %#v; want *serviceevent.RolloutFailedError", err)
+		}
+		if rerr.Message != "ECS deployment circuit breaker: tasks failed to start." {
+			t.Errorf("Message = %q; want %q", rerr.Message, "ECS deployment circuit breaker: tasks failed to start.")
+		}
+	})
+
+	t.Run("with a deployment that failed before the watcher started", func(t *testing.T) {
+		deployments := []ecstypes.Deployment{
+			{
+				Id:           aws.String("ecs-svc/0123"),
+				RolloutState: ecstypes.DeploymentRolloutStateFailed,
+				Status:       aws.String("PRIMARY"),
+				UpdatedAt:    aws.Time(startedAt.Add(-time.Hour)),
+			},
+		}
+
+		w := serviceevent.NewWatcher(startedAt)
+		for range 2 {
+			if err := w.Watch([]ecstypes.Service{newService(deployments, "old")}); err != nil {
+				t.Errorf("err = %#v; want nil", err)
+			}
+		}
+	})
+
+	t.Run("with a deployment whose rollout fails while watching", func(t *testing.T) {
+		deployments := []ecstypes.Deployment{
+			{
+				Id:           aws.String("ecs-svc/0123"),
+				RolloutState: ecstypes.DeploymentRolloutStateInProgress,
+				Status:       aws.String("PRIMARY"),
+				UpdatedAt:    aws.Time(startedAt.Add(-time.Hour)),
+			},
+		}
+
+		w := serviceevent.NewWatcher(startedAt)
+		if err := w.Watch([]ecstypes.Service{newService(deployments, "old")}); err != nil {
+			t.Fatalf("err = %#v; want nil", err)
+		}
+
+		// The update time may not change even if the state changes
+		deployments[0].RolloutState = ecstypes.DeploymentRolloutStateFailed
+		var rerr *serviceevent.RolloutFailedError
+		if err := w.Watch([]ecstypes.Service{newService(deployments, "old")}); !errors.As(err, &rerr) {
+			t.Errorf("err = %#v; want *serviceevent.RolloutFailedError", err)
+		}
+	})
+}
@@ -1,3 +1,3 @@
 package capacitymock
 
-//go:generate mockgen -package capacitymock -destination mocks.go github.com/abicky/ecsmec/internal/capacity AutoScalingAPI,Drainer,EC2API,ECSAPI,Poller,SQSAPI,Cluster
+//go:generate mockgen -package capacitymock -destination mocks.go github.com/abicky/ecsmec/internal/capacity Approver,AutoScalingAPI,Drainer,EC2API,ECSAPI,Poller,SQSAPI,Cluster
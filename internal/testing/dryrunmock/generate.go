@@ -0,0 +1,3 @@
+package dryrunmock
+
+//go:generate mockgen -package dryrunmock -destination mocks.go github.com/abicky/ecsmec/internal/dryrun ECSAPI
@@ -0,0 +1,95 @@
+package timeout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Phase is a phase of operations that waits for resources to reach some state.
+type Phase string
+
+const (
+	PhaseInstanceLaunch       Phase = "instance launch"
+	PhaseInstanceDrain        Phase = "instance drain"
+	PhaseInstanceTermination  Phase = "instance termination"
+	PhaseTaskStop             Phase = "task stop"
+	PhaseServiceStabilization Phase = "service stabilization"
+)
+
+// Phases is the list of all the phases.
+var Phases = []Phase{
+	PhaseInstanceLaunch,
+	PhaseInstanceDrain,
+	PhaseInstanceTermination,
+	PhaseTaskStop,
+	PhaseServiceStabilization,
+}
+
+var defaultTimeouts = map[Phase]time.Duration{
+	PhaseInstanceLaunch:       5 * time.Minute,
+	PhaseInstanceDrain:        5 * time.Minute,
+	PhaseInstanceTermination:  10 * time.Minute,
+	PhaseTaskStop:             10 * time.Minute,
+	PhaseServiceStabilization: 10 * time.Minute,
+}
+
+// Default returns the default timeout of the phase.
+func Default(p Phase) time.Duration {
+	return defaultTimeouts[p]
+}
+
+type contextKey struct{}
+
+// WithTimeouts returns a copy of ctx that carries the timeouts of phases.
+// The phases not included in timeouts use their default timeouts.
+func WithTimeouts(ctx context.Context, timeouts map[Phase]time.Duration) context.Context {
+	return context.WithValue(ctx, contextKey{}, timeouts)
+}
+
+// Get returns the timeout of the phase carried by ctx, or the default timeout if ctx doesn't carry it.
+func Get(ctx context.Context, p Phase) time.Duration {
+	if timeouts, ok := ctx.Value(contextKey{}).(map[Phase]time.Duration); ok {
+		if t, ok := timeouts[p]; ok {
+			return t
+		}
+	}
+	return Default(p)
+}
+
+// Error represents that a phase timed out or the deadline of the whole operation was exceeded during the phase.
+type Error struct {
+	Phase Phase
+	// Timeout is the timeout of the phase, or 0 if the deadline of the whole operation was exceeded
+	Timeout time.Duration
+	Err     error
+}
+
+func (e *Error) Error() string {
+	if e.Timeout > 0 {
+		return fmt.Sprintf("the %s phase timed out after %v: %v", e.Phase, e.Timeout, e.Err)
+	}
+	return fmt.Sprintf("the deadline was exceeded during the %s phase: %v", e.Phase, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Wrap converts err into *Error if err is caused by the deadline of ctx or by a waiter of the AWS SDK exceeding its
+// max wait time, and returns err as is otherwise.
+func Wrap(ctx context.Context, p Phase, err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() != nil {
+		return &Error{Phase: p, Err: err}
+	}
+	// Waiters of the AWS SDK return an untyped error when they exceed the max wait time
+	if strings.HasPrefix(err.Error(), "exceeded max wait time") {
+		return &Error{Phase: p, Timeout: Get(ctx, p), Err: err}
+	}
+	return err
+}
@@ -0,0 +1,70 @@
+package timeout_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/abicky/ecsmec/internal/timeout"
+)
+
+func TestGet(t *testing.T) {
+	ctx := timeout.WithTimeouts(context.Background(), map[timeout.Phase]time.Duration{
+		timeout.PhaseTaskStop: time.Hour,
+	})
+
+	if got := timeout.Get(ctx, timeout.PhaseTaskStop); got != time.Hour {
+		t.Errorf("Get(ctx, %q) = %v; want %v", timeout.PhaseTaskStop, got, time.Hour)
+	}
+	if got, want := timeout.Get(ctx, timeout.PhaseServiceStabilization), timeout.Default(timeout.PhaseServiceStabilization); got != want {
+		t.Errorf("Get(ctx, %q) = %v; want %v", timeout.PhaseServiceStabilization, got, want)
+	}
+	if got, want := timeout.Get(context.Background(), timeout.PhaseTaskStop), timeout.Default(timeout.PhaseTaskStop); got != want {
+		t.Errorf("Get(context.Background(), %q) = %v; want %v", timeout.PhaseTaskStop, got, want)
+	}
+}
+
+func TestWrap(t *testing.T) {
+	t.Run("with an error of a waiter exceeding the max wait time", func(t *testing.T) {
+		ctx := context.Background()
+		err := timeout.Wrap(ctx, timeout.PhaseTaskStop, errors.New("exceeded max wait time for TasksStopped waiter"))
+
+		var terr *timeout.Error
+		if !errors.As(err, &terr) {
+			t.Fatalf("err = %#v; want *timeout.Error", err)
+		}
+		if terr.Timeout != timeout.Default(timeout.PhaseTaskStop) {
+			t.Errorf("Timeout = %v; want %v", terr.Timeout, timeout.Default(timeout.PhaseTaskStop))
+		}
+		if want := "the task stop phase timed out after 10m0s: exceeded max wait time for TasksStopped waiter"; err.Error() != want {
+			t.Errorf("err.Error() = %q; want %q", err.Error(), want)
+		}
+	})
+
+	t.Run("when the deadline is exceeded", func(t *testing.T) {
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now())
+		defer cancel()
+		<-ctx.Done()
+
+		err := timeout.Wrap(ctx, timeout.PhaseServiceStabilization, ctx.Err())
+
+		var terr *timeout.Error
+		if !errors.As(err, &terr) {
+			t.Fatalf("err = %#v; want *timeout.Error", err)
+		}
+		if terr.Timeout != 0 {
+			t.Errorf("Timeout = %v; want 0", terr.Timeout)
+		}
+		if want := "the deadline was exceeded during the service stabilization phase: context deadline exceeded"; err.Error() != want {
+			t.Errorf("err.Error() = %q; want %q", err.Error(), want)
+		}
+	})
+
+	t.Run("with another error", func(t *testing.T) {
+		origErr := errors.New("error")
+		if err := timeout.Wrap(context.Background(), timeout.PhaseTaskStop, origErr); err != origErr {
+			t.Errorf("err = %#v; want %#v", err, origErr)
+		}
+	})
+}